@@ -13,6 +13,7 @@ import (
 	"github.com/xssnick/ton-payment-network/pkg/payments"
 	"github.com/xssnick/ton-payment-network/tonpayments"
 	"github.com/xssnick/ton-payment-network/tonpayments/api"
+	"github.com/xssnick/ton-payment-network/tonpayments/backup"
 	"github.com/xssnick/ton-payment-network/tonpayments/chain"
 	chainClient "github.com/xssnick/ton-payment-network/tonpayments/chain/client"
 	"github.com/xssnick/ton-payment-network/tonpayments/config"
@@ -39,6 +40,7 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -57,6 +59,7 @@ var APICredentialsPassword = flag.String("api-password", "", "HTTP API credentia
 var ConfigPath = flag.String("config", "payment-network-config.json", "config path")
 var ForceBlock = flag.Uint64("force-block", 0, "master block seqno to start scan from, ignored if 0, otherwise - overrides db value")
 var UseBlockScanner = flag.Bool("use-block-scanner", false, "use block scanner instead of watching specific contracts")
+var RecoverBackup = flag.String("recover-backup", "", "channel backup file to restore into the new db, all restored channels will be closed")
 
 var LogFilename = flag.String("log-filename", "payment-network.log", "log file name")
 var LogMaxSize = flag.Int("log-max-size", 1024, "maximum log file size in MB before rotation")
@@ -251,6 +254,41 @@ func main() {
 		}
 	}
 
+	var recovered *backup.Snapshot
+	if *RecoverBackup != "" {
+		if !freshDb {
+			log.Fatal().Str("db", cfg.DBPath).Msg("recovery can be done only into a new db, set another DBPath in config")
+			return
+		}
+
+		if *UseBlockScanner {
+			// block scanner reports only new transactions, we need the current state of restored channels
+			log.Fatal().Msg("recovery requires account scanner, run it without --use-block-scanner")
+			return
+		}
+
+		recovered, err = backup.Read(*RecoverBackup, backup.DeriveKey(cfg.PaymentNodePrivateKey))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read channel backup")
+			return
+		}
+
+		if err = backup.Restore(context.Background(), fdb, recovered); err != nil {
+			log.Fatal().Err(err).Msg("failed to restore channel backup")
+			return
+		}
+
+		log.Info().Int("channels", len(recovered.Channels)).Int("virtual_channels", len(recovered.Virtuals)).Msg("channel backup restored")
+	}
+
+	if freshDb && *RecoverBackup == "" && cfg.ChannelBackupPath != "" {
+		// new db would compact existing backup to empty one, operator should decide what to do with it
+		if st, err := os.Stat(cfg.ChannelBackupPath); err == nil && st.Size() > 0 {
+			log.Fatal().Str("path", cfg.ChannelBackupPath).Msg("db is new but channel backup exists, restore it with --recover-backup or move it aside")
+			return
+		}
+	}
+
 	peerKey := ed25519.NewKeyFromSeed(cfg.ADNLServerKey)
 	trs := adnlTransport.NewServer(dhtClient, gate, peerKey, ed25519.NewKeyFromSeed(cfg.PaymentNodePrivateKey), cfg.ExternalIP != "")
 	tr := transport.NewTransport(ed25519.NewKeyFromSeed(cfg.PaymentNodePrivateKey), trs, false)
@@ -320,6 +358,43 @@ func main() {
 		}
 	}
 
+	if cfg.ChannelBackupPath != "" {
+		bw, err := backup.NewWriter(cfg.ChannelBackupPath, backup.DeriveKey(cfg.PaymentNodePrivateKey))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to init channel backup")
+			return
+		}
+
+		channels, err := fdb.GetChannels(context.Background(), nil, db.ChannelStateAny)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load channels")
+			return
+		}
+
+		metas, err := fdb.ListVirtualChannelMetas(context.Background())
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load virtual channels")
+			return
+		}
+
+		if err = bw.Start(channels, metas); err != nil {
+			log.Fatal().Err(err).Msg("failed to start channel backup")
+			return
+		}
+
+		onChannel := bw.OnChannelUpdated
+		if current := fdb.GetOnChannelUpdated(); current != nil {
+			onChannel = func(ctx context.Context, ch *db.Channel, statusChanged bool) {
+				current(ctx, ch, statusChanged)
+				bw.OnChannelUpdated(ctx, ch, statusChanged)
+			}
+		}
+		fdb.SetOnChannelUpdated(onChannel)
+		fdb.SetOnVirtualChannelUpdated(bw.OnVirtualChannelUpdated)
+
+		log.Info().Str("path", cfg.ChannelBackupPath).Msg("channel backup initialized")
+	}
+
 	w, err := pWallet.InitWallet(apiClient, ed25519.NewKeyFromSeed(cfg.WalletPrivateKey))
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to init wallet")
@@ -338,8 +413,17 @@ func main() {
 		webTr.SetService(svc)
 	}
 
+	if !*UseBlockScanner {
+		// block scanner reports all contracts, for account scanner watched channels should be added explicitly
+		svc.SetContractWatcher(sc.WatchContract)
+	}
+
 	log.Info().Str("pubkey", base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(cfg.PaymentNodePrivateKey).Public().(ed25519.PublicKey))).Msg("payment node initialized")
 
+	if recovered != nil {
+		closeRecoveredChannels(svc, recovered)
+	}
+
 	if !*DaemonMode {
 		go func() {
 			for {
@@ -364,7 +448,7 @@ func main() {
 			}
 		}
 
-		srv := api.NewServer(*API, *Webhook, cfg.WebhooksSignatureHMACSHA256Key, svc, fdb, credentials)
+		srv := api.NewServer(*API, *Webhook, cfg.WebhooksSignatureHMACSHA256Key, svc, fdb, fdb, credentials)
 		if *Webhook != "" {
 			svc.SetWebhook(srv)
 		}
@@ -381,6 +465,27 @@ func main() {
 	svc.Start()
 }
 
+// closeRecoveredChannels - tries to close restored channels cooperatively, uncooperative close
+// is scheduled as a fallback by cooperative request itself, channels which were already closing
+// are continued by the scanner events
+func closeRecoveredChannels(svc *tonpayments.Service, snap *backup.Snapshot) {
+	for addr, ch := range snap.Channels {
+		if ch.Status != db.ChannelStateActive {
+			continue
+		}
+
+		if err := svc.RequestCooperativeClose(context.Background(), addr); err != nil {
+			log.Warn().Err(err).Str("address", addr).Msg("failed to request cooperative close of recovered channel, closing it uncooperatively")
+
+			if err = svc.RequestUncooperativeClose(context.Background(), addr); err != nil {
+				log.Error().Err(err).Str("address", addr).Msg("failed to request uncooperative close of recovered channel")
+				continue
+			}
+		}
+		log.Info().Str("address", addr).Msg("recovered channel closing requested")
+	}
+}
+
 func commandReader(svc *tonpayments.Service, cfg *config.Config, fdb *db.DB, wlt *wallet.Wallet, apiClient ton.APIClientWrapped) error {
 	var cmd string
 	_, _ = fmt.Scanln(&cmd)
@@ -587,6 +692,69 @@ func commandReader(svc *tonpayments.Service, cfg *config.Config, fdb *db.DB, wlt
 		if err = svc.RequestWithdraw(context.Background(), addr, amt, false); err != nil {
 			return fmt.Errorf("failed to withdraw from channel: %w", err)
 		}
+	case "rebalance":
+		log.Info().Msg("enter channel address to move liquidity from:")
+		var fromStr string
+		_, _ = fmt.Scanln(&fromStr)
+
+		log.Info().Msg("enter channel address to move liquidity to:")
+		var toStr string
+		_, _ = fmt.Scanln(&toStr)
+
+		ch, err := svc.GetChannel(context.Background(), fromStr)
+		if err != nil {
+			return fmt.Errorf("failed to get channel: %w", err)
+		}
+
+		cc, err := svc.ResolveCoinConfig(ch.JettonAddress, ch.ExtraCurrencyID, true)
+		if err != nil {
+			return fmt.Errorf("failed to get coin config: %w", err)
+		}
+
+		log.Info().Msg("input amount:")
+		var strAmt string
+		_, _ = fmt.Scanln(&strAmt)
+
+		amt, err := tlb.FromDecimal(strAmt, int(cc.Decimals))
+		if err != nil {
+			return fmt.Errorf("incorrect format of amount")
+		}
+
+		log.Info().Msg("input max fee, or skip for any:")
+		var strFee string
+		_, _ = fmt.Scanln(&strFee)
+
+		var maxFee *big.Int
+		if strFee != "" {
+			fee, err := tlb.FromDecimal(strFee, int(cc.Decimals))
+			if err != nil {
+				return fmt.Errorf("incorrect format of fee")
+			}
+			maxFee = fee.Nano()
+		}
+
+		est, err := svc.Rebalance(context.Background(), fromStr, toStr, amt.Nano(), maxFee, time.Hour, true)
+		if err != nil {
+			return fmt.Errorf("failed to estimate rebalance: %w", err)
+		}
+
+		log.Info().Str("amount", amt.String()).
+			Str("fee", cc.MustAmount(est.Fee).String()).
+			Int("hops", len(est.Route)).
+			Msg("rebalance estimated, type 'y' to execute:")
+
+		var confirm string
+		_, _ = fmt.Scanln(&confirm)
+		if strings.ToLower(confirm) != "y" {
+			log.Info().Msg("rebalance cancelled")
+			return nil
+		}
+
+		rb, err := svc.Rebalance(context.Background(), fromStr, toStr, amt.Nano(), est.Fee, time.Hour, false)
+		if err != nil {
+			return fmt.Errorf("failed to rebalance: %w", err)
+		}
+		log.Info().Str("id", base64.StdEncoding.EncodeToString(rb.ID)).Msg("rebalance requested")
 	case "init":
 		log.Info().Msg("enter the key of node to initialize channel with:")
 
@@ -672,7 +840,7 @@ func commandReader(svc *tonpayments.Service, cfg *config.Config, fdb *db.DB, wlt
 
 		log.Info().Msgf("wallet balance: %s TON", balance.String())
 	case "open", "send":
-		log.Info().Msg("enter nodes to tunnel virtual channel through, including receiver (',' separated):")
+		log.Info().Msg("enter nodes to tunnel virtual channel through, including receiver (',' separated), or only receiver to find route automatically:")
 		var strKeys string
 		_, _ = fmt.Scanln(&strKeys)
 
@@ -725,37 +893,65 @@ func commandReader(svc *tonpayments.Service, cfg *config.Config, fdb *db.DB, wlt
 			return fmt.Errorf("incorrect format of amount")
 		}
 
-		log.Info().Msg("input fee amount per each proxy node:")
+		fullAmt := new(big.Int).Set(amt.Nano())
+		var tunChain []transport.TunnelChainPart
+		if len(parsedKeys) == 1 {
+			ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+			tunChain, err = svc.BuildRouteTunnelChain(ctx, parsedKeys[0], jettonMasterStr, uint32(ecID), amt.Nano(), 3*time.Hour)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to find route: %w", err)
+			}
+			fullAmt = fullAmt.Add(fullAmt, tunChain[0].Fee)
+
+			for i, part := range tunChain {
+				log.Info().Int("hop", i).
+					Str("key", base64.StdEncoding.EncodeToString(part.Target)).
+					Str("fee", tlb.MustFromNano(part.Fee, int(cc.Decimals)).String()).
+					Msg("route hop")
+			}
+		} else {
+			log.Info().Msg("input fee amount per each proxy node (empty to request actual fees from nodes):")
 
-		var strAmtFee string
-		_, _ = fmt.Scanln(&strAmtFee)
-		if strAmtFee == "" {
-			strAmtFee = "0"
-		}
+			var strAmtFee string
+			_, _ = fmt.Scanln(&strAmtFee)
 
-		feeAmt, err := tlb.FromDecimal(strAmtFee, int(cc.Decimals))
-		if err != nil {
-			return fmt.Errorf("incorrect format of fee amount")
-		}
+			var fees []*big.Int
+			if strAmtFee == "" {
+				keys := make([]ed25519.PublicKey, len(parsedKeys))
+				for i, k := range parsedKeys {
+					keys[i] = k
+				}
 
-		safeHopTTL := time.Duration(cfg.ChannelConfig.QuarantineDurationSec+cfg.ChannelConfig.BufferTimeToCommit+cfg.ChannelConfig.ConditionalCloseDurationSec+
-			cfg.ChannelConfig.MinSafeVirtualChannelTimeoutSec) * time.Second
+				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+				fees, err = svc.CalcTunnelChainFees(ctx, keys, jettonMasterStr, uint32(ecID), amt.Nano())
+				cancel()
+				if err != nil {
+					return fmt.Errorf("failed to calculate fees: %w", err)
+				}
+			} else {
+				feeAmt, err := tlb.FromDecimal(strAmtFee, int(cc.Decimals))
+				if err != nil {
+					return fmt.Errorf("incorrect format of fee amount")
+				}
 
-		fullAmt := new(big.Int).Set(amt.Nano())
-		var tunChain []transport.TunnelChainPart
-		for i, parsedKey := range parsedKeys {
-			fee := big.NewInt(0)
-			if len(parsedKeys)-i > 1 {
-				fee = new(big.Int).Mul(feeAmt.Nano(), big.NewInt(int64(len(parsedKeys)-i)-1))
-				fullAmt = fullAmt.Add(fullAmt, fee)
+				for i := range parsedKeys {
+					fees = append(fees, new(big.Int).Mul(feeAmt.Nano(), big.NewInt(int64(len(parsedKeys)-i)-1)))
+				}
+			}
+			fullAmt = fullAmt.Add(fullAmt, fees[0])
+
+			safeHopTTL := time.Duration(cfg.ChannelConfig.QuarantineDurationSec+cfg.ChannelConfig.BufferTimeToCommit+cfg.ChannelConfig.ConditionalCloseDurationSec+
+				cfg.ChannelConfig.MinSafeVirtualChannelTimeoutSec) * time.Second
+
+			for i, parsedKey := range parsedKeys {
+				tunChain = append(tunChain, transport.TunnelChainPart{
+					Target:   parsedKey,
+					Capacity: amt.Nano(),
+					Fee:      fees[i],
+					Deadline: time.Now().Add(3*time.Hour + safeHopTTL*time.Duration(len(parsedKeys)-i)),
+				})
 			}
-
-			tunChain = append(tunChain, transport.TunnelChainPart{
-				Target:   parsedKey,
-				Capacity: amt.Nano(),
-				Fee:      fee,
-				Deadline: time.Now().Add(3*time.Hour + safeHopTTL*time.Duration(len(parsedKeys)-i)),
-			})
 		}
 
 		_, vPriv, _ := ed25519.GenerateKey(nil)
@@ -791,6 +987,37 @@ func commandReader(svc *tonpayments.Service, cfg *config.Config, fdb *db.DB, wlt
 			return fmt.Errorf("failed to commit all virtual channels: %w", err)
 		}
 		log.Info().Msg("all virtual channels committed")
+	case "drain":
+		svc.SetDrainMode(true)
+	case "undrain":
+		svc.SetDrainMode(false)
+	case "drain-status":
+		chs, err := svc.ListChannels(context.Background(), nil, db.ChannelStateAny)
+		if err != nil {
+			return fmt.Errorf("failed to list channels: %w", err)
+		}
+
+		var total int
+		for _, ch := range chs {
+			if ch.Status == db.ChannelStateInactive {
+				continue
+			}
+
+			out, in, err := ch.CountVirtualChannels()
+			if err != nil {
+				return fmt.Errorf("failed to count virtual channels of %s: %w", ch.Address, err)
+			}
+			total += out + in
+
+			if out+in > 0 {
+				log.Info().Str("address", ch.Address).
+					Str("with", base64.StdEncoding.EncodeToString(ch.TheirOnchain.Key)).
+					Int("outgoing", out).
+					Int("incoming", in).
+					Msg("channel has active virtual channels")
+			}
+		}
+		log.Info().Bool("draining", svc.IsDraining()).Int("active_virtual_channels", total).Msg("drain status")
 	case "debug-tasks", "debug-tasks-all":
 		log.Info().Msg("input tasks prefix to search:")
 		var pfx string
@@ -527,6 +527,15 @@ func start(peerKey, channelKey []byte) {
 
 	tn := client.NewTON()
 	nt := web.NewHTTP(tn, ed25519.NewKeyFromSeed(cfg.ADNLServerKey), sPub, pKey)
+	if cfg.ChannelConfig.Watchtower != nil {
+		towers := map[string]string{}
+		for _, t := range cfg.ChannelConfig.Watchtower.Towers {
+			if k, err := base64.StdEncoding.DecodeString(t.Key); err == nil {
+				towers[string(k)] = t.WebURL
+			}
+		}
+		nt.SetWatchtowers(towers)
+	}
 	tr := transport.NewTransport(ed25519.NewKeyFromSeed(cfg.PaymentNodePrivateKey), nt, false)
 
 	ch := make(chan any, 10)
@@ -0,0 +1,216 @@
+package invoice
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tl"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// URIPrefix - invoice string is encoded as URI with this scheme, to be recognizable by wallets and QR readers
+const URIPrefix = "tonpay:invoice/"
+
+const maxMemoLen = 512
+const maxRouteHints = 4
+const maxRouteHintNodes = 6
+
+var ErrExpired = fmt.Errorf("invoice is expired")
+
+func init() {
+	tl.Register(RouteHint{}, "payments.routeHint nodes:(vector int256) = payments.RouteHint")
+	tl.Register(Invoice{}, "payments.invoice id:int256 receiver:int256 jettonAddr:int256 ec_id:int amount:bytes memo:string expiresAt:long routeHints:(vector payments.routeHint) signature:bytes = payments.Invoice")
+}
+
+// RouteHint - chain of nodes leading to the receiver, last node has direct channel with the receiver.
+// Can help payer to find route when receiver's channels are not announced.
+type RouteHint struct {
+	Nodes [][]byte `tl:"vector int256"`
+}
+
+// Invoice - payment request issued and signed by the receiver
+type Invoice struct {
+	ID       []byte            `tl:"int256"`
+	Receiver ed25519.PublicKey `tl:"int256"`
+	// JettonAddr - data part of jetton master address, zeroes for ton and extra currencies
+	JettonAddr      []byte      `tl:"int256"`
+	ExtraCurrencyID uint32      `tl:"int"`
+	Amount          []byte      `tl:"bytes"`
+	Memo            string      `tl:"string"`
+	ExpiresAt       int64       `tl:"long"`
+	RouteHints      []RouteHint `tl:"vector struct"`
+	Signature       []byte      `tl:"bytes"`
+}
+
+// New - creates and signs invoice with receiver's key, zero amount means that payer can choose any amount
+func New(key ed25519.PrivateKey, jettonMaster *address.Address, ecID uint32, amount *big.Int, memo string, ttl time.Duration, hints []RouteHint) (*Invoice, error) {
+	if jettonMaster != nil && ecID != 0 {
+		return nil, fmt.Errorf("jetton and extra currency are mutually exclusive")
+	}
+
+	if amount == nil || amount.Sign() < 0 {
+		return nil, fmt.Errorf("incorrect amount")
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl should be positive")
+	}
+
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate id: %w", err)
+	}
+
+	jetton := make([]byte, 32)
+	if jettonMaster != nil {
+		if jettonMaster.Workchain() != 0 {
+			return nil, fmt.Errorf("only basechain jettons are supported")
+		}
+		jetton = jettonMaster.Data()
+	}
+
+	inv := &Invoice{
+		ID:              id,
+		Receiver:        key.Public().(ed25519.PublicKey),
+		JettonAddr:      jetton,
+		ExtraCurrencyID: ecID,
+		Amount:          amount.Bytes(),
+		Memo:            memo,
+		ExpiresAt:       time.Now().Add(ttl).Unix(),
+		RouteHints:      hints,
+	}
+
+	if err := inv.Sign(key); err != nil {
+		return nil, err
+	}
+
+	if err := inv.Verify(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func (i *Invoice) Sign(key ed25519.PrivateKey) error {
+	if !bytes.Equal(key.Public().(ed25519.PublicKey), i.Receiver) {
+		return fmt.Errorf("key is not belongs to receiver")
+	}
+
+	data, err := i.dataToSign()
+	if err != nil {
+		return err
+	}
+	i.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+// Verify - checks fields and receiver's signature, expiration is not checked
+func (i *Invoice) Verify() error {
+	if len(i.ID) != 32 || len(i.Receiver) != ed25519.PublicKeySize || len(i.JettonAddr) != 32 {
+		return fmt.Errorf("incorrect invoice format")
+	}
+
+	if i.ExtraCurrencyID != 0 && i.JettonAddress() != nil {
+		return fmt.Errorf("jetton and extra currency are mutually exclusive")
+	}
+
+	if len(i.Memo) > maxMemoLen {
+		return fmt.Errorf("memo is too long")
+	}
+
+	if len(i.RouteHints) > maxRouteHints {
+		return fmt.Errorf("too many route hints")
+	}
+
+	for _, hint := range i.RouteHints {
+		if len(hint.Nodes) == 0 || len(hint.Nodes) > maxRouteHintNodes {
+			return fmt.Errorf("incorrect route hint size")
+		}
+
+		for _, node := range hint.Nodes {
+			if len(node) != ed25519.PublicKeySize {
+				return fmt.Errorf("incorrect route hint node key")
+			}
+		}
+	}
+
+	data, err := i.dataToSign()
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(i.Receiver, data, i.Signature) {
+		return fmt.Errorf("incorrect signature")
+	}
+	return nil
+}
+
+func (i *Invoice) IsExpired() bool {
+	return time.Now().Unix() >= i.ExpiresAt
+}
+
+// IsTON - true when invoice is not in jetton and not in extra currency
+func (i *Invoice) IsTON() bool {
+	return i.ExtraCurrencyID == 0 && i.JettonAddress() == nil
+}
+
+// JettonAddress - returns jetton master address, nil when invoice is not in jetton
+func (i *Invoice) JettonAddress() *address.Address {
+	if bytes.Equal(i.JettonAddr, make([]byte, 32)) {
+		return nil
+	}
+	return address.NewAddress(0, 0, i.JettonAddr).Bounce(true)
+}
+
+func (i *Invoice) AmountValue() *big.Int {
+	return new(big.Int).SetBytes(i.Amount)
+}
+
+func (i *Invoice) ExpiresAtTime() time.Time {
+	return time.Unix(i.ExpiresAt, 0)
+}
+
+// String - encodes invoice to URI
+func (i *Invoice) String() string {
+	data, err := tl.Serialize(i, true)
+	if err != nil {
+		// should never happen, all fields are serializable
+		panic(fmt.Errorf("failed to serialize invoice: %w", err))
+	}
+	return URIPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode - parses invoice from URI or raw base64 string, and verifies it
+func Decode(str string) (*Invoice, error) {
+	str = strings.TrimPrefix(strings.TrimSpace(str), URIPrefix)
+
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode invoice: %w", err)
+	}
+
+	var inv Invoice
+	if _, err = tl.Parse(&inv, data, true); err != nil {
+		return nil, fmt.Errorf("failed to parse invoice: %w", err)
+	}
+
+	if err = inv.Verify(); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (i *Invoice) dataToSign() ([]byte, error) {
+	sig := i.Signature
+	i.Signature = nil
+	data, err := tl.Serialize(i, true)
+	i.Signature = sig
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize invoice: %w", err)
+	}
+	return data, nil
+}
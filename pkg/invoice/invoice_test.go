@@ -0,0 +1,62 @@
+package invoice
+
+import (
+	"crypto/ed25519"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+)
+
+func TestInvoice_EncodeDecode(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	hop, _, _ := ed25519.GenerateKey(nil)
+	jetton := address.MustParseAddr("EQCxE6mUtQJKFnGfaROTKOt1lZbDiiX1kCixRv7Nw2Id_sDs")
+
+	inv, err := New(key, jetton, 0, big.NewInt(1500), "order #77", time.Hour, []RouteHint{{Nodes: [][]byte{hop}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	str := inv.String()
+	if !strings.HasPrefix(str, URIPrefix) {
+		t.Fatal("incorrect prefix", str)
+	}
+
+	got, err := Decode(str)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if got.AmountValue().Int64() != 1500 || got.Memo != "order #77" || got.IsExpired() {
+		t.Fatal("incorrect decoded fields")
+	}
+
+	if got.JettonAddress().String() != jetton.Bounce(true).String() {
+		t.Fatal("incorrect jetton", got.JettonAddress().String())
+	}
+
+	if len(got.RouteHints) != 1 || !ed25519.PublicKey(got.RouteHints[0].Nodes[0]).Equal(hop) {
+		t.Fatal("incorrect route hints")
+	}
+}
+
+func TestInvoice_Tampered(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	inv, err := New(key, nil, 0, big.NewInt(1500), "", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !inv.IsTON() {
+		t.Fatal("should be ton")
+	}
+
+	inv.Amount = big.NewInt(1).Bytes()
+	if _, err = Decode(inv.String()); err == nil {
+		t.Fatal("tampered invoice should not be accepted")
+	}
+}
@@ -3,6 +3,7 @@ package payments
 import (
 	"bytes"
 	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"github.com/xssnick/tonutils-go/adnl/keys"
@@ -17,6 +18,9 @@ type VirtualChannel struct {
 	Fee      *big.Int
 	Prepay   *big.Int
 	Deadline int64
+	// HashLock - sha256 hash, when set, condition is resolved for full capacity
+	// by revealing its preimage (HTLC), instead of signed state
+	HashLock []byte
 }
 
 type VirtualChannelState struct {
@@ -24,6 +28,11 @@ type VirtualChannelState struct {
 	Amount    *big.Int
 }
 
+// HTLCState - input for hash-locked condition, reveals preimage of the hash
+type HTLCState struct {
+	Preimage []byte
+}
+
 func SignState(amount tlb.Coins, signKey ed25519.PrivateKey, to ed25519.PublicKey) (res VirtualChannelState, encrypted []byte, err error) {
 	st := VirtualChannelState{
 		Amount: amount.Nano(),
@@ -114,16 +123,88 @@ var virtualChannelStaticCode = func() *cell.Cell {
 	return code
 }()
 
+var hashLockedChannelStaticCode = func() *cell.Cell {
+	// compiled using code:
+	/*
+		fun cond(input: slice, fee: int, capacity: int, prepaid: int, deadline: int, key: int, hash: int) {
+			// key is not used by code, it is kept to identify condition the same way as virtual channel
+			assert((stringHash(input) == hash) & (deadline >= now()), 24);
+			return (capacity - prepaid) + fee;
+		}
+	*/
+
+	data, err := hex.DecodeString("b5ee9c7201010101001200002006f9023125ba01f823beb0f298a1a031")
+	if err != nil {
+		panic(err.Error())
+	}
+
+	code, err := cell.FromBOC(data)
+	if err != nil {
+		panic(err.Error())
+	}
+	return code
+}()
+
 func (c *VirtualChannel) Serialize() *cell.Cell {
-	return cell.BeginCell().
+	b := cell.BeginCell().
 		MustStoreBuilder(pushIntOP(c.Fee)).
 		MustStoreBuilder(pushIntOP(c.Capacity)).
 		MustStoreBuilder(pushIntOP(c.Prepay)).
 		MustStoreBuilder(pushIntOP(big.NewInt(c.Deadline))).
-		MustStoreBuilder(pushIntOP(new(big.Int).SetBytes(c.Key))).
-		// we pack immutable part of code to ref for better BoC compression and cheaper transactions
-		MustStoreRef(virtualChannelStaticCode). // implicit jump
-		EndCell()
+		MustStoreBuilder(pushIntOP(new(big.Int).SetBytes(c.Key)))
+
+	if c.HashLock != nil {
+		return b.MustStoreBuilder(pushIntOP(new(big.Int).SetBytes(c.HashLock))).
+			MustStoreRef(hashLockedChannelStaticCode). // implicit jump
+			EndCell()
+	}
+
+	// we pack immutable part of code to ref for better BoC compression and cheaper transactions
+	return b.MustStoreRef(virtualChannelStaticCode).EndCell() // implicit jump
+}
+
+// IsHashLocked - true when condition is resolved by preimage
+func (c *VirtualChannel) IsHashLocked() bool {
+	return c.HashLock != nil
+}
+
+// CheckPreimage - verifies that preimage matches hash lock of the condition
+func (c *VirtualChannel) CheckPreimage(preimage []byte) bool {
+	if c.HashLock == nil {
+		return false
+	}
+	hash := sha256.Sum256(preimage)
+	return bytes.Equal(hash[:], c.HashLock)
+}
+
+// ResolveAmount - verifies condition input and returns amount which it unlocks for the receiver, without fee.
+// Input is signed state for regular virtual channel, and preimage for hash-locked one, which is always resolved for full capacity.
+func (c *VirtualChannel) ResolveAmount(input *cell.Cell) (*big.Int, error) {
+	if c.HashLock != nil {
+		var st HTLCState
+		if err := tlb.LoadFromCell(&st, input.BeginParse()); err != nil {
+			return nil, fmt.Errorf("failed to parse preimage: %w", err)
+		}
+
+		if !c.CheckPreimage(st.Preimage) {
+			return nil, fmt.Errorf("incorrect preimage")
+		}
+		return new(big.Int).Set(c.Capacity), nil
+	}
+
+	var st VirtualChannelState
+	if err := tlb.LoadFromCell(&st, input.BeginParse()); err != nil {
+		return nil, fmt.Errorf("failed to parse state: %w", err)
+	}
+
+	if !st.Verify(c.Key) {
+		return nil, fmt.Errorf("incorrect channel state signature")
+	}
+
+	if st.Amount.Cmp(c.Capacity) > 0 {
+		return nil, fmt.Errorf("amount cannot be > capacity")
+	}
+	return st.Amount, nil
 }
 
 func ParseVirtualChannelCond(s *cell.Slice) (*VirtualChannel, error) {
@@ -186,12 +267,36 @@ func ParseVirtualChannelCond(s *cell.Slice) (*VirtualChannel, error) {
 		key = append(make([]byte, 32-len(key)), key...)
 	}
 
+	wantCode := virtualChannelStaticCode
+
+	var hashLock []byte
+	if s.BitsLeft() > 0 {
+		// hash-locked condition has one more argument
+		hashInt, err := readIntOP(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hash lock: %w", err)
+		}
+		if hashInt.Sign() < 0 {
+			return nil, fmt.Errorf("failed to parse hash lock: cannot be negative")
+		}
+
+		hashLock = hashInt.Bytes()
+		if len(hashLock) > 32 {
+			return nil, fmt.Errorf("too big hash lock size")
+		}
+
+		if len(hashLock) < 32 {
+			hashLock = append(make([]byte, 32-len(hashLock)), hashLock...)
+		}
+		wantCode = hashLockedChannelStaticCode
+	}
+
 	code, err := s.LoadRefCell()
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse code: %w", err)
 	}
 
-	if !bytes.Equal(code.Hash(), virtualChannelStaticCode.Hash()) {
+	if !bytes.Equal(code.Hash(), wantCode.Hash()) {
 		return nil, fmt.Errorf("incorrect code")
 	}
 
@@ -205,6 +310,7 @@ func ParseVirtualChannelCond(s *cell.Slice) (*VirtualChannel, error) {
 		Fee:      fee,
 		Prepay:   prepay,
 		Deadline: int64(deadline.Uint64()),
+		HashLock: hashLock,
 	}, nil
 }
 
@@ -345,3 +451,19 @@ func (c *VirtualChannelState) Verify(key ed25519.PublicKey) bool {
 	// we need hash of data part only, because CHEKSIGNS is used in condition
 	return ed25519.Verify(key, cl.MustLoadSlice(cl.BitsLeft()), c.Signature)
 }
+
+func (c HTLCState) ToCell() (*cell.Cell, error) {
+	if len(c.Preimage) != 32 {
+		return nil, fmt.Errorf("incorrect preimage size")
+	}
+	return cell.BeginCell().MustStoreSlice(c.Preimage, 256).EndCell(), nil
+}
+
+func (c *HTLCState) LoadFromCell(loader *cell.Slice) error {
+	preimage, err := loader.LoadSlice(256)
+	if err != nil {
+		return err
+	}
+	c.Preimage = preimage
+	return nil
+}
@@ -1,8 +1,14 @@
 package payments
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/xssnick/tonutils-go/tvm/cell"
 	"math/big"
 	"testing"
+	"time"
 )
 
 func Test_pushIntOP(t *testing.T) {
@@ -19,3 +25,70 @@ func Test_pushIntOP(t *testing.T) {
 		}
 	}
 }
+
+func TestVirtualChannel_SerializeHashLocked(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	preimage := make([]byte, 32)
+	_, _ = rand.Read(preimage)
+	hash := sha256.Sum256(preimage)
+
+	for _, lock := range [][]byte{nil, hash[:]} {
+		vc := VirtualChannel{
+			Key:      pub,
+			Capacity: big.NewInt(5_000_000_000),
+			Fee:      big.NewInt(10_000_000),
+			Prepay:   big.NewInt(1_000_000),
+			Deadline: time.Now().Add(time.Hour).Unix(),
+			HashLock: lock,
+		}
+
+		parsed, err := ParseVirtualChannelCond(vc.Serialize().BeginParse())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if !bytes.Equal(parsed.Key, vc.Key) || !bytes.Equal(parsed.HashLock, vc.HashLock) ||
+			parsed.Capacity.Cmp(vc.Capacity) != 0 || parsed.Fee.Cmp(vc.Fee) != 0 ||
+			parsed.Prepay.Cmp(vc.Prepay) != 0 || parsed.Deadline != vc.Deadline {
+			t.Fatal("parsed condition is not equal to original")
+		}
+
+		var input *cell.Cell
+		if lock != nil {
+			input, err = HTLCState{Preimage: preimage}.ToCell()
+		} else {
+			st := VirtualChannelState{Amount: big.NewInt(2_000_000_000)}
+			st.Sign(priv)
+			input, err = st.ToCell()
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		amount, err := parsed.ResolveAmount(input)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		want := big.NewInt(2_000_000_000)
+		if lock != nil {
+			want = vc.Capacity
+		}
+		if amount.Cmp(want) != 0 {
+			t.Fatal("incorrect resolve amount", amount.String())
+		}
+	}
+
+	vc := VirtualChannel{
+		Key:      pub,
+		Capacity: big.NewInt(5),
+		Fee:      big.NewInt(0),
+		Prepay:   big.NewInt(0),
+		Deadline: time.Now().Add(time.Hour).Unix(),
+		HashLock: hash[:],
+	}
+	wrong, _ := HTLCState{Preimage: make([]byte, 32)}.ToCell()
+	if _, err := vc.ResolveAmount(wrong); err == nil {
+		t.Fatal("wrong preimage should not be accepted")
+	}
+}
@@ -0,0 +1,107 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/tonutils-go/tlb"
+	"math/big"
+	"time"
+)
+
+// IncomingVirtualChannel - virtual channel where we are the final receiver, which is about to be accepted
+type IncomingVirtualChannel struct {
+	Key             ed25519.PublicKey
+	Sender          ed25519.PublicKey
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	Coin            *config.CoinConfig
+	Capacity        *big.Int
+	// Amount - amount which will be received, for channels without final state it is the capacity
+	Amount     *big.Int
+	Deadline   time.Time
+	HashLocked bool
+	Memo       string
+	// InvoiceID - set when channel pays our invoice
+	InvoiceID []byte
+}
+
+// AcceptancePolicy - decides whether incoming virtual channel can be accepted,
+// returned error is passed to the sender as rejection reason
+type AcceptancePolicy interface {
+	CheckIncomingVirtualChannel(ctx context.Context, ch *IncomingVirtualChannel) error
+}
+
+// ConfigAcceptancePolicy - checks incoming channel using rules from coin config
+type ConfigAcceptancePolicy struct{}
+
+func (p ConfigAcceptancePolicy) CheckIncomingVirtualChannel(_ context.Context, ch *IncomingVirtualChannel) error {
+	rules := ch.Coin.IncomingPolicy
+	if rules == nil {
+		return nil
+	}
+
+	if rules.Reject {
+		return fmt.Errorf("incoming channels in %s are not accepted", ch.Coin.Symbol)
+	}
+
+	if len(rules.AllowedSenders) > 0 {
+		allowed := false
+		for _, sender := range rules.AllowedSenders {
+			key, err := base64.StdEncoding.DecodeString(sender)
+			if err != nil {
+				return fmt.Errorf("incorrect allowed sender key in config: %w", err)
+			}
+
+			if bytes.Equal(key, ch.Sender) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return fmt.Errorf("sender is not allowed")
+		}
+	}
+
+	if rules.MinAmount != "" {
+		minAmount, err := tlb.FromDecimal(rules.MinAmount, int(ch.Coin.Decimals))
+		if err != nil {
+			return fmt.Errorf("incorrect min amount in config: %w", err)
+		}
+
+		if ch.Amount.Cmp(minAmount.Nano()) < 0 {
+			return fmt.Errorf("amount is less than minimum %s", rules.MinAmount)
+		}
+	}
+
+	if rules.MaxAmount != "" {
+		maxAmount, err := tlb.FromDecimal(rules.MaxAmount, int(ch.Coin.Decimals))
+		if err != nil {
+			return fmt.Errorf("incorrect max amount in config: %w", err)
+		}
+
+		if ch.Amount.Cmp(maxAmount.Nano()) > 0 {
+			return fmt.Errorf("amount is greater than maximum %s", rules.MaxAmount)
+		}
+	}
+
+	if rules.RequireMemo && ch.Memo == "" {
+		return fmt.Errorf("memo is required")
+	}
+
+	if rules.RequireInvoice && ch.InvoiceID == nil {
+		return fmt.Errorf("payment for invoice is required")
+	}
+
+	return nil
+}
+
+// SetAcceptancePolicy - replaces policy for incoming virtual channels, by default rules from coin config are used.
+// Custom policy can call ConfigAcceptancePolicy to keep config rules.
+func (s *Service) SetAcceptancePolicy(policy AcceptancePolicy) {
+	s.acceptancePolicy = policy
+}
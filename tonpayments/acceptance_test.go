@@ -0,0 +1,143 @@
+package tonpayments
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+type rejectAllPolicy struct{}
+
+func (rejectAllPolicy) CheckIncomingVirtualChannel(_ context.Context, ch *IncomingVirtualChannel) error {
+	return fmt.Errorf("closed for %s", ch.Coin.Symbol)
+}
+
+func expectDenied(t *testing.T, err error, reason string) {
+	t.Helper()
+	if !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), reason) {
+		t.Fatal("expected rejection with reason '"+reason+"', got", err)
+	}
+}
+
+func TestAcceptancePolicy_ConfigRules(t *testing.T) {
+	n := newTestNetwork()
+	a, c := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+
+	cfg := testConfig()
+	cfg.SupportedCoins.Ton.IncomingPolicy = &config.IncomingPolicyConfig{
+		AllowedSenders: []string{base64.StdEncoding.EncodeToString(a.pub())},
+		MinAmount:      "0.5",
+		MaxAmount:      "2",
+		RequireMemo:    true,
+	}
+	b := n.addNode(t, cfg)
+	ab := n.connect(t, a, b, "10", "0")
+	cb := n.connect(t, c, b, "10", "0")
+
+	memo := transport.MemoPayload{Memo: "order-1"}
+
+	_, err := proposeVirtual(t, a, b, ab, "1", false, nil)
+	expectDenied(t, err, "memo is required")
+
+	_, err = proposeVirtual(t, a, b, ab, "1", false, nil, transport.MemoPayload{Memo: strings.Repeat("a", transport.MaxMemoLength+1)})
+	expectDenied(t, err, "memo is too long")
+
+	_, err = proposeVirtual(t, a, b, ab, "0.1", false, nil, memo)
+	expectDenied(t, err, "less than minimum")
+
+	_, err = proposeVirtual(t, a, b, ab, "3", false, nil, memo)
+	expectDenied(t, err, "greater than maximum")
+
+	_, err = proposeVirtual(t, c, b, cb, "1", false, nil, memo)
+	expectDenied(t, err, "sender is not allowed")
+
+	key, err := proposeVirtual(t, a, b, ab, "1", false, nil, memo)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	meta, err := b.db.GetVirtualChannelMeta(context.Background(), key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if meta.Memo != memo.Memo {
+		t.Fatal("memo should be delivered to the receiver", meta.Memo)
+	}
+}
+
+func TestAcceptancePolicy_Invoice(t *testing.T) {
+	cfg := testConfig()
+	cfg.SupportedCoins.Ton.IncomingPolicy = &config.IncomingPolicyConfig{
+		RequireInvoice: true,
+	}
+
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, cfg)
+	ab := n.connect(t, a, b, "10", "0")
+
+	inv, err := b.svc.CreateInvoice(context.Background(), "", 0, mustNano(t, "1"), "", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	payload := transport.InvoicePayload{InvoiceID: inv.ID}
+
+	_, err = proposeVirtual(t, a, b, ab, "1", true, nil)
+	expectDenied(t, err, "payment for invoice is required")
+
+	_, err = proposeVirtual(t, a, b, ab, "1", false, nil, payload)
+	expectDenied(t, err, "should have final state")
+
+	_, err = proposeVirtual(t, a, b, ab, "1", true, nil, transport.InvoicePayload{InvoiceID: make([]byte, 32)})
+	expectDenied(t, err, "invoice is not found")
+
+	_, err = proposeVirtual(t, a, b, ab, "0.5", true, nil, payload)
+	expectDenied(t, err, "less than invoice amount")
+
+	key, err := proposeVirtual(t, a, b, ab, "1", true, nil, payload)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got, err := b.svc.GetInvoice(context.Background(), inv.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Status != db.InvoiceStatusPaid || !got.VirtualKey.Equal(key) || !got.Payer.Equal(a.pub()) {
+		t.Fatal("invoice should be paid by the channel", got.Status)
+	}
+
+	_, err = proposeVirtual(t, a, b, ab, "1", true, nil, payload)
+	expectDenied(t, err, "already paid")
+}
+
+func TestAcceptancePolicy_Custom(t *testing.T) {
+	cfg := testConfig()
+	cfg.SupportedCoins.Ton.IncomingPolicy = &config.IncomingPolicyConfig{Reject: true}
+
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, cfg)
+	ab := n.connect(t, a, b, "10", "0")
+
+	_, err := proposeVirtual(t, a, b, ab, "1", false, nil)
+	expectDenied(t, err, "are not accepted")
+
+	b.svc.SetAcceptancePolicy(rejectAllPolicy{})
+	_, err = proposeVirtual(t, a, b, ab, "1", false, nil)
+	expectDenied(t, err, "closed for TON")
+
+	// policy is applied only by the final receiver
+	c := n.addNode(t, cfg)
+	n.connect(t, b, c, "10", "0")
+	_, err = proposeVirtual(t, a, c, ab, "1", false, nil)
+	if err != nil {
+		t.Fatal("intermediate node should not apply its acceptance policy", err)
+	}
+}
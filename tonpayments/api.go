@@ -81,7 +81,26 @@ func (s *Service) GetTunnelingFees(ctx context.Context, jetton string, ecID uint
 		return false, tlb.ZeroCoins, tlb.ZeroCoins, 0, nil
 	}
 
-	return true, tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMinFee, int(cc.Decimals)), tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMaxCapacity, int(cc.Decimals)), cc.VirtualTunnelConfig.ProxyFeePercent, nil
+	return true, tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMinFee, int(cc.Decimals)), tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMaxCapacity, int(cc.Decimals)), cc.VirtualTunnelConfig.AdvertisedFeePercent(), nil
+}
+
+// GetNodeTunnelingFees - same as GetTunnelingFees, but asks actual conditions from the remote node
+func (s *Service) GetNodeTunnelingFees(ctx context.Context, key ed25519.PublicKey, jetton string, ecID uint32) (enabled bool, minFee, maxCap tlb.Coins, percentFee float64, err error) {
+	cc, err := s.ResolveCoinConfig(jetton, ecID, true)
+	if err != nil {
+		return false, tlb.ZeroCoins, tlb.ZeroCoins, 0, fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	p, err := s.QueryTunnelingPolicy(ctx, key, jetton, ecID)
+	if err != nil {
+		return false, tlb.ZeroCoins, tlb.ZeroCoins, 0, err
+	}
+
+	if !p.AllowTunneling {
+		return false, tlb.ZeroCoins, tlb.ZeroCoins, 0, nil
+	}
+
+	return true, cc.MustAmount(p.MinFee), cc.MustAmount(p.MaxCapacity), p.FeePercent, nil
 }
 
 func (s *Service) OpenChannelWithNode(ctx context.Context, nodeKey ed25519.PublicKey, jettonMaster *address.Address, ecID uint32) (*address.Address, error) {
@@ -123,7 +142,8 @@ func (s *Service) OpenChannelWithNode(ctx context.Context, nodeKey ed25519.Publi
 		return nil, fmt.Errorf("channel proposal failed: %w", err)
 	}
 
-	_ = configVirtualResp // TODO: check if it fits us
+	// remember peer's tunnelling conditions, to use them when building routes through it
+	s.graph.SetNodePolicy(nodeKey, jettonAddr, ecID, policyFromVirtualConfig(configVirtualResp))
 	// TODO: if code hash is unknown to peer try older if possible
 
 	pc := payments.PaymentConfig{
@@ -245,21 +265,43 @@ func (s *Service) OpenVirtualChannel(ctx context.Context, with, instructionKey,
 		return fmt.Errorf("failed to get channel: %w", err)
 	}
 
+	failureKeys, err := transport.TunnelFailureKeys(chain, instructionKey)
+	if err != nil {
+		return fmt.Errorf("failed to calc failure keys: %w", err)
+	}
+
+	var jettonAddr string
+	if jettonMaster != nil {
+		jettonAddr = jettonMaster.Bounce(true).String()
+	}
+
 	tryTill := time.Unix(vch.Deadline-channel.SafeOnchainClosePeriod, 0)
-	err = s.db.CreateTask(ctx, PaymentsTaskPool, "open-virtual", channel.Address,
-		"open-virtual-"+base64.StdEncoding.EncodeToString(vch.Key),
-		db.OpenVirtualTask{
-			FinalDestinationKey: finalDest,
-			ChannelAddress:      channel.Address,
-			VirtualKey:          vch.Key,
-			Deadline:            vch.Deadline,
-			Fee:                 vch.Fee.String(),
-			Capacity:            vch.Capacity.String(),
-			Action:              act,
-		}, nil, &tryTill,
-	)
+	err = s.db.Transaction(ctx, func(ctx context.Context) error {
+		if err = s.createTransfer(ctx, vch, finalDest, jettonAddr, ecID); err != nil {
+			return err
+		}
+
+		err = s.db.CreateTask(ctx, PaymentsTaskPool, "open-virtual", channel.Address,
+			"open-virtual-"+base64.StdEncoding.EncodeToString(vch.Key),
+			db.OpenVirtualTask{
+				FinalDestinationKey: finalDest,
+				FailureKeys:         failureKeys,
+				ChannelAddress:      channel.Address,
+				VirtualKey:          vch.Key,
+				Deadline:            vch.Deadline,
+				Fee:                 vch.Fee.String(),
+				Capacity:            vch.Capacity.String(),
+				HashLock:            vch.HashLock,
+				Action:              act,
+			}, nil, &tryTill,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create open task: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create open task: %w", err)
+		return err
 	}
 	s.touchWorker()
 
@@ -375,6 +417,95 @@ func (s *Service) CommitVirtualChannel(ctx context.Context, key []byte) error {
 	return nil
 }
 
+// commitNextVirtual - passes prepay received from the previous node to the next one, keeping our fee
+func (s *Service) commitNextVirtual(ctx context.Context, prev *db.Channel, prevVch *payments.VirtualChannel) error {
+	meta, err := s.db.GetVirtualChannelMeta(ctx, prevVch.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	if meta.Outgoing == nil {
+		// we are the final receiver
+		return nil
+	}
+
+	ch, err := s.db.GetChannel(ctx, meta.Outgoing.ChannelAddress)
+	if err != nil {
+		return fmt.Errorf("failed to get outgoing channel: %w", err)
+	}
+
+	if ch.JettonAddress != prev.JettonAddress || ch.ExtraCurrencyID != prev.ExtraCurrencyID {
+		// converted channels are hash-locked, they are resolved for full capacity anyway
+		return nil
+	}
+
+	_, vch, err := payments.FindVirtualChannel(ch.Our.Conditionals, prevVch.Key)
+	if err != nil {
+		if errors.Is(err, payments.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to find virtual channel: %w", err)
+	}
+
+	ourFee := new(big.Int).Sub(prevVch.Fee, vch.Fee)
+	toPrepay := new(big.Int).Sub(prevVch.Prepay, ourFee)
+	if limit := new(big.Int).Add(vch.Capacity, vch.Fee); toPrepay.Cmp(limit) > 0 {
+		toPrepay = limit
+	}
+
+	if toPrepay.Cmp(vch.Prepay) <= 0 {
+		// our fee is not covered yet, or already commited
+		return nil
+	}
+
+	tryTill := time.Unix(vch.Deadline-ch.SafeOnchainClosePeriod, 0)
+	err = s.db.CreateTask(ctx, PaymentsTaskPool, "commit-virtual", ch.Address,
+		"commit-virtual-"+base64.StdEncoding.EncodeToString(vch.Key)+"-"+toPrepay.String(),
+		db.CommitVirtualTask{
+			ChannelAddress: ch.Address,
+			VirtualKey:     vch.Key,
+			PrepayAmount:   toPrepay.String(),
+		}, nil, &tryTill,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create virtual commit task: %w", err)
+	}
+	s.touchWorker()
+
+	return nil
+}
+
+// GetVirtualChannelCommitStatus - returns how much of the known state is already prepaid to the next node,
+// toPrepay is amount of the known state plus fee, nil when state is unknown
+func (s *Service) GetVirtualChannelCommitStatus(ctx context.Context, key []byte) (toPrepay, prepaid *big.Int, err error) {
+	meta, err := s.db.GetVirtualChannelMeta(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if meta.Outgoing == nil {
+		return nil, nil, fmt.Errorf("virtual channel is not outgoing")
+	}
+
+	ch, err := s.db.GetChannel(ctx, meta.Outgoing.ChannelAddress)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get outgoing channel: %w", err)
+	}
+
+	_, vch, err := payments.FindVirtualChannel(ch.Our.Conditionals, key)
+	if err != nil {
+		if errors.Is(err, payments.ErrNotFound) {
+			return nil, nil, fmt.Errorf("virtual channel is not active")
+		}
+		return nil, nil, fmt.Errorf("failed to find virtual channel: %w", err)
+	}
+
+	if resolve := meta.GetKnownResolve(); resolve != nil {
+		toPrepay = new(big.Int).Add(resolve.Amount, vch.Fee)
+	}
+	return toPrepay, vch.Prepay, nil
+}
+
 func (s *Service) AddVirtualChannelResolve(ctx context.Context, virtualKey ed25519.PublicKey, state payments.VirtualChannelState) error {
 	meta, err := s.db.GetVirtualChannelMeta(ctx, virtualKey)
 	if err != nil {
@@ -384,6 +515,10 @@ func (s *Service) AddVirtualChannelResolve(ctx context.Context, virtualKey ed255
 		return fmt.Errorf("failed to load virtual channel meta: %w", err)
 	}
 
+	if meta.HashLock != nil {
+		return fmt.Errorf("virtual channel is hash-locked, it can be resolved only by preimage")
+	}
+
 	if meta.Incoming != nil {
 		ch, err := s.db.GetChannel(ctx, meta.Incoming.ChannelAddress)
 		if err != nil {
@@ -455,9 +590,65 @@ func (s *Service) AddVirtualChannelResolve(ctx context.Context, virtualKey ed255
 		return fmt.Errorf("failed to update channel in db: %w", err)
 	}
 
+	if meta.Incoming != nil && len(s.towers) > 0 {
+		// with this resolve tower can settle the condition, if channel is closed while we are offline
+		if ch, err := s.db.GetChannel(ctx, meta.Incoming.ChannelAddress); err == nil {
+			s.requestWatchtowerUpload(ctx, ch, "resolve-"+base64.StdEncoding.EncodeToString(virtualKey)+"-"+state.Amount.String())
+		}
+	}
+
 	return nil
 }
 
+// AddVirtualChannelPreimage - saves preimage which unlocks hash-locked virtual channel,
+// after it, channel can be closed for the full capacity.
+func (s *Service) AddVirtualChannelPreimage(ctx context.Context, virtualKey ed25519.PublicKey, preimage []byte) error {
+	meta, err := s.db.GetVirtualChannelMeta(ctx, virtualKey)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("virtual channel is not exists")
+		}
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	if meta.Preimage != nil && bytes.Equal(meta.Preimage, preimage) {
+		// idempotency
+		return nil
+	}
+
+	if meta.Status != db.VirtualChannelStateActive {
+		return fmt.Errorf("virtual channel is inactive")
+	}
+
+	side := meta.Incoming
+	if side == nil {
+		side = meta.Outgoing
+	}
+
+	if side.UncooperativeDeadline.Before(time.Now()) {
+		return fmt.Errorf("virtual channel has expired")
+	}
+
+	if err = meta.AddPreimage(preimage); err != nil {
+		return fmt.Errorf("failed to add preimage: %w", err)
+	}
+
+	return s.db.Transaction(ctx, func(ctx context.Context) error {
+		meta.UpdatedAt = time.Now()
+		if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+			return fmt.Errorf("failed to update channel in db: %w", err)
+		}
+
+		if meta.Incoming == nil {
+			// we are the sender, preimage can unlock our swap
+			if err = s.onSwapPreimageRevealed(ctx, meta.HashLock, preimage); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (s *Service) RequestUncooperativeClose(ctx context.Context, addr string) error {
 	channel, err := s.GetChannel(ctx, addr)
 	if err != nil {
@@ -647,13 +838,22 @@ func (s *Service) CloseVirtualChannel(ctx context.Context, virtualKey ed25519.Pu
 		return fmt.Errorf("failed to find virtual channel: %w", err)
 	}
 
-	resolve := meta.GetKnownResolve()
-	if resolve == nil {
-		return ErrNoResolveExists
+	var amount *big.Int
+	if vch.IsHashLocked() {
+		if meta.Preimage == nil {
+			return ErrNoResolveExists
+		}
+		amount = vch.Capacity
+	} else {
+		resolve := meta.GetKnownResolve()
+		if resolve == nil {
+			return ErrNoResolveExists
+		}
+		amount = resolve.Amount
 	}
 
 	till := time.Unix(vch.Deadline, 0)
-	prepaid := vch.Prepay.Cmp(new(big.Int).Add(resolve.Amount, vch.Fee)) >= 0
+	prepaid := vch.Prepay.Cmp(new(big.Int).Add(amount, vch.Fee)) >= 0
 
 	err = s.db.Transaction(ctx, func(ctx context.Context) error {
 		meta.Status = db.VirtualChannelStateWantClose
@@ -1013,6 +1213,27 @@ func (s *Service) challengeChannelState(ctx context.Context, channelAddr string)
 		return nil
 	}
 
+	msgCell, err := s.buildChallengeMessage(channel)
+	if err != nil {
+		return err
+	}
+
+	if err := s.CheckWalletBalance(ctx, channel.JettonAddress, channel.ExtraCurrencyID, tlb.ZeroCoins); err != nil {
+		return fmt.Errorf("failed to check balance: %w", err)
+	}
+
+	msgHash, err := s.wallet.DoTransaction(ctx, "Channel state challenge, because peer committed older state", address.MustParseAddr(channel.Address), tlb.MustFromTON("0.05"), msgCell)
+	if err != nil {
+		return fmt.Errorf("failed to send internal message to channel: %w", err)
+	}
+	log.Info().Str("addr", channel.Address).Str("hash", base64.StdEncoding.EncodeToString(msgHash)).Msg("challenge channel state transaction completed")
+
+	// TODO: wait event from invalidator here to confirm
+	return nil
+}
+
+// buildChallengeMessage - signed message to challenge quarantined state with our latest states
+func (s *Service) buildChallengeMessage(channel *db.Channel) (*cell.Cell, error) {
 	msg := payments.ChallengeQuarantinedState{
 		IsChallengedByA: channel.WeLeft,
 	}
@@ -1025,27 +1246,15 @@ func (s *Service) challengeChannelState(ctx context.Context, channelAddr string)
 
 	dataCell, err := tlb.ToCell(msg.Signed)
 	if err != nil {
-		return fmt.Errorf("failed to serialize body to cell: %w", err)
+		return nil, fmt.Errorf("failed to serialize body to cell: %w", err)
 	}
 	msg.Signature.Value = dataCell.Sign(s.key)
 
 	msgCell, err := tlb.ToCell(msg)
 	if err != nil {
-		return fmt.Errorf("failed to serialize message to cell: %w", err)
+		return nil, fmt.Errorf("failed to serialize message to cell: %w", err)
 	}
-
-	if err := s.CheckWalletBalance(ctx, channel.JettonAddress, channel.ExtraCurrencyID, tlb.ZeroCoins); err != nil {
-		return fmt.Errorf("failed to check balance: %w", err)
-	}
-
-	msgHash, err := s.wallet.DoTransaction(ctx, "Channel state challenge, because peer committed older state", address.MustParseAddr(channel.Address), tlb.MustFromTON("0.05"), msgCell)
-	if err != nil {
-		return fmt.Errorf("failed to send internal message to channel: %w", err)
-	}
-	log.Info().Str("addr", channel.Address).Str("hash", base64.StdEncoding.EncodeToString(msgHash)).Msg("challenge channel state transaction completed")
-
-	// TODO: wait event from invalidator here to confirm
-	return nil
+	return msgCell, nil
 }
 
 func (s *Service) finishUncooperativeChannelClose(ctx context.Context, channelAddr string) error {
@@ -1084,8 +1293,6 @@ func (s *Service) finishUncooperativeChannelClose(ctx context.Context, channelAd
 }
 
 func (s *Service) settleChannelConditionals(ctx context.Context, channelAddr string) error {
-	const conditionsPerMessage = 30
-
 	log.Info().Str("address", channelAddr).Msg("settling conditionals")
 
 	channel, err := s.db.GetChannel(ctx, channelAddr)
@@ -1110,6 +1317,68 @@ func (s *Service) settleChannelConditionals(ctx context.Context, channelAddr str
 		return nil
 	}
 
+	messages, unresolved, err := s.buildSettleMessages(ctx, channel)
+	if err != nil {
+		return err
+	}
+
+	// TODO: maybe wait for some deadline if not all states resolved, before settle
+	if len(messages) == 0 {
+		log.Warn().Msg("no known resolves for existing conditions")
+		return nil
+	}
+
+	if unresolved > 0 {
+		log.Warn().
+			Int("without_resolves", unresolved).
+			Msg("not all conditions has resolves yet, settling as is")
+	}
+
+	steps := len(messages) / messagesPerTransaction
+	if len(messages)%messagesPerTransaction > 0 {
+		steps++
+	}
+
+	log.Info().Str("address", channel.Address).Int("steps", steps).Msg("calculated settle steps")
+
+	for i := 0; i < steps; i++ {
+		to := (i + 1) * messagesPerTransaction
+		if to > len(messages) {
+			to = len(messages)
+		}
+
+		var list [][]byte
+		for _, c := range messages[i*messagesPerTransaction : to] {
+			list = append(list, c.ToBOC())
+		}
+
+		if err = s.db.CreateTask(ctx, PaymentsTaskPool, "settle-step", channel.Address+"-settle",
+			"settle-"+channel.Address+"-"+fmt.Sprint(i),
+			db.SettleStepTask{
+				Step:               i,
+				Address:            channel.Address,
+				Messages:           list,
+				ChannelInitiatedAt: &channel.InitAt,
+			}, nil, nil,
+		); err != nil {
+			log.Error().Err(err).Str("channel", channel.Address).Msg("failed to create settle step task")
+		}
+
+		log.Info().Str("address", channel.Address).Int("step", i).Msg("settle step created")
+	}
+
+	return nil
+}
+
+// buildSettleMessages - signed messages to settle their conditionals with known resolves,
+// they should be sent in the same order, because each next proof is made for the dictionary updated by previous
+func (s *Service) buildSettleMessages(ctx context.Context, channel *db.Channel) (messages []*cell.Cell, unresolved int, err error) {
+	const conditionsPerMessage = 30
+
+	if channel.Their.Conditionals.IsEmpty() {
+		return nil, 0, nil
+	}
+
 	msg := payments.SettleConditionals{
 		IsFromA: channel.WeLeft,
 	}
@@ -1119,10 +1388,9 @@ func (s *Service) settleChannelConditionals(ctx context.Context, channelAddr str
 	// TODO: get all conditions and make inputs for known
 	all, err := channel.Their.Conditionals.LoadAll()
 	if err != nil {
-		return fmt.Errorf("failed to load their conditions dict: %w", err)
+		return nil, 0, fmt.Errorf("failed to load their conditions dict: %w", err)
 	}
 
-	var messages []*cell.Cell
 	var resolved int
 
 	addMessage := func(data payments.SettleConditionals, proofPath *cell.ProofSkeleton, num int) error {
@@ -1166,12 +1434,13 @@ func (s *Service) settleChannelConditionals(ctx context.Context, channelAddr str
 			continue
 		}
 
-		if resolve := meta.GetKnownResolve(); resolve != nil {
-			rc, err := tlb.ToCell(resolve)
-			if err != nil {
-				log.Warn().Err(err).Msg("failed to serialize known virtual channel state")
-				continue
-			}
+		rc, err := meta.GetResolveCell()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to serialize known virtual channel state")
+			continue
+		}
+
+		if rc != nil {
 
 			if err = msg.Signed.ConditionalsToSettle.Set(kv.Key.MustToCell(), rc); err != nil {
 				log.Warn().Err(err).Msg("failed to store known virtual channel state in request")
@@ -1195,7 +1464,7 @@ func (s *Service) settleChannelConditionals(ctx context.Context, channelAddr str
 			if condNum == conditionsPerMessage {
 				if err := addMessage(msg, proofPath, condNum); err != nil {
 					log.Warn().Err(err).Msg("failed to add settle message")
-					return err
+					return nil, 0, err
 				}
 
 				condNum = 0
@@ -1210,57 +1479,11 @@ func (s *Service) settleChannelConditionals(ctx context.Context, channelAddr str
 	if condNum%conditionsPerMessage != 0 {
 		if err := addMessage(msg, proofPath, condNum); err != nil {
 			log.Warn().Err(err).Msg("failed to add settle last message")
-			return err
-		}
-	}
-
-	// TODO: maybe wait for some deadline if not all states resolved, before settle
-	if len(messages) == 0 {
-		log.Warn().Msg("no known resolves for existing conditions")
-		return nil
-	}
-
-	if resolved != len(all) {
-		log.Warn().
-			Int("with_resolves", resolved).
-			Int("all", len(all)).
-			Msg("not all conditions has resolves yet, settling as is")
-	}
-
-	steps := len(messages) / messagesPerTransaction
-	if len(messages)%messagesPerTransaction > 0 {
-		steps++
-	}
-
-	log.Info().Str("address", channel.Address).Int("steps", steps).Msg("calculated settle steps")
-
-	for i := 0; i < steps; i++ {
-		to := (i + 1) * messagesPerTransaction
-		if to > len(messages) {
-			to = len(messages)
+			return nil, 0, err
 		}
-
-		var list [][]byte
-		for _, c := range messages[i*messagesPerTransaction : to] {
-			list = append(list, c.ToBOC())
-		}
-
-		if err = s.db.CreateTask(ctx, PaymentsTaskPool, "settle-step", channel.Address+"-settle",
-			"settle-"+channel.Address+"-"+fmt.Sprint(i),
-			db.SettleStepTask{
-				Step:               i,
-				Address:            channel.Address,
-				Messages:           list,
-				ChannelInitiatedAt: &channel.InitAt,
-			}, nil, nil,
-		); err != nil {
-			log.Error().Err(err).Str("channel", channel.Address).Msg("failed to create settle step task")
-		}
-
-		log.Info().Str("address", channel.Address).Int("step", i).Msg("settle step created")
 	}
 
-	return nil
+	return messages, len(all) - resolved, nil
 }
 
 func (s *Service) executeSettleStep(ctx context.Context, channelAddr string, messages []*cell.Cell, step int) error {
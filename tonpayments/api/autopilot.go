@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/base64"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AutopilotChannel struct {
+	Address         string    `json:"address"`
+	Peer            string    `json:"peer"`
+	JettonAddress   string    `json:"jetton_address"`
+	ExtraCurrencyID uint32    `json:"ec_id"`
+	Allocated       string    `json:"allocated"`
+	Balance         string    `json:"balance"`
+	Status          string    `json:"status"`
+	LastActivityAt  time.Time `json:"last_activity_at"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type AutopilotDecision struct {
+	Action          string    `json:"action"`
+	Peer            string    `json:"peer,omitempty"`
+	ChannelAddress  string    `json:"channel_address,omitempty"`
+	JettonAddress   string    `json:"jetton_address"`
+	ExtraCurrencyID uint32    `json:"ec_id"`
+	Amount          string    `json:"amount,omitempty"`
+	Reason          string    `json:"reason"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func (s *Server) handleAutopilotChannels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	list, err := s.svc.ListAutopilotChannels(r.Context())
+	if err != nil {
+		writeErr(w, 500, "failed to list autopilot channels: "+err.Error())
+		return
+	}
+
+	res := make([]AutopilotChannel, 0, len(list))
+	for _, apc := range list {
+		cc, err := s.svc.ResolveCoinConfig(apc.JettonAddress, apc.ExtraCurrencyID, false)
+		if err != nil {
+			writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+			return
+		}
+
+		ch, err := s.svc.GetChannel(r.Context(), apc.Address)
+		if err != nil {
+			writeErr(w, 500, "failed to get channel: "+err.Error())
+			return
+		}
+
+		balance, _, err := ch.CalcBalance(false)
+		if err != nil {
+			writeErr(w, 500, "failed to calc channel balance: "+err.Error())
+			return
+		}
+
+		status := "inactive"
+		switch ch.Status {
+		case db.ChannelStateActive:
+			status = "active"
+		case db.ChannelStateClosing:
+			status = "closing"
+		}
+
+		res = append(res, AutopilotChannel{
+			Address:         apc.Address,
+			Peer:            base64.StdEncoding.EncodeToString(apc.PeerKey),
+			JettonAddress:   apc.JettonAddress,
+			ExtraCurrencyID: apc.ExtraCurrencyID,
+			Allocated:       cc.MustAmount(apc.Allocated).String(),
+			Balance:         cc.MustAmount(balance).String(),
+			Status:          status,
+			LastActivityAt:  apc.LastActivityAt,
+			CreatedAt:       apc.CreatedAt,
+		})
+	}
+
+	writeResp(w, res)
+}
+
+func (s *Server) handleAutopilotDecisions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	limit := 100
+	if q := r.URL.Query().Get("limit"); q != "" {
+		var err error
+		limit, err = strconv.Atoi(q)
+		if err != nil || limit < 0 {
+			writeErr(w, 400, "incorrect limit")
+			return
+		}
+	}
+
+	list, err := s.svc.ListAutopilotDecisions(r.Context(), limit)
+	if err != nil {
+		writeErr(w, 500, "failed to list autopilot decisions: "+err.Error())
+		return
+	}
+
+	res := make([]AutopilotDecision, 0, len(list))
+	for _, dc := range list {
+		cc, err := s.svc.ResolveCoinConfig(dc.JettonAddress, dc.ExtraCurrencyID, false)
+		if err != nil {
+			writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+			return
+		}
+
+		item := AutopilotDecision{
+			Action:          convertAutopilotAction(dc.Action),
+			ChannelAddress:  dc.ChannelAddress,
+			JettonAddress:   dc.JettonAddress,
+			ExtraCurrencyID: dc.ExtraCurrencyID,
+			Reason:          dc.Reason,
+			CreatedAt:       dc.CreatedAt,
+		}
+		if dc.PeerKey != nil {
+			item.Peer = base64.StdEncoding.EncodeToString(dc.PeerKey)
+		}
+		if dc.Amount != nil {
+			item.Amount = cc.MustAmount(dc.Amount).String()
+		}
+		res = append(res, item)
+	}
+
+	writeResp(w, res)
+}
+
+func convertAutopilotAction(action db.AutopilotAction) string {
+	switch action {
+	case db.AutopilotActionOpen:
+		return "open"
+	case db.AutopilotActionTopup:
+		return "topup"
+	case db.AutopilotActionClose:
+		return "close"
+	default:
+		return "failed"
+	}
+}
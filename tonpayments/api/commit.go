@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"net/http"
+)
+
+type VirtualCommit struct {
+	Key       string `json:"key"`
+	ToPrepay  string `json:"to_prepay,omitempty"`
+	Prepaid   string `json:"prepaid"`
+	Committed bool   `json:"committed"`
+}
+
+func (s *Server) handleVirtualCommit(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Key   string `json:"key"`
+		State string `json:"state"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	key, err := parseKey(req.Key)
+	if err != nil {
+		writeErr(w, 400, "failed to parse key: "+err.Error())
+		return
+	}
+
+	st, err := parseState(req.State, key)
+	if err != nil {
+		writeErr(w, 400, err.Error())
+		return
+	}
+
+	if err = s.svc.AddVirtualChannelResolve(r.Context(), key, st); err != nil && !errors.Is(err, db.ErrNewerStateIsKnown) {
+		writeErr(w, 500, "failed to add virtual channel state: "+err.Error())
+		return
+	}
+
+	if err = s.svc.CommitVirtualChannel(r.Context(), key); err != nil {
+		writeErr(w, 500, "failed to commit virtual channel: "+err.Error())
+		return
+	}
+
+	res, err := s.getVirtualCommit(r.Context(), key)
+	if err != nil {
+		writeErr(w, 500, err.Error())
+		return
+	}
+	writeResp(w, res)
+}
+
+func (s *Server) handleVirtualCommitStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	key, err := parseKey(r.URL.Query().Get("key"))
+	if err != nil {
+		writeErr(w, 400, "failed to parse key: "+err.Error())
+		return
+	}
+
+	res, err := s.getVirtualCommit(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "virtual channel is not found")
+			return
+		}
+		writeErr(w, 500, err.Error())
+		return
+	}
+	writeResp(w, res)
+}
+
+func (s *Server) getVirtualCommit(ctx context.Context, key []byte) (*VirtualCommit, error) {
+	meta, err := s.svc.GetVirtualChannelMeta(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Outgoing == nil {
+		return nil, fmt.Errorf("virtual channel is not outgoing")
+	}
+
+	ch, err := s.svc.GetChannel(ctx, meta.Outgoing.ChannelAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", err)
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(ch.JettonAddress, ch.ExtraCurrencyID, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	toPrepay, prepaid, err := s.svc.GetVirtualChannelCommitStatus(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commit status: %w", err)
+	}
+
+	res := &VirtualCommit{
+		Key:     base64.StdEncoding.EncodeToString(key),
+		Prepaid: cc.MustAmount(prepaid).String(),
+	}
+
+	if toPrepay != nil {
+		res.ToPrepay = cc.MustAmount(toPrepay).String()
+		res.Committed = prepaid.Cmp(toPrepay) >= 0
+	}
+	return res, nil
+}
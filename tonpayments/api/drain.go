@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"net/http"
+)
+
+type DrainRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type DrainChannel struct {
+	Address         string `json:"address"`
+	Peer            string `json:"peer"`
+	ActiveOutgoing  int    `json:"active_outgoing"`
+	ActiveIncoming  int    `json:"active_incoming"`
+	JettonAddress   string `json:"jetton_address"`
+	ExtraCurrencyID uint32 `json:"ec_id"`
+}
+
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+	// ActiveVirtualChannels - total of all channels, when zero node can be safely restarted
+	ActiveVirtualChannels int            `json:"active_virtual_channels"`
+	Channels              []DrainChannel `json:"channels"`
+}
+
+func (s *Server) handleNodeDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req DrainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	s.svc.SetDrainMode(req.Enabled)
+	writeSuccess(w)
+}
+
+func (s *Server) handleNodeDrainStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	list, err := s.svc.ListChannels(r.Context(), nil, db.ChannelStateAny)
+	if err != nil {
+		writeErr(w, 500, "failed to list channels: "+err.Error())
+		return
+	}
+
+	res := DrainStatus{
+		Draining: s.svc.IsDraining(),
+		Channels: []DrainChannel{},
+	}
+	for _, ch := range list {
+		if ch.Status == db.ChannelStateInactive {
+			continue
+		}
+
+		out, in, err := ch.CountVirtualChannels()
+		if err != nil {
+			writeErr(w, 500, "failed to count virtual channels of "+ch.Address+": "+err.Error())
+			return
+		}
+
+		res.ActiveVirtualChannels += out + in
+		res.Channels = append(res.Channels, DrainChannel{
+			Address:         ch.Address,
+			Peer:            base64.StdEncoding.EncodeToString(ch.TheirOnchain.Key),
+			ActiveOutgoing:  out,
+			ActiveIncoming:  in,
+			JettonAddress:   ch.JettonAddress,
+			ExtraCurrencyID: ch.ExtraCurrencyID,
+		})
+	}
+	writeResp(w, res)
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/base64"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"net/http"
+)
+
+type ChannelProxyFee struct {
+	Address         string  `json:"address"`
+	Peer            string  `json:"peer"`
+	JettonAddress   string  `json:"jetton_address"`
+	ExtraCurrencyID uint32  `json:"ec_id"`
+	FeePercent      float64 `json:"fee_percent"`
+	LiquidityRatio  float64 `json:"liquidity_ratio"`
+}
+
+func (s *Server) handleNodeProxyFees(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	list, err := s.svc.ListChannels(r.Context(), nil, db.ChannelStateActive)
+	if err != nil {
+		writeErr(w, 500, "failed to list channels: "+err.Error())
+		return
+	}
+
+	res := make([]ChannelProxyFee, 0, len(list))
+	for _, ch := range list {
+		percent, ratio, err := s.svc.GetChannelProxyFee(ch)
+		if err != nil {
+			writeErr(w, 500, "failed to get channel fee: "+err.Error())
+			return
+		}
+
+		res = append(res, ChannelProxyFee{
+			Address:         ch.Address,
+			Peer:            base64.StdEncoding.EncodeToString(ch.TheirOnchain.Key),
+			JettonAddress:   ch.JettonAddress,
+			ExtraCurrencyID: ch.ExtraCurrencyID,
+			FeePercent:      percent,
+			LiquidityRatio:  ratio,
+		})
+	}
+
+	writeResp(w, res)
+}
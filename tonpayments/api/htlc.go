@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"net/http"
+	"time"
+)
+
+func (s *Server) handleHTLCOpen(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		TTLSeconds      int64  `json:"ttl_seconds"`
+		Amount          string `json:"amount"`
+		Hash            string `json:"hash"`
+		Destination     string `json:"destination"`
+		JettonMaster    string `json:"jetton_master"`
+		ExtraCurrencyID uint32 `json:"ec_id"`
+	}
+
+	type response struct {
+		Key string `json:"key"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	var jettonAddr string
+	if req.JettonMaster != "" {
+		jetton, err := address.ParseAddr(req.JettonMaster)
+		if err != nil {
+			writeErr(w, 400, "incorrect jetton address format: "+err.Error())
+			return
+		}
+
+		if req.ExtraCurrencyID != 0 {
+			writeErr(w, 400, "jetton master address and extra currency id are mutually exclusive")
+			return
+		}
+		jettonAddr = jetton.Bounce(true).String()
+	}
+
+	dest, err := parseKey(req.Destination)
+	if err != nil {
+		writeErr(w, 400, "failed to parse destination key: "+err.Error())
+		return
+	}
+
+	hash, err := hex.DecodeString(req.Hash)
+	if err != nil || len(hash) != 32 {
+		writeErr(w, 400, "hash should be 32 bytes in hex format")
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(jettonAddr, req.ExtraCurrencyID, true)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	amount, err := tlb.FromDecimal(req.Amount, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, "failed to parse amount: "+err.Error())
+		return
+	}
+
+	if req.TTLSeconds <= 0 {
+		writeErr(w, 400, "ttl_seconds should be positive")
+		return
+	}
+
+	key, err := s.svc.OpenHashLockedChannel(r.Context(), dest, jettonAddr, req.ExtraCurrencyID, amount.Nano(), hash, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		writeErr(w, 403, "failed to open hash-locked channel: "+err.Error())
+		return
+	}
+
+	writeResp(w, response{
+		Key: base64.StdEncoding.EncodeToString(key),
+	})
+}
+
+func (s *Server) handleHTLCResolve(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Key      string `json:"key"`
+		Preimage string `json:"preimage"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	key, err := parseKey(req.Key)
+	if err != nil {
+		writeErr(w, 400, "failed to parse key: "+err.Error())
+		return
+	}
+
+	preimage, err := hex.DecodeString(req.Preimage)
+	if err != nil || len(preimage) != 32 {
+		writeErr(w, 400, "preimage should be 32 bytes in hex format")
+		return
+	}
+
+	if err = s.svc.ResolveHashLockedChannel(r.Context(), key, preimage); err != nil {
+		writeErr(w, 500, "failed to resolve hash-locked channel: "+err.Error())
+		return
+	}
+
+	writeSuccess(w)
+}
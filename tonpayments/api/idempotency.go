@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"io"
+	"net/http"
+	"time"
+)
+
+// IdempotencyKeyRetention - how long response is kept and returned for requests repeated with the same key
+const IdempotencyKeyRetention = 24 * time.Hour
+
+const MaxIdempotencyKeyLength = 256
+
+type IdempotencyStore interface {
+	GetIdempotentResponse(ctx context.Context, key string) (*db.IdempotentResponse, error)
+	SaveIdempotentResponse(ctx context.Context, resp *db.IdempotentResponse) error
+	DeleteIdempotentResponse(ctx context.Context, key string) error
+	DeleteExpiredIdempotentResponses(ctx context.Context) error
+}
+
+// responseRecorder - buffers response, so it is sent only after it is stored
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.code = code
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// idempotent - executes spend request only once for the same Idempotency-Key header,
+// repeated requests get the stored response. Pending marker is stored before the execution,
+// so if node was stopped in the middle, repeated request is rejected instead of spending twice.
+// Only successful responses are stored, so failed request can be safely retried with the same key.
+func (s *Server) idempotent(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idKey := r.Header.Get("Idempotency-Key")
+		if idKey == "" {
+			handler(w, r)
+			return
+		}
+
+		if len(idKey) > MaxIdempotencyKeyLength {
+			writeErr(w, 400, "idempotency key is too long")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeErr(w, 400, "failed to read request body: "+err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+
+		// same key can be used for different endpoints
+		key := r.URL.Path + ":" + idKey
+
+		s.idempotencyMx.Lock()
+		if s.idempotencyInFlight[key] {
+			s.idempotencyMx.Unlock()
+			writeErr(w, 409, "request with this idempotency key is in progress")
+			return
+		}
+		s.idempotencyInFlight[key] = true
+		s.idempotencyMx.Unlock()
+
+		defer func() {
+			s.idempotencyMx.Lock()
+			delete(s.idempotencyInFlight, key)
+			s.idempotencyMx.Unlock()
+		}()
+
+		resp, err := s.idempotency.GetIdempotentResponse(r.Context(), key)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 500, "failed to get idempotent response: "+err.Error())
+			return
+		}
+
+		if resp != nil {
+			if !bytes.Equal(resp.RequestHash, hash[:]) {
+				writeErr(w, 422, "idempotency key was already used for another request")
+				return
+			}
+
+			if resp.Pending {
+				// not in flight in this process, so it was interrupted and result is unknown
+				writeErr(w, 409, "request with this idempotency key was interrupted, its result is unknown, check the state before retrying with a new key")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.StatusCode)
+			_, _ = w.Write(resp.Body)
+			return
+		}
+
+		now := time.Now()
+		if err = s.idempotency.SaveIdempotentResponse(r.Context(), &db.IdempotentResponse{
+			Key:         key,
+			RequestHash: hash[:],
+			Pending:     true,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(IdempotencyKeyRetention),
+		}); err != nil {
+			writeErr(w, 500, "failed to save idempotency key: "+err.Error())
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, code: 200}
+		handler(rec, r)
+
+		if rec.code < 200 || rec.code >= 300 {
+			// nothing was spent, so request can be retried with the same key
+			if err = s.idempotency.DeleteIdempotentResponse(context.Background(), key); err != nil {
+				log.Error().Err(err).Str("key", key).Msg("failed to delete pending idempotent response")
+			}
+		} else if err = s.idempotency.SaveIdempotentResponse(context.Background(), &db.IdempotentResponse{
+			Key:         key,
+			RequestHash: hash[:],
+			StatusCode:  rec.code,
+			Body:        rec.body.Bytes(),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(IdempotencyKeyRetention),
+		}); err != nil {
+			// request is already executed, pending marker is kept to reject retries
+			log.Error().Err(err).Str("key", key).Msg("failed to save idempotent response")
+			writeErr(w, 500, "request was executed, but failed to save idempotent response: "+err.Error())
+			return
+		}
+
+		w.WriteHeader(rec.code)
+		_, _ = w.Write(rec.body.Bytes())
+	}
+}
+
+func (s *Server) startIdempotencyCleaner() {
+	for {
+		if err := s.idempotency.DeleteExpiredIdempotentResponses(context.Background()); err != nil {
+			log.Error().Err(err).Msg("failed to delete expired idempotent responses")
+		}
+		time.Sleep(1 * time.Hour)
+	}
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+)
+
+type memIdempotencyStore struct {
+	data    map[string]db.IdempotentResponse
+	failErr error
+	mx      sync.Mutex
+}
+
+func (m *memIdempotencyStore) GetIdempotentResponse(_ context.Context, key string) (*db.IdempotentResponse, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	resp, ok := m.data[key]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	return &resp, nil
+}
+
+func (m *memIdempotencyStore) SaveIdempotentResponse(_ context.Context, resp *db.IdempotentResponse) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.failErr != nil && !resp.Pending {
+		return m.failErr
+	}
+	m.data[resp.Key] = *resp
+	return nil
+}
+
+func (m *memIdempotencyStore) DeleteIdempotentResponse(_ context.Context, key string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	delete(m.data, key)
+	return nil
+}
+
+func (m *memIdempotencyStore) DeleteExpiredIdempotentResponses(_ context.Context) error {
+	return nil
+}
+
+func newIdempotentTestServer() (*Server, *memIdempotencyStore) {
+	store := &memIdempotencyStore{data: map[string]db.IdempotentResponse{}}
+	return &Server{
+		idempotency:         store,
+		idempotencyInFlight: map[string]bool{},
+	}, store
+}
+
+func doIdempotent(h http.HandlerFunc, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/v1/test/spend", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestIdempotent_Replay(t *testing.T) {
+	s, _ := newIdempotentTestServer()
+
+	var calls atomic.Int32
+	h := s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		writeResp(w, map[string]int32{"n": calls.Load()})
+	})
+
+	first := doIdempotent(h, "k1", `{"amount":"1"}`)
+	if first.Code != 200 || first.Body.String() != `{"n":1}` {
+		t.Fatal("unexpected first response", first.Code, first.Body.String())
+	}
+
+	second := doIdempotent(h, "k1", `{"amount":"1"}`)
+	if second.Code != 200 || second.Body.String() != `{"n":1}` || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("response is not replayed", second.Code, second.Body.String())
+	}
+
+	if calls.Load() != 1 {
+		t.Fatal("handler executed more than once", calls.Load())
+	}
+}
+
+func TestIdempotent_BodyMismatch(t *testing.T) {
+	s, _ := newIdempotentTestServer()
+
+	h := s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		writeSuccess(w)
+	})
+
+	if w := doIdempotent(h, "k1", `{"amount":"1"}`); w.Code != 200 {
+		t.Fatal("unexpected code", w.Code)
+	}
+
+	if w := doIdempotent(h, "k1", `{"amount":"2"}`); w.Code != 422 {
+		t.Fatal("reused key should be rejected, got", w.Code)
+	}
+}
+
+func TestIdempotent_Concurrent(t *testing.T) {
+	s, _ := newIdempotentTestServer()
+
+	started, release := make(chan bool), make(chan bool)
+	h := s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		writeSuccess(w)
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- doIdempotent(h, "k1", `{}`)
+	}()
+	<-started
+
+	if w := doIdempotent(h, "k1", `{}`); w.Code != 409 {
+		t.Fatal("concurrent request should be rejected, got", w.Code)
+	}
+
+	close(release)
+	if w := <-done; w.Code != 200 {
+		t.Fatal("unexpected code of the first request", w.Code)
+	}
+}
+
+func TestIdempotent_Interrupted(t *testing.T) {
+	s, store := newIdempotentTestServer()
+
+	h := s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler should not be called")
+	})
+
+	// pending marker left by the node stopped during execution
+	w := doIdempotent(s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := store.GetIdempotentResponse(r.Context(), "/api/v1/test/spend:k1")
+		if err != nil || !resp.Pending {
+			t.Fatal("pending marker is not stored before execution")
+		}
+		writeErr(w, 500, "stop")
+	}), "k1", `{}`)
+	if w.Code != 500 {
+		t.Fatal("unexpected code", w.Code)
+	}
+
+	// failed request is not remembered
+	if _, err := store.GetIdempotentResponse(context.Background(), "/api/v1/test/spend:k1"); !errors.Is(err, db.ErrNotFound) {
+		t.Fatal("marker of failed request should be deleted")
+	}
+
+	store.data["/api/v1/test/spend:k2"] = db.IdempotentResponse{Key: "/api/v1/test/spend:k2", RequestHash: hashOf(`{}`), Pending: true}
+	if w = doIdempotent(h, "k2", `{}`); w.Code != 409 {
+		t.Fatal("interrupted request should be rejected, got", w.Code)
+	}
+}
+
+func TestIdempotent_SaveFailed(t *testing.T) {
+	s, store := newIdempotentTestServer()
+	store.failErr = errors.New("disk is full")
+
+	var calls atomic.Int32
+	h := s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		writeSuccess(w)
+	})
+
+	if w := doIdempotent(h, "k1", `{}`); w.Code != 500 {
+		t.Fatal("failed save should be reported, got", w.Code)
+	}
+
+	if w := doIdempotent(h, "k1", `{}`); w.Code != 409 {
+		t.Fatal("retry after failed save should be rejected, got", w.Code)
+	}
+
+	if calls.Load() != 1 {
+		t.Fatal("handler executed more than once", calls.Load())
+	}
+}
+
+func hashOf(body string) []byte {
+	h := sha256.Sum256([]byte(body))
+	return h[:]
+}
+
+func TestIdempotent_SpendEndpoints(t *testing.T) {
+	store := &memIdempotencyStore{data: map[string]db.IdempotentResponse{}}
+	s := NewServer("", "", "", nil, nil, store, nil)
+
+	for _, path := range []string{
+		"/api/v1/channel/onchain/open",
+		"/api/v1/channel/onchain/topup",
+		"/api/v1/channel/onchain/withdraw",
+		"/api/v1/channel/virtual/open",
+		"/api/v1/channel/virtual/transfer",
+		"/api/v1/channel/virtual/extend",
+		"/api/v1/channel/virtual/increase",
+		"/api/v1/channel/virtual/htlc/open",
+		"/api/v1/payment/send",
+		"/api/v1/payment/multipath",
+		"/api/v1/invoice/pay",
+		"/api/v1/stream/open",
+		"/api/v1/stream/pay",
+		"/api/v1/swap/execute",
+		"/api/v1/rebalance/execute",
+	} {
+		// service is not set, so request can only be answered from the stored response
+		store.data[path+":k1"] = db.IdempotentResponse{Key: path + ":k1", RequestHash: hashOf(`{}`), StatusCode: 200, Body: []byte(`{"success":true}`)}
+
+		r := httptest.NewRequest("POST", path, strings.NewReader(`{}`))
+		r.Header.Set("Idempotency-Key", "k1")
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, r)
+
+		if w.Code != 200 || w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatal("endpoint is not idempotent", path, w.Code)
+		}
+	}
+}
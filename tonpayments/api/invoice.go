@@ -0,0 +1,322 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/invoice"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+type Invoice struct {
+	ID              string     `json:"id"`
+	Invoice         string     `json:"invoice"`
+	JettonAddress   string     `json:"jetton_address"`
+	ExtraCurrencyID uint32     `json:"ec_id"`
+	Amount          string     `json:"amount"`
+	Memo            string     `json:"memo"`
+	Status          string     `json:"status"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	VirtualKey      string     `json:"virtual_key,omitempty"`
+	PaidAmount      string     `json:"paid_amount,omitempty"`
+	Payer           string     `json:"payer,omitempty"`
+	PaidAt          *time.Time `json:"paid_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+type DecodedInvoice struct {
+	ID              string     `json:"id"`
+	Receiver        string     `json:"receiver"`
+	JettonAddress   string     `json:"jetton_address"`
+	ExtraCurrencyID uint32     `json:"ec_id"`
+	Amount          string     `json:"amount"`
+	Memo            string     `json:"memo"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	Expired         bool       `json:"expired"`
+	RouteHints      [][]string `json:"route_hints"`
+}
+
+func (s *Server) handleInvoiceCreate(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		TTLSeconds      int64      `json:"ttl_seconds"`
+		Amount          string     `json:"amount"`
+		Memo            string     `json:"memo"`
+		RouteHints      [][]string `json:"route_hints"`
+		JettonMaster    string     `json:"jetton_master"`
+		ExtraCurrencyID uint32     `json:"ec_id"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	var jettonAddr string
+	if req.JettonMaster != "" {
+		jetton, err := address.ParseAddr(req.JettonMaster)
+		if err != nil {
+			writeErr(w, 400, "incorrect jetton address format: "+err.Error())
+			return
+		}
+
+		if req.ExtraCurrencyID != 0 {
+			writeErr(w, 400, "jetton master address and extra currency id are mutually exclusive")
+			return
+		}
+		jettonAddr = jetton.Bounce(true).String()
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(jettonAddr, req.ExtraCurrencyID, true)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	amount := big.NewInt(0)
+	if req.Amount != "" {
+		amt, err := tlb.FromDecimal(req.Amount, int(cc.Decimals))
+		if err != nil {
+			writeErr(w, 400, "failed to parse amount: "+err.Error())
+			return
+		}
+		amount = amt.Nano()
+	}
+
+	var hints []invoice.RouteHint
+	for i, hint := range req.RouteHints {
+		var h invoice.RouteHint
+		for _, node := range hint {
+			key, err := parseKey(node)
+			if err != nil {
+				writeErr(w, 400, fmt.Sprintf("failed to parse route hint %d key: %s", i, err.Error()))
+				return
+			}
+			h.Nodes = append(h.Nodes, key)
+		}
+		hints = append(hints, h)
+	}
+
+	inv, err := s.svc.CreateInvoice(r.Context(), jettonAddr, req.ExtraCurrencyID, amount, req.Memo, time.Duration(req.TTLSeconds)*time.Second, hints)
+	if err != nil {
+		writeErr(w, 400, "failed to create invoice: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertInvoice(inv, cc))
+}
+
+func (s *Server) handleInvoiceGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	id, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("id"))
+	if err != nil || len(id) != 32 {
+		writeErr(w, 400, "incorrect invoice id format, should be 32 bytes in base64")
+		return
+	}
+
+	inv, err := s.svc.GetInvoice(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "invoice is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get invoice: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(inv.JettonAddress, inv.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertInvoice(inv, cc))
+}
+
+func (s *Server) handleInvoiceDecode(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Invoice string `json:"invoice"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	inv, err := invoice.Decode(req.Invoice)
+	if err != nil {
+		writeErr(w, 400, "incorrect invoice: "+err.Error())
+		return
+	}
+
+	var jettonAddr string
+	if jetton := inv.JettonAddress(); jetton != nil {
+		jettonAddr = jetton.String()
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(jettonAddr, inv.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	res := DecodedInvoice{
+		ID:              base64.StdEncoding.EncodeToString(inv.ID),
+		Receiver:        base64.StdEncoding.EncodeToString(inv.Receiver),
+		JettonAddress:   jettonAddr,
+		ExtraCurrencyID: inv.ExtraCurrencyID,
+		Amount:          cc.MustAmount(inv.AmountValue()).String(),
+		Memo:            inv.Memo,
+		ExpiresAt:       inv.ExpiresAtTime(),
+		Expired:         inv.IsExpired(),
+		RouteHints:      [][]string{},
+	}
+
+	for _, hint := range inv.RouteHints {
+		var nodes []string
+		for _, node := range hint.Nodes {
+			nodes = append(nodes, base64.StdEncoding.EncodeToString(node))
+		}
+		res.RouteHints = append(res.RouteHints, nodes)
+	}
+
+	writeResp(w, res)
+}
+
+func (s *Server) handleInvoicePay(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Invoice        string `json:"invoice"`
+		Amount         string `json:"amount"`
+		MaxFee         string `json:"max_fee"`
+		TTLSeconds     int64  `json:"ttl_seconds"`
+		TimeoutSeconds int64  `json:"timeout_seconds"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	inv, err := invoice.Decode(req.Invoice)
+	if err != nil {
+		writeErr(w, 400, "incorrect invoice: "+err.Error())
+		return
+	}
+
+	var jettonAddr string
+	if jetton := inv.JettonAddress(); jetton != nil {
+		jettonAddr = jetton.String()
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(jettonAddr, inv.ExtraCurrencyID, true)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	var amount, maxFee *big.Int
+	if req.Amount != "" {
+		amt, err := tlb.FromDecimal(req.Amount, int(cc.Decimals))
+		if err != nil {
+			writeErr(w, 400, "failed to parse amount: "+err.Error())
+			return
+		}
+		amount = amt.Nano()
+	}
+
+	if req.MaxFee != "" {
+		fee, err := tlb.FromDecimal(req.MaxFee, int(cc.Decimals))
+		if err != nil {
+			writeErr(w, 400, "failed to parse max fee: "+err.Error())
+			return
+		}
+		maxFee = fee.Nano()
+	}
+
+	if req.TimeoutSeconds <= 0 {
+		writeErr(w, 400, "timeout_seconds should be positive")
+		return
+	}
+
+	payment, err := s.svc.PayInvoice(r.Context(), req.Invoice, amount, maxFee,
+		time.Duration(req.TTLSeconds)*time.Second, time.Duration(req.TimeoutSeconds)*time.Second)
+	if err != nil {
+		writeErr(w, 403, "failed to pay invoice: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertPayment(payment, cc))
+}
+
+func (s *Server) PushInvoiceEvent(ctx context.Context, inv *db.Invoice) error {
+	cc, err := s.svc.ResolveCoinConfig(inv.JettonAddress, inv.ExtraCurrencyID, false)
+	if err != nil {
+		return fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	res := convertInvoice(inv, cc)
+	if err = s.queue.CreateTask(ctx, WebhooksTaskPool, "invoice-event", "events",
+		res.ID+"-"+res.Status,
+		res, nil, nil,
+	); err != nil {
+		return fmt.Errorf("failed to create invoice-event task: %w", err)
+	}
+	return nil
+}
+
+func convertInvoice(inv *db.Invoice, cc *config.CoinConfig) Invoice {
+	res := Invoice{
+		ID:              base64.StdEncoding.EncodeToString(inv.ID),
+		Invoice:         inv.Data,
+		JettonAddress:   inv.JettonAddress,
+		ExtraCurrencyID: inv.ExtraCurrencyID,
+		Amount:          cc.MustAmount(inv.Amount).String(),
+		Memo:            inv.Memo,
+		Status:          "pending",
+		ExpiresAt:       inv.ExpiresAt,
+		PaidAt:          inv.PaidAt,
+		CreatedAt:       inv.CreatedAt,
+		UpdatedAt:       inv.UpdatedAt,
+	}
+
+	switch {
+	case inv.Status == db.InvoiceStatusPaid:
+		res.Status = "paid"
+		res.VirtualKey = base64.StdEncoding.EncodeToString(inv.VirtualKey)
+		res.PaidAmount = cc.MustAmount(inv.PaidAmount).String()
+		res.Payer = base64.StdEncoding.EncodeToString(inv.Payer)
+	case time.Now().After(inv.ExpiresAt):
+		res.Status = "expired"
+	}
+	return res
+}
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+type PaymentPart struct {
+	VirtualKey string    `json:"virtual_key"`
+	Amount     string    `json:"amount"`
+	Fee        string    `json:"fee"`
+	Deadline   time.Time `json:"deadline"`
+	Status     string    `json:"status"`
+}
+
+type PaymentAttempt struct {
+	VirtualKey string     `json:"virtual_key"`
+	Route      []string   `json:"route"`
+	Fee        string     `json:"fee"`
+	Status     string     `json:"status"`
+	FailedHop  string     `json:"failed_hop,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type Payment struct {
+	ID              string           `json:"id"`
+	Incoming        bool             `json:"incoming"`
+	Counterparty    string           `json:"counterparty"`
+	JettonAddress   string           `json:"jetton_address"`
+	ExtraCurrencyID uint32           `json:"ec_id"`
+	Amount          string           `json:"amount"`
+	Status          string           `json:"status"`
+	Parts           []PaymentPart    `json:"parts"`
+	MaxFee          string           `json:"max_fee,omitempty"`
+	Attempts        []PaymentAttempt `json:"attempts,omitempty"`
+	Reason          string           `json:"reason,omitempty"`
+	CreatedAt       time.Time        `json:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at"`
+}
+
+func (s *Server) handlePaymentMultipath(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		TTLSeconds      int64  `json:"ttl_seconds"`
+		Amount          string `json:"amount"`
+		Parts           int    `json:"parts"`
+		Destination     string `json:"destination"`
+		JettonMaster    string `json:"jetton_master"`
+		ExtraCurrencyID uint32 `json:"ec_id"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	var jettonAddr string
+	if req.JettonMaster != "" {
+		jetton, err := address.ParseAddr(req.JettonMaster)
+		if err != nil {
+			writeErr(w, 400, "incorrect jetton address format: "+err.Error())
+			return
+		}
+
+		if req.ExtraCurrencyID != 0 {
+			writeErr(w, 400, "jetton master address and extra currency id are mutually exclusive")
+			return
+		}
+		jettonAddr = jetton.Bounce(true).String()
+	}
+
+	dest, err := parseKey(req.Destination)
+	if err != nil {
+		writeErr(w, 400, "failed to parse destination key: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(jettonAddr, req.ExtraCurrencyID, true)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	amount, err := tlb.FromDecimal(req.Amount, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, "failed to parse amount: "+err.Error())
+		return
+	}
+
+	if req.Parts == 0 {
+		req.Parts = 1
+	}
+
+	payment, err := s.svc.SendMultipathPayment(r.Context(), dest, jettonAddr, req.ExtraCurrencyID, amount.Nano(), req.Parts, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		writeErr(w, 403, "failed to send payment: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertPayment(payment, cc))
+}
+
+func (s *Server) handlePaymentSend(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		TTLSeconds      int64  `json:"ttl_seconds"`
+		TimeoutSeconds  int64  `json:"timeout_seconds"`
+		Amount          string `json:"amount"`
+		MaxFee          string `json:"max_fee"`
+		Destination     string `json:"destination"`
+		JettonMaster    string `json:"jetton_master"`
+		ExtraCurrencyID uint32 `json:"ec_id"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	var jettonAddr string
+	if req.JettonMaster != "" {
+		jetton, err := address.ParseAddr(req.JettonMaster)
+		if err != nil {
+			writeErr(w, 400, "incorrect jetton address format: "+err.Error())
+			return
+		}
+
+		if req.ExtraCurrencyID != 0 {
+			writeErr(w, 400, "jetton master address and extra currency id are mutually exclusive")
+			return
+		}
+		jettonAddr = jetton.Bounce(true).String()
+	}
+
+	dest, err := parseKey(req.Destination)
+	if err != nil {
+		writeErr(w, 400, "failed to parse destination key: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(jettonAddr, req.ExtraCurrencyID, true)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	amount, err := tlb.FromDecimal(req.Amount, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, "failed to parse amount: "+err.Error())
+		return
+	}
+
+	var maxFee *big.Int
+	if req.MaxFee != "" {
+		fee, err := tlb.FromDecimal(req.MaxFee, int(cc.Decimals))
+		if err != nil {
+			writeErr(w, 400, "failed to parse max fee: "+err.Error())
+			return
+		}
+		maxFee = fee.Nano()
+	}
+
+	if req.TimeoutSeconds <= 0 {
+		writeErr(w, 400, "timeout_seconds should be positive")
+		return
+	}
+
+	payment, err := s.svc.SendPayment(r.Context(), dest, jettonAddr, req.ExtraCurrencyID, amount.Nano(), maxFee,
+		time.Duration(req.TTLSeconds)*time.Second, time.Duration(req.TimeoutSeconds)*time.Second)
+	if err != nil {
+		writeErr(w, 403, "failed to send payment: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertPayment(payment, cc))
+}
+
+func (s *Server) handlePaymentGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	id, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("id"))
+	if err != nil || len(id) != 32 {
+		writeErr(w, 400, "incorrect payment id format, should be 32 bytes in base64")
+		return
+	}
+
+	payment, err := s.svc.GetPayment(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "payment is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get payment: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(payment.JettonAddress, payment.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertPayment(payment, cc))
+}
+
+func convertPayment(p *db.Payment, cc *config.CoinConfig) Payment {
+	res := Payment{
+		ID:              base64.StdEncoding.EncodeToString(p.ID),
+		Incoming:        p.Incoming,
+		Counterparty:    base64.StdEncoding.EncodeToString(p.Counterparty),
+		JettonAddress:   p.JettonAddress,
+		ExtraCurrencyID: p.ExtraCurrencyID,
+		Amount:          cc.MustAmount(p.Amount).String(),
+		Status:          convertPaymentStatus(p.Status),
+		Parts:           make([]PaymentPart, 0, len(p.Parts)),
+		CreatedAt:       p.CreatedAt,
+		UpdatedAt:       p.UpdatedAt,
+	}
+
+	for _, part := range p.Parts {
+		res.Parts = append(res.Parts, PaymentPart{
+			VirtualKey: base64.StdEncoding.EncodeToString(part.VirtualKey),
+			Amount:     cc.MustAmount(part.Amount).String(),
+			Fee:        cc.MustAmount(part.Fee).String(),
+			Deadline:   part.Deadline,
+			Status:     convertPaymentStatus(part.Status),
+		})
+	}
+
+	if p.MaxFee != nil {
+		res.MaxFee = cc.MustAmount(p.MaxFee).String()
+	}
+	res.Reason = p.Reason
+
+	for _, a := range p.Attempts {
+		attempt := PaymentAttempt{
+			VirtualKey: base64.StdEncoding.EncodeToString(a.VirtualKey),
+			Route:      make([]string, 0, len(a.Route)),
+			Fee:        cc.MustAmount(a.Fee).String(),
+			Status:     convertPaymentStatus(a.Status),
+			Reason:     a.Reason,
+			StartedAt:  a.StartedAt,
+		}
+		for _, key := range a.Route {
+			attempt.Route = append(attempt.Route, base64.StdEncoding.EncodeToString(key))
+		}
+		if a.FailedHop != nil {
+			attempt.FailedHop = base64.StdEncoding.EncodeToString(a.FailedHop)
+		}
+		if !a.FinishedAt.IsZero() {
+			at := a.FinishedAt
+			attempt.FinishedAt = &at
+		}
+		res.Attempts = append(res.Attempts, attempt)
+	}
+	return res
+}
+
+func convertPaymentStatus(status db.PaymentStatus) string {
+	switch status {
+	case db.PaymentStatusCompleted:
+		return "completed"
+	case db.PaymentStatusFailed:
+		return "failed"
+	default:
+		return "pending"
+	}
+}
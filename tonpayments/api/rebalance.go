@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/tonutils-go/tlb"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+type Rebalance struct {
+	ID          string    `json:"id,omitempty"`
+	FromChannel string    `json:"from_channel"`
+	ToChannel   string    `json:"to_channel"`
+	Amount      string    `json:"amount"`
+	Fee         string    `json:"fee"`
+	Route       []string  `json:"route"`
+	DryRun      bool      `json:"dry_run,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (s *Server) handleRebalance(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		From       string `json:"from"`
+		To         string `json:"to"`
+		Amount     string `json:"amount"`
+		MaxFee     string `json:"max_fee"`
+		TTLSeconds int64  `json:"ttl_seconds"`
+		DryRun     bool   `json:"dry_run"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	ch, err := s.svc.GetChannel(r.Context(), req.From)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "'from' channel is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get channel: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(ch.JettonAddress, ch.ExtraCurrencyID, true)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	amount, err := tlb.FromDecimal(req.Amount, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, "failed to parse amount: "+err.Error())
+		return
+	}
+
+	var maxFee *big.Int
+	if req.MaxFee != "" {
+		fee, err := tlb.FromDecimal(req.MaxFee, int(cc.Decimals))
+		if err != nil {
+			writeErr(w, 400, "failed to parse max fee: "+err.Error())
+			return
+		}
+		maxFee = fee.Nano()
+	}
+
+	rb, err := s.svc.Rebalance(r.Context(), req.From, req.To, amount.Nano(), maxFee, time.Duration(req.TTLSeconds)*time.Second, req.DryRun)
+	if err != nil {
+		writeErr(w, 403, "failed to rebalance: "+err.Error())
+		return
+	}
+
+	res := convertRebalance(rb, cc)
+	res.DryRun = req.DryRun
+	if !req.DryRun {
+		res.Status = "pending"
+	}
+	writeResp(w, res)
+}
+
+func (s *Server) handleRebalanceGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	id, err := parseKey(r.URL.Query().Get("id"))
+	if err != nil {
+		writeErr(w, 400, "incorrect rebalance id format: "+err.Error())
+		return
+	}
+
+	rb, tr, err := s.svc.GetRebalance(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "rebalance is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get rebalance: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(tr.JettonAddress, tr.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	res := convertRebalance(rb, cc)
+	res.Status = convertTransferStatus(tr.Status)
+	res.Reason = tr.Reason
+	writeResp(w, res)
+}
+
+func convertRebalance(rb *db.Rebalance, cc *config.CoinConfig) Rebalance {
+	res := Rebalance{
+		FromChannel: rb.FromChannel,
+		ToChannel:   rb.ToChannel,
+		Amount:      cc.MustAmount(rb.Amount).String(),
+		Fee:         cc.MustAmount(rb.Fee).String(),
+		Route:       make([]string, 0, len(rb.Route)),
+		CreatedAt:   rb.CreatedAt,
+	}
+
+	if rb.ID != nil {
+		res.ID = base64.StdEncoding.EncodeToString(rb.ID)
+	}
+
+	for _, key := range rb.Route {
+		res.Route = append(res.Route, base64.StdEncoding.EncodeToString(key))
+	}
+	return res
+}
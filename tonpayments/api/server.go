@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/invoice"
 	"github.com/xssnick/ton-payment-network/pkg/payments"
 	"github.com/xssnick/ton-payment-network/tonpayments/config"
 	"github.com/xssnick/ton-payment-network/tonpayments/db"
@@ -13,7 +14,9 @@ import (
 	"github.com/xssnick/tonutils-go/address"
 	"github.com/xssnick/tonutils-go/tlb"
 	"github.com/xssnick/tonutils-go/tvm/cell"
+	"math/big"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -34,13 +37,49 @@ type Service interface {
 	RequestCooperativeClose(ctx context.Context, channelAddr string) error
 	RequestUncooperativeClose(ctx context.Context, addr string) error
 	CloseVirtualChannel(ctx context.Context, virtualKey ed25519.PublicKey) error
+	ExtendVirtualChannel(ctx context.Context, key ed25519.PublicKey, extend time.Duration, fee *big.Int) error
+	IncreaseVirtualChannel(ctx context.Context, key ed25519.PublicKey, capacity, fee *big.Int) error
 	AddVirtualChannelResolve(ctx context.Context, virtualKey ed25519.PublicKey, state payments.VirtualChannelState) error
+	CommitVirtualChannel(ctx context.Context, key []byte) error
+	GetVirtualChannelCommitStatus(ctx context.Context, key []byte) (toPrepay, prepaid *big.Int, err error)
 	OpenVirtualChannel(ctx context.Context, with, instructionKey, finalDest ed25519.PublicKey, private ed25519.PrivateKey, chain []transport.OpenVirtualInstruction, vch payments.VirtualChannel, jettonMaster *address.Address, ecID uint32) error
+	BuildRouteTunnelChain(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, capacity *big.Int, ttl time.Duration) ([]transport.TunnelChainPart, error)
+	CalcTunnelChainFees(ctx context.Context, keys []ed25519.PublicKey, jettonAddr string, ecID uint32, capacity *big.Int) ([]*big.Int, error)
+	SendMultipathPayment(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount *big.Int, parts int, ttl time.Duration) (*db.Payment, error)
+	SendPayment(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount, maxFee *big.Int, ttl, timeout time.Duration) (*db.Payment, error)
+	GetPayment(ctx context.Context, id []byte) (*db.Payment, error)
+	CreateInvoice(ctx context.Context, jettonAddr string, ecID uint32, amount *big.Int, memo string, ttl time.Duration, hints []invoice.RouteHint) (*db.Invoice, error)
+	GetInvoice(ctx context.Context, id []byte) (*db.Invoice, error)
+	PayInvoice(ctx context.Context, data string, amount, maxFee *big.Int, ttl, timeout time.Duration) (*db.Payment, error)
+	OpenStreamSession(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, capacity *big.Int, ttl, idleTimeout time.Duration) (*db.StreamSession, error)
+	StreamPay(ctx context.Context, key ed25519.PublicKey, increment *big.Int) (*db.StreamSession, error)
+	CloseStreamSession(ctx context.Context, key ed25519.PublicKey) (*db.StreamSession, error)
+	GetStreamSession(ctx context.Context, key ed25519.PublicKey) (*db.StreamSession, error)
+	OpenHashLockedChannel(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount *big.Int, hash []byte, ttl time.Duration) (ed25519.PublicKey, error)
+	ResolveHashLockedChannel(ctx context.Context, key ed25519.PublicKey, preimage []byte) error
+	QuoteSwap(ctx context.Context, giveJettonAddr string, giveEcID uint32, giveAmount *big.Int, receiveJettonAddr string, receiveEcID uint32, rate *big.Rat, ttl time.Duration) (*db.Swap, error)
+	ExecuteSwap(ctx context.Context, maker ed25519.PublicKey, id []byte, giveJettonAddr string, giveEcID uint32, giveAmount *big.Int, receiveJettonAddr string, receiveEcID uint32, receiveAmount *big.Int, ttl time.Duration) (*db.Swap, error)
+	GetSwap(ctx context.Context, id []byte) (*db.Swap, error)
+	GetTransfer(ctx context.Context, id []byte) (*db.Transfer, error)
+	ListTransfers(ctx context.Context, filter db.TransferFilter) ([]*db.Transfer, error)
+	Rebalance(ctx context.Context, fromAddr, toAddr string, amount, maxFee *big.Int, ttl time.Duration, dryRun bool) (*db.Rebalance, error)
+	GetRebalance(ctx context.Context, id []byte) (*db.Rebalance, *db.Transfer, error)
+	ListAutopilotChannels(ctx context.Context) ([]*db.AutopilotChannel, error)
+	ListAutopilotDecisions(ctx context.Context, limit int) ([]*db.AutopilotDecision, error)
+	ListWatchtowerChannels(ctx context.Context) ([]*db.WatchtowerChannel, error)
+	ResolvePeerCoinConfig(key ed25519.PublicKey, jetton string, ecID uint32) (*config.CoinConfig, error)
+	SetTunnelOverride(ctx context.Context, o *db.TunnelOverride) error
+	RemoveTunnelOverride(ctx context.Context, key ed25519.PublicKey, jetton string, ecID uint32) error
+	ListTunnelOverrides(ctx context.Context) ([]*db.TunnelOverride, error)
+	GetChannelProxyFee(ch *db.Channel) (percent float64, ratio float64, err error)
+	GetNodeTunnelingFees(ctx context.Context, key ed25519.PublicKey, jetton string, ecID uint32) (enabled bool, minFee, maxCap tlb.Coins, percentFee float64, err error)
 	OpenChannelWithNode(ctx context.Context, nodeKey ed25519.PublicKey, jettonMaster *address.Address, ecID uint32) (*address.Address, error)
 	TopupChannel(ctx context.Context, ch *db.Channel, amount tlb.Coins) error
 	RequestWithdraw(ctx context.Context, addr *address.Address, amount tlb.Coins, doTxOurself bool) error
 	ResolveCoinConfig(jetton string, ecID uint32, onlyEnabled bool) (*config.CoinConfig, error)
 	GetPrivateKey() ed25519.PrivateKey
+	SetDrainMode(enabled bool)
+	IsDraining() bool
 }
 
 type Success struct {
@@ -60,6 +99,10 @@ type Server struct {
 	srv            http.Server
 	sender         http.Client
 	apiCredentials *Credentials
+
+	idempotency         IdempotencyStore
+	idempotencyInFlight map[string]bool
+	idempotencyMx       sync.Mutex
 }
 
 type Credentials struct {
@@ -67,7 +110,7 @@ type Credentials struct {
 	Password string
 }
 
-func NewServer(addr, webhook, webhookKey string, svc Service, queue Queue, credentials *Credentials) *Server {
+func NewServer(addr, webhook, webhookKey string, svc Service, queue Queue, idempotency IdempotencyStore, credentials *Credentials) *Server {
 	s := &Server{
 		svc:        svc,
 		queue:      queue,
@@ -76,24 +119,70 @@ func NewServer(addr, webhook, webhookKey string, svc Service, queue Queue, crede
 		sender: http.Client{
 			Timeout: 10 * time.Second,
 		},
-		apiCredentials: credentials,
+		apiCredentials:      credentials,
+		idempotency:         idempotency,
+		idempotencyInFlight: map[string]bool{},
 	}
 
 	mx := http.NewServeMux()
-	mx.HandleFunc("/api/v1/channel/onchain/open", s.checkCredentials(s.handleChannelOpen))
-	mx.HandleFunc("/api/v1/channel/onchain/topup", s.checkCredentials(s.handleTopup))
-	mx.HandleFunc("/api/v1/channel/onchain/withdraw", s.checkCredentials(s.handleWithdraw))
+	mx.HandleFunc("/api/v1/channel/onchain/open", s.checkCredentials(s.idempotent(s.handleChannelOpen)))
+	mx.HandleFunc("/api/v1/channel/onchain/topup", s.checkCredentials(s.idempotent(s.handleTopup)))
+	mx.HandleFunc("/api/v1/channel/onchain/withdraw", s.checkCredentials(s.idempotent(s.handleWithdraw)))
 	mx.HandleFunc("/api/v1/channel/onchain/close", s.checkCredentials(s.handleChannelClose))
 	mx.HandleFunc("/api/v1/channel/onchain/list", s.checkCredentials(s.handleChannelsList))
 	mx.HandleFunc("/api/v1/channel/onchain", s.checkCredentials(s.handleChannelGet))
 
-	mx.HandleFunc("/api/v1/channel/virtual/open", s.checkCredentials(s.handleVirtualOpen))
+	mx.HandleFunc("/api/v1/channel/virtual/open", s.checkCredentials(s.idempotent(s.handleVirtualOpen)))
 	mx.HandleFunc("/api/v1/channel/virtual/close", s.checkCredentials(s.handleVirtualClose))
-	mx.HandleFunc("/api/v1/channel/virtual/transfer", s.checkCredentials(s.handleVirtualTransfer))
+	mx.HandleFunc("/api/v1/channel/virtual/extend", s.checkCredentials(s.idempotent(s.handleVirtualExtend)))
+	mx.HandleFunc("/api/v1/channel/virtual/increase", s.checkCredentials(s.idempotent(s.handleVirtualIncrease)))
+	mx.HandleFunc("/api/v1/channel/virtual/transfer", s.checkCredentials(s.idempotent(s.handleVirtualTransfer)))
 	mx.HandleFunc("/api/v1/channel/virtual/state", s.checkCredentials(s.handleVirtualState))
+	mx.HandleFunc("/api/v1/channel/virtual/commit/status", s.checkCredentials(s.handleVirtualCommitStatus))
+	mx.HandleFunc("/api/v1/channel/virtual/commit", s.checkCredentials(s.handleVirtualCommit))
 	mx.HandleFunc("/api/v1/channel/virtual/list", s.checkCredentials(s.handleVirtualList))
+	mx.HandleFunc("/api/v1/channel/virtual/fees", s.checkCredentials(s.handleVirtualFees))
+	mx.HandleFunc("/api/v1/channel/virtual/htlc/open", s.checkCredentials(s.idempotent(s.handleHTLCOpen)))
+	mx.HandleFunc("/api/v1/channel/virtual/htlc/resolve", s.checkCredentials(s.handleHTLCResolve))
 	mx.HandleFunc("/api/v1/channel/virtual", s.checkCredentials(s.handleVirtualGet))
 
+	mx.HandleFunc("/api/v1/payment/multipath", s.checkCredentials(s.idempotent(s.handlePaymentMultipath)))
+	mx.HandleFunc("/api/v1/payment/send", s.checkCredentials(s.idempotent(s.handlePaymentSend)))
+	mx.HandleFunc("/api/v1/payment", s.checkCredentials(s.handlePaymentGet))
+
+	mx.HandleFunc("/api/v1/transfer/list", s.checkCredentials(s.handleTransferList))
+	mx.HandleFunc("/api/v1/transfer", s.checkCredentials(s.handleTransferGet))
+
+	mx.HandleFunc("/api/v1/rebalance/execute", s.checkCredentials(s.idempotent(s.handleRebalance)))
+	mx.HandleFunc("/api/v1/rebalance", s.checkCredentials(s.handleRebalanceGet))
+
+	mx.HandleFunc("/api/v1/autopilot/channels", s.checkCredentials(s.handleAutopilotChannels))
+	mx.HandleFunc("/api/v1/autopilot/decisions", s.checkCredentials(s.handleAutopilotDecisions))
+	mx.HandleFunc("/api/v1/watchtower/channels", s.checkCredentials(s.handleWatchtowerChannels))
+
+	mx.HandleFunc("/api/v1/invoice/create", s.checkCredentials(s.handleInvoiceCreate))
+	mx.HandleFunc("/api/v1/invoice/decode", s.checkCredentials(s.handleInvoiceDecode))
+	mx.HandleFunc("/api/v1/invoice/pay", s.checkCredentials(s.idempotent(s.handleInvoicePay)))
+	mx.HandleFunc("/api/v1/invoice", s.checkCredentials(s.handleInvoiceGet))
+
+	mx.HandleFunc("/api/v1/stream/open", s.checkCredentials(s.idempotent(s.handleStreamOpen)))
+	mx.HandleFunc("/api/v1/stream/pay", s.checkCredentials(s.idempotent(s.handleStreamPay)))
+	mx.HandleFunc("/api/v1/stream/close", s.checkCredentials(s.handleStreamClose))
+	mx.HandleFunc("/api/v1/stream", s.checkCredentials(s.handleStreamGet))
+
+	mx.HandleFunc("/api/v1/swap/quote", s.checkCredentials(s.handleSwapQuote))
+	mx.HandleFunc("/api/v1/swap/execute", s.checkCredentials(s.idempotent(s.handleSwapExecute)))
+	mx.HandleFunc("/api/v1/swap", s.checkCredentials(s.handleSwapGet))
+
+	mx.HandleFunc("/api/v1/node/tunneling-fees", s.checkCredentials(s.handleNodeTunnelingFees))
+	mx.HandleFunc("/api/v1/node/proxy-fees", s.checkCredentials(s.handleNodeProxyFees))
+	mx.HandleFunc("/api/v1/node/peer-policy", s.checkCredentials(s.handlePeerPolicyGet))
+	mx.HandleFunc("/api/v1/node/peer-policy/set", s.checkCredentials(s.handlePeerPolicySet))
+	mx.HandleFunc("/api/v1/node/peer-policy/remove", s.checkCredentials(s.handlePeerPolicyRemove))
+	mx.HandleFunc("/api/v1/node/peer-policy/list", s.checkCredentials(s.handlePeerPolicyList))
+	mx.HandleFunc("/api/v1/node/drain", s.checkCredentials(s.handleNodeDrain))
+	mx.HandleFunc("/api/v1/node/drain/status", s.checkCredentials(s.handleNodeDrainStatus))
+
 	s.srv = http.Server{
 		Addr:    addr,
 		Handler: mx,
@@ -106,6 +195,7 @@ func (s *Server) Start() error {
 	if s.webhook != "" {
 		go s.startWebhooksSender()
 	}
+	go s.startIdempotencyCleaner()
 	return s.srv.ListenAndServe()
 }
 
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"net/http"
+	"time"
+)
+
+type StreamSession struct {
+	Key                string    `json:"key"`
+	Incoming           bool      `json:"incoming"`
+	Counterparty       string    `json:"counterparty"`
+	JettonAddress      string    `json:"jetton_address"`
+	ExtraCurrencyID    uint32    `json:"ec_id"`
+	Capacity           string    `json:"capacity"`
+	Paid               string    `json:"paid"`
+	IdleTimeoutSeconds int64     `json:"idle_timeout_seconds"`
+	Deadline           time.Time `json:"deadline"`
+	Status             string    `json:"status"`
+	LastPaidAt         time.Time `json:"last_paid_at"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+func (s *Server) handleStreamOpen(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		TTLSeconds         int64  `json:"ttl_seconds"`
+		IdleTimeoutSeconds int64  `json:"idle_timeout_seconds"`
+		Capacity           string `json:"capacity"`
+		Destination        string `json:"destination"`
+		JettonMaster       string `json:"jetton_master"`
+		ExtraCurrencyID    uint32 `json:"ec_id"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	var jettonAddr string
+	if req.JettonMaster != "" {
+		jetton, err := address.ParseAddr(req.JettonMaster)
+		if err != nil {
+			writeErr(w, 400, "incorrect jetton address format: "+err.Error())
+			return
+		}
+
+		if req.ExtraCurrencyID != 0 {
+			writeErr(w, 400, "jetton master address and extra currency id are mutually exclusive")
+			return
+		}
+		jettonAddr = jetton.Bounce(true).String()
+	}
+
+	dest, err := parseKey(req.Destination)
+	if err != nil {
+		writeErr(w, 400, "failed to parse destination key: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(jettonAddr, req.ExtraCurrencyID, true)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	capacity, err := tlb.FromDecimal(req.Capacity, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, "failed to parse capacity: "+err.Error())
+		return
+	}
+
+	if req.TTLSeconds <= 0 {
+		writeErr(w, 400, "ttl_seconds should be positive")
+		return
+	}
+
+	if req.IdleTimeoutSeconds < 0 {
+		writeErr(w, 400, "idle_timeout_seconds cannot be negative")
+		return
+	}
+
+	session, err := s.svc.OpenStreamSession(r.Context(), dest, jettonAddr, req.ExtraCurrencyID, capacity.Nano(),
+		time.Duration(req.TTLSeconds)*time.Second, time.Duration(req.IdleTimeoutSeconds)*time.Second)
+	if err != nil {
+		writeErr(w, 403, "failed to open stream session: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertStreamSession(session, cc))
+}
+
+func (s *Server) handleStreamPay(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Key       string `json:"key"`
+		Increment string `json:"increment"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	key, err := parseKey(req.Key)
+	if err != nil {
+		writeErr(w, 400, "failed to parse key: "+err.Error())
+		return
+	}
+
+	session, err := s.svc.GetStreamSession(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "stream session is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get stream session: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(session.JettonAddress, session.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	increment, err := tlb.FromDecimal(req.Increment, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, "failed to parse increment: "+err.Error())
+		return
+	}
+
+	session, err = s.svc.StreamPay(r.Context(), key, increment.Nano())
+	if err != nil {
+		writeErr(w, 403, "failed to pay: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertStreamSession(session, cc))
+}
+
+func (s *Server) handleStreamClose(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Key string `json:"key"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	key, err := parseKey(req.Key)
+	if err != nil {
+		writeErr(w, 400, "failed to parse key: "+err.Error())
+		return
+	}
+
+	session, err := s.svc.CloseStreamSession(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "stream session is not found")
+			return
+		}
+		writeErr(w, 403, "failed to close stream session: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(session.JettonAddress, session.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertStreamSession(session, cc))
+}
+
+func (s *Server) handleStreamGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	key, err := parseKey(r.URL.Query().Get("key"))
+	if err != nil {
+		writeErr(w, 400, "failed to parse key: "+err.Error())
+		return
+	}
+
+	session, err := s.svc.GetStreamSession(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "stream session is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get stream session: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(session.JettonAddress, session.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertStreamSession(session, cc))
+}
+
+func convertStreamSession(session *db.StreamSession, cc *config.CoinConfig) StreamSession {
+	res := StreamSession{
+		Key:                base64.StdEncoding.EncodeToString(session.Key),
+		Incoming:           session.Incoming,
+		Counterparty:       base64.StdEncoding.EncodeToString(session.Counterparty),
+		JettonAddress:      session.JettonAddress,
+		ExtraCurrencyID:    session.ExtraCurrencyID,
+		Capacity:           cc.MustAmount(session.Capacity).String(),
+		Paid:               cc.MustAmount(session.Paid).String(),
+		IdleTimeoutSeconds: int64(session.IdleTimeout / time.Second),
+		Deadline:           session.Deadline,
+		Status:             "active",
+		LastPaidAt:         session.LastPaidAt,
+		CreatedAt:          session.CreatedAt,
+		UpdatedAt:          session.UpdatedAt,
+	}
+
+	if session.Status == db.StreamSessionStatusClosed {
+		res.Status = "closed"
+	}
+	return res
+}
@@ -0,0 +1,303 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+type SwapCoin struct {
+	JettonMaster    string `json:"jetton_master"`
+	ExtraCurrencyID uint32 `json:"ec_id"`
+	Amount          string `json:"amount"`
+}
+
+// SwapQuote - terms of the swap from the maker's perspective, taker should pass it as is to execute
+type SwapQuote struct {
+	ID        string    `json:"id"`
+	Maker     string    `json:"maker"`
+	Give      SwapCoin  `json:"give"`
+	Receive   SwapCoin  `json:"receive"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type Swap struct {
+	ID           string    `json:"id"`
+	Role         string    `json:"role"`
+	Counterparty string    `json:"counterparty"`
+	Give         SwapCoin  `json:"give"`
+	Receive      SwapCoin  `json:"receive"`
+	Hash         string    `json:"hash"`
+	Status       string    `json:"status"`
+	OutgoingKey  string    `json:"outgoing_key"`
+	IncomingKey  string    `json:"incoming_key"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func (s *Server) handleSwapQuote(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		TTLSeconds int64    `json:"ttl_seconds"`
+		Give       SwapCoin `json:"give"`
+		Receive    SwapCoin `json:"receive"`
+		Rate       string   `json:"rate"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	giveJetton, amount, err := s.parseSwapCoin(req.Give)
+	if err != nil {
+		writeErr(w, 400, err.Error())
+		return
+	}
+
+	receiveJetton, err := parseSwapJetton(req.Receive)
+	if err != nil {
+		writeErr(w, 400, err.Error())
+		return
+	}
+
+	rate, ok := new(big.Rat).SetString(req.Rate)
+	if !ok {
+		writeErr(w, 400, "failed to parse rate")
+		return
+	}
+
+	if req.TTLSeconds <= 0 {
+		writeErr(w, 400, "ttl_seconds should be positive")
+		return
+	}
+
+	swap, err := s.svc.QuoteSwap(r.Context(), giveJetton, req.Give.ExtraCurrencyID, amount,
+		receiveJetton, req.Receive.ExtraCurrencyID, rate, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		writeErr(w, 400, "failed to create quote: "+err.Error())
+		return
+	}
+
+	res, err := s.convertSwap(swap)
+	if err != nil {
+		writeErr(w, 500, err.Error())
+		return
+	}
+
+	writeResp(w, SwapQuote{
+		ID:        res.ID,
+		Maker:     base64.StdEncoding.EncodeToString(s.svc.GetPrivateKey().Public().(ed25519.PublicKey)),
+		Give:      res.Give,
+		Receive:   res.Receive,
+		ExpiresAt: res.ExpiresAt,
+	})
+}
+
+func (s *Server) handleSwapExecute(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		TTLSeconds int64     `json:"ttl_seconds"`
+		Quote      SwapQuote `json:"quote"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	if req.TTLSeconds < 0 {
+		writeErr(w, 400, "ttl_seconds cannot be negative")
+		return
+	}
+
+	if time.Now().After(req.Quote.ExpiresAt) {
+		writeErr(w, 400, "quote is expired")
+		return
+	}
+
+	id, err := base64.StdEncoding.DecodeString(req.Quote.ID)
+	if err != nil {
+		writeErr(w, 400, "failed to parse quote id: "+err.Error())
+		return
+	}
+
+	maker, err := parseKey(req.Quote.Maker)
+	if err != nil {
+		writeErr(w, 400, "failed to parse maker key: "+err.Error())
+		return
+	}
+
+	// we give what maker receives and receive what maker gives
+	giveJetton, give, err := s.parseSwapCoin(req.Quote.Receive)
+	if err != nil {
+		writeErr(w, 400, err.Error())
+		return
+	}
+
+	receiveJetton, receive, err := s.parseSwapCoin(req.Quote.Give)
+	if err != nil {
+		writeErr(w, 400, err.Error())
+		return
+	}
+
+	swap, err := s.svc.ExecuteSwap(r.Context(), maker, id, giveJetton, req.Quote.Receive.ExtraCurrencyID, give,
+		receiveJetton, req.Quote.Give.ExtraCurrencyID, receive, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		writeErr(w, 403, "failed to execute swap: "+err.Error())
+		return
+	}
+
+	res, err := s.convertSwap(swap)
+	if err != nil {
+		writeErr(w, 500, err.Error())
+		return
+	}
+	writeResp(w, res)
+}
+
+func (s *Server) handleSwapGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	id, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("id"))
+	if err != nil {
+		writeErr(w, 400, "failed to parse id: "+err.Error())
+		return
+	}
+
+	swap, err := s.svc.GetSwap(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "swap is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get swap: "+err.Error())
+		return
+	}
+
+	res, err := s.convertSwap(swap)
+	if err != nil {
+		writeErr(w, 500, err.Error())
+		return
+	}
+	writeResp(w, res)
+}
+
+func (s *Server) parseSwapCoin(c SwapCoin) (string, *big.Int, error) {
+	jettonAddr, err := parseSwapJetton(c)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(jettonAddr, c.ExtraCurrencyID, true)
+	if err != nil {
+		return "", nil, errors.New("failed to resolve coin config: " + err.Error())
+	}
+
+	amount, err := tlb.FromDecimal(c.Amount, int(cc.Decimals))
+	if err != nil {
+		return "", nil, errors.New("failed to parse amount: " + err.Error())
+	}
+	return jettonAddr, amount.Nano(), nil
+}
+
+func parseSwapJetton(c SwapCoin) (string, error) {
+	if c.JettonMaster == "" {
+		return "", nil
+	}
+
+	if c.ExtraCurrencyID != 0 {
+		return "", errors.New("jetton master address and extra currency id are mutually exclusive")
+	}
+
+	jetton, err := address.ParseAddr(c.JettonMaster)
+	if err != nil {
+		return "", errors.New("incorrect jetton address format: " + err.Error())
+	}
+	return jetton.Bounce(true).String(), nil
+}
+
+func (s *Server) convertSwap(swap *db.Swap) (*Swap, error) {
+	giveCC, err := s.svc.ResolveCoinConfig(swap.GiveJettonAddress, swap.GiveExtraCurrencyID, false)
+	if err != nil {
+		return nil, errors.New("failed to resolve coin config: " + err.Error())
+	}
+
+	receiveCC, err := s.svc.ResolveCoinConfig(swap.ReceiveJettonAddress, swap.ReceiveExtraCurrencyID, false)
+	if err != nil {
+		return nil, errors.New("failed to resolve coin config: " + err.Error())
+	}
+
+	res := &Swap{
+		ID:   base64.StdEncoding.EncodeToString(swap.ID),
+		Role: "taker",
+		Give: SwapCoin{
+			JettonMaster:    swap.GiveJettonAddress,
+			ExtraCurrencyID: swap.GiveExtraCurrencyID,
+			Amount:          giveCC.MustAmount(swap.GiveAmount).String(),
+		},
+		Receive: SwapCoin{
+			JettonMaster:    swap.ReceiveJettonAddress,
+			ExtraCurrencyID: swap.ReceiveExtraCurrencyID,
+			Amount:          receiveCC.MustAmount(swap.ReceiveAmount).String(),
+		},
+		ExpiresAt: swap.ExpiresAt,
+		CreatedAt: swap.CreatedAt,
+		UpdatedAt: swap.UpdatedAt,
+	}
+
+	if swap.Maker {
+		res.Role = "maker"
+	}
+
+	if swap.Counterparty != nil {
+		res.Counterparty = base64.StdEncoding.EncodeToString(swap.Counterparty)
+	}
+
+	if swap.Hash != nil {
+		res.Hash = hex.EncodeToString(swap.Hash)
+	}
+
+	if key := swap.OutgoingKey(); key != nil {
+		res.OutgoingKey = base64.StdEncoding.EncodeToString(key)
+	}
+
+	if swap.IncomingKey != nil {
+		res.IncomingKey = base64.StdEncoding.EncodeToString(swap.IncomingKey)
+	}
+
+	switch swap.Status {
+	case db.SwapStatusPending:
+		res.Status = "pending"
+		if time.Now().After(swap.ExpiresAt) {
+			res.Status = "expired"
+		}
+	case db.SwapStatusLocked:
+		res.Status = "locked"
+	case db.SwapStatusCompleted:
+		res.Status = "completed"
+	}
+	return res, nil
+}
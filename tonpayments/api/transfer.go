@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Transfer struct {
+	ID              string    `json:"id"`
+	Destination     string    `json:"destination"`
+	JettonAddress   string    `json:"jetton_address"`
+	ExtraCurrencyID uint32    `json:"ec_id"`
+	Capacity        string    `json:"capacity"`
+	Fee             string    `json:"fee"`
+	Amount          string    `json:"amount,omitempty"`
+	Deadline        time.Time `json:"deadline"`
+	Status          string    `json:"status"`
+	Reason          string    `json:"reason,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+func (s *Server) handleTransferGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	id, err := parseKey(r.URL.Query().Get("id"))
+	if err != nil {
+		writeErr(w, 400, "incorrect transfer id format: "+err.Error())
+		return
+	}
+
+	tr, err := s.svc.GetTransfer(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "transfer is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get transfer: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(tr.JettonAddress, tr.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	writeResp(w, convertTransfer(tr, cc))
+}
+
+func (s *Server) handleTransferList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var filter db.TransferFilter
+
+	if q := r.URL.Query().Get("status"); q != "" {
+		switch q {
+		case "pending":
+			filter.Status = db.TransferStatusPending
+		case "opened":
+			filter.Status = db.TransferStatusOpened
+		case "delivered":
+			filter.Status = db.TransferStatusDelivered
+		case "closed":
+			filter.Status = db.TransferStatusClosed
+		case "failed":
+			filter.Status = db.TransferStatusFailed
+		case "any":
+		default:
+			writeErr(w, 400, "unknown status: "+q)
+			return
+		}
+	}
+
+	if q := r.URL.Query().Get("destination"); q != "" {
+		key, err := parseKey(q)
+		if err != nil {
+			writeErr(w, 400, "incorrect destination key format: "+err.Error())
+			return
+		}
+		filter.Destination = key
+	}
+
+	if q := r.URL.Query().Get("created_after"); q != "" {
+		ts, err := strconv.ParseInt(q, 10, 64)
+		if err != nil {
+			writeErr(w, 400, "incorrect created_after, should be unix timestamp: "+err.Error())
+			return
+		}
+		filter.CreatedAfter = time.Unix(ts, 0)
+	}
+
+	if q := r.URL.Query().Get("created_before"); q != "" {
+		ts, err := strconv.ParseInt(q, 10, 64)
+		if err != nil {
+			writeErr(w, 400, "incorrect created_before, should be unix timestamp: "+err.Error())
+			return
+		}
+		filter.CreatedBefore = time.Unix(ts, 0)
+	}
+
+	if q := r.URL.Query().Get("limit"); q != "" {
+		limit, err := strconv.Atoi(q)
+		if err != nil || limit < 0 {
+			writeErr(w, 400, "incorrect limit")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	list, err := s.svc.ListTransfers(r.Context(), filter)
+	if err != nil {
+		writeErr(w, 500, "failed to list transfers: "+err.Error())
+		return
+	}
+
+	res := make([]Transfer, 0, len(list))
+	for _, tr := range list {
+		cc, err := s.svc.ResolveCoinConfig(tr.JettonAddress, tr.ExtraCurrencyID, false)
+		if err != nil {
+			writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+			return
+		}
+		res = append(res, convertTransfer(tr, cc))
+	}
+
+	writeResp(w, res)
+}
+
+func (s *Server) PushTransferEvent(ctx context.Context, tr *db.Transfer) error {
+	cc, err := s.svc.ResolveCoinConfig(tr.JettonAddress, tr.ExtraCurrencyID, false)
+	if err != nil {
+		return fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	res := convertTransfer(tr, cc)
+	if err = s.queue.CreateTask(ctx, WebhooksTaskPool, "transfer-event", "events",
+		res.ID+"-"+res.Status,
+		res, nil, nil,
+	); err != nil {
+		return fmt.Errorf("failed to create transfer-event task: %w", err)
+	}
+	return nil
+}
+
+func convertTransfer(tr *db.Transfer, cc *config.CoinConfig) Transfer {
+	res := Transfer{
+		ID:              base64.StdEncoding.EncodeToString(tr.ID),
+		Destination:     base64.StdEncoding.EncodeToString(tr.Destination),
+		JettonAddress:   tr.JettonAddress,
+		ExtraCurrencyID: tr.ExtraCurrencyID,
+		Capacity:        cc.MustAmount(tr.Capacity).String(),
+		Fee:             cc.MustAmount(tr.Fee).String(),
+		Deadline:        tr.Deadline,
+		Status:          convertTransferStatus(tr.Status),
+		Reason:          tr.Reason,
+		CreatedAt:       tr.CreatedAt,
+		UpdatedAt:       tr.UpdatedAt,
+	}
+
+	if tr.Amount != nil {
+		res.Amount = cc.MustAmount(tr.Amount).String()
+	}
+	return res
+}
+
+func convertTransferStatus(status db.TransferStatus) string {
+	switch status {
+	case db.TransferStatusOpened:
+		return "opened"
+	case db.TransferStatusDelivered:
+		return "delivered"
+	case db.TransferStatusClosed:
+		return "closed"
+	case db.TransferStatusFailed:
+		return "failed"
+	default:
+		return "pending"
+	}
+}
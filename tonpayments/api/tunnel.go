@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/tonutils-go/address"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type TunnelOverride struct {
+	Key              string    `json:"key"`
+	JettonMaster     string    `json:"jetton_master"`
+	ExtraCurrencyID  uint32    `json:"ec_id"`
+	AllowTunneling   *bool     `json:"allow_tunneling,omitempty"`
+	ProxyMinFee      string    `json:"proxy_min_fee,omitempty"`
+	ProxyFeePercent  *float64  `json:"proxy_fee_percent,omitempty"`
+	ProxyMaxCapacity string    `json:"proxy_max_capacity,omitempty"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+func (s *Server) handlePeerPolicyGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	key, err := parseKey(r.URL.Query().Get("key"))
+	if err != nil {
+		writeErr(w, 400, "failed to parse peer key: "+err.Error())
+		return
+	}
+
+	var jettonAddr string
+	if q := r.URL.Query().Get("jetton_master"); q != "" {
+		jetton, err := address.ParseAddr(q)
+		if err != nil {
+			writeErr(w, 400, "incorrect jetton address format: "+err.Error())
+			return
+		}
+		jettonAddr = jetton.Bounce(true).String()
+	}
+
+	var ecID uint32
+	if q := r.URL.Query().Get("ec_id"); q != "" {
+		id, err := strconv.ParseUint(q, 10, 32)
+		if err != nil {
+			writeErr(w, 400, "incorrect extra currency id: "+err.Error())
+			return
+		}
+		ecID = uint32(id)
+	}
+
+	cc, err := s.svc.ResolvePeerCoinConfig(key, jettonAddr, ecID)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	tc := cc.VirtualTunnelConfig
+	writeResp(w, struct {
+		AllowTunneling bool    `json:"allow_tunneling"`
+		MinFee         string  `json:"min_fee"`
+		MaxCapacity    string  `json:"max_capacity"`
+		FeePercent     float64 `json:"fee_percent"`
+	}{
+		AllowTunneling: tc.AllowTunneling,
+		MinFee:         cc.MustAmountDecimal(tc.ProxyMinFee).String(),
+		MaxCapacity:    cc.MustAmountDecimal(tc.ProxyMaxCapacity).String(),
+		FeePercent:     tc.ProxyFeePercent,
+	})
+}
+
+func (s *Server) handlePeerPolicySet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req TunnelOverride
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	o, err := parseTunnelOverride(req)
+	if err != nil {
+		writeErr(w, 400, err.Error())
+		return
+	}
+
+	o.Override = config.TunnelOverrideConfig{
+		AllowTunneling:   req.AllowTunneling,
+		ProxyMinFee:      req.ProxyMinFee,
+		ProxyFeePercent:  req.ProxyFeePercent,
+		ProxyMaxCapacity: req.ProxyMaxCapacity,
+	}
+
+	if err = s.svc.SetTunnelOverride(r.Context(), o); err != nil {
+		writeErr(w, 400, "failed to set peer policy: "+err.Error())
+		return
+	}
+
+	writeSuccess(w)
+}
+
+func (s *Server) handlePeerPolicyRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req TunnelOverride
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	o, err := parseTunnelOverride(req)
+	if err != nil {
+		writeErr(w, 400, err.Error())
+		return
+	}
+
+	if err = s.svc.RemoveTunnelOverride(r.Context(), o.PeerKey, o.JettonAddress, o.ExtraCurrencyID); err != nil {
+		writeErr(w, 500, "failed to remove peer policy: "+err.Error())
+		return
+	}
+
+	writeSuccess(w)
+}
+
+func (s *Server) handlePeerPolicyList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	list, err := s.svc.ListTunnelOverrides(r.Context())
+	if err != nil {
+		writeErr(w, 500, "failed to list peer policies: "+err.Error())
+		return
+	}
+
+	res := make([]TunnelOverride, 0, len(list))
+	for _, o := range list {
+		res = append(res, TunnelOverride{
+			Key:              base64.StdEncoding.EncodeToString(o.PeerKey),
+			JettonMaster:     o.JettonAddress,
+			ExtraCurrencyID:  o.ExtraCurrencyID,
+			AllowTunneling:   o.Override.AllowTunneling,
+			ProxyMinFee:      o.Override.ProxyMinFee,
+			ProxyFeePercent:  o.Override.ProxyFeePercent,
+			ProxyMaxCapacity: o.Override.ProxyMaxCapacity,
+			UpdatedAt:        o.UpdatedAt,
+		})
+	}
+
+	writeResp(w, res)
+}
+
+func parseTunnelOverride(req TunnelOverride) (*db.TunnelOverride, error) {
+	key, err := parseKey(req.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer key: %w", err)
+	}
+
+	var jettonAddr string
+	if req.JettonMaster != "" {
+		jetton, err := address.ParseAddr(req.JettonMaster)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect jetton address format: %w", err)
+		}
+		jettonAddr = jetton.Bounce(true).String()
+	}
+
+	if jettonAddr != "" && req.ExtraCurrencyID != 0 {
+		return nil, fmt.Errorf("jetton and extra currency are mutually exclusive")
+	}
+
+	return &db.TunnelOverride{
+		PeerKey:         key,
+		JettonAddress:   jettonAddr,
+		ExtraCurrencyID: req.ExtraCurrencyID,
+	}, nil
+}
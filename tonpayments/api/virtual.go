@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/ed25519"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,7 +15,9 @@ import (
 	"github.com/xssnick/tonutils-go/address"
 	"github.com/xssnick/tonutils-go/tlb"
 	"github.com/xssnick/tonutils-go/tvm/cell"
+	"math/big"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -33,13 +36,19 @@ type VirtualSide struct {
 }
 
 type VirtualChannel struct {
-	Key       string       `json:"key"`
-	Status    string       `json:"status"`
-	Amount    string       `json:"amount"`
-	Outgoing  *VirtualSide `json:"outgoing"`
-	Incoming  *VirtualSide `json:"incoming"`
-	CreatedAt time.Time    `json:"created_at"`
-	UpdatedAt time.Time    `json:"updated_at"`
+	Key      string       `json:"key"`
+	Status   string       `json:"status"`
+	Amount   string       `json:"amount"`
+	Outgoing *VirtualSide `json:"outgoing"`
+	Incoming *VirtualSide `json:"incoming"`
+	Memo     string       `json:"memo,omitempty"`
+	HashLock string       `json:"hash_lock,omitempty"`
+	Preimage string       `json:"preimage,omitempty"`
+	// UpdatePending - extension or capacity increase is sent and not yet confirmed by the receiver
+	UpdatePending    bool      `json:"update_pending,omitempty"`
+	UpdateFailReason string    `json:"update_fail_reason,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
 }
 
 func (s *Server) handleVirtualGet(w http.ResponseWriter, r *http.Request) {
@@ -208,6 +217,7 @@ func (s *Server) getVirtual(ctx context.Context, meta *db.VirtualChannelMeta, de
 	res := &VirtualChannel{
 		Key:       base64.StdEncoding.EncodeToString(meta.Key),
 		Status:    status,
+		Memo:      meta.Memo,
 		CreatedAt: meta.CreatedAt,
 		UpdatedAt: meta.UpdatedAt,
 		Amount:    "0",
@@ -231,6 +241,23 @@ func (s *Server) getVirtual(ctx context.Context, meta *db.VirtualChannelMeta, de
 		res.Amount = tlb.MustFromNano(st.Amount, decimals).String()
 	}
 
+	if meta.HashLock != nil {
+		res.HashLock = hex.EncodeToString(meta.HashLock)
+		if meta.Preimage != nil {
+			res.Preimage = hex.EncodeToString(meta.Preimage)
+
+			// revealed preimage resolves channel for the full capacity
+			if meta.Incoming != nil {
+				res.Amount = meta.Incoming.Capacity
+			} else if meta.Outgoing != nil {
+				res.Amount = meta.Outgoing.Capacity
+			}
+		}
+	}
+
+	res.UpdatePending = meta.PendingUpdate != nil
+	res.UpdateFailReason = meta.UpdateFailReason
+
 	if meta.Status != db.VirtualChannelStateClosed && meta.Status != db.VirtualChannelStateRemoved {
 		if meta.Incoming != nil {
 			res.Incoming = &VirtualSide{
@@ -335,6 +362,155 @@ func (s *Server) handleVirtualClose(w http.ResponseWriter, r *http.Request) {
 	writeSuccess(w)
 }
 
+func (s *Server) handleVirtualExtend(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Key           string `json:"key"`
+		ExtendSeconds int64  `json:"extend_seconds"`
+		Fee           string `json:"fee"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	key, err := parseKey(req.Key)
+	if err != nil {
+		writeErr(w, 400, "failed to parse key: "+err.Error())
+		return
+	}
+
+	if req.ExtendSeconds <= 0 {
+		writeErr(w, 400, "extend_seconds should be positive")
+		return
+	}
+
+	meta, err := s.svc.GetVirtualChannelMeta(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "virtual channel is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get virtual channel: "+err.Error())
+		return
+	}
+
+	if meta.Outgoing == nil {
+		writeErr(w, 400, "virtual channel is not outgoing")
+		return
+	}
+
+	ch, err := s.svc.GetChannel(r.Context(), meta.Outgoing.ChannelAddress)
+	if err != nil {
+		writeErr(w, 500, "failed to get channel: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(ch.JettonAddress, ch.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	fee := big.NewInt(0)
+	if req.Fee != "" {
+		f, err := tlb.FromDecimal(req.Fee, int(cc.Decimals))
+		if err != nil {
+			writeErr(w, 400, "failed to parse fee: "+err.Error())
+			return
+		}
+		fee = f.Nano()
+	}
+
+	if err = s.svc.ExtendVirtualChannel(r.Context(), key, time.Duration(req.ExtendSeconds)*time.Second, fee); err != nil {
+		writeErr(w, 403, "failed to request virtual channel extension: "+err.Error())
+		return
+	}
+
+	writeSuccess(w)
+}
+
+func (s *Server) handleVirtualIncrease(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Key      string `json:"key"`
+		Capacity string `json:"capacity"`
+		Fee      string `json:"fee"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	key, err := parseKey(req.Key)
+	if err != nil {
+		writeErr(w, 400, "failed to parse key: "+err.Error())
+		return
+	}
+
+	meta, err := s.svc.GetVirtualChannelMeta(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			writeErr(w, 404, "virtual channel is not found")
+			return
+		}
+		writeErr(w, 500, "failed to get virtual channel: "+err.Error())
+		return
+	}
+
+	if meta.Outgoing == nil {
+		writeErr(w, 400, "virtual channel is not outgoing")
+		return
+	}
+
+	ch, err := s.svc.GetChannel(r.Context(), meta.Outgoing.ChannelAddress)
+	if err != nil {
+		writeErr(w, 500, "failed to get channel: "+err.Error())
+		return
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(ch.JettonAddress, ch.ExtraCurrencyID, false)
+	if err != nil {
+		writeErr(w, 500, "failed to resolve coin config: "+err.Error())
+		return
+	}
+
+	capacity, err := tlb.FromDecimal(req.Capacity, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, "failed to parse capacity: "+err.Error())
+		return
+	}
+
+	fee := big.NewInt(0)
+	if req.Fee != "" {
+		f, err := tlb.FromDecimal(req.Fee, int(cc.Decimals))
+		if err != nil {
+			writeErr(w, 400, "failed to parse fee: "+err.Error())
+			return
+		}
+		fee = f.Nano()
+	}
+
+	if err = s.svc.IncreaseVirtualChannel(r.Context(), key, capacity.Nano(), fee); err != nil {
+		writeErr(w, 403, "failed to request virtual channel capacity increase: "+err.Error())
+		return
+	}
+
+	writeSuccess(w)
+}
+
 func (s *Server) handleVirtualOpen(w http.ResponseWriter, r *http.Request) {
 	type request struct {
 		TTLSeconds      int64       `json:"ttl_seconds"`
@@ -342,6 +518,7 @@ func (s *Server) handleVirtualOpen(w http.ResponseWriter, r *http.Request) {
 		JettonMaster    string      `json:"jetton_master"`
 		ExtraCurrencyID uint32      `json:"ec_id"`
 		NodesChain      []NodeChain `json:"nodes_chain"`
+		Destination     string      `json:"destination"`
 	}
 
 	if r.Method != "POST" {
@@ -370,19 +547,11 @@ func (s *Server) handleVirtualOpen(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if len(req.NodesChain) == 0 {
-		writeErr(w, 400, "no nodes passed")
+	if len(req.NodesChain) == 0 && req.Destination == "" {
+		writeErr(w, 400, "no nodes or destination passed")
 		return
 	}
 
-	deadline := time.Now().Add(time.Duration(req.TTLSeconds) * time.Second)
-
-	deadlines := make([]time.Time, len(req.NodesChain))
-	for i := range req.NodesChain {
-		deadlines[i] = deadline
-		deadline = deadline.Add(time.Duration(req.NodesChain[i].DeadlineGapSeconds) * time.Second)
-	}
-
 	cc, err := s.svc.ResolveCoinConfig(req.JettonMaster, req.ExtraCurrencyID, true)
 	if err != nil {
 		writeErr(w, 400, "failed to resolve coin config"+err.Error())
@@ -395,32 +564,12 @@ func (s *Server) handleVirtualOpen(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var with []byte
-	var tunChain []transport.TunnelChainPart
-	for i, node := range req.NodesChain {
-		key, err := parseKey(node.Key)
-		if err != nil {
-			writeErr(w, 400, "failed to parse node "+fmt.Sprint(i)+" key: "+err.Error())
-			return
-		}
-
-		fee, err := tlb.FromDecimal(node.Fee, int(cc.Decimals))
-		if err != nil {
-			writeErr(w, 400, "failed to parse node "+fmt.Sprint(i)+" fee: "+err.Error())
-			return
-		}
-
-		if with == nil {
-			with = key
-		}
-
-		tunChain = append(tunChain, transport.TunnelChainPart{
-			Target:   key,
-			Capacity: capacity.Nano(),
-			Fee:      fee.Nano(),
-			Deadline: deadlines[i],
-		})
+	tunChain, err := s.buildTunnelChain(r.Context(), req.NodesChain, req.Destination, jetton, req.ExtraCurrencyID, capacity, time.Duration(req.TTLSeconds)*time.Second, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, err.Error())
+		return
 	}
+	with := tunChain[0].Target
 
 	_, vPriv, err := ed25519.GenerateKey(nil)
 	if err != nil {
@@ -449,7 +598,7 @@ func (s *Server) handleVirtualOpen(w http.ResponseWriter, r *http.Request) {
 		PublicKey:      base64.StdEncoding.EncodeToString(vPriv.Public().(ed25519.PublicKey)),
 		PrivateKeySeed: base64.StdEncoding.EncodeToString(vPriv.Seed()),
 		Status:         "pending",
-		Deadline:       deadlines[len(req.NodesChain)-1],
+		Deadline:       tunChain[len(tunChain)-1].Deadline,
 	})
 }
 
@@ -460,6 +609,8 @@ func (s *Server) handleVirtualTransfer(w http.ResponseWriter, r *http.Request) {
 		JettonMaster    string      `json:"jetton_master"`
 		ExtraCurrencyID uint32      `json:"ec_id"`
 		NodesChain      []NodeChain `json:"nodes_chain"`
+		Destination     string      `json:"destination"`
+		Memo            string      `json:"memo"`
 	}
 
 	if r.Method != "POST" {
@@ -488,8 +639,13 @@ func (s *Server) handleVirtualTransfer(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if len(req.NodesChain) == 0 {
-		writeErr(w, 400, "no nodes passed")
+	if len(req.NodesChain) == 0 && req.Destination == "" {
+		writeErr(w, 400, "no nodes or destination passed")
+		return
+	}
+
+	if len(req.Memo) > transport.MaxMemoLength {
+		writeErr(w, 400, fmt.Sprintf("memo is too long, max %d bytes", transport.MaxMemoLength))
 		return
 	}
 
@@ -499,74 +655,234 @@ func (s *Server) handleVirtualTransfer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deadline := time.Now().Add(time.Duration(req.TTLSeconds) * time.Second)
+	capacity, err := tlb.FromDecimal(req.Amount, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, "failed to parse capacity: "+err.Error())
+		return
+	}
 
-	deadlines := make([]time.Time, len(req.NodesChain))
-	for i := range req.NodesChain {
-		deadlines[i] = deadline
-		deadline = deadline.Add(time.Duration(req.NodesChain[i].DeadlineGapSeconds) * time.Second)
+	tunChain, err := s.buildTunnelChain(r.Context(), req.NodesChain, req.Destination, jetton, req.ExtraCurrencyID, capacity, time.Duration(req.TTLSeconds)*time.Second, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, err.Error())
+		return
 	}
+	with := tunChain[0].Target
 
-	capacity, err := tlb.FromDecimal(req.Amount, int(cc.Decimals))
+	_, vPriv, err := ed25519.GenerateKey(nil)
 	if err != nil {
-		writeErr(w, 400, "failed to parse capacity: "+err.Error())
+		writeErr(w, 500, "failed to generate key: "+err.Error())
 		return
 	}
 
-	var with []byte
-	var tunChain []transport.TunnelChainPart
-	for i, node := range req.NodesChain {
-		key, err := parseKey(node.Key)
+	var payloads []any
+	if req.Memo != "" {
+		// encrypted for the final receiver only
+		payloads = append(payloads, transport.MemoPayload{Memo: req.Memo})
+	}
+
+	vc, firstInstructionKey, tun, err := transport.GenerateTunnel(vPriv, tunChain, 5, true, s.svc.GetPrivateKey(), payloads...)
+	if err != nil {
+		writeErr(w, 500, "failed to generate tunnel: "+err.Error())
+		return
+	}
+
+	err = s.svc.OpenVirtualChannel(r.Context(), with, firstInstructionKey, tunChain[len(tunChain)-1].Target, vPriv, tun, vc, jetton, req.ExtraCurrencyID)
+	if err != nil {
+		writeErr(w, 403, "failed to request virtual channel open: "+err.Error())
+		return
+	}
+
+	writeResp(w, struct {
+		ID       string    `json:"id"`
+		Status   string    `json:"status"`
+		Deadline time.Time `json:"deadline"`
+	}{
+		ID:       base64.StdEncoding.EncodeToString(vc.Key),
+		Status:   "pending",
+		Deadline: tunChain[len(tunChain)-1].Deadline,
+	})
+}
+
+func (s *Server) handleVirtualFees(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Capacity        string   `json:"capacity"`
+		JettonMaster    string   `json:"jetton_master"`
+		ExtraCurrencyID uint32   `json:"ec_id"`
+		Nodes           []string `json:"nodes"`
+	}
+
+	type nodeFee struct {
+		Key string `json:"key"`
+		Fee string `json:"fee"`
+	}
+
+	if r.Method != "POST" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "incorrect request body: "+err.Error())
+		return
+	}
+
+	if len(req.Nodes) == 0 {
+		writeErr(w, 400, "no nodes passed")
+		return
+	}
+
+	var jettonAddr string
+	if req.JettonMaster != "" {
+		jetton, err := address.ParseAddr(req.JettonMaster)
 		if err != nil {
-			writeErr(w, 400, "failed to parse node "+fmt.Sprint(i)+" key: "+err.Error())
+			writeErr(w, 400, "incorrect jetton address format: "+err.Error())
 			return
 		}
+		jettonAddr = jetton.Bounce(true).String()
+	}
+
+	cc, err := s.svc.ResolveCoinConfig(jettonAddr, req.ExtraCurrencyID, true)
+	if err != nil {
+		writeErr(w, 400, "failed to resolve coin config: "+err.Error())
+		return
+	}
 
-		fee, err := tlb.FromDecimal(node.Fee, int(cc.Decimals))
+	capacity, err := tlb.FromDecimal(req.Capacity, int(cc.Decimals))
+	if err != nil {
+		writeErr(w, 400, "failed to parse capacity: "+err.Error())
+		return
+	}
+
+	keys := make([]ed25519.PublicKey, 0, len(req.Nodes))
+	for i, node := range req.Nodes {
+		key, err := parseKey(node)
 		if err != nil {
-			writeErr(w, 400, "failed to parse node "+fmt.Sprint(i)+" fee: "+err.Error())
+			writeErr(w, 400, fmt.Sprintf("failed to parse node %d key: %s", i, err.Error()))
 			return
 		}
+		keys = append(keys, key)
+	}
 
-		if with == nil {
-			with = key
-		}
+	fees, err := s.svc.CalcTunnelChainFees(r.Context(), keys, jettonAddr, req.ExtraCurrencyID, capacity.Nano())
+	if err != nil {
+		writeErr(w, 500, "failed to calculate fees: "+err.Error())
+		return
+	}
 
-		tunChain = append(tunChain, transport.TunnelChainPart{
-			Target:   key,
-			Capacity: capacity.Nano(),
-			Fee:      fee.Nano(),
-			Deadline: deadlines[i],
+	res := make([]nodeFee, 0, len(fees))
+	for i, fee := range fees {
+		res = append(res, nodeFee{
+			Key: req.Nodes[i],
+			Fee: cc.MustAmount(fee).String(),
 		})
 	}
 
-	_, vPriv, err := ed25519.GenerateKey(nil)
-	if err != nil {
-		writeErr(w, 500, "failed to generate key: "+err.Error())
+	writeResp(w, struct {
+		NodesChain []nodeFee `json:"nodes_chain"`
+		TotalFee   string    `json:"total_fee"`
+	}{
+		NodesChain: res,
+		TotalFee:   cc.MustAmount(fees[0]).String(),
+	})
+}
+
+func (s *Server) handleNodeTunnelingFees(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
 		return
 	}
 
-	vc, firstInstructionKey, tun, err := transport.GenerateTunnel(vPriv, tunChain, 5, true, s.svc.GetPrivateKey())
+	key, err := parseKey(r.URL.Query().Get("key"))
 	if err != nil {
-		writeErr(w, 500, "failed to generate tunnel: "+err.Error())
+		writeErr(w, 400, "failed to parse node key: "+err.Error())
 		return
 	}
 
-	err = s.svc.OpenVirtualChannel(r.Context(), with, firstInstructionKey, tunChain[len(tunChain)-1].Target, vPriv, tun, vc, jetton, req.ExtraCurrencyID)
+	var jettonAddr string
+	if q := r.URL.Query().Get("jetton_master"); q != "" {
+		jetton, err := address.ParseAddr(q)
+		if err != nil {
+			writeErr(w, 400, "incorrect jetton address format: "+err.Error())
+			return
+		}
+		jettonAddr = jetton.Bounce(true).String()
+	}
+
+	var ecID uint32
+	if q := r.URL.Query().Get("ec_id"); q != "" {
+		id, err := strconv.ParseUint(q, 10, 32)
+		if err != nil {
+			writeErr(w, 400, "incorrect extra currency id: "+err.Error())
+			return
+		}
+		ecID = uint32(id)
+	}
+
+	enabled, minFee, maxCap, percentFee, err := s.svc.GetNodeTunnelingFees(r.Context(), key, jettonAddr, ecID)
 	if err != nil {
-		writeErr(w, 403, "failed to request virtual channel open: "+err.Error())
+		writeErr(w, 500, "failed to get node tunneling fees: "+err.Error())
 		return
 	}
 
 	writeResp(w, struct {
-		Status   string    `json:"status"`
-		Deadline time.Time `json:"deadline"`
+		AllowTunneling bool    `json:"allow_tunneling"`
+		MinFee         string  `json:"min_fee"`
+		MaxCapacity    string  `json:"max_capacity"`
+		FeePercent     float64 `json:"fee_percent"`
 	}{
-		Status:   "pending",
-		Deadline: deadlines[len(req.NodesChain)-1],
+		AllowTunneling: enabled,
+		MinFee:         minFee.String(),
+		MaxCapacity:    maxCap.String(),
+		FeePercent:     percentFee,
 	})
 }
 
+// buildTunnelChain - prepares tunnel chain from passed nodes, or discovers route to destination when nodes are not passed
+func (s *Server) buildTunnelChain(ctx context.Context, nodes []NodeChain, destination string, jetton *address.Address, ecID uint32, capacity tlb.Coins, ttl time.Duration, decimals int) ([]transport.TunnelChainPart, error) {
+	if len(nodes) == 0 {
+		dest, err := parseKey(destination)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse destination key: %w", err)
+		}
+
+		var jettonAddr string
+		if jetton != nil {
+			jettonAddr = jetton.Bounce(true).String()
+		}
+
+		tunChain, err := s.svc.BuildRouteTunnelChain(ctx, dest, jettonAddr, ecID, capacity.Nano(), ttl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find route to destination: %w", err)
+		}
+		return tunChain, nil
+	}
+
+	deadline := time.Now().Add(ttl)
+
+	var tunChain []transport.TunnelChainPart
+	for i, node := range nodes {
+		key, err := parseKey(node.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse node %d key: %w", i, err)
+		}
+
+		fee, err := tlb.FromDecimal(node.Fee, decimals)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse node %d fee: %w", i, err)
+		}
+
+		tunChain = append(tunChain, transport.TunnelChainPart{
+			Target:   key,
+			Capacity: capacity.Nano(),
+			Fee:      fee.Nano(),
+			Deadline: deadline,
+		})
+		deadline = deadline.Add(time.Duration(node.DeadlineGapSeconds) * time.Second)
+	}
+	return tunChain, nil
+}
+
 func (s *Server) PushVirtualChannelEvent(ctx context.Context, event db.VirtualChannelEventType, meta *db.VirtualChannelMeta, cc *config.CoinConfig) error {
 	vc, err := s.getVirtual(ctx, meta, int(cc.Decimals))
 	if err != nil {
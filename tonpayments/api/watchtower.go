@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+type WatchtowerChannel struct {
+	Address           string     `json:"address"`
+	Client            string     `json:"client"`
+	Version           uint64     `json:"version"`
+	ClosureDetectedAt *time.Time `json:"closure_detected_at,omitempty"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+func (s *Server) handleWatchtowerChannels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErr(w, 400, "incorrect request method")
+		return
+	}
+
+	list, err := s.svc.ListWatchtowerChannels(r.Context())
+	if err != nil {
+		writeErr(w, 500, "failed to list watched channels: "+err.Error())
+		return
+	}
+
+	res := make([]WatchtowerChannel, 0, len(list))
+	for _, wch := range list {
+		res = append(res, WatchtowerChannel{
+			Address:           wch.Address,
+			Client:            base64.StdEncoding.EncodeToString(wch.ClientKey),
+			Version:           wch.Backup.Version,
+			ClosureDetectedAt: wch.ClosureDetectedAt,
+			UpdatedAt:         wch.UpdatedAt,
+			CreatedAt:         wch.CreatedAt,
+		})
+	}
+	writeResp(w, res)
+}
@@ -0,0 +1,412 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	autopilotInterval     = 10 * time.Minute
+	autopilotFailBackoff  = 24 * time.Hour
+	autopilotOpenTimeout  = 120 * time.Second
+	autopilotTopupDivider = 4
+)
+
+type autopilotConfig struct {
+	jetton             string
+	ecID               uint32
+	budget             *big.Int
+	deposit            *big.Int
+	target             int
+	seeds              []ed25519.PublicKey
+	closeInactiveAfter time.Duration
+
+	// avoid - nodes which should not be tried till the time, because of failure or closed channel
+	avoid map[string]time.Time
+	// lastFailure - to not repeat the same failed decision on each step
+	lastFailure string
+	mx          sync.Mutex
+}
+
+func newAutopilotConfig(jetton string, ecID uint32, cc config.CoinConfig) (*autopilotConfig, error) {
+	ap := cc.Autopilot
+
+	budget, err := tlb.FromDecimal(ap.Budget, int(cc.Decimals))
+	if err != nil {
+		return nil, fmt.Errorf("incorrect autopilot budget: %w", err)
+	}
+
+	deposit, err := tlb.FromDecimal(ap.DepositPerChannel, int(cc.Decimals))
+	if err != nil {
+		return nil, fmt.Errorf("incorrect autopilot deposit per channel: %w", err)
+	}
+
+	if deposit.Nano().Sign() <= 0 {
+		return nil, fmt.Errorf("autopilot deposit per channel should be positive")
+	}
+
+	if ap.TargetChannels < 0 || ap.CloseInactiveAfterSec < 0 {
+		return nil, fmt.Errorf("autopilot target channels and inactivity period cannot be negative")
+	}
+
+	conf := &autopilotConfig{
+		jetton:             jetton,
+		ecID:               ecID,
+		budget:             budget.Nano(),
+		deposit:            deposit.Nano(),
+		target:             ap.TargetChannels,
+		closeInactiveAfter: time.Duration(ap.CloseInactiveAfterSec) * time.Second,
+		avoid:              map[string]time.Time{},
+	}
+
+	for _, seed := range ap.Seeds {
+		key, err := base64.StdEncoding.DecodeString(seed)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("incorrect autopilot seed key %s", seed)
+		}
+		conf.seeds = append(conf.seeds, key)
+	}
+
+	return conf, nil
+}
+
+func (a *autopilotConfig) isAvoided(key ed25519.PublicKey) bool {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	till, ok := a.avoid[string(key)]
+	if ok && time.Now().After(till) {
+		delete(a.avoid, string(key))
+		return false
+	}
+	return ok
+}
+
+func (a *autopilotConfig) setAvoid(key ed25519.PublicKey, dur time.Duration) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	a.avoid[string(key)] = time.Now().Add(dur)
+}
+
+func (s *Service) autopilotLoop() {
+	// give some time to connect to peers and receive network view
+	wait := 1 * time.Minute
+	for {
+		select {
+		case <-s.globalCtx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait = autopilotInterval
+
+		for _, ap := range s.autopilots {
+			if err := s.autopilotStep(s.globalCtx, ap); err != nil {
+				log.Error().Err(err).Str("jetton", ap.jetton).Uint32("ec", ap.ecID).Msg("autopilot step failed")
+			}
+		}
+	}
+}
+
+// autopilotStep - checks channels managed by autopilot for a coin: closes unused ones,
+// tops up depleted ones and opens new ones till target count, while budget allows it
+func (s *Service) autopilotStep(ctx context.Context, ap *autopilotConfig) error {
+	cc, err := s.ResolveCoinConfig(ap.jetton, ap.ecID, true)
+	if err != nil {
+		return fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	list, err := s.db.ListAutopilotChannels(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list autopilot channels: %w", err)
+	}
+
+	used := big.NewInt(0)
+	active := 0
+	for _, apc := range list {
+		if apc.JettonAddress != ap.jetton || apc.ExtraCurrencyID != ap.ecID {
+			continue
+		}
+
+		ch, err := s.db.GetChannel(ctx, apc.Address)
+		if err != nil {
+			return fmt.Errorf("failed to get channel %s: %w", apc.Address, err)
+		}
+
+		if ch.Status == db.ChannelStateInactive {
+			// closed, budget is returned to wallet
+			if err = s.db.RemoveAutopilotChannel(ctx, apc.Address); err != nil {
+				return fmt.Errorf("failed to remove autopilot channel: %w", err)
+			}
+			continue
+		}
+
+		used.Add(used, apc.Allocated)
+		if ch.Status != db.ChannelStateActive {
+			continue
+		}
+
+		seqno := ch.Our.State.Data.Seqno + ch.Their.State.Data.Seqno
+		if seqno != apc.LastSeqno {
+			apc.LastSeqno = seqno
+			apc.LastActivityAt = time.Now()
+			if err = s.db.SetAutopilotChannel(ctx, apc); err != nil {
+				return fmt.Errorf("failed to update autopilot channel: %w", err)
+			}
+		} else if ap.closeInactiveAfter > 0 && time.Since(apc.LastActivityAt) > ap.closeInactiveAfter &&
+			ch.Our.Conditionals.IsEmpty() && ch.Their.Conditionals.IsEmpty() {
+			if err = s.RequestCooperativeClose(ctx, ch.Address); err != nil {
+				s.addAutopilotDecision(ctx, ap, db.AutopilotActionFailed, ch.TheirOnchain.Key, ch.Address, nil,
+					"failed to close inactive channel: "+err.Error())
+				continue
+			}
+			ap.setAvoid(ch.TheirOnchain.Key, autopilotFailBackoff)
+			s.addAutopilotDecision(ctx, ap, db.AutopilotActionClose, ch.TheirOnchain.Key, ch.Address, nil,
+				fmt.Sprintf("no activity since %s", apc.LastActivityAt.Format(time.RFC3339)))
+			continue
+		}
+		active++
+
+		if ch.OurOnchain.Deposited.Cmp(apc.Allocated) < 0 {
+			// previous deposit is not yet completed
+			continue
+		}
+
+		balance, _, err := ch.CalcBalance(false)
+		if err != nil {
+			return fmt.Errorf("failed to calc channel balance: %w", err)
+		}
+
+		if balance.Cmp(new(big.Int).Div(ap.deposit, big.NewInt(autopilotTopupDivider))) >= 0 {
+			continue
+		}
+
+		amt := new(big.Int).Sub(ap.deposit, balance)
+		if new(big.Int).Add(used, amt).Cmp(ap.budget) > 0 {
+			s.addAutopilotDecision(ctx, ap, db.AutopilotActionFailed, ch.TheirOnchain.Key, ch.Address, amt,
+				"not enough budget to topup depleted channel")
+			continue
+		}
+
+		if err = s.TopupChannel(ctx, ch, cc.MustAmount(amt)); err != nil {
+			s.addAutopilotDecision(ctx, ap, db.AutopilotActionFailed, ch.TheirOnchain.Key, ch.Address, amt,
+				"failed to topup channel: "+err.Error())
+			continue
+		}
+		s.touchWorker()
+
+		apc.Allocated = new(big.Int).Add(apc.Allocated, amt)
+		if err = s.db.SetAutopilotChannel(ctx, apc); err != nil {
+			return fmt.Errorf("failed to update autopilot channel: %w", err)
+		}
+		used.Add(used, amt)
+
+		s.addAutopilotDecision(ctx, ap, db.AutopilotActionTopup, ch.TheirOnchain.Key, ch.Address, amt,
+			fmt.Sprintf("our balance %s is less than a quarter of deposit", cc.MustAmount(balance).String()))
+	}
+
+	if active >= ap.target {
+		return nil
+	}
+
+	candidates, err := s.autopilotCandidates(ctx, ap)
+	if err != nil {
+		return fmt.Errorf("failed to find candidates: %w", err)
+	}
+
+	var jettonMaster *address.Address
+	if ap.jetton != "" {
+		jettonMaster = address.MustParseAddr(ap.jetton)
+	}
+
+	for _, c := range candidates {
+		if active >= ap.target {
+			break
+		}
+
+		if new(big.Int).Add(used, ap.deposit).Cmp(ap.budget) > 0 {
+			s.addAutopilotDecision(ctx, ap, db.AutopilotActionFailed, nil, "", ap.deposit,
+				fmt.Sprintf("not enough budget to open more channels, %d of %d are active", active, ap.target))
+			break
+		}
+
+		if err = s.CheckWalletBalance(ctx, ap.jetton, ap.ecID, cc.MustAmount(ap.deposit)); err != nil {
+			s.addAutopilotDecision(ctx, ap, db.AutopilotActionFailed, nil, "", ap.deposit,
+				"not enough wallet balance to open channel: "+err.Error())
+			break
+		}
+
+		openCtx, cancel := context.WithTimeout(ctx, autopilotOpenTimeout)
+		addr, err := s.OpenChannelWithNode(openCtx, c.key, jettonMaster, ap.ecID)
+		cancel()
+		if err != nil {
+			ap.setAvoid(c.key, autopilotFailBackoff)
+			s.addAutopilotDecision(ctx, ap, db.AutopilotActionFailed, c.key, "", nil,
+				"failed to open channel: "+err.Error())
+			continue
+		}
+
+		ch, err := s.db.GetChannel(ctx, addr.String())
+		if err != nil {
+			return fmt.Errorf("failed to get opened channel: %w", err)
+		}
+
+		apc := &db.AutopilotChannel{
+			Address:         ch.Address,
+			PeerKey:         c.key,
+			JettonAddress:   ap.jetton,
+			ExtraCurrencyID: ap.ecID,
+			Allocated:       new(big.Int).Set(ap.deposit),
+			LastActivityAt:  time.Now(),
+			CreatedAt:       time.Now(),
+		}
+		if err = s.db.SetAutopilotChannel(ctx, apc); err != nil {
+			return fmt.Errorf("failed to save autopilot channel: %w", err)
+		}
+		used.Add(used, ap.deposit)
+		active++
+
+		s.addAutopilotDecision(ctx, ap, db.AutopilotActionOpen, c.key, ch.Address, ap.deposit, c.reason)
+
+		if err = s.TopupChannel(ctx, ch, cc.MustAmount(ap.deposit)); err != nil {
+			// will be retried on next step, because allocated is more than deposited
+			log.Warn().Err(err).Str("address", ch.Address).Msg("failed to topup channel opened by autopilot")
+			continue
+		}
+		s.touchWorker()
+	}
+
+	return nil
+}
+
+type autopilotCandidate struct {
+	key    ed25519.PublicKey
+	reason string
+}
+
+// autopilotCandidates - returns nodes to open channels with, seeds first,
+// then tunnelling nodes from the network graph ordered by number of their channels
+func (s *Service) autopilotCandidates(ctx context.Context, ap *autopilotConfig) ([]autopilotCandidate, error) {
+	channels, err := s.db.GetChannels(ctx, nil, db.ChannelStateAny)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channels: %w", err)
+	}
+
+	skip := map[string]bool{
+		string(s.key.Public().(ed25519.PublicKey)): true,
+	}
+	for _, ch := range channels {
+		if ch.Status != db.ChannelStateInactive && ch.JettonAddress == ap.jetton && ch.ExtraCurrencyID == ap.ecID {
+			skip[string(ch.TheirOnchain.Key)] = true
+		}
+	}
+
+	var res []autopilotCandidate
+	for _, key := range ap.seeds {
+		if skip[string(key)] || ap.isAvoided(key) {
+			continue
+		}
+		skip[string(key)] = true
+		res = append(res, autopilotCandidate{key: key, reason: "configured seed"})
+	}
+
+	type ranked struct {
+		key   string
+		count int
+	}
+
+	var graphNodes []ranked
+	for key, peers := range s.graph.neighbours(ap.jetton, ap.ecID, nil) {
+		if skip[key] || ap.isAvoided(ed25519.PublicKey(key)) {
+			continue
+		}
+
+		p := s.graph.GetNodePolicy(ed25519.PublicKey(key), ap.jetton, ap.ecID)
+		if p == nil || !p.AllowTunneling {
+			continue
+		}
+		graphNodes = append(graphNodes, ranked{key: key, count: len(peers)})
+	}
+
+	sort.Slice(graphNodes, func(i, j int) bool {
+		return graphNodes[i].count > graphNodes[j].count
+	})
+
+	for _, n := range graphNodes {
+		res = append(res, autopilotCandidate{
+			key:    ed25519.PublicKey(n.key),
+			reason: fmt.Sprintf("tunnelling node with %d channels in network", n.count),
+		})
+	}
+	return res, nil
+}
+
+func (s *Service) addAutopilotDecision(ctx context.Context, ap *autopilotConfig, action db.AutopilotAction, peer ed25519.PublicKey, channel string, amount *big.Int, reason string) {
+	l := log.Info()
+	if action == db.AutopilotActionFailed {
+		failure := string(peer) + channel + reason
+		ap.mx.Lock()
+		repeated := ap.lastFailure == failure
+		ap.lastFailure = failure
+		ap.mx.Unlock()
+
+		if repeated {
+			return
+		}
+		l = log.Warn()
+	}
+	l.Str("action", autopilotActionName(action)).
+		Str("jetton", ap.jetton).Uint32("ec", ap.ecID).
+		Str("peer", base64.StdEncoding.EncodeToString(peer)).
+		Str("channel", channel).
+		Str("reason", reason).
+		Msg("autopilot decision")
+
+	if err := s.db.AddAutopilotDecision(ctx, &db.AutopilotDecision{
+		Action:          action,
+		PeerKey:         peer,
+		ChannelAddress:  channel,
+		JettonAddress:   ap.jetton,
+		ExtraCurrencyID: ap.ecID,
+		Amount:          amount,
+		Reason:          reason,
+		CreatedAt:       time.Now(),
+	}); err != nil {
+		log.Error().Err(err).Msg("failed to save autopilot decision")
+	}
+}
+
+func autopilotActionName(action db.AutopilotAction) string {
+	switch action {
+	case db.AutopilotActionOpen:
+		return "open"
+	case db.AutopilotActionTopup:
+		return "topup"
+	case db.AutopilotActionClose:
+		return "close"
+	case db.AutopilotActionFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// ListAutopilotChannels - returns channels managed by autopilot
+func (s *Service) ListAutopilotChannels(ctx context.Context) ([]*db.AutopilotChannel, error) {
+	return s.db.ListAutopilotChannels(ctx)
+}
+
+// ListAutopilotDecisions - returns last autopilot decisions, newest first
+func (s *Service) ListAutopilotDecisions(ctx context.Context, limit int) ([]*db.AutopilotDecision, error) {
+	return s.db.ListAutopilotDecisions(ctx, limit)
+}
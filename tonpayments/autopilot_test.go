@@ -0,0 +1,174 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+)
+
+func randomKey(t *testing.T) ed25519.PublicKey {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return pub
+}
+
+func testConfigAutopilot(budget string, target int, seeds ...ed25519.PublicKey) config.ChannelsConfig {
+	cfg := testConfig()
+	cfg.SupportedCoins.Ton.Autopilot = &config.AutopilotConfig{
+		Budget:            budget,
+		TargetChannels:    target,
+		DepositPerChannel: "1",
+	}
+	for _, seed := range seeds {
+		cfg.SupportedCoins.Ton.Autopilot.Seeds = append(cfg.SupportedCoins.Ton.Autopilot.Seeds, base64.StdEncoding.EncodeToString(seed))
+	}
+	return cfg
+}
+
+func TestAutopilot_Config(t *testing.T) {
+	cc := testConfig().SupportedCoins.Ton
+
+	for name, ap := range map[string]config.AutopilotConfig{
+		"zero deposit":     {Budget: "10", TargetChannels: 1, DepositPerChannel: "0"},
+		"negative target":  {Budget: "10", TargetChannels: -1, DepositPerChannel: "1"},
+		"incorrect seed":   {Budget: "10", TargetChannels: 1, DepositPerChannel: "1", Seeds: []string{"AAAA"}},
+		"incorrect budget": {Budget: "abc", TargetChannels: 1, DepositPerChannel: "1"},
+	} {
+		cc.Autopilot = &ap
+		if _, err := newAutopilotConfig("", 0, cc); err == nil {
+			t.Fatal("config should be rejected:", name)
+		}
+	}
+
+	n := newTestNetwork()
+	a := n.addNode(t, testConfigAutopilot("10", 1))
+	if a.svc.autopilots[ccToKey("", 0)] == nil {
+		t.Fatal("autopilot should be enabled for ton")
+	}
+}
+
+func TestAutopilot_Candidates(t *testing.T) {
+	seed, wide, narrow, silent := randomKey(t), randomKey(t), randomKey(t), randomKey(t)
+
+	n := newTestNetwork()
+	a := n.addNode(t, testConfigAutopilot("10", 3, seed))
+	b := n.addNode(t, testConfig())
+	n.connect(t, a, b, "10", "0")
+
+	link := func(x, y ed25519.PublicKey) {
+		a.svc.graph.UpdateChannel(&GraphChannel{
+			Address:   base64.StdEncoding.EncodeToString(append(append([]byte{}, x...), y...)),
+			KeyA:      x,
+			KeyB:      y,
+			UpdatedAt: time.Now(),
+		})
+	}
+	for i := 0; i < 3; i++ {
+		link(wide, randomKey(t))
+		link(silent, randomKey(t))
+		link(b.pub(), randomKey(t))
+	}
+	link(narrow, randomKey(t))
+
+	tunnelling := &NodeTunnelPolicy{AllowTunneling: true, MinFee: big.NewInt(0)}
+	a.svc.graph.SetNodePolicy(wide, "", 0, tunnelling)
+	a.svc.graph.SetNodePolicy(narrow, "", 0, tunnelling)
+	a.svc.graph.SetNodePolicy(b.pub(), "", 0, tunnelling)
+	a.svc.graph.SetNodePolicy(silent, "", 0, &NodeTunnelPolicy{MinFee: big.NewInt(0)})
+
+	ap := a.svc.autopilots[ccToKey("", 0)]
+	list, err := a.svc.autopilotCandidates(context.Background(), ap)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// nodes we already have channel with and nodes which are not tunnelling are skipped
+	exp := []ed25519.PublicKey{seed, wide, narrow}
+	if len(list) != len(exp) {
+		t.Fatal("unexpected candidates count", len(list))
+	}
+	for i, key := range exp {
+		if !list[i].key.Equal(key) {
+			t.Fatal("unexpected candidate at", i, list[i].reason)
+		}
+	}
+	if !strings.Contains(list[1].reason, "3 channels") {
+		t.Fatal("reason should explain the choice", list[1].reason)
+	}
+
+	ap.setAvoid(seed, time.Hour)
+	ap.setAvoid(wide, -time.Second)
+	if list, err = a.svc.autopilotCandidates(context.Background(), ap); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list) != 2 || !list[0].key.Equal(wide) || !list[1].key.Equal(narrow) {
+		t.Fatal("only avoided nodes should be skipped till backoff is passed", len(list))
+	}
+}
+
+func TestAutopilot_Step(t *testing.T) {
+	n := newTestNetwork()
+	a := n.addNode(t, testConfigAutopilot("1", 2, randomKey(t)))
+	b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	ab := n.connect(t, a, b, "10", "0")
+	ac := n.connect(t, a, c, "10", "0")
+
+	for _, addr := range []string{ab, ac} {
+		if err := a.db.SetAutopilotChannel(context.Background(), &db.AutopilotChannel{
+			Address:        addr,
+			Allocated:      mustNano(t, "1"),
+			LastActivityAt: time.Now().Add(-time.Hour),
+			CreatedAt:      time.Now(),
+		}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// channel with c was closed, its allocation is returned to budget
+	ch, err := a.db.GetChannel(context.Background(), ac)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ch.Status = db.ChannelStateInactive
+	if err = a.db.UpdateChannel(context.Background(), ch); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	waitTransferStatus(t, a, sendTransfer(t, a, b, "1"), db.TransferStatusClosed)
+
+	ap := a.svc.autopilots[ccToKey("", 0)]
+	for i := 0; i < 2; i++ {
+		if err = a.svc.autopilotStep(context.Background(), ap); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	list, err := a.svc.ListAutopilotChannels(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list) != 1 || list[0].Address != ab {
+		t.Fatal("only record of closed channel should be removed", len(list))
+	}
+	if list[0].LastSeqno == 0 || time.Since(list[0].LastActivityAt) > time.Minute {
+		t.Fatal("activity of used channel should be noticed")
+	}
+
+	decisions, err := a.svc.ListAutopilotDecisions(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the same failure is recorded once
+	if len(decisions) != 1 || decisions[0].Action != db.AutopilotActionFailed || !strings.Contains(decisions[0].Reason, "not enough budget") {
+		t.Fatal("budget limit should be explained", len(decisions))
+	}
+}
@@ -0,0 +1,380 @@
+package backup
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	KindChannel = "channel"
+	KindVirtual = "virtual"
+)
+
+// maxRecordSize - protection from allocating huge buffer when reading corrupted file
+const maxRecordSize = 64 << 20
+
+// Record - single entry of the backup file, each entry is encrypted separately,
+// so file can be appended on each change without rewriting it.
+type Record struct {
+	Kind    string
+	Channel *db.Channel            `json:",omitempty"`
+	Virtual *db.VirtualChannelMeta `json:",omitempty"`
+	At      time.Time
+}
+
+// Snapshot - latest known state of each channel and virtual channel restored from the backup
+type Snapshot struct {
+	Channels map[string]*db.Channel
+	Virtuals map[string]*db.VirtualChannelMeta
+}
+
+type DB interface {
+	Transaction(ctx context.Context, f func(ctx context.Context) error) error
+	CreateChannel(ctx context.Context, channel *db.Channel) error
+	CreateVirtualChannelMeta(ctx context.Context, meta *db.VirtualChannelMeta) error
+}
+
+// Writer - appends channel states to the backup file, it is called from db hooks inside transaction,
+// record is encoded at this moment, but written only after the transaction is committed.
+type Writer struct {
+	path string
+	aead cipher.AEAD
+	file *os.File
+	mx   sync.Mutex
+}
+
+// DeriveKey - backup key is derived from the node key seed,
+// so backup can be opened having only the config.
+func DeriveKey(seed []byte) []byte {
+	k := sha256.Sum256(append([]byte("channel-backup:"), seed...))
+	return k[:]
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func NewWriter(path string, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		path: path,
+		aead: aead,
+	}, nil
+}
+
+// ErrUnknownChannels - existing backup has active channels which are not in the db,
+// it happens when node is started with a new or damaged db, compacting would lose them.
+var ErrUnknownChannels = errors.New("backup contains active channels which are not in the db")
+
+// Start - rewrites backup file with the current states and opens it for appending.
+// New file is written next to the old one and replaces it only when fully synced,
+// previous file is kept with .prev suffix. Existing backup is never replaced
+// when it cannot be read or has active channels missing in the given states.
+func (w *Writer) Start(channels []*db.Channel, metas []*db.VirtualChannelMeta) error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if w.file != nil {
+		return fmt.Errorf("already started")
+	}
+
+	exists, err := w.checkExisting(channels)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := w.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+
+	err = func() error {
+		for _, ch := range channels {
+			if ch.Status == db.ChannelStateInactive {
+				continue
+			}
+
+			if err = w.write(f, &Record{Kind: KindChannel, Channel: ch, At: time.Now()}); err != nil {
+				return err
+			}
+		}
+
+		for _, meta := range metas {
+			if !needVirtual(meta) {
+				continue
+			}
+
+			if err = w.write(f, &Record{Kind: KindVirtual, Virtual: meta, At: time.Now()}); err != nil {
+				return err
+			}
+		}
+		return f.Sync()
+	}()
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write backup file: %w", err)
+	}
+
+	if exists {
+		if err = os.Rename(w.path, w.path+".prev"); err != nil {
+			return fmt.Errorf("failed to keep previous backup file: %w", err)
+		}
+	}
+
+	if err = os.Rename(tmpPath, w.path); err != nil {
+		return fmt.Errorf("failed to replace backup file: %w", err)
+	}
+
+	w.file, err = os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	return nil
+}
+
+// checkExisting - verifies that all active channels from the existing backup are known,
+// returns false when there is no backup or it is empty.
+func (w *Writer) checkExisting(channels []*db.Channel) (bool, error) {
+	st, err := os.Stat(w.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check backup file: %w", err)
+	}
+	if st.Size() == 0 {
+		return true, nil
+	}
+
+	snap, err := readFile(w.path, w.aead)
+	if err != nil {
+		return false, fmt.Errorf("existing backup cannot be read, it will not be replaced: %w", err)
+	}
+
+	known := map[string]bool{}
+	for _, ch := range channels {
+		known[ch.Address] = true
+	}
+
+	for addr, ch := range snap.Channels {
+		if ch.Status != db.ChannelStateInactive && !known[addr] {
+			return false, fmt.Errorf("%w: %s", ErrUnknownChannels, addr)
+		}
+	}
+	return true, nil
+}
+
+func (w *Writer) Close() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+}
+
+// OnChannelUpdated - db hook, appends new channel state
+func (w *Writer) OnChannelUpdated(ctx context.Context, ch *db.Channel, _ bool) {
+	w.append(ctx, &Record{Kind: KindChannel, Channel: ch, At: time.Now()})
+}
+
+// OnVirtualChannelUpdated - db hook, appends virtual channel meta when resolve is known
+func (w *Writer) OnVirtualChannelUpdated(ctx context.Context, meta *db.VirtualChannelMeta) {
+	if !needVirtual(meta) {
+		return
+	}
+	w.append(ctx, &Record{Kind: KindVirtual, Virtual: meta, At: time.Now()})
+}
+
+func (w *Writer) append(ctx context.Context, rec *Record) {
+	// encoded now, because objects can be changed after the hook
+	buf, err := w.seal(rec)
+	if err != nil {
+		log.Error().Err(err).Str("kind", rec.Kind).Msg("failed to encode channel backup")
+		return
+	}
+
+	db.AfterCommit(ctx, func() {
+		w.mx.Lock()
+		defer w.mx.Unlock()
+
+		if w.file == nil {
+			return
+		}
+
+		// single write call to not leave partially written header when failed
+		if _, err := w.file.Write(buf); err != nil {
+			log.Error().Err(err).Str("kind", rec.Kind).Msg("failed to append channel backup")
+			return
+		}
+
+		if err := w.file.Sync(); err != nil {
+			log.Error().Err(err).Str("kind", rec.Kind).Msg("failed to sync channel backup")
+		}
+	})
+}
+
+func (w *Writer) write(f io.Writer, rec *Record) error {
+	buf, err := w.seal(rec)
+	if err != nil {
+		return err
+	}
+
+	// single write call to not leave partially written header when failed
+	if _, err = f.Write(buf); err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	return nil
+}
+
+// seal - encrypts record and prepends its size
+func (w *Writer) seal(rec *Record) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := w.aead.Seal(nonce, nonce, data, nil)
+
+	buf := make([]byte, 4+len(sealed))
+	binary.LittleEndian.PutUint32(buf, uint32(len(sealed)))
+	copy(buf[4:], sealed)
+	return buf, nil
+}
+
+func needVirtual(meta *db.VirtualChannelMeta) bool {
+	if meta.LastKnownResolve == nil {
+		return false
+	}
+	return meta.Status != db.VirtualChannelStateClosed && meta.Status != db.VirtualChannelStateRemoved
+}
+
+// Read - decrypts backup file and collects the latest state of each channel,
+// incomplete record at the end of the file (in case of crash during write) is skipped.
+func Read(path string, key []byte) (*Snapshot, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return readFile(path, aead)
+}
+
+func readFile(path string, aead cipher.AEAD) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer f.Close()
+
+	snap := &Snapshot{
+		Channels: map[string]*db.Channel{},
+		Virtuals: map[string]*db.VirtualChannelMeta{},
+	}
+
+	hdr := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(f, hdr); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Warn().Msg("backup file has incomplete record at the end, skipping it")
+				break
+			}
+			return nil, fmt.Errorf("failed to read record header: %w", err)
+		}
+
+		sz := binary.LittleEndian.Uint32(hdr)
+		if sz > maxRecordSize || int(sz) < aead.NonceSize() {
+			return nil, fmt.Errorf("corrupted record of size %d", sz)
+		}
+
+		sealed := make([]byte, sz)
+		if _, err = io.ReadFull(f, sealed); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+				log.Warn().Msg("backup file has incomplete record at the end, skipping it")
+				break
+			}
+			return nil, fmt.Errorf("failed to read record: %w", err)
+		}
+
+		data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt record, incorrect key or corrupted file: %w", err)
+		}
+
+		var rec Record
+		if err = json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("failed to decode record: %w", err)
+		}
+
+		switch rec.Kind {
+		case KindChannel:
+			if rec.Channel == nil {
+				return nil, fmt.Errorf("channel record without channel")
+			}
+			snap.Channels[rec.Channel.Address] = rec.Channel
+		case KindVirtual:
+			if rec.Virtual == nil {
+				return nil, fmt.Errorf("virtual record without meta")
+			}
+			snap.Virtuals[base64.StdEncoding.EncodeToString(rec.Virtual.Key)] = rec.Virtual
+		default:
+			return nil, fmt.Errorf("unknown record kind %s", rec.Kind)
+		}
+	}
+
+	return snap, nil
+}
+
+// Restore - writes snapshot to the empty db. Last processed onchain tx is shifted back,
+// so the scanner will report the latest channel state again and closing tasks will be recreated if needed.
+func Restore(ctx context.Context, d DB, snap *Snapshot) error {
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		for _, ch := range snap.Channels {
+			if ch.LastProcessedLT > 0 {
+				ch.LastProcessedLT--
+			}
+
+			if err := d.CreateChannel(ctx, ch); err != nil {
+				return fmt.Errorf("failed to create channel %s: %w", ch.Address, err)
+			}
+		}
+
+		for _, meta := range snap.Virtuals {
+			if err := d.CreateVirtualChannelMeta(ctx, meta); err != nil {
+				return fmt.Errorf("failed to create virtual channel %s: %w", base64.StdEncoding.EncodeToString(meta.Key), err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,272 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/db/leveldb"
+)
+
+func testChannel(addr string, status db.ChannelStatus, lt uint64) *db.Channel {
+	id := make([]byte, 16)
+	copy(id, addr)
+	return &db.Channel{
+		ID:              id,
+		Address:         addr,
+		Status:          status,
+		LastProcessedLT: lt,
+		OurOnchain:      db.OnchainState{Deposited: big.NewInt(100), Withdrawn: big.NewInt(0)},
+		TheirOnchain:    db.OnchainState{Deposited: big.NewInt(0), Withdrawn: big.NewInt(0)},
+		Our:             db.NewSide(id, 0, 0),
+		Their:           db.NewSide(id, 0, 0),
+	}
+}
+
+func testWriter(t *testing.T, path string, key []byte) *Writer {
+	w, err := NewWriter(path, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return w
+}
+
+func TestWriteRead(t *testing.T) {
+	key := DeriveKey([]byte("seed"))
+	path := filepath.Join(t.TempDir(), "channels.backup")
+
+	w := testWriter(t, path, key)
+	meta := &db.VirtualChannelMeta{Key: []byte{1, 2, 3}, Status: db.VirtualChannelStateActive, LastKnownResolve: []byte{4}}
+	if err := w.Start([]*db.Channel{testChannel("a", db.ChannelStateActive, 10), testChannel("closed", db.ChannelStateInactive, 1)},
+		[]*db.VirtualChannelMeta{meta, {Key: []byte{5}, Status: db.VirtualChannelStateActive}}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// later state overrides the earlier one
+	w.OnChannelUpdated(context.Background(), testChannel("a", db.ChannelStateActive, 20), false)
+	w.OnChannelUpdated(context.Background(), testChannel("b", db.ChannelStateActive, 5), true)
+	w.Close()
+
+	snap, err := Read(path, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(snap.Channels) != 2 || snap.Channels["a"].LastProcessedLT != 20 || snap.Channels["b"] == nil {
+		t.Fatal("incorrect channels", len(snap.Channels))
+	}
+	if len(snap.Virtuals) != 1 {
+		t.Fatal("only virtual channels with resolve should be stored", len(snap.Virtuals))
+	}
+	for _, v := range snap.Virtuals {
+		if !bytes.Equal(v.Key, meta.Key) || !bytes.Equal(v.LastKnownResolve, meta.LastKnownResolve) {
+			t.Fatal("incorrect virtual channel")
+		}
+	}
+
+	if _, err = Read(path, DeriveKey([]byte("another seed"))); err == nil {
+		t.Fatal("backup should not be opened with another key")
+	}
+}
+
+func TestRead_TruncatedRecord(t *testing.T) {
+	key := DeriveKey([]byte("seed"))
+	path := filepath.Join(t.TempDir(), "channels.backup")
+
+	w := testWriter(t, path, key)
+	if err := w.Start([]*db.Channel{testChannel("a", db.ChannelStateActive, 10)}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	first := int(st.Size())
+
+	w.OnChannelUpdated(context.Background(), testChannel("a", db.ChannelStateActive, 20), false)
+	w.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// crash in the middle of the last record header and body
+	for _, cut := range []int{first + 2, len(data) - 1} {
+		if err = os.WriteFile(path, data[:cut], 0600); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		snap, err := Read(path, key)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(snap.Channels) != 1 || snap.Channels["a"].LastProcessedLT != 10 {
+			t.Fatal("incomplete record should be skipped", cut)
+		}
+	}
+
+	// damaged record in the middle is not skipped silently
+	data[first-1] ^= 0xFF
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = Read(path, key); err == nil {
+		t.Fatal("corrupted record should be reported")
+	}
+}
+
+func TestStart_KeepsUnknownChannels(t *testing.T) {
+	key := DeriveKey([]byte("seed"))
+	path := filepath.Join(t.TempDir(), "channels.backup")
+
+	w := testWriter(t, path, key)
+	if err := w.Start([]*db.Channel{testChannel("a", db.ChannelStateActive, 10), testChannel("b", db.ChannelStateActive, 10)}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	w.OnChannelUpdated(context.Background(), testChannel("b", db.ChannelStateInactive, 11), true)
+	w.Close()
+
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// empty db
+	if err = testWriter(t, path, key).Start(nil, nil); !errors.Is(err, ErrUnknownChannels) {
+		t.Fatal("backup with unknown channels should not be compacted", err)
+	}
+
+	if err = testWriter(t, path, DeriveKey([]byte("another seed"))).Start(nil, nil); err == nil {
+		t.Fatal("unreadable backup should not be compacted")
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("backup was modified")
+	}
+
+	// closed channel is not required to be in db
+	w = testWriter(t, path, key)
+	if err = w.Start([]*db.Channel{testChannel("a", db.ChannelStateActive, 12)}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	w.Close()
+
+	prev, err := os.ReadFile(path + ".prev")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(before, prev) {
+		t.Fatal("previous backup is not kept")
+	}
+
+	snap, err := Read(path, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(snap.Channels) != 1 || snap.Channels["a"].LastProcessedLT != 12 {
+		t.Fatal("backup is not compacted")
+	}
+}
+
+func TestWriter_OnlyCommitted(t *testing.T) {
+	key := DeriveKey([]byte("seed"))
+	path := filepath.Join(t.TempDir(), "channels.backup")
+
+	ldb, _, err := leveldb.NewLevelDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ldb.Close()
+
+	pub, _, _ := ed25519.GenerateKey(nil)
+	d := db.NewDB(ldb, pub)
+
+	w := testWriter(t, path, key)
+	if err = w.Start(nil, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer w.Close()
+	d.SetOnChannelUpdated(w.OnChannelUpdated)
+
+	if err = d.CreateChannel(context.Background(), testChannel("a", db.ChannelStateActive, 10)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	errRollback := errors.New("rollback")
+	err = d.Transaction(context.Background(), func(ctx context.Context) error {
+		if err := d.CreateChannel(ctx, testChannel("b", db.ChannelStateActive, 10)); err != nil {
+			return err
+		}
+
+		ch, err := d.GetChannel(ctx, "a")
+		if err != nil {
+			return err
+		}
+		ch.LastProcessedLT = 20
+		if err = d.UpdateChannel(ctx, ch); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatal("transaction should be rolled back", err)
+	}
+
+	snap, err := Read(path, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(snap.Channels) != 1 || snap.Channels["a"].LastProcessedLT != 10 {
+		t.Fatal("state of rolled back transaction should not be written", len(snap.Channels))
+	}
+}
+
+type memDB struct {
+	channels []*db.Channel
+	metas    []*db.VirtualChannelMeta
+}
+
+func (m *memDB) Transaction(ctx context.Context, f func(ctx context.Context) error) error {
+	return f(ctx)
+}
+
+func (m *memDB) CreateChannel(_ context.Context, channel *db.Channel) error {
+	m.channels = append(m.channels, channel)
+	return nil
+}
+
+func (m *memDB) CreateVirtualChannelMeta(_ context.Context, meta *db.VirtualChannelMeta) error {
+	m.metas = append(m.metas, meta)
+	return nil
+}
+
+func TestRestore(t *testing.T) {
+	snap := &Snapshot{
+		Channels: map[string]*db.Channel{"a": testChannel("a", db.ChannelStateActive, 10)},
+		Virtuals: map[string]*db.VirtualChannelMeta{"AQ==": {Key: []byte{1}, LastKnownResolve: []byte{2}}},
+	}
+
+	m := &memDB{}
+	if err := Restore(context.Background(), m, snap); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(m.channels) != 1 || len(m.metas) != 1 {
+		t.Fatal("not all records restored")
+	}
+	if m.channels[0].LastProcessedLT != 9 {
+		t.Fatal("last processed tx should be shifted back", m.channels[0].LastProcessedLT)
+	}
+}
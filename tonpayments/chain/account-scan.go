@@ -49,6 +49,30 @@ func (v *Scanner) OnChannelUpdate(_ context.Context, ch *db.Channel, statusChang
 	}
 }
 
+// WatchContract - starts or stops listening for events of contract which is not our channel,
+// used by watchtower to follow channels of its clients
+func (v *Scanner) WatchContract(addr string, watch bool) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+
+	if !watch {
+		if c := v.activeChannels[addr]; c != nil {
+			c() // stop listener
+			delete(v.activeChannels, addr)
+		}
+		log.Info().Str("address", addr).Msg("stop watching contract events")
+		return
+	}
+
+	if v.activeChannels[addr] == nil {
+		ctx, cancel := context.WithCancel(v.globalCtx)
+		v.activeChannels[addr] = cancel
+
+		log.Info().Str("address", addr).Msg("start watching contract events")
+		go v.startForContract(ctx, address.MustParseAddr(addr), 0)
+	}
+}
+
 func (v *Scanner) startForContract(ctx context.Context, addr *address.Address, sinceLT uint64) {
 	originalCtx := ctx
 	for {
@@ -4,8 +4,10 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	"github.com/xssnick/tonutils-go/tlb"
 	"math/big"
+	"strconv"
 )
 
 type VirtualConfig struct {
@@ -16,6 +18,26 @@ type VirtualConfig struct {
 	ProxyMinFee                 string
 	ProxyFeePercent             float64
 	AllowTunneling              bool
+	// ExtensionFee - fee for extending deadline of virtual channel tunnelled through us, empty means free
+	ExtensionFee string
+	// DynamicFee - fee percent depends on liquidity of outgoing channel, nil means ProxyFeePercent is always used
+	DynamicFee *DynamicFeeConfig
+}
+
+// DynamicFeeConfig - fee percent moves from min, when all liquidity of outgoing channel is on our side,
+// to max, when we have nothing left in it
+type DynamicFeeConfig struct {
+	MinFeePercent float64
+	MaxFeePercent float64
+}
+
+// AdvertisedFeePercent - fee percent we announce to others. With dynamic fee the outgoing channel
+// is not known in advance, so the max is announced, to not reject senders who trust it.
+func (c VirtualConfig) AdvertisedFeePercent() float64 {
+	if c.DynamicFee != nil {
+		return c.DynamicFee.MaxFeePercent
+	}
+	return c.ProxyFeePercent
 }
 
 type BalanceControlConfig struct {
@@ -34,7 +56,79 @@ type CoinConfig struct {
 	MinCapacityRequest    string
 	FeePerWithdrawPropose string
 
+	// ExchangeRate - price of one coin in a unit common for all coins of the node, like USD.
+	// When set for two coins, node can tunnel hash-locked virtual channel from one of them to another.
+	ExchangeRate string
+	// ExchangeSpreadPercent - margin node wants to receive in this coin for conversion, in addition to tunneling fee
+	ExchangeSpreadPercent float64
+
 	BalanceControl *BalanceControlConfig
+
+	// IncomingPolicy - rules for virtual channels in this coin where we are the final receiver, nil means accept any
+	IncomingPolicy *IncomingPolicyConfig
+
+	// Autopilot - automatic opening of channels in this coin, nil means disabled
+	Autopilot *AutopilotConfig
+
+	// PeerTunnelOverrides - tunnelling conditions for specific peers by their base64 key,
+	// they replace values of VirtualTunnelConfig for virtual channels coming from these peers
+	PeerTunnelOverrides map[string]TunnelOverrideConfig
+}
+
+// TunnelOverrideConfig - nil or empty values are taken from VirtualTunnelConfig
+type TunnelOverrideConfig struct {
+	AllowTunneling   *bool
+	ProxyMinFee      string
+	ProxyFeePercent  *float64
+	ProxyMaxCapacity string
+}
+
+// WithOverride - returns config with values replaced by the ones set in override
+func (c VirtualConfig) WithOverride(o TunnelOverrideConfig) VirtualConfig {
+	if o.AllowTunneling != nil {
+		c.AllowTunneling = *o.AllowTunneling
+	}
+	if o.ProxyMinFee != "" {
+		c.ProxyMinFee = o.ProxyMinFee
+	}
+	if o.ProxyFeePercent != nil {
+		// fee set for the peer explicitly is static
+		c.ProxyFeePercent = *o.ProxyFeePercent
+		c.DynamicFee = nil
+	}
+	if o.ProxyMaxCapacity != "" {
+		c.ProxyMaxCapacity = o.ProxyMaxCapacity
+	}
+	return c
+}
+
+// AutopilotConfig - node opens channels with well-connected nodes by itself, keeping total deposit within budget
+type AutopilotConfig struct {
+	// Budget - max amount of wallet funds to deposit into channels opened by autopilot
+	Budget string
+	// TargetChannels - number of active autopilot channels to keep
+	TargetChannels int
+	// DepositPerChannel - deposit of new channel, channel is topped up back to it when our balance is less than a quarter
+	DepositPerChannel string
+	// Seeds - base64 keys of preferred nodes, they are tried before nodes from the network graph
+	Seeds []string
+	// CloseInactiveAfterSec - close autopilot channels without state updates for this period, 0 means never
+	CloseInactiveAfterSec int64
+}
+
+// IncomingPolicyConfig - channels not matching these rules are rejected before they lock our capacity
+type IncomingPolicyConfig struct {
+	// Reject - do not accept incoming virtual channels in this coin at all
+	Reject bool
+	// AllowedSenders - base64 keys of nodes which can send to us, empty means any
+	AllowedSenders []string
+	// MinAmount and MaxAmount - limits of amount to receive, empty means no limit
+	MinAmount string
+	MaxAmount string
+	// RequireMemo - sender should attach memo, like order id
+	RequireMemo bool
+	// RequireInvoice - channel should pay our invoice
+	RequireInvoice bool
 }
 
 func (c *CoinConfig) MustAmount(nano *big.Int) tlb.Coins {
@@ -45,6 +139,48 @@ func (c *CoinConfig) MustAmountDecimal(str string) tlb.Coins {
 	return tlb.MustFromDecimal(str, int(c.Decimals))
 }
 
+func (c *CoinConfig) ExchangeEnabled() bool {
+	return c.ExchangeRate != ""
+}
+
+// ConvertFrom - calculates amount of this coin, which node wants to receive
+// in exchange for the amount of another coin, including spread. Result is rounded up.
+func (c *CoinConfig) ConvertFrom(from *CoinConfig, amount *big.Int) (*big.Int, error) {
+	rate, ok := new(big.Rat).SetString(c.ExchangeRate)
+	if !ok || rate.Sign() <= 0 {
+		return nil, fmt.Errorf("incorrect exchange rate of %s", c.Symbol)
+	}
+
+	fromRate, ok := new(big.Rat).SetString(from.ExchangeRate)
+	if !ok || fromRate.Sign() <= 0 {
+		return nil, fmt.Errorf("incorrect exchange rate of %s", from.Symbol)
+	}
+
+	// parse from shortest decimal representation, to not get binary float error in amount
+	spread, ok := new(big.Rat).SetString(strconv.FormatFloat(c.ExchangeSpreadPercent, 'f', -1, 64))
+	if !ok || spread.Sign() < 0 {
+		return nil, fmt.Errorf("incorrect exchange spread of %s", c.Symbol)
+	}
+	spread.Quo(spread, big.NewRat(100, 1))
+	spread.Add(spread, big.NewRat(1, 1))
+
+	// amount * fromRate / rate * 10^(decimals - from decimals) * spread
+	res := new(big.Rat).SetInt(amount)
+	res.Mul(res, fromRate)
+	res.Quo(res, rate)
+	res.Mul(res, new(big.Rat).SetFrac(
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(c.Decimals)), nil),
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(from.Decimals)), nil),
+	))
+	res.Mul(res, spread)
+
+	val, rem := new(big.Int).QuoRem(res.Num(), res.Denom(), new(big.Int))
+	if rem.Sign() > 0 {
+		val.Add(val, big.NewInt(1))
+	}
+	return val, nil
+}
+
 type ChannelsConfig struct {
 	SupportedCoins CoinTypes
 
@@ -52,6 +188,35 @@ type ChannelsConfig struct {
 	QuarantineDurationSec           uint32
 	ConditionalCloseDurationSec     uint32
 	MinSafeVirtualChannelTimeoutSec uint32
+
+	// DrainMode - new virtual channels, capacity rentals, extensions and increases of virtual channels are rejected,
+	// already opened ones are still processed till their close, used before node restart
+	DrainMode bool
+
+	// Watchtower - nil means we neither watch channels of others, nor upload backups of ours
+	Watchtower *WatchtowerConfig
+}
+
+// WatchtowerConfig - tower keeps presigned backups of clients channels and defends them onchain,
+// when counterparty starts closure with an outdated state, while the client is offline
+type WatchtowerConfig struct {
+	// Serve - accept backups of channels from other nodes and web clients,
+	// web clients upload them to our web transport
+	Serve bool
+	// MaxChannelsPerClient - limit of channels watched for a single client key
+	MaxChannelsPerClient int
+	// Clients - base64 keys of registered clients, tower pays network fees to defend them,
+	// so backups of other nodes are not accepted
+	Clients []string
+	// Towers - nodes we upload backups of our channels to
+	Towers []WatchtowerNodeConfig
+}
+
+type WatchtowerNodeConfig struct {
+	// Key - base64 channel key of the tower
+	Key string
+	// WebURL - base url of the tower web transport, used when we are web client and cannot reach tower by adnl
+	WebURL string
 }
 
 type CoinTypes struct {
@@ -74,6 +239,7 @@ type Config struct {
 	ExternalIP                     string
 	NetworkConfigUrl               string
 	DBPath                         string
+	ChannelBackupPath              string // empty to disable, better to keep it on another disk than db
 	SecureProofPolicy              bool
 	ChannelConfig                  ChannelsConfig
 }
@@ -114,6 +280,7 @@ func Generate() (*Config, error) {
 		ExternalIP:                     "",
 		NetworkConfigUrl:               "https://ton-blockchain.github.io/global.config.json",
 		DBPath:                         "./payment-node-db",
+		ChannelBackupPath:              "./payment-node-channels.backup",
 		WebhooksSignatureHMACSHA256Key: base64.StdEncoding.EncodeToString(whKey),
 		SecureProofPolicy:              false,
 		ChannelConfig: ChannelsConfig{
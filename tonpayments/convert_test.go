@@ -0,0 +1,107 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+// testConfigExchange - node converts between ton and extra currency at 1:1
+func testConfigExchange() config.ChannelsConfig {
+	cfg := testConfigEC()
+	cfg.SupportedCoins.Ton.ExchangeRate = "1"
+	ec := cfg.SupportedCoins.ExtraCurrencies[testEC]
+	ec.ExchangeRate = "1"
+	cfg.SupportedCoins.ExtraCurrencies[testEC] = ec
+	return cfg
+}
+
+// convertChain - ton channel to the proxy, which tunnels it to the receiver in extra currency
+func convertChain(t *testing.T, sender, proxy, receiver *testNode, ecID uint32, capacity, fee string) []transport.TunnelChainPart {
+	safe := sender.svc.GetMinSafeTTL()
+	now := time.Now()
+	return []transport.TunnelChainPart{
+		{
+			Target:   proxy.pub(),
+			Capacity: mustNano(t, capacity),
+			Fee:      mustNano(t, fee),
+			Deadline: now.Add(5*time.Minute + 2*safe),
+			Payloads: []any{transport.ConvertPayload{JettonAddr: make([]byte, 32), ExtraCurrencyID: ecID}},
+		},
+		{
+			Target:   receiver.pub(),
+			Capacity: mustNano(t, capacity),
+			Fee:      mustNano(t, "0"),
+			Deadline: now.Add(5*time.Minute + safe),
+		},
+	}
+}
+
+func TestConvertPayload_Tunnelled(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfigEC()), n.addNode(t, testConfigExchange()), n.addNode(t, testConfigEC())
+	ab := n.connect(t, a, b, "10", "0")
+	bc := n.connectCoin(t, b, c, testEC, "10", "0")
+
+	hash := sha256.Sum256([]byte("preimage"))
+	key, err := proposeTunnel(t, a, ab, convertChain(t, a, b, c, testEC, "1", "0.01"), false, hash[:])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	waitFor(t, 10*time.Second, "converted channel open", func() bool {
+		meta, err := c.db.GetVirtualChannelMeta(context.Background(), key)
+		return err == nil && meta.Status == db.VirtualChannelStateActive && meta.Incoming.ChannelAddress == bc
+	})
+
+	if got := outgoingVirtual(t, b, bc, key); got.Capacity.Cmp(mustNano(t, "1")) != 0 {
+		t.Fatal("incorrect converted capacity", got.Capacity.String())
+	}
+}
+
+func TestConvertPayload_ProcessAction(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfigEC()), n.addNode(t, testConfigExchange()), n.addNode(t, testConfigEC())
+	ab := n.connect(t, a, b, "10", "0")
+	n.connectCoin(t, b, c, testEC, "10", "0")
+
+	hash := sha256.Sum256([]byte("preimage"))
+
+	if _, err := proposeTunnel(t, a, ab, convertChain(t, a, b, c, testEC, "1", "0.01"), false, nil); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "only for hash-locked") {
+		t.Fatal("conversion of not hash-locked channel should be rejected", err)
+	}
+
+	if _, err := proposeTunnel(t, a, ab, convertChain(t, a, b, c, 9, "1", "0.01"), false, hash[:]); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "not supported") {
+		t.Fatal("conversion to unknown coin should be rejected", err)
+	}
+
+	if _, err := proposeTunnel(t, a, ab, convertChain(t, a, b, c, testEC, "1", "0"), false, hash[:]); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "min fee") {
+		t.Fatal("conversion without fee should be rejected", err)
+	}
+
+	// next capacity converted to incoming coin cannot be more than incoming capacity
+	chain := convertChain(t, a, b, c, testEC, "1", "0.01")
+	chain[1].Capacity = mustNano(t, "2")
+	if _, err := proposeTunnel(t, a, ab, chain, false, hash[:]); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "capacity cannot increase") {
+		t.Fatal("conversion with increased capacity should be rejected", err)
+	}
+}
+
+func TestConvertPayload_ExchangeDisabled(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfigEC()), n.addNode(t, testConfigEC()), n.addNode(t, testConfigEC())
+	ab := n.connect(t, a, b, "10", "0")
+	n.connectCoin(t, b, c, testEC, "10", "0")
+
+	hash := sha256.Sum256([]byte("preimage"))
+	if _, err := proposeTunnel(t, a, ab, convertChain(t, a, b, c, testEC, "1", "0.01"), false, hash[:]); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "conversion between these coins is not allowed") {
+		t.Fatal("conversion should be rejected when exchange is disabled", err)
+	}
+}
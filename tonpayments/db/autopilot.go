@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+func (d *DB) SetAutopilotChannel(ctx context.Context, ch *AutopilotChannel) error {
+	data, err := json.Marshal(ch)
+	if err != nil {
+		return fmt.Errorf("failed to encode json: %w", err)
+	}
+
+	if err = d.storage.GetExecutor(ctx).Put([]byte("apc:"+ch.Address), data); err != nil {
+		return fmt.Errorf("failed to put: %w", err)
+	}
+	return nil
+}
+
+func (d *DB) GetAutopilotChannel(ctx context.Context, addr string) (*AutopilotChannel, error) {
+	data, err := d.storage.GetExecutor(ctx).Get([]byte("apc:" + addr))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var ch *AutopilotChannel
+	if err = json.Unmarshal(data, &ch); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+	return ch, nil
+}
+
+func (d *DB) ListAutopilotChannels(ctx context.Context) ([]*AutopilotChannel, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	iter := tx.NewIterator([]byte("apc:"), true)
+	defer iter.Release()
+
+	var list []*AutopilotChannel
+	for iter.Next() {
+		var ch *AutopilotChannel
+		if err := json.Unmarshal(iter.Value(), &ch); err != nil {
+			return nil, fmt.Errorf("failed to decode json data: %w", err)
+		}
+		list = append(list, ch)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (d *DB) RemoveAutopilotChannel(ctx context.Context, addr string) error {
+	if err := d.storage.GetExecutor(ctx).Delete([]byte("apc:" + addr)); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+	return nil
+}
+
+func (d *DB) AddAutopilotDecision(ctx context.Context, dc *AutopilotDecision) error {
+	data, err := json.Marshal(dc)
+	if err != nil {
+		return fmt.Errorf("failed to encode json: %w", err)
+	}
+
+	// zero padded time, to keep keys ordered
+	key := []byte(fmt.Sprintf("apd:%020d", dc.CreatedAt.UnixNano()))
+	if err = d.storage.GetExecutor(ctx).Put(key, data); err != nil {
+		return fmt.Errorf("failed to put: %w", err)
+	}
+	return nil
+}
+
+// ListAutopilotDecisions - returns autopilot decisions, newest first
+func (d *DB) ListAutopilotDecisions(ctx context.Context, limit int) ([]*AutopilotDecision, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	iter := tx.NewIterator([]byte("apd:"), true)
+	defer iter.Release()
+
+	var list []*AutopilotDecision
+	for iter.Next() {
+		var dc *AutopilotDecision
+		if err := json.Unmarshal(iter.Value(), &dc); err != nil {
+			return nil, fmt.Errorf("failed to decode json data: %w", err)
+		}
+		list = append(list, dc)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
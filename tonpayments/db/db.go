@@ -5,6 +5,7 @@ import (
 	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"sync"
 )
 
 type Iterator interface {
@@ -36,6 +37,16 @@ type DB struct {
 
 	onChannelStateChange   func(ctx context.Context, ch *Channel, statusChanged bool)
 	onChannelHistoryUpdate func(ctx context.Context, ch *Channel, item ChannelHistoryItem)
+	onVirtualChannelUpdate func(ctx context.Context, meta *VirtualChannelMeta)
+
+	// commitMx - keeps after commit callbacks in the same order as transactions are committed
+	commitMx sync.Mutex
+}
+
+type afterCommitKey struct{}
+
+type afterCommit struct {
+	list []func()
 }
 
 func NewDB(storage Storage, pubKey ed25519.PublicKey) *DB {
@@ -50,7 +61,34 @@ func (d *DB) Close() {
 }
 
 func (d *DB) Transaction(ctx context.Context, f func(ctx context.Context) error) error {
-	return d.storage.Transaction(ctx, f)
+	if _, ok := ctx.Value(afterCommitKey{}).(*afterCommit); ok {
+		// already inside tx
+		return d.storage.Transaction(ctx, f)
+	}
+
+	d.commitMx.Lock()
+	defer d.commitMx.Unlock()
+
+	ac := &afterCommit{}
+	if err := d.storage.Transaction(context.WithValue(ctx, afterCommitKey{}, ac), f); err != nil {
+		return err
+	}
+
+	for _, cb := range ac.list {
+		cb()
+	}
+	return nil
+}
+
+// AfterCommit - runs f when the current transaction is committed, or immediately when called outside of transaction.
+// It is not called when transaction is rolled back. f should not use db, it is called under commit lock.
+func AfterCommit(ctx context.Context, f func()) {
+	ac, ok := ctx.Value(afterCommitKey{}).(*afterCommit)
+	if !ok {
+		f()
+		return
+	}
+	ac.list = append(ac.list, f)
 }
 
 // SetMigrationVersion sets the migration version in the DB.
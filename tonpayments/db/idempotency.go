@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func (d *DB) GetIdempotentResponse(ctx context.Context, key string) (*IdempotentResponse, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := tx.Get([]byte("idem:" + key))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var resp *IdempotentResponse
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+
+	if time.Now().After(resp.ExpiresAt) {
+		// not yet cleaned up
+		return nil, ErrNotFound
+	}
+	return resp, nil
+}
+
+func (d *DB) SaveIdempotentResponse(ctx context.Context, resp *IdempotentResponse) error {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to encode json: %w", err)
+	}
+
+	if err = tx.Put([]byte("idem:"+resp.Key), data); err != nil {
+		return fmt.Errorf("failed to put: %w", err)
+	}
+	return nil
+}
+
+func (d *DB) DeleteIdempotentResponse(ctx context.Context, key string) error {
+	tx := d.storage.GetExecutor(ctx)
+
+	if err := tx.Delete([]byte("idem:" + key)); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredIdempotentResponses - removes responses which retention period is over
+func (d *DB) DeleteExpiredIdempotentResponses(ctx context.Context) error {
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		iter := tx.NewIterator([]byte("idem:"), true)
+		defer iter.Release()
+
+		var expired [][]byte
+		for iter.Next() {
+			var resp *IdempotentResponse
+			if err := json.Unmarshal(iter.Value(), &resp); err != nil {
+				return fmt.Errorf("failed to decode json data: %w", err)
+			}
+
+			if time.Now().After(resp.ExpiresAt) {
+				expired = append(expired, append([]byte{}, iter.Key()...))
+			}
+		}
+
+		if err := iter.Error(); err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := tx.Delete(key); err != nil {
+				return fmt.Errorf("failed to delete: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func (d *DB) SetNetworkNode(ctx context.Context, node *NetworkNode) error {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("failed to encode json: %w", err)
+	}
+
+	if err = tx.Put([]byte("nn:"+base64.StdEncoding.EncodeToString(node.Key)), data); err != nil {
+		return fmt.Errorf("failed to put: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) GetNetworkNode(ctx context.Context, key ed25519.PublicKey) (*NetworkNode, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := tx.Get([]byte("nn:" + base64.StdEncoding.EncodeToString(key)))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var node *NetworkNode
+	if err = json.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+
+	return node, nil
+}
+
+func (d *DB) ListNetworkNodes(ctx context.Context) ([]*NetworkNode, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	iter := tx.NewIterator([]byte("nn:"), true)
+	defer iter.Release()
+
+	var nodes []*NetworkNode
+	for iter.Next() {
+		var node *NetworkNode
+		if err := json.Unmarshal(iter.Value(), &node); err != nil {
+			return nil, fmt.Errorf("failed to decode json data: %w", err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate: %w", err)
+	}
+
+	return nodes, nil
+}
+
+func (d *DB) RemoveNetworkNode(ctx context.Context, key ed25519.PublicKey) error {
+	tx := d.storage.GetExecutor(ctx)
+
+	if err := tx.Delete([]byte("nn:" + base64.StdEncoding.EncodeToString(key))); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+	return nil
+}
+
+func (d *DB) SetNetworkChannel(ctx context.Context, ch *NetworkChannel) error {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := json.Marshal(ch)
+	if err != nil {
+		return fmt.Errorf("failed to encode json: %w", err)
+	}
+
+	if err = tx.Put([]byte("nc:"+ch.Address), data); err != nil {
+		return fmt.Errorf("failed to put: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) GetNetworkChannel(ctx context.Context, addr string) (*NetworkChannel, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := tx.Get([]byte("nc:" + addr))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var ch *NetworkChannel
+	if err = json.Unmarshal(data, &ch); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+
+	return ch, nil
+}
+
+func (d *DB) ListNetworkChannels(ctx context.Context) ([]*NetworkChannel, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	iter := tx.NewIterator([]byte("nc:"), true)
+	defer iter.Release()
+
+	var list []*NetworkChannel
+	for iter.Next() {
+		var ch *NetworkChannel
+		if err := json.Unmarshal(iter.Value(), &ch); err != nil {
+			return nil, fmt.Errorf("failed to decode json data: %w", err)
+		}
+		list = append(list, ch)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate: %w", err)
+	}
+
+	return list, nil
+}
+
+func (d *DB) RemoveNetworkChannel(ctx context.Context, addr string) error {
+	tx := d.storage.GetExecutor(ctx)
+
+	if err := tx.Delete([]byte("nc:" + addr)); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+	return nil
+}
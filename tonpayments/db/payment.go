@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func (d *DB) CreatePayment(ctx context.Context, payment *Payment) error {
+	key := []byte("pay:" + base64.StdEncoding.EncodeToString(payment.ID))
+
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		has, err := tx.Has(key)
+		if err != nil {
+			return fmt.Errorf("failed to check existance: %w", err)
+		}
+		if has {
+			return ErrAlreadyExists
+		}
+
+		data, err := json.Marshal(payment)
+		if err != nil {
+			return fmt.Errorf("failed to encode json: %w", err)
+		}
+
+		if err = tx.Put(key, data); err != nil {
+			return fmt.Errorf("failed to put: %w", err)
+		}
+		return nil
+	})
+}
+
+func (d *DB) UpdatePayment(ctx context.Context, payment *Payment) error {
+	key := []byte("pay:" + base64.StdEncoding.EncodeToString(payment.ID))
+
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		has, err := tx.Has(key)
+		if err != nil {
+			return fmt.Errorf("failed to check existance: %w", err)
+		}
+		if !has {
+			return ErrNotFound
+		}
+
+		data, err := json.Marshal(payment)
+		if err != nil {
+			return fmt.Errorf("failed to encode json: %w", err)
+		}
+
+		if err = tx.Put(key, data); err != nil {
+			return fmt.Errorf("failed to put: %w", err)
+		}
+		return nil
+	})
+}
+
+func (d *DB) GetPayment(ctx context.Context, id []byte) (*Payment, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := tx.Get([]byte("pay:" + base64.StdEncoding.EncodeToString(id)))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var p *Payment
+	if err = json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+	return p, nil
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func (d *DB) CreateRebalance(ctx context.Context, rb *Rebalance) error {
+	key := []byte("rb:" + base64.StdEncoding.EncodeToString(rb.ID))
+
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		has, err := tx.Has(key)
+		if err != nil {
+			return fmt.Errorf("failed to check existance: %w", err)
+		}
+		if has {
+			return ErrAlreadyExists
+		}
+
+		data, err := json.Marshal(rb)
+		if err != nil {
+			return fmt.Errorf("failed to encode json: %w", err)
+		}
+
+		if err = tx.Put(key, data); err != nil {
+			return fmt.Errorf("failed to put: %w", err)
+		}
+		return nil
+	})
+}
+
+func (d *DB) GetRebalance(ctx context.Context, id []byte) (*Rebalance, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := tx.Get([]byte("rb:" + base64.StdEncoding.EncodeToString(id)))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var rb *Rebalance
+	if err = json.Unmarshal(data, &rb); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+	return rb, nil
+}
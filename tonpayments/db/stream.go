@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func (d *DB) CreateStreamSession(ctx context.Context, session *StreamSession) error {
+	key := []byte("ss:" + base64.StdEncoding.EncodeToString(session.Key))
+
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		has, err := tx.Has(key)
+		if err != nil {
+			return fmt.Errorf("failed to check existance: %w", err)
+		}
+		if has {
+			return ErrAlreadyExists
+		}
+
+		data, err := json.Marshal(session)
+		if err != nil {
+			return fmt.Errorf("failed to encode json: %w", err)
+		}
+
+		if err = tx.Put(key, data); err != nil {
+			return fmt.Errorf("failed to put: %w", err)
+		}
+		return nil
+	})
+}
+
+func (d *DB) UpdateStreamSession(ctx context.Context, session *StreamSession) error {
+	key := []byte("ss:" + base64.StdEncoding.EncodeToString(session.Key))
+
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		has, err := tx.Has(key)
+		if err != nil {
+			return fmt.Errorf("failed to check existance: %w", err)
+		}
+		if !has {
+			return ErrNotFound
+		}
+
+		data, err := json.Marshal(session)
+		if err != nil {
+			return fmt.Errorf("failed to encode json: %w", err)
+		}
+
+		if err = tx.Put(key, data); err != nil {
+			return fmt.Errorf("failed to put: %w", err)
+		}
+		return nil
+	})
+}
+
+func (d *DB) GetStreamSession(ctx context.Context, key []byte) (*StreamSession, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := tx.Get([]byte("ss:" + base64.StdEncoding.EncodeToString(key)))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var session *StreamSession
+	if err = json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+	return session, nil
+}
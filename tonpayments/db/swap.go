@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func (d *DB) CreateSwap(ctx context.Context, swap *Swap) error {
+	key := []byte("sw:" + base64.StdEncoding.EncodeToString(swap.ID))
+
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		has, err := tx.Has(key)
+		if err != nil {
+			return fmt.Errorf("failed to check existance: %w", err)
+		}
+		if has {
+			return ErrAlreadyExists
+		}
+
+		return d.putSwap(tx, key, swap)
+	})
+}
+
+func (d *DB) UpdateSwap(ctx context.Context, swap *Swap) error {
+	key := []byte("sw:" + base64.StdEncoding.EncodeToString(swap.ID))
+
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		has, err := tx.Has(key)
+		if err != nil {
+			return fmt.Errorf("failed to check existance: %w", err)
+		}
+		if !has {
+			return ErrNotFound
+		}
+
+		return d.putSwap(tx, key, swap)
+	})
+}
+
+func (d *DB) putSwap(tx Executor, key []byte, swap *Swap) error {
+	data, err := json.Marshal(swap)
+	if err != nil {
+		return fmt.Errorf("failed to encode json: %w", err)
+	}
+
+	if err = tx.Put(key, data); err != nil {
+		return fmt.Errorf("failed to put: %w", err)
+	}
+
+	if swap.Hash != nil {
+		// index to find swap when preimage is revealed
+		if err = tx.Put([]byte("swh:"+base64.StdEncoding.EncodeToString(swap.Hash)), swap.ID); err != nil {
+			return fmt.Errorf("failed to put hash index: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *DB) GetSwap(ctx context.Context, id []byte) (*Swap, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := tx.Get([]byte("sw:" + base64.StdEncoding.EncodeToString(id)))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var swap *Swap
+	if err = json.Unmarshal(data, &swap); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+	return swap, nil
+}
+
+func (d *DB) GetSwapByHash(ctx context.Context, hash []byte) (*Swap, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	id, err := tx.Get([]byte("swh:" + base64.StdEncoding.EncodeToString(hash)))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+	return d.GetSwap(ctx, id)
+}
@@ -80,20 +80,47 @@ type CloseNextVirtualTask struct {
 type CommitVirtualTask struct {
 	ChannelAddress string
 	VirtualKey     []byte
+	// PrepayAmount - set when commit is passed from the previous node, empty means commit of known resolve
+	PrepayAmount string
+}
+
+type ExtendVirtualTask struct {
+	ChannelAddress string
+	VirtualKey     []byte
+	ID             []byte
+	Deadline       int64
+	Fee            string
+}
+
+type IncreaseVirtualTask struct {
+	ChannelAddress string
+	VirtualKey     []byte
+	ID             []byte
+	Capacity       string
+	Fee            string
 }
 
 type OpenVirtualTask struct {
 	SenderKey           ed25519.PublicKey
 	FinalDestinationKey ed25519.PublicKey // known only for initiator
+	FailureKeys         [][]byte          // known only for initiator
 	PrevChannelAddress  string
 	ChannelAddress      string
 	VirtualKey          []byte
 	Deadline            int64
 	Fee                 string
 	Capacity            string
+	HashLock            []byte // set for hash-locked channels
 	Action              transport.OpenVirtualAction
 }
 
+type VirtualUpdateResultTask struct {
+	ChannelAddress string
+	VirtualKey     []byte
+	ID             []byte
+	Report         []byte
+}
+
 type AskRemoveVirtualTask struct {
 	Key            []byte
 	ChannelAddress string
@@ -117,3 +144,32 @@ type IncrementStatesTask struct {
 type RemoveVirtualTask struct {
 	Key []byte
 }
+
+type PaymentAttemptTask struct {
+	PaymentID []byte
+}
+
+type StreamSessionCheckTask struct {
+	Key []byte
+}
+
+type SwapTask struct {
+	ID []byte
+}
+
+type WatchtowerUploadTask struct {
+	ChannelAddress string
+	TowerKey       ed25519.PublicKey
+	// Seqno, Wrap - our state at the moment of change, each of our states should be uploaded,
+	// because any of them can be committed by the party
+	Seqno uint64
+	Wrap  []byte
+}
+
+// WatchtowerSendTask - presigned messages of the tower client to send to its channel
+type WatchtowerSendTask struct {
+	Address   string
+	ClientKey ed25519.PublicKey
+	Kind      string
+	Messages  [][]byte
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+func (d *DB) CreateTransfer(ctx context.Context, tr *Transfer) error {
+	key := []byte("tr:" + base64.StdEncoding.EncodeToString(tr.ID))
+
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		has, err := tx.Has(key)
+		if err != nil {
+			return fmt.Errorf("failed to check existance: %w", err)
+		}
+		if has {
+			return ErrAlreadyExists
+		}
+
+		data, err := json.Marshal(tr)
+		if err != nil {
+			return fmt.Errorf("failed to encode json: %w", err)
+		}
+
+		if err = tx.Put(key, data); err != nil {
+			return fmt.Errorf("failed to put: %w", err)
+		}
+		return nil
+	})
+}
+
+func (d *DB) UpdateTransfer(ctx context.Context, tr *Transfer) error {
+	key := []byte("tr:" + base64.StdEncoding.EncodeToString(tr.ID))
+
+	return d.Transaction(ctx, func(ctx context.Context) error {
+		tx := d.storage.GetExecutor(ctx)
+
+		has, err := tx.Has(key)
+		if err != nil {
+			return fmt.Errorf("failed to check existance: %w", err)
+		}
+		if !has {
+			return ErrNotFound
+		}
+
+		data, err := json.Marshal(tr)
+		if err != nil {
+			return fmt.Errorf("failed to encode json: %w", err)
+		}
+
+		if err = tx.Put(key, data); err != nil {
+			return fmt.Errorf("failed to put: %w", err)
+		}
+		return nil
+	})
+}
+
+func (d *DB) GetTransfer(ctx context.Context, id []byte) (*Transfer, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	data, err := tx.Get([]byte("tr:" + base64.StdEncoding.EncodeToString(id)))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var tr *Transfer
+	if err = json.Unmarshal(data, &tr); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+	return tr, nil
+}
+
+// ListTransfers - returns transfers matching filter, newest first
+func (d *DB) ListTransfers(ctx context.Context, filter TransferFilter) ([]*Transfer, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	iter := tx.NewIterator([]byte("tr:"), true)
+	defer iter.Release()
+
+	// TODO: optimize, use indexing
+	var list []*Transfer
+	for iter.Next() {
+		var tr *Transfer
+		if err := json.Unmarshal(iter.Value(), &tr); err != nil {
+			return nil, fmt.Errorf("failed to decode json data: %w", err)
+		}
+
+		if filter.Status != 0 && tr.Status != filter.Status {
+			continue
+		}
+		if filter.Destination != nil && !bytes.Equal(tr.Destination, filter.Destination) {
+			continue
+		}
+		if !filter.CreatedAfter.IsZero() && tr.CreatedAt.Before(filter.CreatedAfter) {
+			continue
+		}
+		if !filter.CreatedBefore.IsZero() && tr.CreatedAt.After(filter.CreatedBefore) {
+			continue
+		}
+		list = append(list, tr)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+
+	if filter.Limit > 0 && len(list) > filter.Limit {
+		list = list[:filter.Limit]
+	}
+	return list, nil
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+func tunnelOverrideKey(o *TunnelOverride) []byte {
+	return []byte(fmt.Sprintf("to:%s:%s:%d", base64.StdEncoding.EncodeToString(o.PeerKey), o.JettonAddress, o.ExtraCurrencyID))
+}
+
+func (d *DB) SetTunnelOverride(ctx context.Context, o *TunnelOverride) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return fmt.Errorf("failed to encode json: %w", err)
+	}
+
+	if err = d.storage.GetExecutor(ctx).Put(tunnelOverrideKey(o), data); err != nil {
+		return fmt.Errorf("failed to put: %w", err)
+	}
+	return nil
+}
+
+func (d *DB) RemoveTunnelOverride(ctx context.Context, o *TunnelOverride) error {
+	if err := d.storage.GetExecutor(ctx).Delete(tunnelOverrideKey(o)); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+	return nil
+}
+
+func (d *DB) ListTunnelOverrides(ctx context.Context) ([]*TunnelOverride, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	iter := tx.NewIterator([]byte("to:"), true)
+	defer iter.Release()
+
+	var list []*TunnelOverride
+	for iter.Next() {
+		var o *TunnelOverride
+		if err := json.Unmarshal(iter.Value(), &o); err != nil {
+			return nil, fmt.Errorf("failed to decode json data: %w", err)
+		}
+		list = append(list, o)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -3,12 +3,14 @@ package db
 import (
 	"bytes"
 	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/xssnick/ton-payment-network/pkg/payments"
 	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
 	"github.com/xssnick/tonutils-go/tlb"
 	"github.com/xssnick/tonutils-go/tvm/cell"
 	"math/big"
@@ -108,11 +110,38 @@ type VirtualChannelMeta struct {
 	Outgoing         *VirtualChannelMetaSide
 	LastKnownResolve []byte
 	FinalDestination ed25519.PublicKey // known only to first initiator
+	Memo             string            // known only to final receiver
+	// FailReason - why the next node has rejected the channel, known only to the node who proposed it
+	FailReason string
+	// FailureKeys - keys shared with each node of the tunnel, known only to first initiator
+	FailureKeys [][]byte
+	// FailureReport - onion encrypted report received from the next node, already wrapped by us
+	FailureReport []byte
+	// HashLock - set for hash-locked channels, they are resolved by preimage instead of signed state
+	HashLock []byte
+	// Preimage - revealed preimage of HashLock, known after receiver resolves channel
+	Preimage []byte
+	// PendingUpdate - extension or capacity increase requested by us as the sender, which is not yet confirmed by the final receiver
+	PendingUpdate *VirtualChannelUpdate
+	// UpdateFailReason - why the last requested update was not accepted along the whole chain, known only to the sender
+	UpdateFailReason string
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// VirtualChannelUpdate - new values of our condition with the first node,
+// they are applied to our side only when the final receiver has confirmed the update
+type VirtualChannelUpdate struct {
+	ID []byte
+	// Deadline - new deadline, set for extension
+	Deadline int64
+	// Capacity, Fee - new capacity and fee in nano, set for capacity increase
+	Capacity  string
+	Fee       string
+	CreatedAt time.Time
+}
+
 type ChannelHistoryItem struct {
 	At     time.Time `json:"-"`
 	Action ChannelHistoryEventType
@@ -176,6 +205,306 @@ type Side struct {
 	PendingWithdraw *big.Int
 }
 
+type PaymentStatus uint8
+
+const (
+	PaymentStatusPending PaymentStatus = iota + 1
+	PaymentStatusCompleted
+	PaymentStatusFailed
+)
+
+// PaymentPart - virtual channel which carries part of the payment
+type PaymentPart struct {
+	VirtualKey ed25519.PublicKey
+	Amount     *big.Int
+	Fee        *big.Int
+	Deadline   time.Time
+	Status     PaymentStatus
+	// State - signed final state, known for incoming parts
+	State []byte
+}
+
+// PaymentAttempt - try to deliver payment using specific route
+type PaymentAttempt struct {
+	VirtualKey ed25519.PublicKey
+	Route      []ed25519.PublicKey
+	Fee        *big.Int
+	Status     PaymentStatus
+	// FailedHop - node which has rejected the channel, when known
+	FailedHop ed25519.PublicKey
+	Reason    string
+
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Payment - transfer which can be split to several virtual channels, tied together by id
+type Payment struct {
+	ID              []byte
+	Incoming        bool
+	Counterparty    ed25519.PublicKey
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	Amount          *big.Int
+	Status          PaymentStatus
+	Parts           []*PaymentPart
+
+	// MaxFee - total fee budget for retried payment, nil means unlimited
+	MaxFee *big.Int
+	// RetryTill - when set, payment is retried over alternative routes till this time
+	RetryTill time.Time
+	// TTL - lifetime of each attempt's virtual channel
+	TTL      time.Duration
+	Attempts []*PaymentAttempt
+	Reason   string
+	// InvoiceID - set when payment is made for invoice
+	InvoiceID []byte
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type InvoiceStatus uint8
+
+const (
+	InvoiceStatusPending InvoiceStatus = iota + 1
+	InvoiceStatusPaid
+)
+
+// Invoice - payment request issued by us
+type Invoice struct {
+	ID              []byte
+	Data            string // encoded signed invoice
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	Amount          *big.Int
+	Memo            string
+	Status          InvoiceStatus
+	ExpiresAt       time.Time
+
+	// filled when paid
+	VirtualKey ed25519.PublicKey
+	PaidAmount *big.Int
+	Payer      ed25519.PublicKey
+	PaidAt     *time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type StreamSessionStatus uint8
+
+const (
+	StreamSessionStatusActive StreamSessionStatus = iota + 1
+	StreamSessionStatusClosed
+)
+
+// StreamSession - virtual channel used for incremental payments,
+// sender bumps paid amount and receiver acknowledges each state
+type StreamSession struct {
+	Key             ed25519.PublicKey
+	Incoming        bool
+	Counterparty    ed25519.PublicKey
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	Capacity        *big.Int
+	Paid            *big.Int
+	IdleTimeout     time.Duration
+	// Deadline - session is closed with the last state before this moment
+	Deadline time.Time
+	Status   StreamSessionStatus
+	// PrivateKey - virtual channel key to sign states, known only on sender side
+	PrivateKey ed25519.PrivateKey
+
+	LastPaidAt time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+type SwapStatus uint8
+
+const (
+	SwapStatusPending SwapStatus = iota + 1
+	SwapStatusLocked
+	SwapStatusCompleted
+)
+
+// Swap - exchange of one coin to another with counterparty, done atomically using two hash-locked virtual channels.
+// Maker creates quote and locks its part only after taker's part is locked for it, taker knows the preimage
+// and reveals it by resolving maker's part, maker uses the same preimage to resolve taker's part.
+type Swap struct {
+	ID    []byte
+	Maker bool
+	// Counterparty - unknown for maker until quote is taken
+	Counterparty ed25519.PublicKey
+
+	GiveJettonAddress      string
+	GiveExtraCurrencyID    uint32
+	GiveAmount             *big.Int
+	ReceiveJettonAddress   string
+	ReceiveExtraCurrencyID uint32
+	ReceiveAmount          *big.Int
+
+	Hash     []byte
+	Preimage []byte
+
+	// OutgoingPrivateKey - key of our hash-locked part, kept to open it idempotently
+	OutgoingPrivateKey ed25519.PrivateKey
+	IncomingKey        ed25519.PublicKey
+
+	Status SwapStatus
+	// ExpiresAt - quote can be taken only before this moment
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type TransferStatus uint8
+
+const (
+	TransferStatusPending TransferStatus = iota + 1
+	TransferStatusOpened
+	TransferStatusDelivered
+	TransferStatusClosed
+	TransferStatusFailed
+)
+
+// Transfer - record of outgoing virtual channel opened by us, tracked from open request till close or failure
+type Transfer struct {
+	// ID - key of the virtual channel
+	ID              ed25519.PublicKey
+	Destination     ed25519.PublicKey
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	Capacity        *big.Int
+	Fee             *big.Int
+	// Amount - resolved amount, known after delivery
+	Amount   *big.Int
+	Deadline time.Time
+	Status   TransferStatus
+	Reason   string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Rebalance - virtual transfer from us to ourselves through a cycle of peers,
+// status of it is tracked by the transfer with the same id
+type Rebalance struct {
+	// ID - key of the virtual channel
+	ID          ed25519.PublicKey
+	FromChannel string
+	ToChannel   string
+	Amount      *big.Int
+	Fee         *big.Int
+	Route       []ed25519.PublicKey
+	CreatedAt   time.Time
+}
+
+type AutopilotAction uint8
+
+const (
+	AutopilotActionOpen AutopilotAction = iota + 1
+	AutopilotActionTopup
+	AutopilotActionClose
+	AutopilotActionFailed
+)
+
+// AutopilotChannel - onchain channel opened and managed by autopilot
+type AutopilotChannel struct {
+	Address         string
+	PeerKey         ed25519.PublicKey
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	// Allocated - total amount autopilot has requested to deposit, counted in budget
+	Allocated *big.Int
+	// LastSeqno - sum of both sides seqno, when it changes channel is considered used
+	LastSeqno      uint64
+	LastActivityAt time.Time
+	CreatedAt      time.Time
+}
+
+// AutopilotDecision - record of autopilot action, kept to explain why channels were opened or closed
+type AutopilotDecision struct {
+	Action          AutopilotAction
+	PeerKey         ed25519.PublicKey
+	ChannelAddress  string
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	Amount          *big.Int
+	Reason          string
+	CreatedAt       time.Time
+}
+
+// TunnelOverride - tunnelling conditions for specific peer and coin, set in runtime,
+// it is applied on top of the override from config
+type TunnelOverride struct {
+	PeerKey         ed25519.PublicKey
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	Override        config.TunnelOverrideConfig
+	UpdatedAt       time.Time
+}
+
+// IdempotentResponse - result of API request, returned again when the request is repeated with the same idempotency key
+type IdempotentResponse struct {
+	Key string
+	// RequestHash - hash of request body, to detect key reuse for different request
+	RequestHash []byte
+	// Pending - request is being executed, or node was stopped during execution, so result is unknown
+	Pending    bool
+	StatusCode int
+	Body       []byte
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+// TransferFilter - criteria to list transfers, zero values are not used for filtering
+type TransferFilter struct {
+	Status        TransferStatus
+	Destination   ed25519.PublicKey
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Limit         int
+}
+
+// OutgoingKey - virtual key of our hash-locked part, nil when not locked yet
+func (s *Swap) OutgoingKey() ed25519.PublicKey {
+	if s.OutgoingPrivateKey == nil {
+		return nil
+	}
+	return s.OutgoingPrivateKey.Public().(ed25519.PublicKey)
+}
+
+// NetworkCoinPolicy - tunnelling conditions announced by node for specific coin
+type NetworkCoinPolicy struct {
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	AllowTunneling  bool
+	MinFee          *big.Int
+	MaxCapacity     *big.Int
+	FeePercent      float64
+}
+
+// NetworkNode - node of payment network, known from announcements
+type NetworkNode struct {
+	Key         ed25519.PublicKey
+	Policies    []NetworkCoinPolicy
+	AnnouncedAt time.Time
+	UpdatedAt   time.Time
+}
+
+// NetworkChannel - onchain channel between 2 nodes of payment network, verified with blockchain
+type NetworkChannel struct {
+	Address         string
+	KeyA            ed25519.PublicKey
+	KeyB            ed25519.PublicKey
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	AnnouncedAt     time.Time
+	VerifiedAt      time.Time
+}
+
 var ErrNewerStateIsKnown = errors.New("newer state is already known")
 
 func (ld *LockedDepositInfo) Available() *big.Int {
@@ -353,6 +682,32 @@ func (ch *Channel) CalcBalance(isTheir bool) (*big.Int, *big.Int, error) {
 	return balance, locked, nil
 }
 
+// CountVirtualChannels - number of virtual channels which are still open in our (outgoing) and their (incoming) conditionals
+func (ch *Channel) CountVirtualChannels() (outgoing, incoming int, err error) {
+	ch.mx.RLock()
+	defer ch.mx.RUnlock()
+
+	count := func(s *Side) (int, error) {
+		if s.Conditionals == nil || s.Conditionals.IsEmpty() {
+			return 0, nil
+		}
+
+		all, err := s.Conditionals.LoadAll()
+		if err != nil {
+			return 0, fmt.Errorf("failed to load conditions: %w", err)
+		}
+		return len(all), nil
+	}
+
+	if outgoing, err = count(&ch.Our); err != nil {
+		return 0, 0, err
+	}
+	if incoming, err = count(&ch.Their); err != nil {
+		return 0, 0, err
+	}
+	return outgoing, incoming, nil
+}
+
 func (ch *Channel) CalcDepositFee(cc *config.CoinConfig, newAmount *big.Int, till time.Time, isTheir bool) *big.Int {
 	const periodSec = 30 * 24 * 60 * 60 // 30 days in seconds
 
@@ -483,6 +838,38 @@ func (ch *VirtualChannelMeta) AddKnownResolve(state *payments.VirtualChannelStat
 	return nil
 }
 
+// AddPreimage - saves preimage of hash-locked channel, it is used as a resolve
+func (ch *VirtualChannelMeta) AddPreimage(preimage []byte) error {
+	if ch.HashLock == nil {
+		return fmt.Errorf("virtual channel is not hash-locked")
+	}
+
+	hash := sha256.Sum256(preimage)
+	if !bytes.Equal(hash[:], ch.HashLock) {
+		return fmt.Errorf("incorrect preimage")
+	}
+
+	ch.Preimage = preimage
+	return nil
+}
+
+// GetResolveCell - condition input to resolve channel with, preimage for hash-locked channel
+// and the last known state for others. Nil is returned when resolve is unknown yet.
+func (ch *VirtualChannelMeta) GetResolveCell() (*cell.Cell, error) {
+	if ch.HashLock != nil {
+		if ch.Preimage == nil {
+			return nil, nil
+		}
+		return payments.HTLCState{Preimage: ch.Preimage}.ToCell()
+	}
+
+	resolve := ch.GetKnownResolve()
+	if resolve == nil {
+		return nil, nil
+	}
+	return resolve.ToCell()
+}
+
 func (h *ChannelHistoryItem) ParseData() any {
 	var dst any
 
@@ -505,3 +892,17 @@ func (h *ChannelHistoryItem) ParseData() any {
 	}
 	return dst
 }
+
+// WatchtowerChannel - channel of other node, which we watch as a tower, with the latest backup uploaded by the client
+type WatchtowerChannel struct {
+	Address   string
+	ClientKey ed25519.PublicKey
+	ClientIsA bool
+	Backup    transport.WatchtowerBackup
+	// Wraps - key of the latest blob, encrypted with keys of the client states, by state seqno
+	Wraps map[uint64][]byte
+	// ClosureDetectedAt - when closure was seen onchain and backup was opened
+	ClosureDetectedAt *time.Time
+	UpdatedAt         time.Time
+	CreatedAt         time.Time
+}
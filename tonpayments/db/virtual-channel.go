@@ -8,6 +8,14 @@ import (
 	"fmt"
 )
 
+func (d *DB) SetOnVirtualChannelUpdated(f func(ctx context.Context, meta *VirtualChannelMeta)) {
+	d.onVirtualChannelUpdate = f
+}
+
+func (d *DB) GetOnVirtualChannelUpdated() func(ctx context.Context, meta *VirtualChannelMeta) {
+	return d.onVirtualChannelUpdate
+}
+
 func (d *DB) CreateVirtualChannelMeta(ctx context.Context, meta *VirtualChannelMeta) error {
 	key := []byte("vch:" + base64.StdEncoding.EncodeToString(meta.Key))
 
@@ -30,6 +38,10 @@ func (d *DB) CreateVirtualChannelMeta(ctx context.Context, meta *VirtualChannelM
 		if err = tx.Put(key, data); err != nil {
 			return fmt.Errorf("failed to put: %w", err)
 		}
+
+		if d.onVirtualChannelUpdate != nil {
+			d.onVirtualChannelUpdate(ctx, meta)
+		}
 		return nil
 	})
 }
@@ -56,6 +68,10 @@ func (d *DB) UpdateVirtualChannelMeta(ctx context.Context, meta *VirtualChannelM
 		if err = tx.Put(key, data); err != nil {
 			return fmt.Errorf("failed to put: %w", err)
 		}
+
+		if d.onVirtualChannelUpdate != nil {
+			d.onVirtualChannelUpdate(ctx, meta)
+		}
 		return nil
 	})
 }
@@ -77,3 +93,24 @@ func (d *DB) GetVirtualChannelMeta(ctx context.Context, key []byte) (*VirtualCha
 	}
 	return vc, nil
 }
+
+func (d *DB) ListVirtualChannelMetas(ctx context.Context) ([]*VirtualChannelMeta, error) {
+	tx := d.storage.GetExecutor(ctx)
+
+	iter := tx.NewIterator([]byte("vch:"), true)
+	defer iter.Release()
+
+	var list []*VirtualChannelMeta
+	for iter.Next() {
+		var vc *VirtualChannelMeta
+		if err := json.Unmarshal(iter.Value(), &vc); err != nil {
+			return nil, fmt.Errorf("failed to decode json data: %w", err)
+		}
+		list = append(list, vc)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate virtual channels: %w", err)
+	}
+	return list, nil
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func watchtowerChannelKey(addr string, clientKey []byte) []byte {
+	return []byte("wt:" + addr + ":" + base64.StdEncoding.EncodeToString(clientKey))
+}
+
+func (d *DB) SetWatchtowerChannel(ctx context.Context, ch *WatchtowerChannel) error {
+	data, err := json.Marshal(ch)
+	if err != nil {
+		return fmt.Errorf("failed to encode json: %w", err)
+	}
+
+	if err = d.storage.GetExecutor(ctx).Put(watchtowerChannelKey(ch.Address, ch.ClientKey), data); err != nil {
+		return fmt.Errorf("failed to put: %w", err)
+	}
+	return nil
+}
+
+func (d *DB) GetWatchtowerChannel(ctx context.Context, addr string, clientKey []byte) (*WatchtowerChannel, error) {
+	data, err := d.storage.GetExecutor(ctx).Get(watchtowerChannelKey(addr, clientKey))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get from db: %w", err)
+	}
+
+	var ch *WatchtowerChannel
+	if err = json.Unmarshal(data, &ch); err != nil {
+		return nil, fmt.Errorf("failed to decode json data: %w", err)
+	}
+	return ch, nil
+}
+
+func (d *DB) RemoveWatchtowerChannel(ctx context.Context, addr string, clientKey []byte) error {
+	if err := d.storage.GetExecutor(ctx).Delete(watchtowerChannelKey(addr, clientKey)); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+	return nil
+}
+
+// ListWatchtowerChannels - returns watched channels, when addr is set, only backups of this channel are returned
+func (d *DB) ListWatchtowerChannels(ctx context.Context, addr string) ([]*WatchtowerChannel, error) {
+	prefix := "wt:"
+	if addr != "" {
+		prefix += addr + ":"
+	}
+
+	tx := d.storage.GetExecutor(ctx)
+
+	iter := tx.NewIterator([]byte(prefix), true)
+	defer iter.Release()
+
+	var list []*WatchtowerChannel
+	for iter.Next() {
+		var ch *WatchtowerChannel
+		if err := json.Unmarshal(iter.Value(), &ch); err != nil {
+			return nil, fmt.Errorf("failed to decode json data: %w", err)
+		}
+		list = append(list, ch)
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,23 @@
+package tonpayments
+
+import (
+	"github.com/xssnick/ton-payment-network/pkg/log"
+)
+
+// SetDrainMode - when enabled, node stops accepting new virtual channels, capacity rentals,
+// extensions and capacity increases, but keeps processing close, commit and remove of already opened ones, so they can finish before restart.
+func (s *Service) SetDrainMode(enabled bool) {
+	if s.draining.Swap(enabled) == enabled {
+		return
+	}
+
+	if enabled {
+		log.Info().Msg("drain mode enabled, new virtual channels will be rejected")
+	} else {
+		log.Info().Msg("drain mode disabled")
+	}
+}
+
+func (s *Service) IsDraining() bool {
+	return s.draining.Load()
+}
@@ -0,0 +1,52 @@
+package tonpayments
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+func TestDrain_RejectsExtendAndIncrease(t *testing.T) {
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	addr := n.connect(t, a, b, "10", "0")
+
+	key := openVirtual(t, "1", nil, a, b).Public().(ed25519.PublicKey)
+	vch := outgoingVirtual(t, a, addr, key)
+
+	extend := transport.ExtendVirtualAction{
+		Key:      key,
+		ID:       make([]byte, 32),
+		Deadline: vch.Deadline + 60,
+		Fee:      big.NewInt(0).Bytes(),
+	}
+	increase := transport.IncreaseVirtualAction{
+		Key:      key,
+		ID:       make([]byte, 32),
+		Capacity: new(big.Int).Add(vch.Capacity, big.NewInt(1000)).Bytes(),
+		Fee:      vch.Fee.Bytes(),
+	}
+
+	b.svc.SetDrainMode(true)
+	for _, action := range []transport.Action{extend, increase} {
+		err := propose(t, a, addr, action)
+		if !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), ErrDraining.Error()) {
+			t.Fatal("action should be rejected in drain mode", err)
+		}
+	}
+
+	if got := outgoingVirtual(t, a, addr, key); got.Deadline != vch.Deadline || got.Capacity.Cmp(vch.Capacity) != 0 {
+		t.Fatal("rejected action should not change our state")
+	}
+
+	b.svc.SetDrainMode(false)
+	for _, action := range []transport.Action{extend, increase} {
+		if err := propose(t, a, addr, action); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"math/big"
+	"time"
+)
+
+// ExtendVirtualChannel - moves deadline of virtual channel opened by us further, without closing it.
+// Extension is passed hop by hop along the chain, and each node shifts its deadline for the same duration,
+// so safety gaps between nodes are kept. Fee is paid to the first node, each node takes
+// its extension fee from it and passes the rest further. Our side is updated only when
+// the final receiver confirms the extension, new request replaces the pending one.
+func (s *Service) ExtendVirtualChannel(ctx context.Context, key ed25519.PublicKey, extend time.Duration, fee *big.Int) error {
+	if extend < time.Second {
+		return fmt.Errorf("extension should be at least one second")
+	}
+
+	if fee.Sign() < 0 {
+		return fmt.Errorf("fee cannot be negative")
+	}
+
+	meta, err := s.db.GetVirtualChannelMeta(ctx, key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("virtual channel is not exists")
+		}
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	if meta.Incoming != nil || meta.Outgoing == nil {
+		return fmt.Errorf("virtual channel is not opened by us")
+	}
+
+	if meta.Status != db.VirtualChannelStateActive {
+		return fmt.Errorf("virtual channel is not active")
+	}
+
+	ch, err := s.db.GetChannel(ctx, meta.Outgoing.ChannelAddress)
+	if err != nil {
+		return fmt.Errorf("failed to get outgoing channel: %w", err)
+	}
+
+	_, vch, err := payments.FindVirtualChannel(ch.Our.Conditionals, key)
+	if err != nil {
+		return fmt.Errorf("failed to find virtual channel: %w", err)
+	}
+
+	if safe := vch.Deadline - (time.Now().UTC().Unix() + ch.SafeOnchainClosePeriod); safe < int64(s.cfg.MinSafeVirtualChannelTimeoutSec) {
+		return fmt.Errorf("virtual channel is too close to deadline to be extended")
+	}
+
+	deadline := vch.Deadline + int64(extend/time.Second)
+
+	id := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return fmt.Errorf("failed to generate extension id: %w", err)
+	}
+
+	tryTill := time.Unix(vch.Deadline-ch.SafeOnchainClosePeriod, 0)
+	err = s.db.Transaction(ctx, func(ctx context.Context) error {
+		meta.PendingUpdate = &db.VirtualChannelUpdate{
+			ID:        id,
+			Deadline:  deadline,
+			CreatedAt: time.Now(),
+		}
+		meta.UpdateFailReason = ""
+		meta.UpdatedAt = time.Now()
+		if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+			return fmt.Errorf("failed to update virtual channel meta: %w", err)
+		}
+
+		if err = s.db.CreateTask(ctx, PaymentsTaskPool, "extend-virtual", ch.Address,
+			"extend-virtual-"+base64.StdEncoding.EncodeToString(key)+"-"+fmt.Sprint(deadline),
+			db.ExtendVirtualTask{
+				ChannelAddress: ch.Address,
+				VirtualKey:     key,
+				ID:             id,
+				Deadline:       deadline,
+				Fee:            fee.String(),
+			}, nil, &tryTill,
+		); err != nil {
+			return fmt.Errorf("failed to create extend task: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.touchWorker()
+
+	return nil
+}
+
+func (s *Service) executeExtendVirtual(ctx context.Context, data *db.ExtendVirtualTask) error {
+	channel, lockId, unlock, err := s.AcquireChannel(ctx, data.ChannelAddress)
+	if err != nil {
+		return fmt.Errorf("failed to acquire channel: %w", err)
+	}
+	defer unlock()
+
+	if channel.Status != db.ChannelStateActive {
+		// not needed anymore
+		return nil
+	}
+
+	fee, ok := new(big.Int).SetString(data.Fee, 10)
+	if !ok {
+		return fmt.Errorf("incorrect fee")
+	}
+
+	if err = s.proposeAction(ctx, lockId, data.ChannelAddress, transport.ExtendVirtualAction{
+		Key:      data.VirtualKey,
+		ID:       data.ID,
+		Deadline: data.Deadline,
+		Fee:      fee.Bytes(),
+	}, nil); err != nil {
+		if errors.Is(err, ErrDenied) || errors.Is(err, ErrNotPossible) {
+			// our incoming side, if any, is already extended,
+			// so keeping the old deadline with the next node is safe for us
+			log.Warn().Err(err).Str("key", base64.StdEncoding.EncodeToString(data.VirtualKey)).
+				Msg("virtual channel extension was not accepted by the next node")
+
+			code := transport.FailureCodeNotPossible
+			if errors.Is(err, ErrDenied) {
+				code = transport.FailureCodeDenied
+			}
+			return s.failVirtualUpdate(ctx, data.VirtualKey, data.ID, code, err.Error())
+		}
+		return fmt.Errorf("failed to propose extend virtual action: %w", err)
+	}
+	return nil
+}
+
+// onOutgoingVirtualExtended - updates our side after the next node has accepted extension,
+// when we are the sender, it is updated later, when the final receiver confirms extension
+func (s *Service) onOutgoingVirtualExtended(ctx context.Context, channel *db.Channel, vch *payments.VirtualChannel) error {
+	meta, err := s.db.GetVirtualChannelMeta(ctx, vch.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	if meta.Outgoing == nil || meta.Incoming == nil {
+		return nil
+	}
+
+	deadline := time.Unix(vch.Deadline, 0)
+	meta.Outgoing.UncooperativeDeadline = deadline
+	meta.Outgoing.SafeDeadline = deadline.Add(-time.Duration(channel.SafeOnchainClosePeriod+int64(s.cfg.MinSafeVirtualChannelTimeoutSec)) * time.Second)
+	meta.UpdatedAt = time.Now()
+	if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+		return fmt.Errorf("failed to update virtual channel meta: %w", err)
+	}
+	return nil
+}
+
+// applyVirtualExtension - updates our side as the sender, when extension is confirmed by the final receiver,
+// meta is saved by the caller
+func (s *Service) applyVirtualExtension(ctx context.Context, meta *db.VirtualChannelMeta, deadlineAt int64) error {
+	channel, err := s.db.GetChannel(ctx, meta.Outgoing.ChannelAddress)
+	if err != nil {
+		return fmt.Errorf("failed to get outgoing channel: %w", err)
+	}
+
+	deadline := time.Unix(deadlineAt, 0)
+	delta := deadline.Sub(meta.Outgoing.UncooperativeDeadline)
+	if delta <= 0 {
+		return nil
+	}
+
+	meta.Outgoing.UncooperativeDeadline = deadline
+	meta.Outgoing.SafeDeadline = deadline.Add(-time.Duration(channel.SafeOnchainClosePeriod+int64(s.cfg.MinSafeVirtualChannelTimeoutSec)) * time.Second)
+
+	tr, err := s.db.GetTransfer(ctx, meta.Key)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("failed to get transfer: %w", err)
+	}
+
+	if tr != nil {
+		tr.Deadline = deadline
+		tr.UpdatedAt = time.Now()
+		if err = s.db.UpdateTransfer(ctx, tr); err != nil {
+			return fmt.Errorf("failed to update transfer: %w", err)
+		}
+	}
+
+	return s.extendStreamSession(ctx, meta.Key, delta)
+}
+
+// onIncomingVirtualExtended - updates our side after the previous node has extended the channel,
+// and passes the extension to the next node, when channel is tunnelled through us, or confirms it to the sender
+func (s *Service) onIncomingVirtualExtended(ctx context.Context, channel *db.Channel, meta *db.VirtualChannelMeta, vch *payments.VirtualChannel, id []byte, nextFee *big.Int) error {
+	deadline := time.Unix(vch.Deadline, 0)
+	delta := deadline.Sub(meta.Incoming.UncooperativeDeadline)
+
+	meta.Incoming.UncooperativeDeadline = deadline
+	meta.Incoming.SafeDeadline = deadline.Add(-time.Duration(channel.SafeOnchainClosePeriod+int64(s.cfg.MinSafeVirtualChannelTimeoutSec)) * time.Second)
+	meta.UpdatedAt = time.Now()
+	if err := s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+		return fmt.Errorf("failed to update virtual channel meta: %w", err)
+	}
+
+	if meta.Outgoing != nil {
+		// keep the same gap with the next node
+		nextDeadline := meta.Outgoing.UncooperativeDeadline.Add(delta)
+		tryTill := meta.Outgoing.SafeDeadline
+		if err := s.db.CreateTask(ctx, PaymentsTaskPool, "extend-virtual", meta.Outgoing.ChannelAddress,
+			"extend-virtual-"+base64.StdEncoding.EncodeToString(vch.Key)+"-"+fmt.Sprint(nextDeadline.Unix()),
+			db.ExtendVirtualTask{
+				ChannelAddress: meta.Outgoing.ChannelAddress,
+				VirtualKey:     vch.Key,
+				ID:             id,
+				Deadline:       nextDeadline.Unix(),
+				Fee:            nextFee.String(),
+			}, nil, &tryTill,
+		); err != nil {
+			return fmt.Errorf("failed to create extend-virtual task: %w", err)
+		}
+	} else {
+		if err := s.extendStreamSession(ctx, vch.Key, delta); err != nil {
+			return err
+		}
+
+		if err := s.reportVirtualUpdate(ctx, meta, id, transport.FailureCodeAccepted, ""); err != nil {
+			return err
+		}
+	}
+
+	// removal scheduled for the old deadline will be skipped, because channel is not expired at that moment
+	dl := deadline.Add(1 * time.Second)
+	if err := s.db.CreateTask(ctx, PaymentsTaskPool, "ask-remove-virtual", channel.Address,
+		"ask-remove-virtual-"+base64.StdEncoding.EncodeToString(vch.Key)+"-timeout-"+fmt.Sprint(vch.Deadline),
+		db.AskRemoveVirtualTask{
+			ChannelAddress: channel.Address,
+			Key:            vch.Key,
+		}, &dl, nil,
+	); err != nil {
+		return fmt.Errorf("failed to create ask-remove-virtual task: %w", err)
+	}
+
+	log.Info().Str("key", base64.StdEncoding.EncodeToString(vch.Key)).
+		Time("deadline", deadline).
+		Str("extended_for", delta.String()).
+		Msg("virtual channel deadline extended")
+
+	return nil
+}
+
+// extendStreamSession - moves deadline of stream session over the extended virtual channel
+func (s *Service) extendStreamSession(ctx context.Context, key []byte, delta time.Duration) error {
+	session, err := s.db.GetStreamSession(ctx, key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load stream session: %w", err)
+	}
+
+	if session.Status != db.StreamSessionStatusActive {
+		return nil
+	}
+
+	session.Deadline = session.Deadline.Add(delta)
+	session.UpdatedAt = time.Now()
+	if err = s.db.UpdateStreamSession(ctx, session); err != nil {
+		return fmt.Errorf("failed to update stream session: %w", err)
+	}
+	return nil
+}
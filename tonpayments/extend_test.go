@@ -0,0 +1,162 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+func waitUpdateFinished(t *testing.T, n *testNode, key ed25519.PublicKey) *db.VirtualChannelMeta {
+	var meta *db.VirtualChannelMeta
+	waitFor(t, 10*time.Second, "virtual channel update result", func() bool {
+		var err error
+		meta, err = n.db.GetVirtualChannelMeta(context.Background(), key)
+		return err == nil && meta.PendingUpdate == nil
+	})
+	return meta
+}
+
+func TestExtendVirtual_ConfirmedByReceiver(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	n.connect(t, a, b, "10", "0")
+	bc := n.connect(t, b, c, "10", "0")
+
+	key := openVirtual(t, "1", nil, a, b, c).Public().(ed25519.PublicKey)
+	before, err := a.db.GetVirtualChannelMeta(context.Background(), key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	last := outgoingVirtual(t, b, bc, key)
+
+	if err = a.svc.ExtendVirtualChannel(context.Background(), key, time.Minute, big.NewInt(0)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	meta := waitUpdateFinished(t, a, key)
+	if meta.UpdateFailReason != "" {
+		t.Fatal("extension should be confirmed", meta.UpdateFailReason)
+	}
+	if got := meta.Outgoing.UncooperativeDeadline.Sub(before.Outgoing.UncooperativeDeadline); got != time.Minute {
+		t.Fatal("sender deadline is not extended", got)
+	}
+	if got := outgoingVirtual(t, b, bc, key); got.Deadline != last.Deadline+60 {
+		t.Fatal("deadline with receiver is not extended", got.Deadline-last.Deadline)
+	}
+}
+
+func TestExtendVirtual_PartialNotApplied(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	ab := n.connect(t, a, b, "10", "0")
+	bc := n.connect(t, b, c, "10", "0")
+
+	key := openVirtual(t, "1", nil, a, b, c).Public().(ed25519.PublicKey)
+	before, err := a.db.GetVirtualChannelMeta(context.Background(), key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	first, last := outgoingVirtual(t, a, ab, key), outgoingVirtual(t, b, bc, key)
+
+	c.svc.SetDrainMode(true)
+	if err = a.svc.ExtendVirtualChannel(context.Background(), key, time.Minute, big.NewInt(0)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	meta := waitUpdateFinished(t, a, key)
+	if !strings.Contains(meta.UpdateFailReason, "node 1") || !strings.Contains(meta.UpdateFailReason, ErrDraining.Error()) {
+		t.Fatal("rejection by the receiver should be reported", meta.UpdateFailReason)
+	}
+	if !meta.Outgoing.UncooperativeDeadline.Equal(before.Outgoing.UncooperativeDeadline) {
+		t.Fatal("sender deadline should not be changed")
+	}
+
+	// first hop has accepted it, but the receiver has not
+	if got := outgoingVirtual(t, a, ab, key); got.Deadline != first.Deadline+60 {
+		t.Fatal("first hop should be extended", got.Deadline-first.Deadline)
+	}
+	if got := outgoingVirtual(t, b, bc, key); got.Deadline != last.Deadline {
+		t.Fatal("deadline with receiver should not be changed")
+	}
+}
+
+func TestExtendVirtual_RejectedByFirstHop(t *testing.T) {
+	cfg := testConfig()
+	cfg.SupportedCoins.Ton.VirtualTunnelConfig.ExtensionFee = "0.01"
+
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, cfg), n.addNode(t, testConfig())
+	ab := n.connect(t, a, b, "10", "0")
+	n.connect(t, b, c, "10", "0")
+
+	key := openVirtual(t, "1", nil, a, b, c).Public().(ed25519.PublicKey)
+	first := outgoingVirtual(t, a, ab, key)
+
+	if err := a.svc.ExtendVirtualChannel(context.Background(), key, time.Minute, big.NewInt(0)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	meta := waitUpdateFinished(t, a, key)
+	if !strings.Contains(meta.UpdateFailReason, "extension fee should be at least") {
+		t.Fatal("rejection reason should be kept", meta.UpdateFailReason)
+	}
+	if got := outgoingVirtual(t, a, ab, key); got.Deadline != first.Deadline {
+		t.Fatal("deadline should not be changed")
+	}
+}
+
+func TestExtendVirtual_ProcessAction(t *testing.T) {
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	addr := n.connect(t, a, b, "10", "0")
+
+	key := openVirtual(t, "1", nil, a, b).Public().(ed25519.PublicKey)
+	vch := outgoingVirtual(t, a, addr, key)
+
+	if err := propose(t, a, addr, transport.ExtendVirtualAction{
+		Key:      key,
+		ID:       make([]byte, 32),
+		Deadline: vch.Deadline + 60,
+		Fee:      big.NewInt(0).Bytes(),
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	waitFor(t, 5*time.Second, "receiver extension", func() bool {
+		meta, err := b.db.GetVirtualChannelMeta(context.Background(), key)
+		return err == nil && meta.Incoming.UncooperativeDeadline.Unix() == vch.Deadline+60
+	})
+
+	// result can be passed only by the next node of the tunnel
+	if _, err := a.svc.requestAction(context.Background(), addr, transport.VirtualUpdateResultAction{
+		Key:    key,
+		ID:     make([]byte, 32),
+		Report: make([]byte, transport.FailureReportSize),
+	}); !errors.Is(err, ErrDenied) {
+		t.Fatal("result from the previous node should be rejected", err)
+	}
+
+	// result of unknown update is ignored by the sender
+	if _, err := b.svc.requestAction(context.Background(), addr, transport.VirtualUpdateResultAction{
+		Key:    key,
+		ID:     make([]byte, 32),
+		Report: make([]byte, transport.FailureReportSize),
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	meta, err := a.db.GetVirtualChannelMeta(context.Background(), key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if meta.UpdateFailReason != "" || meta.Outgoing.UncooperativeDeadline.Unix() != vch.Deadline {
+		t.Fatal("sender side should not be changed by unknown result")
+	}
+}
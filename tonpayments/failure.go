@@ -0,0 +1,127 @@
+package tonpayments
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"time"
+)
+
+// failVirtualOpen - marks virtual channel as unsuccessful, and when we are not the first node of the tunnel,
+// asks previous node to remove it, passing encrypted failure report back to the sender.
+func (s *Service) failVirtualOpen(ctx context.Context, data *db.OpenVirtualTask, code int32, reason string) error {
+	return s.db.Transaction(ctx, func(ctx context.Context) error {
+		meta, err := s.db.GetVirtualChannelMeta(ctx, data.VirtualKey)
+		if err != nil {
+			return fmt.Errorf("failed to load virtual channel meta: %w", err)
+		}
+
+		meta.Status = db.VirtualChannelStateWantRemove
+		meta.FailReason = reason
+		meta.UpdatedAt = time.Now()
+
+		if meta.Incoming != nil && meta.Incoming.SenderKey != nil {
+			sharedKey, err := keys.SharedKey(s.key, meta.Incoming.SenderKey)
+			if err != nil {
+				return fmt.Errorf("failed to calc shared key: %w", err)
+			}
+
+			meta.FailureReport, err = transport.NewFailureReport(sharedKey, meta.Key, code, reason)
+			if err != nil {
+				return fmt.Errorf("failed to create failure report: %w", err)
+			}
+		}
+
+		if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+			return fmt.Errorf("failed to update virtual channel meta: %w", err)
+		}
+
+		if data.PrevChannelAddress == "" {
+			// we are the sender
+			if err = s.updateTransfer(ctx, data.VirtualKey, db.TransferStatusFailed, nil, reason); err != nil {
+				return err
+			}
+		}
+
+		// if we are not the first node of the tunnel
+		if data.PrevChannelAddress != "" {
+			// consider virtual channel unsuccessful and gracefully removed
+			// and notify previous party that we are ready to release locked coins.
+			err = s.db.CreateTask(ctx, PaymentsTaskPool, "ask-remove-virtual", data.PrevChannelAddress,
+				"ask-remove-virtual-"+base64.StdEncoding.EncodeToString(data.VirtualKey),
+				db.AskRemoveVirtualTask{
+					ChannelAddress: data.PrevChannelAddress,
+					Key:            data.VirtualKey,
+				}, nil, nil,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to create ask-remove-virtual task: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// acceptFailureReport - saves report received from the next node, wrapping it with our layer,
+// so it can be passed further to the previous node. Only the first report is kept.
+func (s *Service) acceptFailureReport(ctx context.Context, channelAddr string, key, report []byte) error {
+	meta, err := s.db.GetVirtualChannelMeta(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	if meta.Outgoing == nil || meta.Outgoing.ChannelAddress != channelAddr {
+		return fmt.Errorf("report is not from the next node")
+	}
+
+	if meta.FailureReport != nil {
+		return nil
+	}
+
+	if meta.Incoming != nil && meta.Incoming.SenderKey != nil {
+		sharedKey, err := keys.SharedKey(s.key, meta.Incoming.SenderKey)
+		if err != nil {
+			return fmt.Errorf("failed to calc shared key: %w", err)
+		}
+
+		if report, err = transport.WrapFailureReport(sharedKey, meta.Key, report); err != nil {
+			return fmt.Errorf("failed to wrap failure report: %w", err)
+		}
+	} else if meta.FailureKeys != nil {
+		// we are the sender
+		hop, rep, err := transport.DecryptFailureReport(meta.FailureKeys, meta.Key, report)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt failure report: %w", err)
+		}
+
+		log.Warn().Str("key", base64.StdEncoding.EncodeToString(meta.Key)).
+			Int("hop", hop).
+			Int("code", int(rep.Code)).
+			Str("reason", rep.Message).
+			Msg("virtual channel failure reported by tunnel node")
+	}
+
+	meta.FailureReport = report
+	meta.UpdatedAt = time.Now()
+	if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+		return fmt.Errorf("failed to update virtual channel meta: %w", err)
+	}
+	return nil
+}
+
+// readFailureReport - decrypts report received by the sender, returns index of the tunnel node who has created it
+func (s *Service) readFailureReport(meta *db.VirtualChannelMeta) (int, *transport.FailureReport, error) {
+	if meta.FailureReport == nil {
+		return -1, nil, fmt.Errorf("no failure report")
+	}
+
+	if meta.FailureKeys == nil {
+		return -1, nil, fmt.Errorf("failure keys are unknown, we are not the sender")
+	}
+
+	return transport.DecryptFailureReport(meta.FailureKeys, meta.Key, meta.FailureReport)
+}
@@ -0,0 +1,78 @@
+package tonpayments
+
+import (
+	"fmt"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"math/big"
+)
+
+// proxyFeePercent - fee percent we want for tunnelling through the outgoing channel.
+// With dynamic fee it is interpolated between min and max by share of channel liquidity on our side,
+// so drained channels become more expensive and attract less traffic.
+func proxyFeePercent(tc config.VirtualConfig, target *db.Channel) (float64, error) {
+	if tc.DynamicFee == nil {
+		return tc.ProxyFeePercent, nil
+	}
+
+	ratio, err := liquidityRatio(target)
+	if err != nil {
+		return 0, err
+	}
+
+	lo, hi := tc.DynamicFee.MinFeePercent, tc.DynamicFee.MaxFeePercent
+	return hi - (hi-lo)*ratio, nil
+}
+
+// liquidityRatio - share of channel liquidity on our side, from 0 to 1
+func liquidityRatio(ch *db.Channel) (float64, error) {
+	our, _, err := ch.CalcBalance(false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to calc our balance: %w", err)
+	}
+
+	their, _, err := ch.CalcBalance(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to calc their balance: %w", err)
+	}
+
+	if our.Sign() <= 0 {
+		return 0, nil
+	}
+	if their.Sign() < 0 {
+		their = big.NewInt(0)
+	}
+
+	ratio, _ := new(big.Rat).SetFrac(our, new(big.Int).Add(our, their)).Float64()
+	return ratio, nil
+}
+
+// GetChannelProxyFee - returns fee percent we currently want for tunnelling through the channel,
+// and share of its liquidity on our side
+func (s *Service) GetChannelProxyFee(ch *db.Channel) (percent float64, ratio float64, err error) {
+	cc, err := s.ResolveCoinConfig(ch.JettonAddress, ch.ExtraCurrencyID, false)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	if ratio, err = liquidityRatio(ch); err != nil {
+		return 0, 0, err
+	}
+
+	if percent, err = proxyFeePercent(cc.VirtualTunnelConfig, ch); err != nil {
+		return 0, 0, err
+	}
+	return percent, ratio, nil
+}
+
+func validateDynamicFee(cc config.CoinConfig) error {
+	df := cc.VirtualTunnelConfig.DynamicFee
+	if df == nil {
+		return nil
+	}
+
+	if df.MinFeePercent < 0 || df.MaxFeePercent < df.MinFeePercent {
+		return fmt.Errorf("dynamic fee of %s should have 0 <= min <= max", cc.Symbol)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package tonpayments
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+)
+
+func testChannel(ourDeposit, theirDeposit int64) *db.Channel {
+	id := make([]byte, 16)
+	return &db.Channel{
+		ID:           id,
+		OurOnchain:   db.OnchainState{Deposited: big.NewInt(ourDeposit), Withdrawn: big.NewInt(0)},
+		TheirOnchain: db.OnchainState{Deposited: big.NewInt(theirDeposit), Withdrawn: big.NewInt(0)},
+		Our:          db.NewSide(id, 0, 0),
+		Their:        db.NewSide(id, 0, 0),
+	}
+}
+
+func TestLiquidityRatio(t *testing.T) {
+	tests := []struct {
+		name        string
+		our, their  int64
+		wantRatio   float64
+		wantDynamic float64
+	}{
+		{name: "all on our side", our: 100, their: 0, wantRatio: 1, wantDynamic: 0.1},
+		{name: "drained", our: 0, their: 100, wantRatio: 0, wantDynamic: 2},
+		{name: "half", our: 50, their: 50, wantRatio: 0.5, wantDynamic: 1.05},
+		{name: "zero capacity", our: 0, their: 0, wantRatio: 0, wantDynamic: 2},
+	}
+
+	dynamic := config.VirtualConfig{
+		ProxyFeePercent: 0.5,
+		DynamicFee: &config.DynamicFeeConfig{
+			MinFeePercent: 0.1,
+			MaxFeePercent: 2,
+		},
+	}
+	static := config.VirtualConfig{ProxyFeePercent: 0.5}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := testChannel(tt.our, tt.their)
+
+			ratio, err := liquidityRatio(ch)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if math.Abs(ratio-tt.wantRatio) > 1e-9 {
+				t.Fatal("incorrect ratio", ratio)
+			}
+
+			percent, err := proxyFeePercent(dynamic, ch)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if math.Abs(percent-tt.wantDynamic) > 1e-9 {
+				t.Fatal("incorrect dynamic fee", percent)
+			}
+
+			if percent > dynamic.AdvertisedFeePercent() {
+				t.Fatal("fee is higher than advertised", percent)
+			}
+
+			percent, err = proxyFeePercent(static, ch)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if percent != 0.5 || static.AdvertisedFeePercent() != 0.5 {
+				t.Fatal("static fee should not depend on liquidity", percent)
+			}
+		})
+	}
+}
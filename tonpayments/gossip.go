@@ -0,0 +1,478 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"math"
+	"math/big"
+	"time"
+)
+
+const (
+	gossipAnnounceInterval   = 30 * time.Minute
+	gossipAnnouncementTTL    = 3 * time.Hour
+	gossipChannelReverifyAge = 1 * time.Hour
+	gossipMaxItems           = 512
+	gossipMaxNodes           = 64
+	gossipMaxPolicies        = 64
+)
+
+func (s *Service) gossipLoop() {
+	if err := s.loadNetworkView(context.Background()); err != nil {
+		log.Error().Err(err).Msg("failed to load network view from db")
+	}
+
+	// give some time to connect to peers before first announcement
+	wait := 30 * time.Second
+	for {
+		select {
+		case <-s.globalCtx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait = gossipAnnounceInterval
+
+		if err := s.pruneNetworkView(context.Background()); err != nil {
+			log.Error().Err(err).Msg("failed to prune network view")
+		}
+
+		g, err := s.buildOurAnnouncements(context.Background())
+		if err != nil {
+			log.Error().Err(err).Msg("failed to build our announcements")
+			continue
+		}
+
+		s.broadcastGossip(g, nil)
+	}
+}
+
+func (s *Service) loadNetworkView(ctx context.Context) error {
+	nodes, err := s.db.ListNetworkNodes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	for _, node := range nodes {
+		s.applyNetworkNode(node)
+	}
+
+	channels, err := s.db.ListNetworkChannels(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list channels: %w", err)
+	}
+
+	for _, ch := range channels {
+		s.graph.UpdateChannel(networkChannelToGraph(ch))
+	}
+
+	log.Info().Int("nodes", len(nodes)).Int("channels", len(channels)).Msg("network view loaded")
+	return nil
+}
+
+func (s *Service) pruneNetworkView(ctx context.Context) error {
+	outdated := time.Now().Add(-gossipAnnouncementTTL)
+
+	nodes, err := s.db.ListNetworkNodes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	for _, node := range nodes {
+		if node.AnnouncedAt.After(outdated) {
+			continue
+		}
+
+		if err = s.db.RemoveNetworkNode(ctx, node.Key); err != nil {
+			return fmt.Errorf("failed to remove node: %w", err)
+		}
+		s.graph.RemoveNodePolicies(node.Key)
+	}
+
+	channels, err := s.db.ListNetworkChannels(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list channels: %w", err)
+	}
+
+	for _, ch := range channels {
+		if ch.AnnouncedAt.After(outdated) {
+			continue
+		}
+
+		if err = s.db.RemoveNetworkChannel(ctx, ch.Address); err != nil {
+			return fmt.Errorf("failed to remove channel: %w", err)
+		}
+		s.graph.RemoveChannel(ch.Address)
+	}
+
+	return nil
+}
+
+// buildOurAnnouncements - prepares signed announcements of our tunnelling policies and our onchain channels
+func (s *Service) buildOurAnnouncements(ctx context.Context) (transport.Gossip, error) {
+	now := time.Now().Unix()
+
+	var policies []transport.CoinPolicy
+	if s.supportedTon {
+		policies = append(policies, coinPolicyFromConfig(make([]byte, 32), 0, s.cfg.SupportedCoins.Ton))
+	}
+	for jetton, cc := range s.supportedJettons {
+		if !cc.Enabled {
+			continue
+		}
+
+		addr, err := address.ParseAddr(jetton)
+		if err != nil {
+			return transport.Gossip{}, fmt.Errorf("failed to parse jetton address: %w", err)
+		}
+		policies = append(policies, coinPolicyFromConfig(addr.Data(), 0, cc))
+	}
+	for id, cc := range s.supportedEC {
+		if !cc.Enabled {
+			continue
+		}
+		policies = append(policies, coinPolicyFromConfig(make([]byte, 32), id, cc))
+	}
+
+	node := transport.NodeAnnouncement{
+		Timestamp: now,
+		Policies:  policies,
+	}
+	if err := node.Sign(s.key); err != nil {
+		return transport.Gossip{}, fmt.Errorf("failed to sign node announcement: %w", err)
+	}
+
+	channels, err := s.db.GetChannels(ctx, nil, db.ChannelStateActive)
+	if err != nil {
+		return transport.Gossip{}, fmt.Errorf("failed to get active channels: %w", err)
+	}
+
+	g := transport.Gossip{
+		Nodes: []transport.NodeAnnouncement{node},
+	}
+	for _, ch := range channels {
+		if ch.WebPeer || !ch.ActiveOnchain {
+			// web peers cannot tunnel, no sense to announce
+			continue
+		}
+
+		ann := transport.ChannelAnnouncement{
+			ChannelAddr: address.MustParseAddr(ch.Address).Data(),
+			Timestamp:   now,
+		}
+		if err = ann.Sign(s.key); err != nil {
+			return transport.Gossip{}, fmt.Errorf("failed to sign channel announcement: %w", err)
+		}
+		g.Channels = append(g.Channels, ann)
+
+		if len(g.Channels) >= gossipMaxItems-1 {
+			break
+		}
+	}
+
+	return g, nil
+}
+
+// broadcastGossip - sends gossip to all our direct peers except the source
+func (s *Service) broadcastGossip(g transport.Gossip, except ed25519.PublicKey) {
+	if len(g.Nodes) == 0 && len(g.Channels) == 0 {
+		return
+	}
+
+	channels, err := s.db.GetChannels(context.Background(), nil, db.ChannelStateActive)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to get active channels to broadcast gossip")
+		return
+	}
+
+	sent := map[string]bool{}
+	for _, ch := range channels {
+		if ch.WebPeer || sent[string(ch.TheirOnchain.Key)] || bytes.Equal(ch.TheirOnchain.Key, except) {
+			continue
+		}
+		sent[string(ch.TheirOnchain.Key)] = true
+
+		go func(key ed25519.PublicKey) {
+			ctx, cancel := context.WithTimeout(s.globalCtx, 15*time.Second)
+			defer cancel()
+
+			if err := s.regularTransport.SendGossip(ctx, key, g); err != nil {
+				log.Debug().Err(err).Str("peer", base64.StdEncoding.EncodeToString(key)).Msg("failed to send gossip")
+			}
+		}(ch.TheirOnchain.Key)
+	}
+}
+
+func (s *Service) ProcessGossip(ctx context.Context, key ed25519.PublicKey, g transport.Gossip) error {
+	if isWeb {
+		return fmt.Errorf("gossip is not supported by web node")
+	}
+
+	if len(g.Nodes)+len(g.Channels) > gossipMaxItems || len(g.Nodes) > gossipMaxNodes {
+		return fmt.Errorf("too many announcements")
+	}
+
+	// only signatures are checked synchronously, onchain verification may take time
+	for _, n := range g.Nodes {
+		if len(n.Policies) > gossipMaxPolicies {
+			return fmt.Errorf("too many policies in node announcement")
+		}
+
+		if !n.Verify() {
+			return fmt.Errorf("incorrect node announcement signature")
+		}
+	}
+	for _, c := range g.Channels {
+		if !c.Verify() {
+			return fmt.Errorf("incorrect channel announcement signature")
+		}
+	}
+
+	go s.processGossip(append(ed25519.PublicKey{}, key...), g)
+	return nil
+}
+
+func (s *Service) processGossip(from ed25519.PublicKey, g transport.Gossip) {
+	ctx := s.globalCtx
+	ourKey := s.key.Public().(ed25519.PublicKey)
+	outdated, future := time.Now().Add(-gossipAnnouncementTTL).Unix(), time.Now().Add(time.Minute).Unix()
+
+	var relay transport.Gossip
+	// channels go first, node is accepted only when some of its channels is verified
+	for _, c := range g.Channels {
+		if c.Timestamp < outdated || c.Timestamp > future || bytes.Equal(c.Key, ourKey) {
+			continue
+		}
+
+		ok, err := s.storeChannelAnnouncement(ctx, c)
+		if err != nil {
+			log.Debug().Err(err).Str("channel", address.NewAddress(0, 0, c.ChannelAddr).String()).Msg("failed to process channel announcement")
+			continue
+		}
+
+		if ok {
+			relay.Channels = append(relay.Channels, c)
+		}
+	}
+
+	var known map[string]bool
+	for _, n := range g.Nodes {
+		if n.Timestamp < outdated || n.Timestamp > future || bytes.Equal(n.Key, ourKey) {
+			continue
+		}
+
+		if known == nil {
+			var err error
+			if known, err = s.nodesWithChannels(ctx); err != nil {
+				log.Warn().Err(err).Msg("failed to load known channels to process node announcements")
+				break
+			}
+		}
+
+		if !known[string(n.Key)] {
+			log.Debug().Str("node", base64.StdEncoding.EncodeToString(n.Key)).Msg("node announcement without verified channels skipped")
+			continue
+		}
+
+		ok, err := s.storeNodeAnnouncement(ctx, n)
+		if err != nil {
+			log.Warn().Err(err).Str("node", base64.StdEncoding.EncodeToString(n.Key)).Msg("failed to process node announcement")
+			continue
+		}
+
+		if ok {
+			relay.Nodes = append(relay.Nodes, n)
+		}
+	}
+
+	// relay only new information to not flood the network
+	s.broadcastGossip(relay, from)
+}
+
+// nodesWithChannels - keys of nodes which have onchain verified channels, announced or with us
+func (s *Service) nodesWithChannels(ctx context.Context) (map[string]bool, error) {
+	known := map[string]bool{}
+
+	channels, err := s.db.ListNetworkChannels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network channels: %w", err)
+	}
+	for _, ch := range channels {
+		known[string(ch.KeyA)] = true
+		known[string(ch.KeyB)] = true
+	}
+
+	our, err := s.db.GetChannels(ctx, nil, db.ChannelStateActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active channels: %w", err)
+	}
+	for _, ch := range our {
+		if ch.ActiveOnchain {
+			known[string(ch.TheirOnchain.Key)] = true
+		}
+	}
+	return known, nil
+}
+
+// storeNodeAnnouncement - saves node policies if announcement is newer than known, returns true if updated
+func (s *Service) storeNodeAnnouncement(ctx context.Context, n transport.NodeAnnouncement) (bool, error) {
+	at := time.Unix(n.Timestamp, 0)
+
+	node, err := s.db.GetNetworkNode(ctx, n.Key)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return false, fmt.Errorf("failed to get node: %w", err)
+	}
+
+	if node != nil && !node.AnnouncedAt.Before(at) {
+		return false, nil
+	}
+
+	node = &db.NetworkNode{
+		Key:         append(ed25519.PublicKey{}, n.Key...),
+		AnnouncedAt: at,
+		UpdatedAt:   time.Now(),
+	}
+
+	for _, p := range n.Policies {
+		fee := math.Float64frombits(p.ProxyPercentFeeFloat)
+		if math.IsNaN(fee) || math.IsInf(fee, 0) || fee < 0 {
+			return false, fmt.Errorf("invalid fee percent")
+		}
+
+		var jetton string
+		if !bytes.Equal(p.JettonAddr, make([]byte, 32)) {
+			jetton = address.NewAddress(0, 0, p.JettonAddr).String()
+		}
+
+		node.Policies = append(node.Policies, db.NetworkCoinPolicy{
+			JettonAddress:   jetton,
+			ExtraCurrencyID: p.ExtraCurrencyID,
+			AllowTunneling:  p.ProxyAllowed,
+			MinFee:          new(big.Int).SetBytes(p.ProxyMinFee),
+			MaxCapacity:     new(big.Int).SetBytes(p.ProxyMaxCap),
+			FeePercent:      fee,
+		})
+	}
+
+	if err = s.db.SetNetworkNode(ctx, node); err != nil {
+		return false, fmt.Errorf("failed to save node: %w", err)
+	}
+	s.applyNetworkNode(node)
+
+	return true, nil
+}
+
+// storeChannelAnnouncement - verifies channel onchain and saves it, returns true if announcement is new
+func (s *Service) storeChannelAnnouncement(ctx context.Context, c transport.ChannelAnnouncement) (bool, error) {
+	at := time.Unix(c.Timestamp, 0)
+	addr := address.NewAddress(0, 0, c.ChannelAddr)
+
+	ch, err := s.db.GetNetworkChannel(ctx, addr.String())
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return false, fmt.Errorf("failed to get channel: %w", err)
+	}
+
+	if ch != nil {
+		if !ch.AnnouncedAt.Before(at) {
+			return false, nil
+		}
+
+		if !bytes.Equal(ch.KeyA, c.Key) && !bytes.Equal(ch.KeyB, c.Key) {
+			return false, fmt.Errorf("announcer is not a party of the channel")
+		}
+	}
+
+	if ch == nil || time.Since(ch.VerifiedAt) > gossipChannelReverifyAge {
+		onchain, err := s.channelClient.GetAsyncChannel(ctx, addr, true)
+		if err != nil {
+			return false, fmt.Errorf("failed to get channel from chain: %w", err)
+		}
+
+		if onchain.Status != payments.ChannelStatusOpen {
+			if ch != nil {
+				if err = s.db.RemoveNetworkChannel(ctx, ch.Address); err != nil {
+					return false, fmt.Errorf("failed to remove channel: %w", err)
+				}
+				s.graph.RemoveChannel(ch.Address)
+			}
+			return false, fmt.Errorf("channel is not open")
+		}
+
+		if !bytes.Equal(onchain.Storage.KeyA, c.Key) && !bytes.Equal(onchain.Storage.KeyB, c.Key) {
+			return false, fmt.Errorf("announcer is not a party of the channel")
+		}
+
+		ch = &db.NetworkChannel{
+			Address:    addr.String(),
+			KeyA:       append(ed25519.PublicKey{}, onchain.Storage.KeyA...),
+			KeyB:       append(ed25519.PublicKey{}, onchain.Storage.KeyB...),
+			VerifiedAt: time.Now(),
+		}
+
+		switch cc := onchain.Storage.PaymentConfig.CurrencyConfig.(type) {
+		case payments.CurrencyConfigJetton:
+			ch.JettonAddress = cc.Info.Master.String()
+		case payments.CurrencyConfigEC:
+			ch.ExtraCurrencyID = cc.ID
+		}
+	}
+	ch.AnnouncedAt = at
+
+	if err = s.db.SetNetworkChannel(ctx, ch); err != nil {
+		return false, fmt.Errorf("failed to save channel: %w", err)
+	}
+	s.graph.UpdateChannel(networkChannelToGraph(ch))
+
+	return true, nil
+}
+
+func (s *Service) applyNetworkNode(node *db.NetworkNode) {
+	s.graph.RemoveNodePolicies(node.Key)
+	for _, p := range node.Policies {
+		policy := &NodeTunnelPolicy{
+			AllowTunneling: p.AllowTunneling,
+			MinFee:         p.MinFee,
+			FeePercent:     p.FeePercent,
+			UpdatedAt:      node.AnnouncedAt,
+		}
+		if p.AllowTunneling {
+			policy.MaxCapacity = p.MaxCapacity
+		}
+		s.graph.SetNodePolicy(node.Key, p.JettonAddress, p.ExtraCurrencyID, policy)
+	}
+}
+
+func networkChannelToGraph(ch *db.NetworkChannel) *GraphChannel {
+	return &GraphChannel{
+		Address:         ch.Address,
+		KeyA:            ch.KeyA,
+		KeyB:            ch.KeyB,
+		JettonAddress:   ch.JettonAddress,
+		ExtraCurrencyID: ch.ExtraCurrencyID,
+		UpdatedAt:       ch.AnnouncedAt,
+	}
+}
+
+func coinPolicyFromConfig(jettonAddr []byte, ecID uint32, cc config.CoinConfig) transport.CoinPolicy {
+	p := transport.CoinPolicy{
+		JettonAddr:      jettonAddr,
+		ExtraCurrencyID: ecID,
+		ProxyAllowed:    cc.VirtualTunnelConfig.AllowTunneling,
+	}
+
+	if p.ProxyAllowed {
+		p.ProxyMaxCap = cc.MustAmountDecimal(cc.VirtualTunnelConfig.ProxyMaxCapacity).Nano().Bytes()
+		p.ProxyMinFee = cc.MustAmountDecimal(cc.VirtualTunnelConfig.ProxyMinFee).Nano().Bytes()
+		p.ProxyPercentFeeFloat = math.Float64bits(cc.VirtualTunnelConfig.AdvertisedFeePercent())
+	}
+	return p
+}
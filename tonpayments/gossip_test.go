@@ -0,0 +1,78 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+func signedNodeAnnouncement(t *testing.T) transport.NodeAnnouncement {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ann := transport.NodeAnnouncement{Timestamp: time.Now().Unix()}
+	if err = ann.Sign(key); err != nil {
+		t.Fatal(err.Error())
+	}
+	return ann
+}
+
+func TestGossip_NodeRequiresVerifiedChannel(t *testing.T) {
+	n := newTestNetwork()
+	a := n.addNode(t, testConfig())
+
+	withChannel, withoutChannel := signedNodeAnnouncement(t), signedNodeAnnouncement(t)
+	if err := a.db.SetNetworkChannel(context.Background(), &db.NetworkChannel{
+		Address:     "EQAANEnaPXDkcZjhM1H4-B5gADRJ2j1w5HGY4TNR-PgeYHda",
+		KeyA:        withChannel.Key,
+		KeyB:        a.pub(),
+		AnnouncedAt: time.Now(),
+		VerifiedAt:  time.Now(),
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	a.svc.processGossip(nil, transport.Gossip{Nodes: []transport.NodeAnnouncement{withChannel, withoutChannel}})
+
+	if _, err := a.db.GetNetworkNode(context.Background(), withChannel.Key); err != nil {
+		t.Fatal("node with verified channel should be stored", err)
+	}
+	if _, err := a.db.GetNetworkNode(context.Background(), withoutChannel.Key); !errors.Is(err, db.ErrNotFound) {
+		t.Fatal("node without channels should be skipped", err)
+	}
+}
+
+func TestGossip_Limits(t *testing.T) {
+	n := newTestNetwork()
+	a := n.addNode(t, testConfig())
+
+	var g transport.Gossip
+	for i := 0; i <= gossipMaxNodes; i++ {
+		g.Nodes = append(g.Nodes, signedNodeAnnouncement(t))
+	}
+	if err := a.svc.ProcessGossip(context.Background(), nil, g); err == nil {
+		t.Fatal("too many node announcements should be rejected")
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ann := transport.NodeAnnouncement{
+		Timestamp: time.Now().Unix(),
+		Policies:  make([]transport.CoinPolicy, gossipMaxPolicies+1),
+	}
+	if err = ann.Sign(key); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = a.svc.ProcessGossip(context.Background(), nil, transport.Gossip{Nodes: []transport.NodeAnnouncement{ann}}); err == nil {
+		t.Fatal("too many policies should be rejected")
+	}
+}
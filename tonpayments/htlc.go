@@ -0,0 +1,106 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"math/big"
+	"time"
+)
+
+// OpenHashLockedChannel - opens virtual channel to target, which can be closed only for the full amount
+// and only by revealing preimage of the given sha256 hash. Until the deadline, whole chain is locked,
+// and the funds are returned to us after it when preimage was not revealed.
+func (s *Service) OpenHashLockedChannel(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount *big.Int, hash []byte, ttl time.Duration) (ed25519.PublicKey, error) {
+	_, vPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	if err = s.openHashLockedChannel(ctx, vPriv, target, jettonAddr, ecID, amount, hash, ttl); err != nil {
+		return nil, err
+	}
+	return vPriv.Public().(ed25519.PublicKey), nil
+}
+
+// openHashLockedChannel - opens hash-locked channel with the given virtual key,
+// opening with the same key again is ignored, so it can be safely retried.
+func (s *Service) openHashLockedChannel(ctx context.Context, vPriv ed25519.PrivateKey, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount *big.Int, hash []byte, ttl time.Duration, payloads ...any) error {
+	if len(hash) != 32 {
+		return fmt.Errorf("hash should be 32 bytes")
+	}
+
+	if amount.Sign() <= 0 {
+		return fmt.Errorf("amount should be positive")
+	}
+
+	var jettonMaster *address.Address
+	if jettonAddr != "" {
+		var err error
+		jettonMaster, err = address.ParseAddr(jettonAddr)
+		if err != nil {
+			return fmt.Errorf("failed to parse jetton address: %w", err)
+		}
+		jettonAddr = jettonMaster.Bounce(true).String()
+	}
+
+	chain, err := s.BuildRouteTunnelChain(ctx, target, jettonAddr, ecID, amount, ttl)
+	if err != nil {
+		return fmt.Errorf("failed to build route: %w", err)
+	}
+
+	vc, firstInstructionKey, tun, err := transport.GenerateTunnel(vPriv, chain, 5, false, s.key, payloads...)
+	if err != nil {
+		return fmt.Errorf("failed to generate tunnel: %w", err)
+	}
+	vc.HashLock = append([]byte{}, hash...)
+
+	if err = s.OpenVirtualChannel(ctx, chain[0].Target, firstInstructionKey, target, vPriv, tun, vc, jettonMaster, ecID); err != nil {
+		return fmt.Errorf("failed to open virtual channel: %w", err)
+	}
+
+	log.Info().Str("key", base64.StdEncoding.EncodeToString(vc.Key)).
+		Str("amount", amount.String()).
+		Str("hash", base64.StdEncoding.EncodeToString(hash)).
+		Msg("hash-locked virtual channel opening started")
+
+	return nil
+}
+
+// ResolveHashLockedChannel - reveals preimage of incoming hash-locked virtual channel and closes it,
+// preimage is passed back through the chain, so each node can unlock its incoming channel.
+func (s *Service) ResolveHashLockedChannel(ctx context.Context, key ed25519.PublicKey, preimage []byte) error {
+	meta, err := s.db.GetVirtualChannelMeta(ctx, key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("virtual channel is not exists")
+		}
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	if meta.Incoming == nil || meta.Outgoing != nil {
+		return fmt.Errorf("virtual channel is not incoming to us")
+	}
+
+	if meta.HashLock == nil {
+		return fmt.Errorf("virtual channel is not hash-locked")
+	}
+
+	if err = s.AddVirtualChannelPreimage(ctx, key, preimage); err != nil {
+		return err
+	}
+
+	if err = s.CloseVirtualChannel(ctx, key); err != nil {
+		return fmt.Errorf("failed to close virtual channel: %w", err)
+	}
+
+	log.Info().Str("key", base64.StdEncoding.EncodeToString(key)).Msg("hash-locked virtual channel resolved")
+
+	return nil
+}
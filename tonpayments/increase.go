@@ -0,0 +1,281 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"math/big"
+	"time"
+)
+
+// IncreaseVirtualChannel - adds capacity to virtual channel opened by us, key and already sent states stay valid.
+// Increase is passed hop by hop along the chain, fee is paid to the first node,
+// each node takes its percent from the added capacity and passes the rest further. Our side is raised only when
+// the final receiver confirms the increase, new request replaces the pending one.
+func (s *Service) IncreaseVirtualChannel(ctx context.Context, key ed25519.PublicKey, capacity, fee *big.Int) error {
+	if capacity.Sign() <= 0 {
+		return fmt.Errorf("capacity to add should be positive")
+	}
+
+	if fee.Sign() < 0 {
+		return fmt.Errorf("fee cannot be negative")
+	}
+
+	meta, err := s.db.GetVirtualChannelMeta(ctx, key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("virtual channel is not exists")
+		}
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	if meta.Incoming != nil || meta.Outgoing == nil {
+		return fmt.Errorf("virtual channel is not opened by us")
+	}
+
+	if meta.Status != db.VirtualChannelStateActive {
+		return fmt.Errorf("virtual channel is not active")
+	}
+
+	ch, err := s.db.GetChannel(ctx, meta.Outgoing.ChannelAddress)
+	if err != nil {
+		return fmt.Errorf("failed to get outgoing channel: %w", err)
+	}
+
+	_, vch, err := payments.FindVirtualChannel(ch.Our.Conditionals, key)
+	if err != nil {
+		return fmt.Errorf("failed to find virtual channel: %w", err)
+	}
+
+	newCap := new(big.Int).Add(vch.Capacity, capacity)
+	newFee := new(big.Int).Add(vch.Fee, fee)
+
+	balance, _, err := ch.CalcBalance(false)
+	if err != nil {
+		return fmt.Errorf("failed to calc channel balance: %w", err)
+	}
+
+	if balance.Cmp(new(big.Int).Add(capacity, fee)) < 0 {
+		return fmt.Errorf("not enough available balance in channel")
+	}
+
+	id := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return fmt.Errorf("failed to generate increase id: %w", err)
+	}
+
+	tryTill := meta.Outgoing.SafeDeadline
+	err = s.db.Transaction(ctx, func(ctx context.Context) error {
+		meta.PendingUpdate = &db.VirtualChannelUpdate{
+			ID:        id,
+			Capacity:  newCap.String(),
+			Fee:       newFee.String(),
+			CreatedAt: time.Now(),
+		}
+		meta.UpdateFailReason = ""
+		meta.UpdatedAt = time.Now()
+		if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+			return fmt.Errorf("failed to update virtual channel meta: %w", err)
+		}
+
+		if err = s.db.CreateTask(ctx, PaymentsTaskPool, "increase-virtual", ch.Address,
+			"increase-virtual-"+base64.StdEncoding.EncodeToString(key)+"-"+newCap.String(),
+			db.IncreaseVirtualTask{
+				ChannelAddress: ch.Address,
+				VirtualKey:     key,
+				ID:             id,
+				Capacity:       newCap.String(),
+				Fee:            newFee.String(),
+			}, nil, &tryTill,
+		); err != nil {
+			return fmt.Errorf("failed to create increase task: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.touchWorker()
+
+	return nil
+}
+
+func (s *Service) executeIncreaseVirtual(ctx context.Context, data *db.IncreaseVirtualTask) error {
+	channel, lockId, unlock, err := s.AcquireChannel(ctx, data.ChannelAddress)
+	if err != nil {
+		return fmt.Errorf("failed to acquire channel: %w", err)
+	}
+	defer unlock()
+
+	if channel.Status != db.ChannelStateActive {
+		// not needed anymore
+		return nil
+	}
+
+	capacity, ok := new(big.Int).SetString(data.Capacity, 10)
+	if !ok {
+		return fmt.Errorf("incorrect capacity")
+	}
+
+	fee, ok := new(big.Int).SetString(data.Fee, 10)
+	if !ok {
+		return fmt.Errorf("incorrect fee")
+	}
+
+	if err = s.proposeAction(ctx, lockId, data.ChannelAddress, transport.IncreaseVirtualAction{
+		Key:      data.VirtualKey,
+		ID:       data.ID,
+		Capacity: capacity.Bytes(),
+		Fee:      fee.Bytes(),
+	}, nil); err != nil {
+		if errors.Is(err, ErrDenied) || errors.Is(err, ErrNotPossible) {
+			// our incoming side, if any, is already increased,
+			// next node cannot receive more than before, so it is safe for us
+			log.Warn().Err(err).Str("key", base64.StdEncoding.EncodeToString(data.VirtualKey)).
+				Msg("virtual channel capacity increase was not accepted by the next node")
+
+			code := transport.FailureCodeNotPossible
+			if errors.Is(err, ErrDenied) {
+				code = transport.FailureCodeDenied
+			}
+			return s.failVirtualUpdate(ctx, data.VirtualKey, data.ID, code, err.Error())
+		}
+		return fmt.Errorf("failed to propose increase virtual action: %w", err)
+	}
+	return nil
+}
+
+// onOutgoingVirtualIncreased - updates our side after the next node has accepted increase,
+// when we are the sender, it is updated later, when the final receiver confirms increase
+func (s *Service) onOutgoingVirtualIncreased(ctx context.Context, channel *db.Channel, vch *payments.VirtualChannel) error {
+	meta, err := s.db.GetVirtualChannelMeta(ctx, vch.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	if meta.Outgoing == nil || meta.Incoming == nil {
+		return nil
+	}
+
+	cc, err := s.ResolveCoinConfig(channel.JettonAddress, channel.ExtraCurrencyID, false)
+	if err != nil {
+		return fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	meta.Outgoing.Capacity = cc.MustAmount(vch.Capacity).String()
+	meta.Outgoing.Fee = cc.MustAmount(vch.Fee).String()
+	meta.UpdatedAt = time.Now()
+	if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+		return fmt.Errorf("failed to update virtual channel meta: %w", err)
+	}
+	return nil
+}
+
+// applyVirtualIncrease - raises our side as the sender, when increase is confirmed by the final receiver,
+// meta is saved by the caller
+func (s *Service) applyVirtualIncrease(ctx context.Context, meta *db.VirtualChannelMeta, capacity, fee *big.Int) error {
+	channel, err := s.db.GetChannel(ctx, meta.Outgoing.ChannelAddress)
+	if err != nil {
+		return fmt.Errorf("failed to get outgoing channel: %w", err)
+	}
+
+	cc, err := s.ResolveCoinConfig(channel.JettonAddress, channel.ExtraCurrencyID, false)
+	if err != nil {
+		return fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	meta.Outgoing.Capacity = cc.MustAmount(capacity).String()
+	meta.Outgoing.Fee = cc.MustAmount(fee).String()
+
+	tr, err := s.db.GetTransfer(ctx, meta.Key)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("failed to get transfer: %w", err)
+	}
+
+	if tr != nil {
+		tr.Capacity = capacity
+		tr.Fee = fee
+		tr.UpdatedAt = time.Now()
+		if err = s.db.UpdateTransfer(ctx, tr); err != nil {
+			return fmt.Errorf("failed to update transfer: %w", err)
+		}
+	}
+
+	return s.increaseStreamSession(ctx, meta.Key, capacity)
+}
+
+// onIncomingVirtualIncreased - updates our side after the previous node has increased the channel,
+// and passes the increase to the next node, when channel is tunnelled through us, or confirms it to the sender
+func (s *Service) onIncomingVirtualIncreased(ctx context.Context, channel *db.Channel, meta *db.VirtualChannelMeta, vch *payments.VirtualChannel, id []byte, nextCap, nextFee *big.Int) error {
+	cc, err := s.ResolveCoinConfig(channel.JettonAddress, channel.ExtraCurrencyID, false)
+	if err != nil {
+		return fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	meta.Incoming.Capacity = cc.MustAmount(vch.Capacity).String()
+	meta.Incoming.Fee = cc.MustAmount(vch.Fee).String()
+	meta.UpdatedAt = time.Now()
+	if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+		return fmt.Errorf("failed to update virtual channel meta: %w", err)
+	}
+
+	if meta.Outgoing != nil {
+		tryTill := meta.Outgoing.SafeDeadline
+		if err = s.db.CreateTask(ctx, PaymentsTaskPool, "increase-virtual", meta.Outgoing.ChannelAddress,
+			"increase-virtual-"+base64.StdEncoding.EncodeToString(vch.Key)+"-"+nextCap.String(),
+			db.IncreaseVirtualTask{
+				ChannelAddress: meta.Outgoing.ChannelAddress,
+				VirtualKey:     vch.Key,
+				ID:             id,
+				Capacity:       nextCap.String(),
+				Fee:            nextFee.String(),
+			}, nil, &tryTill,
+		); err != nil {
+			return fmt.Errorf("failed to create increase-virtual task: %w", err)
+		}
+	} else {
+		if err = s.increaseStreamSession(ctx, vch.Key, vch.Capacity); err != nil {
+			return err
+		}
+
+		if err = s.reportVirtualUpdate(ctx, meta, id, transport.FailureCodeAccepted, ""); err != nil {
+			return err
+		}
+	}
+
+	log.Info().Str("key", base64.StdEncoding.EncodeToString(vch.Key)).
+		Str("capacity", cc.MustAmount(vch.Capacity).String()).
+		Str("fee", cc.MustAmount(vch.Fee).String()).
+		Msg("virtual channel capacity increased")
+
+	return nil
+}
+
+// increaseStreamSession - updates capacity of stream session over the increased virtual channel
+func (s *Service) increaseStreamSession(ctx context.Context, key []byte, capacity *big.Int) error {
+	session, err := s.db.GetStreamSession(ctx, key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load stream session: %w", err)
+	}
+
+	if session.Status != db.StreamSessionStatusActive {
+		return nil
+	}
+
+	session.Capacity = capacity
+	session.UpdatedAt = time.Now()
+	if err = s.db.UpdateStreamSession(ctx, session); err != nil {
+		return fmt.Errorf("failed to update stream session: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+func TestIncreaseVirtual_ConfirmedByReceiver(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	n.connect(t, a, b, "10", "0")
+	bc := n.connect(t, b, c, "10", "0")
+
+	key := openVirtual(t, "1", nil, a, b, c).Public().(ed25519.PublicKey)
+	last := outgoingVirtual(t, b, bc, key)
+
+	if err := a.svc.IncreaseVirtualChannel(context.Background(), key, mustNano(t, "1"), mustNano(t, "0.01")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	meta := waitUpdateFinished(t, a, key)
+	if meta.UpdateFailReason != "" {
+		t.Fatal("increase should be confirmed", meta.UpdateFailReason)
+	}
+	if meta.Outgoing.Capacity != "2" {
+		t.Fatal("sender capacity is not increased", meta.Outgoing.Capacity)
+	}
+	if got := outgoingVirtual(t, b, bc, key); got.Capacity.Cmp(new(big.Int).Add(last.Capacity, mustNano(t, "1"))) != 0 {
+		t.Fatal("capacity with receiver is not increased", got.Capacity.String())
+	}
+}
+
+func TestIncreaseVirtual_PartialNotApplied(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	ab := n.connect(t, a, b, "10", "0")
+	bc := n.connect(t, b, c, "10", "0")
+
+	key := openVirtual(t, "1", nil, a, b, c).Public().(ed25519.PublicKey)
+	first, last := outgoingVirtual(t, a, ab, key), outgoingVirtual(t, b, bc, key)
+
+	c.svc.SetDrainMode(true)
+	if err := a.svc.IncreaseVirtualChannel(context.Background(), key, mustNano(t, "1"), mustNano(t, "0.01")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	meta := waitUpdateFinished(t, a, key)
+	if !strings.Contains(meta.UpdateFailReason, "node 1") || !strings.Contains(meta.UpdateFailReason, ErrDraining.Error()) {
+		t.Fatal("rejection by the receiver should be reported", meta.UpdateFailReason)
+	}
+	if meta.Outgoing.Capacity != "1" {
+		t.Fatal("sender capacity should not be changed", meta.Outgoing.Capacity)
+	}
+
+	// first hop has accepted it, but the receiver has not
+	if got := outgoingVirtual(t, a, ab, key); got.Capacity.Cmp(first.Capacity) <= 0 {
+		t.Fatal("first hop should be increased")
+	}
+	if got := outgoingVirtual(t, b, bc, key); got.Capacity.Cmp(last.Capacity) != 0 {
+		t.Fatal("capacity with receiver should not be changed")
+	}
+}
+
+func TestIncreaseVirtual_RejectedByFirstHop(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	ab := n.connect(t, a, b, "10", "0")
+	n.connect(t, b, c, "10", "0")
+
+	key := openVirtual(t, "1", nil, a, b, c).Public().(ed25519.PublicKey)
+	first := outgoingVirtual(t, a, ab, key)
+
+	// proxy fee for the added capacity is not paid
+	if err := a.svc.IncreaseVirtualChannel(context.Background(), key, mustNano(t, "1"), big.NewInt(0)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	meta := waitUpdateFinished(t, a, key)
+	if !strings.Contains(meta.UpdateFailReason, "min fee to increase capacity") {
+		t.Fatal("rejection reason should be kept", meta.UpdateFailReason)
+	}
+	if got := outgoingVirtual(t, a, ab, key); got.Capacity.Cmp(first.Capacity) != 0 {
+		t.Fatal("capacity should not be changed")
+	}
+}
+
+func TestIncreaseVirtual_ProcessAction(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	ab := n.connect(t, a, b, "10", "0")
+	n.connect(t, b, c, "10", "0")
+
+	key := openVirtual(t, "1", nil, a, b, c).Public().(ed25519.PublicKey)
+	vch := outgoingVirtual(t, a, ab, key)
+
+	err := propose(t, a, ab, transport.IncreaseVirtualAction{
+		Key:      key,
+		ID:       make([]byte, 32),
+		Capacity: new(big.Int).Add(vch.Capacity, mustNano(t, "1")).Bytes(),
+		Fee:      vch.Fee.Bytes(),
+	})
+	if !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "min fee to increase capacity") {
+		t.Fatal("increase without proxy fee should be rejected", err)
+	}
+
+	if err = propose(t, a, ab, transport.IncreaseVirtualAction{
+		Key:      key,
+		ID:       make([]byte, 32),
+		Capacity: new(big.Int).Add(vch.Capacity, mustNano(t, "1")).Bytes(),
+		Fee:      new(big.Int).Add(vch.Fee, mustNano(t, "0.01")).Bytes(),
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	waitFor(t, 5*time.Second, "receiver increase", func() bool {
+		meta, err := c.db.GetVirtualChannelMeta(context.Background(), key)
+		return err == nil && meta.Incoming.Capacity == "2"
+	})
+
+	// confirmation of the update which was not requested by the sender is ignored
+	waitFor(t, 5*time.Second, "confirmation delivery", func() bool {
+		tasks, err := b.db.ListActiveTasks(context.Background(), PaymentsTaskPool)
+		return err == nil && len(tasks) == 0
+	})
+	meta, err := a.db.GetVirtualChannelMeta(context.Background(), key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if meta.Outgoing.Capacity != "1" || meta.UpdateFailReason != "" {
+		t.Fatal("sender side should not be changed by unknown result", meta.Outgoing.Capacity)
+	}
+}
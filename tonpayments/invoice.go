@@ -0,0 +1,174 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/invoice"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"math/big"
+	"time"
+)
+
+// CreateInvoice - issues payment request signed by our key, zero amount means any amount
+func (s *Service) CreateInvoice(ctx context.Context, jettonAddr string, ecID uint32, amount *big.Int, memo string, ttl time.Duration, hints []invoice.RouteHint) (*db.Invoice, error) {
+	var jettonMaster *address.Address
+	if jettonAddr != "" {
+		var err error
+		jettonMaster, err = address.ParseAddr(jettonAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse jetton address: %w", err)
+		}
+	}
+
+	if _, err := s.ResolveCoinConfig(jettonAddr, ecID, true); err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	inv, err := invoice.New(s.key, jettonMaster, ecID, amount, memo, ttl, hints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create invoice: %w", err)
+	}
+
+	res := &db.Invoice{
+		ID:              inv.ID,
+		Data:            inv.String(),
+		JettonAddress:   jettonAddr,
+		ExtraCurrencyID: ecID,
+		Amount:          amount,
+		Memo:            memo,
+		Status:          db.InvoiceStatusPending,
+		ExpiresAt:       inv.ExpiresAtTime(),
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	if err = s.db.CreateInvoice(ctx, res); err != nil {
+		return nil, fmt.Errorf("failed to save invoice: %w", err)
+	}
+	return res, nil
+}
+
+func (s *Service) GetInvoice(ctx context.Context, id []byte) (*db.Invoice, error) {
+	return s.db.GetInvoice(ctx, id)
+}
+
+// PayInvoice - sends payment for invoice issued by other node, amount is used only when invoice has no amount
+func (s *Service) PayInvoice(ctx context.Context, data string, amount, maxFee *big.Int, ttl, timeout time.Duration) (*db.Payment, error) {
+	inv, err := invoice.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect invoice: %w", err)
+	}
+
+	if inv.IsExpired() {
+		return nil, invoice.ErrExpired
+	}
+
+	if bytes.Equal(inv.Receiver, s.key.Public().(ed25519.PublicKey)) {
+		return nil, fmt.Errorf("invoice is issued by us")
+	}
+
+	if invAmount := inv.AmountValue(); invAmount.Sign() > 0 {
+		amount = invAmount
+	} else if amount == nil || amount.Sign() <= 0 {
+		return nil, fmt.Errorf("invoice has no amount, it should be specified")
+	}
+
+	var jettonAddr string
+	if jetton := inv.JettonAddress(); jetton != nil {
+		jettonAddr = jetton.String()
+	}
+
+	// hints are added to graph as known channels, so route can be found through them
+	for _, hint := range inv.RouteHints {
+		nodes := append(append([][]byte{}, hint.Nodes...), inv.Receiver)
+		for i := 0; i < len(nodes)-1; i++ {
+			s.graph.UpdateChannel(&GraphChannel{
+				Address:         "hint:" + base64.StdEncoding.EncodeToString(nodes[i]) + base64.StdEncoding.EncodeToString(nodes[i+1]),
+				KeyA:            nodes[i],
+				KeyB:            nodes[i+1],
+				JettonAddress:   jettonAddr,
+				ExtraCurrencyID: inv.ExtraCurrencyID,
+				UpdatedAt:       time.Now(),
+			})
+		}
+	}
+
+	if till := inv.ExpiresAtTime(); time.Now().Add(timeout).After(till) {
+		// no sense to retry after invoice expiration
+		timeout = time.Until(till)
+	}
+
+	return s.sendPayment(ctx, inv.Receiver, jettonAddr, inv.ExtraCurrencyID, amount, maxFee, ttl, timeout, inv.ID)
+}
+
+// checkIncomingInvoicePayment - verifies that virtual channel can pay our invoice
+func (s *Service) checkIncomingInvoicePayment(ctx context.Context, payload *transport.InvoicePayload, channel *db.Channel, amount *big.Int) error {
+	inv, err := s.db.GetInvoice(ctx, payload.InvoiceID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("invoice is not found")
+		}
+		return fmt.Errorf("failed to get invoice: %w", err)
+	}
+
+	if inv.Status != db.InvoiceStatusPending {
+		return fmt.Errorf("invoice is already paid")
+	}
+
+	if time.Now().After(inv.ExpiresAt) {
+		return invoice.ErrExpired
+	}
+
+	if inv.JettonAddress != channel.JettonAddress || inv.ExtraCurrencyID != channel.ExtraCurrencyID {
+		return fmt.Errorf("currency is not matching invoice")
+	}
+
+	if amount.Cmp(inv.Amount) < 0 {
+		return fmt.Errorf("amount is less than invoice amount")
+	}
+	return nil
+}
+
+// markInvoicePaid - called from action processing transaction, when virtual channel with invoice payload is accepted
+func (s *Service) markInvoicePaid(ctx context.Context, payload *transport.InvoicePayload, payer, virtualKey ed25519.PublicKey, amount *big.Int) error {
+	inv, err := s.db.GetInvoice(ctx, payload.InvoiceID)
+	if err != nil {
+		return fmt.Errorf("failed to get invoice: %w", err)
+	}
+
+	if inv.Status != db.InvoiceStatusPending {
+		log.Warn().Str("invoice", base64.StdEncoding.EncodeToString(inv.ID)).
+			Str("key", base64.StdEncoding.EncodeToString(virtualKey)).
+			Msg("invoice is already paid, but one more payment is received")
+		return nil
+	}
+
+	now := time.Now()
+	inv.Status = db.InvoiceStatusPaid
+	inv.VirtualKey = virtualKey
+	inv.PaidAmount = amount
+	inv.Payer = payer
+	inv.PaidAt = &now
+	inv.UpdatedAt = now
+	if err = s.db.UpdateInvoice(ctx, inv); err != nil {
+		return fmt.Errorf("failed to update invoice: %w", err)
+	}
+
+	if s.webhook != nil {
+		if err = s.webhook.PushInvoiceEvent(ctx, inv); err != nil {
+			return fmt.Errorf("failed to push invoice event: %w", err)
+		}
+	}
+
+	log.Info().Str("invoice", base64.StdEncoding.EncodeToString(inv.ID)).
+		Str("key", base64.StdEncoding.EncodeToString(virtualKey)).
+		Msg("invoice paid")
+	return nil
+}
@@ -13,6 +13,7 @@ var (
 	ActiveVirtualChannelsCapacity *prometheus.GaugeVec
 	ActiveVirtualChannelsFee      *prometheus.GaugeVec
 	QueuedTasks                   *prometheus.GaugeVec
+	ProxyFeePercent               *prometheus.GaugeVec
 )
 
 var Registered = false
@@ -83,10 +84,21 @@ func RegisterMetrics(namespace string) {
 		[]string{"job_type", "in_retry", "execute_later"},
 	)
 
+	ProxyFeePercent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "proxy_fee_percent",
+			Namespace: namespace,
+			Subsystem: "payments",
+			Help:      "Effective fee percent for tunnelling through our channel.",
+		},
+		[]string{"channel", "coin"},
+	)
+
 	prometheus.MustRegister(ChannelBalance)
 	prometheus.MustRegister(ActiveVirtualChannels)
 	prometheus.MustRegister(QueuedTasks)
 	prometheus.MustRegister(ActiveVirtualChannelsCapacity)
 	prometheus.MustRegister(ActiveVirtualChannelsFee)
 	prometheus.MustRegister(WalletBalance)
+	prometheus.MustRegister(ProxyFeePercent)
 }
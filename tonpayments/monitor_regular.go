@@ -110,6 +110,9 @@ func (s *Service) channelsMonitor() {
 			continue
 		}
 
+		// to not keep closed channels
+		metrics.ProxyFeePercent.Reset()
+
 	next:
 		for _, channel := range list {
 			coinConfig, err := s.ResolveCoinConfig(channel.JettonAddress, channel.ExtraCurrencyID, false)
@@ -118,6 +121,10 @@ func (s *Service) channelsMonitor() {
 				continue next
 			}
 
+			if percent, _, err := s.GetChannelProxyFee(channel); err == nil {
+				metrics.ProxyFeePercent.WithLabelValues(channel.Address, coinConfig.Symbol).Set(percent)
+			}
+
 			channelName := "other"
 			s.urgentPeersMx.RLock()
 			key := base64.StdEncoding.EncodeToString(channel.TheirOnchain.Key)
@@ -0,0 +1,632 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+	"math/big"
+	"time"
+)
+
+const maxPaymentParts = 16
+
+// maxRouteSearches - how many times we try to find cheaper route, when found one is out of fee budget
+const maxRouteSearches = 8
+
+// SendMultipathPayment - splits amount to several parts and sends each part by separate virtual channel,
+// using different routes when possible. Receiver accepts parts only when all of them are arrived.
+func (s *Service) SendMultipathPayment(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount *big.Int, parts int, ttl time.Duration) (*db.Payment, error) {
+	if parts < 1 || parts > maxPaymentParts {
+		return nil, fmt.Errorf("parts number should be in range 1-%d", maxPaymentParts)
+	}
+
+	if amount.Sign() <= 0 || amount.Cmp(big.NewInt(int64(parts))) < 0 {
+		return nil, fmt.Errorf("amount is too small to split")
+	}
+
+	var jettonMaster *address.Address
+	if jettonAddr != "" {
+		var err error
+		jettonMaster, err = address.ParseAddr(jettonAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse jetton address: %w", err)
+		}
+	}
+
+	if _, err := s.ResolveCoinConfig(jettonAddr, ecID, true); err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate payment id: %w", err)
+	}
+
+	payment := &db.Payment{
+		ID:              id,
+		Counterparty:    target,
+		JettonAddress:   jettonAddr,
+		ExtraCurrencyID: ecID,
+		Amount:          amount,
+		Status:          db.PaymentStatusPending,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	payload := transport.PaymentPartPayload{
+		PaymentID:   id,
+		TotalAmount: amount.Bytes(),
+	}
+
+	partAmount := new(big.Int).Div(amount, big.NewInt(int64(parts)))
+	firstPartAmount := new(big.Int).Add(partAmount, new(big.Int).Mod(amount, big.NewInt(int64(parts))))
+
+	type preparedPart struct {
+		chain []transport.TunnelChainPart
+		key   ed25519.PrivateKey
+	}
+
+	// we build all routes before sending, to not send anything if payment cannot be fully delivered
+	restrictions := &routeRestrictions{reserved: map[string]*big.Int{}}
+	prepared := make([]preparedPart, 0, parts)
+	for i := 0; i < parts; i++ {
+		amt := partAmount
+		if i == 0 {
+			amt = firstPartAmount
+		}
+
+		chain, err := s.buildRouteTunnelChain(ctx, target, jettonAddr, ecID, amt, ttl, restrictions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build route for part %d: %w", i, err)
+		}
+
+		firstHop := string(chain[0].Target)
+		if restrictions.reserved[firstHop] == nil {
+			restrictions.reserved[firstHop] = big.NewInt(0)
+		}
+		restrictions.reserved[firstHop].Add(restrictions.reserved[firstHop], new(big.Int).Add(amt, chain[0].Fee))
+
+		_, vPriv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+
+		prepared = append(prepared, preparedPart{chain: chain, key: vPriv})
+		payment.Parts = append(payment.Parts, &db.PaymentPart{
+			VirtualKey: vPriv.Public().(ed25519.PublicKey),
+			Amount:     amt,
+			Fee:        chain[0].Fee,
+			Deadline:   chain[0].Deadline,
+			Status:     db.PaymentStatusPending,
+		})
+	}
+
+	if err := s.db.CreatePayment(ctx, payment); err != nil {
+		return nil, fmt.Errorf("failed to save payment: %w", err)
+	}
+
+	for i, part := range prepared {
+		vc, firstInstructionKey, tun, err := transport.GenerateTunnel(part.key, part.chain, 5, true, s.key, payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate tunnel for part %d: %w", i, err)
+		}
+
+		if err = s.OpenVirtualChannel(ctx, part.chain[0].Target, firstInstructionKey, target, part.key, tun, vc, jettonMaster, ecID); err != nil {
+			// already sent parts will be removed by timeout, because receiver will not get full amount
+			payment.Status = db.PaymentStatusFailed
+			payment.UpdatedAt = time.Now()
+			if err := s.db.UpdatePayment(ctx, payment); err != nil {
+				log.Error().Err(err).Str("payment", base64.StdEncoding.EncodeToString(id)).Msg("failed to update payment")
+			}
+			return nil, fmt.Errorf("failed to open virtual channel for part %d: %w", i, err)
+		}
+	}
+
+	log.Info().Str("payment", base64.StdEncoding.EncodeToString(id)).
+		Int("parts", parts).
+		Str("target", base64.StdEncoding.EncodeToString(target)).
+		Msg("multipath payment started")
+
+	return payment, nil
+}
+
+// SendPayment - sends amount to target using single virtual channel, when some node on the route rejects it,
+// payment is retried over alternative route without this node, till it fits fee and time budget.
+// Zero maxFee means no fee limit.
+func (s *Service) SendPayment(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount, maxFee *big.Int, ttl, timeout time.Duration) (*db.Payment, error) {
+	return s.sendPayment(ctx, target, jettonAddr, ecID, amount, maxFee, ttl, timeout, nil)
+}
+
+func (s *Service) sendPayment(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount, maxFee *big.Int, ttl, timeout time.Duration, invoiceID []byte) (*db.Payment, error) {
+	if amount.Sign() <= 0 {
+		return nil, fmt.Errorf("amount should be positive")
+	}
+
+	if maxFee != nil && maxFee.Sign() < 0 {
+		return nil, fmt.Errorf("max fee should not be negative")
+	}
+
+	if timeout <= 0 {
+		return nil, fmt.Errorf("timeout should be positive")
+	}
+
+	if jettonAddr != "" {
+		if _, err := address.ParseAddr(jettonAddr); err != nil {
+			return nil, fmt.Errorf("failed to parse jetton address: %w", err)
+		}
+	}
+
+	if _, err := s.ResolveCoinConfig(jettonAddr, ecID, true); err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate payment id: %w", err)
+	}
+
+	payment := &db.Payment{
+		ID:              id,
+		Counterparty:    target,
+		JettonAddress:   jettonAddr,
+		ExtraCurrencyID: ecID,
+		Amount:          amount,
+		Status:          db.PaymentStatusPending,
+		MaxFee:          maxFee,
+		RetryTill:       time.Now().Add(timeout),
+		TTL:             ttl,
+		InvoiceID:       invoiceID,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	// first route is built synchronously, to return error immediately when there is no route at all
+	if _, err := s.buildPaymentRoute(ctx, payment); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Transaction(ctx, func(ctx context.Context) error {
+		if err := s.db.CreatePayment(ctx, payment); err != nil {
+			return fmt.Errorf("failed to save payment: %w", err)
+		}
+
+		strId := base64.StdEncoding.EncodeToString(id)
+		if err := s.db.CreateTask(ctx, PaymentsTaskPool, "payment-attempt", "payment-"+strId,
+			"payment-attempt-"+strId,
+			db.PaymentAttemptTask{
+				PaymentID: id,
+			}, nil, nil,
+		); err != nil {
+			return fmt.Errorf("failed to create payment-attempt task: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	s.touchWorker()
+
+	log.Info().Str("payment", base64.StdEncoding.EncodeToString(id)).
+		Str("target", base64.StdEncoding.EncodeToString(target)).
+		Msg("payment started")
+
+	return payment, nil
+}
+
+// buildPaymentRoute - finds route which is not using nodes failed in previous attempts and fits fee budget
+func (s *Service) buildPaymentRoute(ctx context.Context, payment *db.Payment) ([]transport.TunnelChainPart, error) {
+	restrictions := &routeRestrictions{
+		excludeNodes: map[string]bool{},
+	}
+
+	for _, a := range payment.Attempts {
+		if a.Status != db.PaymentStatusFailed {
+			continue
+		}
+
+		if a.FailedHop != nil {
+			restrictions.excludeNodes[string(a.FailedHop)] = true
+			continue
+		}
+
+		// we don't know exactly who has failed, so we exclude all intermediate nodes,
+		// except our direct peer, which has accepted channel from us
+		intermediate := a.Route[:len(a.Route)-1]
+		if len(intermediate) > 1 {
+			intermediate = intermediate[1:]
+		}
+		for _, key := range intermediate {
+			restrictions.excludeNodes[string(key)] = true
+		}
+	}
+
+	for i := 0; i < maxRouteSearches; i++ {
+		chain, err := s.buildRouteTunnelChain(ctx, payment.Counterparty, payment.JettonAddress, payment.ExtraCurrencyID, payment.Amount, payment.TTL, restrictions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build route: %w", err)
+		}
+
+		if payment.MaxFee == nil || chain[0].Fee.Cmp(payment.MaxFee) <= 0 {
+			return chain, nil
+		}
+
+		// exclude the most expensive intermediate node and try again
+		var expensive ed25519.PublicKey
+		maxHopFee := big.NewInt(-1)
+		for j := 0; j < len(chain)-1; j++ {
+			hopFee := new(big.Int).Sub(chain[j].Fee, chain[j+1].Fee)
+			if hopFee.Cmp(maxHopFee) > 0 {
+				maxHopFee = hopFee
+				expensive = chain[j].Target
+			}
+		}
+
+		if expensive == nil {
+			break
+		}
+		restrictions.excludeNodes[string(expensive)] = true
+	}
+
+	return nil, fmt.Errorf("no route which fits fee budget")
+}
+
+// executePaymentAttempt - checks result of the current attempt and starts the next one when needed.
+// Returns retryable error while payment is in progress.
+func (s *Service) executePaymentAttempt(ctx context.Context, id []byte) error {
+	payment, err := s.db.GetPayment(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	if payment.Status != db.PaymentStatusPending {
+		return nil
+	}
+
+	strId := base64.StdEncoding.EncodeToString(id)
+
+	finish := func(status db.PaymentStatus, reason string) error {
+		payment.Status = status
+		payment.Reason = reason
+		payment.UpdatedAt = time.Now()
+		for _, part := range payment.Parts {
+			if part.Status == db.PaymentStatusPending {
+				part.Status = status
+			}
+		}
+
+		if err := s.db.UpdatePayment(ctx, payment); err != nil {
+			return fmt.Errorf("failed to update payment: %w", err)
+		}
+
+		if status == db.PaymentStatusCompleted {
+			log.Info().Str("payment", strId).Int("attempts", len(payment.Attempts)).Msg("payment completed")
+		} else {
+			log.Warn().Str("payment", strId).Int("attempts", len(payment.Attempts)).Str("reason", reason).Msg("payment failed")
+		}
+		return nil
+	}
+
+	if len(payment.Attempts) > 0 {
+		attempt := payment.Attempts[len(payment.Attempts)-1]
+		if attempt.Status == db.PaymentStatusPending {
+			meta, err := s.db.GetVirtualChannelMeta(ctx, attempt.VirtualKey)
+			if err != nil && !errors.Is(err, db.ErrNotFound) {
+				return fmt.Errorf("failed to get virtual channel meta: %w", err)
+			}
+
+			deadline := payment.Parts[len(payment.Parts)-1].Deadline
+			switch {
+			case meta != nil && meta.GetKnownResolve() != nil:
+				attempt.Status = db.PaymentStatusCompleted
+				attempt.FinishedAt = time.Now()
+				return finish(db.PaymentStatusCompleted, "")
+			case meta != nil && (meta.Status == db.VirtualChannelStateWantRemove || meta.Status == db.VirtualChannelStateRemoved):
+				attempt.Status = db.PaymentStatusFailed
+				attempt.Reason = "rejected by one of the next nodes"
+				if meta.FailReason != "" {
+					// our direct peer has rejected the channel
+					attempt.FailedHop = attempt.Route[0]
+					attempt.Reason = meta.FailReason
+				} else if meta.FailureReport != nil {
+					hop, rep, err := s.readFailureReport(meta)
+					if err != nil {
+						log.Warn().Err(err).Str("payment", strId).Msg("failed to read failure report")
+					} else {
+						if rep.Code == transport.FailureCodeDenied {
+							// node has reported that its next node has rejected the channel
+							hop++
+						}
+
+						if hop < len(attempt.Route) {
+							attempt.FailedHop = attempt.Route[hop]
+						}
+						attempt.Reason = rep.Message
+					}
+				}
+			case (meta == nil || meta.Status == db.VirtualChannelStatePending) && time.Now().After(deadline):
+				attempt.Status = db.PaymentStatusFailed
+				attempt.Reason = "channel was not opened before deadline"
+			default:
+				return fmt.Errorf("payment attempt is in progress: %w", ErrActionStarted)
+			}
+			attempt.FinishedAt = time.Now()
+			payment.Parts[len(payment.Parts)-1].Status = db.PaymentStatusFailed
+
+			log.Debug().Str("payment", strId).Str("reason", attempt.Reason).Msg("payment attempt failed")
+
+			if attempt.FailedHop != nil && bytes.Equal(attempt.FailedHop, payment.Counterparty) {
+				return finish(db.PaymentStatusFailed, "rejected by receiver: "+attempt.Reason)
+			}
+		}
+	}
+
+	if time.Now().After(payment.RetryTill) {
+		return finish(db.PaymentStatusFailed, "time budget exceeded")
+	}
+
+	chain, err := s.buildPaymentRoute(ctx, payment)
+	if err != nil {
+		return finish(db.PaymentStatusFailed, err.Error())
+	}
+
+	var jettonMaster *address.Address
+	if payment.JettonAddress != "" {
+		jettonMaster = address.MustParseAddr(payment.JettonAddress)
+	}
+
+	_, vPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	vKey := vPriv.Public().(ed25519.PublicKey)
+
+	route := make([]ed25519.PublicKey, 0, len(chain))
+	for _, part := range chain {
+		route = append(route, part.Target)
+	}
+
+	// attempt is saved before opening, so we will not lose it in case of failure in between
+	payment.Attempts = append(payment.Attempts, &db.PaymentAttempt{
+		VirtualKey: vKey,
+		Route:      route,
+		Fee:        chain[0].Fee,
+		Status:     db.PaymentStatusPending,
+		StartedAt:  time.Now(),
+	})
+	payment.Parts = append(payment.Parts, &db.PaymentPart{
+		VirtualKey: vKey,
+		Amount:     payment.Amount,
+		Fee:        chain[0].Fee,
+		Deadline:   chain[0].Deadline,
+		Status:     db.PaymentStatusPending,
+	})
+	payment.UpdatedAt = time.Now()
+	if err = s.db.UpdatePayment(ctx, payment); err != nil {
+		return fmt.Errorf("failed to update payment: %w", err)
+	}
+
+	var payloads []any
+	if payment.InvoiceID != nil {
+		payloads = append(payloads, transport.InvoicePayload{InvoiceID: payment.InvoiceID})
+	}
+
+	vc, firstInstructionKey, tun, err := transport.GenerateTunnel(vPriv, chain, 5, true, s.key, payloads...)
+	if err != nil {
+		return fmt.Errorf("failed to generate tunnel: %w", err)
+	}
+
+	if err = s.OpenVirtualChannel(ctx, chain[0].Target, firstInstructionKey, payment.Counterparty, vPriv, tun, vc, jettonMaster, payment.ExtraCurrencyID); err != nil {
+		// channel was not opened, so we can safely try another peer
+		attempt := payment.Attempts[len(payment.Attempts)-1]
+		attempt.Status = db.PaymentStatusFailed
+		attempt.FailedHop = chain[0].Target
+		attempt.Reason = err.Error()
+		attempt.FinishedAt = time.Now()
+		payment.Parts[len(payment.Parts)-1].Status = db.PaymentStatusFailed
+		payment.UpdatedAt = time.Now()
+		if err = s.db.UpdatePayment(ctx, payment); err != nil {
+			return fmt.Errorf("failed to update payment: %w", err)
+		}
+		return fmt.Errorf("failed to open virtual channel for payment attempt, will try another route: %w", ErrActionStarted)
+	}
+
+	log.Debug().Str("payment", strId).Int("attempt", len(payment.Attempts)).Msg("payment attempt started")
+
+	return fmt.Errorf("payment attempt is started: %w", ErrActionStarted)
+}
+
+// GetPayment - returns payment with actualized status of each part
+func (s *Service) GetPayment(ctx context.Context, id []byte) (*db.Payment, error) {
+	payment, err := s.db.GetPayment(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if payment.Status != db.PaymentStatusPending || !payment.RetryTill.IsZero() {
+		// retried payments are actualized by worker
+		return payment, nil
+	}
+
+	changed := false
+	if payment.Incoming {
+		// not collected parts will be removed after timeout, and payment will never complete
+		expired := true
+		for _, part := range payment.Parts {
+			if part.Deadline.After(time.Now()) {
+				expired = false
+				break
+			}
+		}
+
+		if expired {
+			payment.Status = db.PaymentStatusFailed
+			for _, part := range payment.Parts {
+				part.Status = db.PaymentStatusFailed
+			}
+			changed = true
+		}
+	} else {
+		completed := 0
+		for _, part := range payment.Parts {
+			if part.Status == db.PaymentStatusPending {
+				meta, err := s.db.GetVirtualChannelMeta(ctx, part.VirtualKey)
+				if err != nil && !errors.Is(err, db.ErrNotFound) {
+					return nil, fmt.Errorf("failed to get virtual channel meta: %w", err)
+				}
+
+				if meta != nil {
+					switch {
+					case meta.Status == db.VirtualChannelStateRemoved || meta.Status == db.VirtualChannelStateWantRemove:
+						part.Status = db.PaymentStatusFailed
+						changed = true
+					case meta.GetKnownResolve() != nil:
+						// receiver has closed the channel with the final state
+						part.Status = db.PaymentStatusCompleted
+						changed = true
+					}
+				}
+			}
+
+			switch part.Status {
+			case db.PaymentStatusCompleted:
+				completed++
+			case db.PaymentStatusFailed:
+				payment.Status = db.PaymentStatusFailed
+			}
+		}
+
+		if completed == len(payment.Parts) {
+			payment.Status = db.PaymentStatusCompleted
+		}
+	}
+
+	if changed || payment.Status != db.PaymentStatusPending {
+		payment.UpdatedAt = time.Now()
+		if err = s.db.UpdatePayment(ctx, payment); err != nil {
+			return nil, fmt.Errorf("failed to update payment: %w", err)
+		}
+	}
+
+	return payment, nil
+}
+
+// checkIncomingPaymentPart - verifies that part fits already known parts of the same payment
+func (s *Service) checkIncomingPaymentPart(ctx context.Context, sender ed25519.PublicKey, part *transport.PaymentPartPayload, channel *db.Channel) error {
+	total := new(big.Int).SetBytes(part.TotalAmount)
+	if total.Sign() <= 0 {
+		return fmt.Errorf("incorrect total amount")
+	}
+
+	payment, err := s.db.GetPayment(ctx, part.PaymentID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	if !payment.Incoming || !bytes.Equal(payment.Counterparty, sender) {
+		return fmt.Errorf("payment id is already used")
+	}
+
+	if payment.Amount.Cmp(total) != 0 || payment.JettonAddress != channel.JettonAddress || payment.ExtraCurrencyID != channel.ExtraCurrencyID {
+		return fmt.Errorf("part is not matching payment")
+	}
+
+	if payment.Status == db.PaymentStatusFailed {
+		return fmt.Errorf("payment is already failed")
+	}
+
+	if len(payment.Parts) >= maxPaymentParts {
+		return fmt.Errorf("too many parts")
+	}
+
+	return nil
+}
+
+// addIncomingPaymentPart - saves received part, and when total amount is collected, closes all parts
+func (s *Service) addIncomingPaymentPart(ctx context.Context, sender ed25519.PublicKey, part *transport.PaymentPartPayload, channel *db.Channel, vch *payments.VirtualChannel, state *cell.Cell) error {
+	payment, err := s.db.GetPayment(ctx, part.PaymentID)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	create := payment == nil
+	if create {
+		payment = &db.Payment{
+			ID:              part.PaymentID,
+			Incoming:        true,
+			Counterparty:    sender,
+			JettonAddress:   channel.JettonAddress,
+			ExtraCurrencyID: channel.ExtraCurrencyID,
+			Amount:          new(big.Int).SetBytes(part.TotalAmount),
+			Status:          db.PaymentStatusPending,
+			CreatedAt:       time.Now(),
+		}
+	}
+	payment.UpdatedAt = time.Now()
+
+	payment.Parts = append(payment.Parts, &db.PaymentPart{
+		VirtualKey: vch.Key,
+		Amount:     vch.Capacity,
+		Fee:        vch.Fee,
+		Deadline:   time.Unix(vch.Deadline, 0),
+		Status:     db.PaymentStatusPending,
+		State:      state.ToBOC(),
+	})
+
+	if payment.Status == db.PaymentStatusPending {
+		collected := big.NewInt(0)
+		for _, p := range payment.Parts {
+			collected.Add(collected, p.Amount)
+		}
+
+		if collected.Cmp(payment.Amount) >= 0 {
+			payment.Status = db.PaymentStatusCompleted
+		}
+	}
+
+	if payment.Status == db.PaymentStatusCompleted {
+		for _, p := range payment.Parts {
+			if p.Status != db.PaymentStatusPending {
+				continue
+			}
+
+			tryTill := p.Deadline
+			if err = s.db.CreateTask(ctx, PaymentsTaskPool, "close-next-virtual", channel.Address,
+				"close-next-"+base64.StdEncoding.EncodeToString(p.VirtualKey),
+				db.CloseNextVirtualTask{
+					VirtualKey: p.VirtualKey,
+					State:      p.State,
+				}, nil, &tryTill,
+			); err != nil {
+				return fmt.Errorf("failed to create close-next-virtual task: %w", err)
+			}
+			p.Status = db.PaymentStatusCompleted
+		}
+
+		log.Info().Str("payment", base64.StdEncoding.EncodeToString(payment.ID)).
+			Int("parts", len(payment.Parts)).
+			Msg("multipath payment received")
+	}
+
+	if create {
+		err = s.db.CreatePayment(ctx, payment)
+	} else {
+		err = s.db.UpdatePayment(ctx, payment)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save payment: %w", err)
+	}
+
+	return nil
+}
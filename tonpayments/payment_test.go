@@ -0,0 +1,177 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+func TestPaymentPart_ProcessAction(t *testing.T) {
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	addr := n.connect(t, a, b, "10", "0")
+
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err.Error())
+	}
+	part := transport.PaymentPartPayload{PaymentID: id, TotalAmount: mustNano(t, "2").Bytes()}
+
+	if _, err := proposeVirtual(t, a, b, addr, "1", false, nil, part); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "should have final state") {
+		t.Fatal("part without final state should be rejected", err)
+	}
+
+	if _, err := proposeVirtual(t, a, b, addr, "1", true, nil, transport.PaymentPartPayload{PaymentID: id, TotalAmount: []byte{}}); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "incorrect total amount") {
+		t.Fatal("part with zero total should be rejected", err)
+	}
+
+	if _, err := proposeVirtual(t, a, b, addr, "1", true, nil, part); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	payment, err := b.db.GetPayment(context.Background(), id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !payment.Incoming || payment.Status != db.PaymentStatusPending || len(payment.Parts) != 1 {
+		t.Fatal("first part should be kept until all parts are received", payment.Status, len(payment.Parts))
+	}
+
+	if _, err = proposeVirtual(t, a, b, addr, "1", true, nil, transport.PaymentPartPayload{PaymentID: id, TotalAmount: mustNano(t, "3").Bytes()}); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "not matching payment") {
+		t.Fatal("part with another total should be rejected", err)
+	}
+
+	if _, err = proposeVirtual(t, a, b, addr, "1", true, nil, part); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if payment, err = b.db.GetPayment(context.Background(), id); err != nil {
+		t.Fatal(err.Error())
+	}
+	if payment.Status != db.PaymentStatusCompleted || len(payment.Parts) != 2 {
+		t.Fatal("payment should be completed when all parts are received", payment.Status, len(payment.Parts))
+	}
+
+	// another sender cannot add parts to this payment
+	c := n.addNode(t, testConfig())
+	cb := n.connect(t, c, b, "10", "0")
+	if _, err = proposeVirtual(t, c, b, cb, "1", true, nil, part); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "already used") {
+		t.Fatal("part of another sender should be rejected", err)
+	}
+}
+
+func TestPaymentPart_HashLockedRejected(t *testing.T) {
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	addr := n.connect(t, a, b, "10", "0")
+
+	part := transport.PaymentPartPayload{PaymentID: make([]byte, 32), TotalAmount: mustNano(t, "1").Bytes()}
+	if _, err := proposeVirtual(t, a, b, addr, "1", false, make([]byte, 32), part); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "cannot carry payment") {
+		t.Fatal("hash-locked payment part should be rejected", err)
+	}
+}
+
+func TestMultipathPayment_Completed(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	n.connect(t, a, b, "10", "0")
+	n.connect(t, b, c, "10", "0")
+
+	payment, err := a.svc.SendMultipathPayment(context.Background(), c.pub(), "", 0, mustNano(t, "2"), 2, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	waitFor(t, 10*time.Second, "payment receive", func() bool {
+		p, err := c.db.GetPayment(context.Background(), payment.ID)
+		return err == nil && p.Status == db.PaymentStatusCompleted && len(p.Parts) == 2
+	})
+}
+
+func TestSendPayment_RetriedOverAnotherRoute(t *testing.T) {
+	n := newTestNetwork()
+	a, x, y, d := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	n.connect(t, a, x, "10", "0")
+	n.connect(t, x, d, "10", "0")
+	n.connect(t, a, y, "10", "0")
+	n.connect(t, y, d, "10", "0")
+
+	// first hops are tried in order of their keys
+	first := x
+	if string(y.pub()) < string(x.pub()) {
+		first = y
+	}
+	first.svc.SetDrainMode(true)
+
+	payment, err := a.svc.SendPayment(context.Background(), d.pub(), "", 0, mustNano(t, "1"), nil, 5*time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	waitFor(t, 20*time.Second, "payment completion", func() bool {
+		p, err := a.db.GetPayment(context.Background(), payment.ID)
+		return err == nil && p.Status != db.PaymentStatusPending
+	})
+
+	p, err := a.db.GetPayment(context.Background(), payment.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if p.Status != db.PaymentStatusCompleted || len(p.Attempts) != 2 {
+		t.Fatal("payment should be completed by the second attempt", p.Status, p.Reason, len(p.Attempts))
+	}
+	if p.Attempts[0].Status != db.PaymentStatusFailed || !bytes.Equal(p.Attempts[0].FailedHop, first.pub()) {
+		t.Fatal("first attempt should be failed by the draining node")
+	}
+	if bytes.Equal(p.Attempts[1].Route[0], first.pub()) {
+		t.Fatal("failed node should not be used again")
+	}
+}
+
+func TestSendPayment_RejectedByReceiver(t *testing.T) {
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	n.connect(t, a, b, "10", "0")
+
+	b.svc.SetDrainMode(true)
+	payment, err := a.svc.SendPayment(context.Background(), b.pub(), "", 0, mustNano(t, "1"), nil, 5*time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	waitFor(t, 20*time.Second, "payment failure", func() bool {
+		p, err := a.db.GetPayment(context.Background(), payment.ID)
+		return err == nil && p.Status != db.PaymentStatusPending
+	})
+
+	p, err := a.db.GetPayment(context.Background(), payment.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if p.Status != db.PaymentStatusFailed || len(p.Attempts) != 1 || !strings.Contains(p.Reason, "rejected by receiver") {
+		t.Fatal("payment rejected by receiver should not be retried", p.Status, p.Reason, len(p.Attempts))
+	}
+}
+
+func TestSendPayment_FeeBudget(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	n.connect(t, a, b, "10", "0")
+	n.connect(t, b, c, "10", "0")
+
+	// proxy min fee is 0.001, and there is no cheaper route
+	if _, err := a.svc.SendPayment(context.Background(), c.pub(), "", 0, mustNano(t, "0.01"), mustNano(t, "0.0001"), 5*time.Minute, time.Minute); err == nil {
+		t.Fatal("payment should not be sent over fee budget")
+	}
+
+	if _, err := a.svc.SendPayment(context.Background(), c.pub(), "", 0, mustNano(t, "0.01"), mustNano(t, "0.001"), 5*time.Minute, time.Minute); err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -210,20 +210,12 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 
 		balanceDiff := new(big.Int).Sub(signedState.State.Data.Sent.Nano(), channel.Their.State.Data.Sent.Nano())
 
-		var vState payments.VirtualChannelState
-		if err = tlb.LoadFromCell(&vState, data.State.BeginParse()); err != nil {
-			return nil, fmt.Errorf("failed to load virtual channel state cell: %w", err)
-		}
-
-		if !vState.Verify(vch.Key) {
-			return nil, fmt.Errorf("incorrect channel state signature")
-		}
-
-		if vState.Amount.Cmp(vch.Capacity) > 0 {
-			return nil, fmt.Errorf("amount cannot be > capacity")
+		amount, err := vch.ResolveAmount(data.State)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect resolve: %w", err)
 		}
 
-		needAmt := new(big.Int).Add(vState.Amount, vch.Fee)
+		needAmt := new(big.Int).Add(amount, vch.Fee)
 		needAmt = needAmt.Sub(needAmt, vch.Prepay)
 
 		if needAmt.Sign() < 0 {
@@ -244,8 +236,12 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 			return nil, fmt.Errorf("virtual channel close was not requested")
 		}
 
-		if res := meta.GetKnownResolve(); res != nil {
-			if res.Amount.Cmp(vState.Amount) > 0 {
+		if vch.IsHashLocked() {
+			if meta.Preimage == nil {
+				return nil, fmt.Errorf("preimage is unknown on node side")
+			}
+		} else if res := meta.GetKnownResolve(); res != nil {
+			if res.Amount.Cmp(amount) > 0 {
 				return nil, fmt.Errorf("outdated virtual channel state")
 			}
 		} else {
@@ -280,7 +276,7 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 			}
 
 			evData := db.ChannelHistoryActionTransferInData{
-				Amount: vState.Amount.String(),
+				Amount: amount.String(),
 				From:   senderKey,
 			}
 
@@ -345,7 +341,192 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 				Str("sent_diff", tlb.MustFromNano(sentDiff, int(cc.Decimals)).String()).
 				Msg("virtual channel prepaid")
 
-			return nil
+			return s.commitNextVirtual(ctx, channel, vchOld)
+		}
+	case transport.ExtendVirtualAction:
+		if s.draining.Load() {
+			return nil, fmt.Errorf("%w, virtual channels are not extended", ErrDraining)
+		}
+
+		_, vchNew, err := payments.FindVirtualChannel(condProposal, data.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find virtual channel in their new state: %w", err)
+		}
+
+		index, vchOld, err := payments.FindVirtualChannel(channel.Their.Conditionals, data.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find virtual channel in their old state: %w", err)
+		}
+
+		if vchNew.Deadline != data.Deadline {
+			return nil, fmt.Errorf("deadline in state is different from requested")
+		}
+
+		if vchNew.Deadline <= vchOld.Deadline {
+			return nil, fmt.Errorf("deadline should be increased")
+		}
+
+		if vchOld.Deadline < time.Now().UTC().Unix() {
+			return nil, fmt.Errorf("virtual channel is expired")
+		}
+
+		if safe := vchNew.Deadline - (time.Now().UTC().Unix() + channel.SafeOnchainClosePeriod); safe < int64(s.cfg.MinSafeVirtualChannelTimeoutSec) {
+			return nil, fmt.Errorf("safe deadline is less than acceptable")
+		}
+
+		fee := new(big.Int).SetBytes(data.Fee)
+		sentDiff := new(big.Int).Sub(signedState.State.Data.Sent.Nano(), channel.Their.State.Data.Sent.Nano())
+		if sentDiff.Cmp(fee) != 0 {
+			return nil, fmt.Errorf("sent diff is not equal to fee")
+		}
+
+		meta, err := s.db.GetVirtualChannelMeta(context.Background(), data.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load virtual channel meta: %w", err)
+		}
+
+		if meta.Status != db.VirtualChannelStateActive {
+			return nil, fmt.Errorf("virtual channel is not active")
+		}
+
+		var nextFee *big.Int
+		if meta.Outgoing != nil {
+			ourFee := big.NewInt(0)
+			if cc.VirtualTunnelConfig.ExtensionFee != "" {
+				ourFee = cc.MustAmountDecimal(cc.VirtualTunnelConfig.ExtensionFee).Nano()
+			}
+
+			if fee.Cmp(ourFee) < 0 {
+				return nil, fmt.Errorf("extension fee should be at least %s", cc.MustAmount(ourFee).String())
+			}
+			nextFee = new(big.Int).Sub(fee, ourFee)
+		}
+
+		// only deadline can change
+		vchOld.Deadline = vchNew.Deadline
+		if err = channel.Their.Conditionals.SetIntKey(index, vchOld.Serialize()); err != nil {
+			return nil, fmt.Errorf("failed to set condition with index %s: %w", index.String(), err)
+		}
+
+		toExecute = func(ctx context.Context) error {
+			return s.onIncomingVirtualExtended(ctx, channel, meta, vchOld, data.ID, nextFee)
+		}
+	case transport.IncreaseVirtualAction:
+		if s.draining.Load() {
+			return nil, fmt.Errorf("%w, capacity of virtual channels is not increased", ErrDraining)
+		}
+
+		_, vchNew, err := payments.FindVirtualChannel(condProposal, data.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find virtual channel in their new state: %w", err)
+		}
+
+		index, vchOld, err := payments.FindVirtualChannel(channel.Their.Conditionals, data.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find virtual channel in their old state: %w", err)
+		}
+
+		if vchNew.Capacity.Cmp(new(big.Int).SetBytes(data.Capacity)) != 0 || vchNew.Fee.Cmp(new(big.Int).SetBytes(data.Fee)) != 0 {
+			return nil, fmt.Errorf("capacity or fee in state is different from requested")
+		}
+
+		if vchNew.Capacity.Cmp(vchOld.Capacity) <= 0 {
+			return nil, fmt.Errorf("capacity should be increased")
+		}
+
+		if vchNew.Fee.Cmp(vchOld.Fee) < 0 {
+			return nil, fmt.Errorf("fee cannot be decreased")
+		}
+
+		if vchOld.Deadline < time.Now().UTC().Unix() {
+			return nil, fmt.Errorf("virtual channel is expired")
+		}
+
+		meta, err := s.db.GetVirtualChannelMeta(context.Background(), data.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load virtual channel meta: %w", err)
+		}
+
+		if meta.Status != db.VirtualChannelStateActive {
+			return nil, fmt.Errorf("virtual channel is not active")
+		}
+
+		// only capacity and fee can change
+		capDelta := new(big.Int).Sub(vchNew.Capacity, vchOld.Capacity)
+		feeDelta := new(big.Int).Sub(vchNew.Fee, vchOld.Fee)
+		vchOld.Capacity = vchNew.Capacity
+		vchOld.Fee = vchNew.Fee
+		if err = channel.Their.Conditionals.SetIntKey(index, vchOld.Serialize()); err != nil {
+			return nil, fmt.Errorf("failed to set condition with index %s: %w", index.String(), err)
+		}
+
+		// increased capacity should be backed by their balance, both when we proxy it and when we are the receiver
+		theirBalance, _, err := channel.CalcBalance(true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to calc other side balance: %w", err)
+		}
+
+		if theirBalance.Sign() < 0 {
+			return nil, fmt.Errorf("not enough available balance, you need %s more to increase capacity", cc.MustAmount(new(big.Int).Neg(theirBalance)).String())
+		}
+
+		var nextCap, nextFee *big.Int
+		if meta.Outgoing != nil {
+			tc := s.tunnelConfig(key, channel.JettonAddress, channel.ExtraCurrencyID, cc)
+			if !tc.AllowTunneling {
+				return nil, fmt.Errorf("tunneling of such coin is not allowed through this node")
+			}
+
+			target, err := s.db.GetChannel(context.Background(), meta.Outgoing.ChannelAddress)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load outgoing channel: %w", err)
+			}
+
+			if target.Status != db.ChannelStateActive {
+				return nil, fmt.Errorf("outgoing channel is not active")
+			}
+
+			if target.JettonAddress != channel.JettonAddress || target.ExtraCurrencyID != channel.ExtraCurrencyID {
+				return nil, fmt.Errorf("capacity of converted virtual channel cannot be increased")
+			}
+
+			_, nextVch, err := payments.FindVirtualChannel(target.Our.Conditionals, data.Key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find outgoing virtual channel: %w", err)
+			}
+
+			feePercent, err := proxyFeePercent(tc, target)
+			if err != nil {
+				return nil, fmt.Errorf("failed to calc fee: %w", err)
+			}
+
+			// we take fee only for the added capacity, min fee was already paid on open
+			wantFee, _ := new(big.Float).Mul(new(big.Float).SetInt(capDelta), big.NewFloat(feePercent/100.0)).Int(nil)
+			if feeDelta.Cmp(wantFee) < 0 {
+				return nil, fmt.Errorf("min fee to increase capacity is %s", cc.MustAmount(wantFee).String())
+			}
+
+			nextCap = new(big.Int).Add(nextVch.Capacity, capDelta)
+			nextFee = new(big.Int).Add(nextVch.Fee, new(big.Int).Sub(feeDelta, wantFee))
+
+			maxCap := tlb.MustFromDecimal(tc.ProxyMaxCapacity, int(cc.Decimals))
+			if new(big.Int).Add(nextCap, nextFee).Cmp(maxCap.Nano()) > 0 {
+				return nil, fmt.Errorf("too big next capacity+fee")
+			}
+
+			balance, _, err := target.CalcBalance(false)
+			if err != nil {
+				return nil, fmt.Errorf("failed to calc our channel %s balance: %w", target.Address, err)
+			}
+
+			need := new(big.Int).Sub(new(big.Int).Add(nextCap, nextFee), new(big.Int).Add(nextVch.Capacity, nextVch.Fee))
+			if balance.Cmp(need) < 0 {
+				return nil, fmt.Errorf("not enough liquidity to tunnel increased capacity")
+			}
+		}
+
+		toExecute = func(ctx context.Context) error {
+			return s.onIncomingVirtualIncreased(ctx, channel, meta, vchOld, data.ID, nextCap, nextFee)
 		}
 	case transport.OpenVirtualAction:
 		index, vch, err := payments.FindVirtualChannel(condProposal, data.ChannelKey)
@@ -377,11 +558,25 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 			return nil, fmt.Errorf("channel with this key is already exists and has different configuration")
 		}
 
-		if _, err = s.db.GetVirtualChannelMeta(context.Background(), vch.Key); err != nil && !errors.Is(err, db.ErrNotFound) {
+		if s.draining.Load() {
+			return nil, fmt.Errorf("%w, new virtual channels are not accepted", ErrDraining)
+		}
+
+		usedMeta, err := s.db.GetVirtualChannelMeta(context.Background(), vch.Key)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
 			return nil, fmt.Errorf("failed to load virtual channel meta: %w", err)
 		}
+
+		var ownRebalance bool
 		if err == nil {
-			return nil, fmt.Errorf("this virtual channel key was already used before")
+			// our rebalance comes back to us with the key of our outgoing channel
+			if ownRebalance, err = s.isOwnRebalance(context.Background(), usedMeta); err != nil {
+				return nil, err
+			}
+
+			if !ownRebalance || usedMeta.Incoming != nil {
+				return nil, fmt.Errorf("this virtual channel key was already used before")
+			}
 		}
 
 		// we put our serialized condition to make sure that party is not cheated,
@@ -395,7 +590,7 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 			return nil, fmt.Errorf("failed to calc other side balance: %w", err)
 		}
 
-		currentInstruction, err := data.DecryptOurInstruction(s.key, data.InstructionKey)
+		currentInstruction, payloads, err := data.DecryptOurInstructionWithPayloads(s.key, data.InstructionKey)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decrypt instruction: %w", err)
 		}
@@ -424,6 +619,10 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 		}
 
 		if !bytes.Equal(currentInstruction.NextTarget, s.key.Public().(ed25519.PublicKey)) {
+			if ownRebalance {
+				return nil, fmt.Errorf("this virtual channel key was already used before")
+			}
+
 			// willing to open tunnel for a virtual channel, for this we require party to have enough balance
 			if theirBalance.Sign() < 0 {
 				return nil, fmt.Errorf("not enough available balance, you need %s more tunnel channel through me", theirBalance.Abs(theirBalance).String())
@@ -437,33 +636,68 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 				return nil, fmt.Errorf("next deadline too late (not enough safety gap)")
 			}
 
-			if nextCap.Cmp(vch.Capacity) > 0 {
-				return nil, fmt.Errorf("capacity cannot increase")
-			}
-
-			if !cc.VirtualTunnelConfig.AllowTunneling {
+			tc := s.tunnelConfig(key, channel.JettonAddress, channel.ExtraCurrencyID, cc)
+			if !tc.AllowTunneling {
 				return nil, fmt.Errorf("tunneling of such coin is not allowed through this node")
 			}
 
-			wantMinFee := tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMinFee, int(cc.Decimals))
-			wantFeePercent := cc.VirtualTunnelConfig.ProxyFeePercent / 100.0
+			// next channel is in the same coin, unless conversion is requested
+			nextJetton, nextEcID := channel.JettonAddress, channel.ExtraCurrencyID
+			// next capacity and fee in our incoming coin, to compare with incoming channel
+			nextCapIn, nextFeeIn := nextCap, nextFee
+			for _, payload := range payloads {
+				convert, ok := payload.(transport.ConvertPayload)
+				if !ok {
+					continue
+				}
 
-			wantFeeInt := new(big.Int).Add(nextCap, nextFee)
+				if !vch.IsHashLocked() {
+					// signed state amount is the same for the whole chain, so it cannot be converted
+					return nil, fmt.Errorf("conversion is possible only for hash-locked channels")
+				}
 
-			maxCap := tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMaxCapacity, int(cc.Decimals))
-			if wantFeeInt.Cmp(maxCap.Nano()) > 0 {
-				return nil, fmt.Errorf("too big next capacity+fee")
+				nextJetton, nextEcID = convert.JettonAddress(), convert.ExtraCurrencyID
+				if nextJetton != "" && nextEcID != 0 {
+					return nil, fmt.Errorf("jetton and extra currency are mutually exclusive")
+				}
+
+				if nextJetton == channel.JettonAddress && nextEcID == channel.ExtraCurrencyID {
+					break
+				}
+
+				nextCC, err := s.ResolveCoinConfig(nextJetton, nextEcID, true)
+				if err != nil {
+					return nil, fmt.Errorf("coin to convert is not supported: %w", err)
+				}
+
+				if !cc.ExchangeEnabled() || !nextCC.ExchangeEnabled() {
+					return nil, fmt.Errorf("conversion between these coins is not allowed through this node")
+				}
+
+				maxNextCap := nextCC.MustAmountDecimal(nextCC.VirtualTunnelConfig.ProxyMaxCapacity)
+				if new(big.Int).Add(nextCap, nextFee).Cmp(maxNextCap.Nano()) > 0 {
+					return nil, fmt.Errorf("too big next capacity+fee")
+				}
+
+				if nextCapIn, err = cc.ConvertFrom(nextCC, nextCap); err != nil {
+					return nil, fmt.Errorf("failed to convert next capacity: %w", err)
+				}
+
+				if nextFeeIn, err = cc.ConvertFrom(nextCC, nextFee); err != nil {
+					return nil, fmt.Errorf("failed to convert next fee: %w", err)
+				}
+				break
 			}
 
-			wantFeeInt, _ = new(big.Float).Mul(new(big.Float).SetInt(wantFeeInt), big.NewFloat(wantFeePercent)).Int(wantFeeInt)
-			wantFee := tlb.MustFromNano(wantFeeInt, int(cc.Decimals))
-			if wantFee.Compare(wantMinFee) < 0 {
-				wantFee = wantMinFee
+			if nextCapIn.Cmp(vch.Capacity) > 0 {
+				return nil, fmt.Errorf("capacity cannot increase")
 			}
 
-			proposedFee := new(big.Int).Sub(vch.Fee, nextFee)
-			if proposedFee.Cmp(wantFee.Nano()) < 0 {
-				return nil, fmt.Errorf("min fee to open channel is %s TON", wantFee.String())
+			wantFeeInt := new(big.Int).Add(nextCapIn, nextFeeIn)
+
+			maxCap := tlb.MustFromDecimal(tc.ProxyMaxCapacity, int(cc.Decimals))
+			if wantFeeInt.Cmp(maxCap.Nano()) > 0 {
+				return nil, fmt.Errorf("too big next capacity+fee")
 			}
 
 			targetChannels, err := s.db.GetChannels(context.Background(), currentInstruction.NextTarget, db.ChannelStateAny)
@@ -484,12 +718,12 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 					continue
 				}
 
-				// token should be the same
-				if targetChannel.JettonAddress != channel.JettonAddress {
+				// token should be the same, or the one we convert to
+				if targetChannel.JettonAddress != nextJetton {
 					continue
 				}
 
-				if targetChannel.ExtraCurrencyID != channel.ExtraCurrencyID {
+				if targetChannel.ExtraCurrencyID != nextEcID {
 					continue
 				}
 
@@ -519,6 +753,24 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 				target = targetNoBalance // we will tunnel and topup to get a resolve
 			}
 
+			// fee can depend on liquidity of the chosen outgoing channel
+			feePercent, err := proxyFeePercent(tc, target)
+			if err != nil {
+				return nil, fmt.Errorf("failed to calc fee: %w", err)
+			}
+
+			wantMinFee := tlb.MustFromDecimal(tc.ProxyMinFee, int(cc.Decimals))
+			wantFeeInt, _ = new(big.Float).Mul(new(big.Float).SetInt(wantFeeInt), big.NewFloat(feePercent/100.0)).Int(wantFeeInt)
+			wantFee := tlb.MustFromNano(wantFeeInt, int(cc.Decimals))
+			if wantFee.Compare(wantMinFee) < 0 {
+				wantFee = wantMinFee
+			}
+
+			proposedFee := new(big.Int).Sub(vch.Fee, nextFeeIn)
+			if proposedFee.Cmp(wantFee.Nano()) < 0 {
+				return nil, fmt.Errorf("min fee to open channel is %s TON", wantFee.String())
+			}
+
 			// we will execute it only after all checks passed and final signature verified
 			toExecute = func(ctx context.Context) error {
 				senderKey := data.InstructionKey
@@ -535,6 +787,7 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 						Deadline:           currentInstruction.NextDeadline,
 						Fee:                nextFee.String(),
 						Capacity:           nextCap.String(),
+						HashLock:           vch.HashLock,
 						Action:             data,
 					}, nil, &tryTill,
 				)
@@ -578,6 +831,108 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 				return nil, fmt.Errorf("not enough available balance, you need %s more to open virtual channel with me", theirBalance.Abs(theirBalance).String())
 			}
 
+			var paymentPart *transport.PaymentPartPayload
+			var invoicePayload *transport.InvoicePayload
+			var streamPayload *transport.StreamPayload
+			var swapPayload *transport.SwapPayload
+			var memo string
+			for _, payload := range payloads {
+				switch p := payload.(type) {
+				case transport.PaymentPartPayload:
+					paymentPart = &p
+				case transport.InvoicePayload:
+					invoicePayload = &p
+				case transport.MemoPayload:
+					memo = p.Memo
+				case transport.StreamPayload:
+					streamPayload = &p
+				case transport.SwapPayload:
+					swapPayload = &p
+				}
+			}
+
+			if len(memo) > transport.MaxMemoLength {
+				return nil, fmt.Errorf("memo is too long")
+			}
+
+			if vch.IsHashLocked() {
+				if currentInstruction.FinalState != nil {
+					return nil, fmt.Errorf("hash-locked channel should not have final state")
+				}
+
+				if paymentPart != nil || invoicePayload != nil || streamPayload != nil {
+					return nil, fmt.Errorf("hash-locked channel cannot carry payment, invoice or stream payload")
+				}
+
+				if swapPayload != nil {
+					if err = s.checkIncomingSwapLock(context.Background(), swapPayload, channel, vch.Capacity, vch.Deadline); err != nil {
+						return nil, fmt.Errorf("swap is not acceptable: %w", err)
+					}
+				}
+			} else if swapPayload != nil {
+				return nil, fmt.Errorf("swap part should be hash-locked")
+			}
+
+			if invoicePayload != nil {
+				if currentInstruction.FinalState == nil {
+					return nil, fmt.Errorf("invoice payment should have final state")
+				}
+
+				if err = s.checkIncomingInvoicePayment(context.Background(), invoicePayload, channel, state.Amount); err != nil {
+					return nil, fmt.Errorf("invoice payment is not acceptable: %w", err)
+				}
+			}
+
+			if streamPayload != nil && currentInstruction.FinalState != nil {
+				return nil, fmt.Errorf("stream session should not have final state")
+			}
+
+			if paymentPart != nil {
+				if currentInstruction.FinalState == nil {
+					return nil, fmt.Errorf("payment part should have final state")
+				}
+
+				if err = s.checkIncomingPaymentPart(context.Background(), data.InstructionKey, paymentPart, channel); err != nil {
+					return nil, fmt.Errorf("payment part is not acceptable: %w", err)
+				}
+			}
+
+			if ownRebalance {
+				if currentInstruction.FinalState == nil || len(payloads) > 0 {
+					return nil, fmt.Errorf("rebalance should have only final state")
+				}
+
+				toExecute = func(ctx context.Context) error {
+					return s.onRebalanceIncoming(ctx, channel, data.InstructionKey, vch, &state, currentInstruction.FinalState)
+				}
+				break
+			}
+
+			if s.acceptancePolicy != nil {
+				incoming := &IncomingVirtualChannel{
+					Key:             vch.Key,
+					Sender:          data.InstructionKey,
+					JettonAddress:   channel.JettonAddress,
+					ExtraCurrencyID: channel.ExtraCurrencyID,
+					Coin:            cc,
+					Capacity:        vch.Capacity,
+					Amount:          vch.Capacity,
+					Deadline:        time.Unix(vch.Deadline, 0),
+					HashLocked:      vch.IsHashLocked(),
+					Memo:            memo,
+				}
+				if currentInstruction.FinalState != nil {
+					incoming.Amount = state.Amount
+				}
+				if invoicePayload != nil {
+					incoming.InvoiceID = invoicePayload.InvoiceID
+				}
+
+				if err = s.acceptancePolicy.CheckIncomingVirtualChannel(context.Background(), incoming); err != nil {
+					return nil, fmt.Errorf("virtual channel is not accepted by receiver: %w", err)
+				}
+			}
+
 			toExecute = func(ctx context.Context) error {
 				meta := &db.VirtualChannelMeta{
 					Key:    vch.Key,
@@ -590,11 +945,26 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 						UncooperativeDeadline: time.Unix(vch.Deadline, 0),
 						SafeDeadline:          time.Unix(vch.Deadline, 0).Add(-time.Duration(channel.SafeOnchainClosePeriod+int64(s.cfg.MinSafeVirtualChannelTimeoutSec)) * time.Second),
 					},
+					Memo:      memo,
+					HashLock:  vch.HashLock,
 					CreatedAt: time.Now(),
 					UpdatedAt: time.Now(),
 				}
 
-				if currentInstruction.FinalState != nil {
+				if paymentPart != nil {
+					if err = meta.AddKnownResolve(&state); err != nil {
+						return fmt.Errorf("failed to add channel condition resolve: %w", err)
+					}
+
+					// part will be closed only when all parts are received
+					if err = s.addIncomingPaymentPart(ctx, data.InstructionKey, paymentPart, channel, vch, currentInstruction.FinalState); err != nil {
+						return err
+					}
+
+					if err = removeAfterTimeout(ctx); err != nil {
+						return err
+					}
+				} else if currentInstruction.FinalState != nil {
 					if err = meta.AddKnownResolve(&state); err != nil {
 						return fmt.Errorf("failed to add channel condition resolve: %w", err)
 					}
@@ -619,6 +989,28 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 					return fmt.Errorf("failed to update virtual channel meta: %w", err)
 				}
 
+				if streamPayload != nil {
+					if err = s.createIncomingStreamSession(ctx, streamPayload, meta, channel, vch.Capacity); err != nil {
+						return err
+					}
+				}
+
+				if swapPayload != nil {
+					if err = s.acceptIncomingSwapLock(ctx, swapPayload, meta); err != nil {
+						return err
+					}
+				} else if vch.IsHashLocked() {
+					if err = s.onIncomingHashLocked(ctx, meta, channel, vch.Capacity); err != nil {
+						return err
+					}
+				}
+
+				if invoicePayload != nil {
+					if err = s.markInvoicePaid(ctx, invoicePayload, data.InstructionKey, vch.Key, state.Amount); err != nil {
+						return err
+					}
+				}
+
 				if currentInstruction.FinalState == nil && s.webhook != nil {
 					if err = s.webhook.PushVirtualChannelEvent(ctx, db.VirtualChannelEventTypeOpen, meta, cc); err != nil {
 						return fmt.Errorf("failed to push virtual channel close event: %w", err)
@@ -729,6 +1121,10 @@ func (s *Service) ProcessAction(ctx context.Context, key ed25519.PublicKey, lock
 			return nil
 		}
 	case transport.RentCapacityAction:
+		if s.draining.Load() {
+			return nil, fmt.Errorf("%w, capacity is not rented", ErrDraining)
+		}
+
 		attachedFee := new(big.Int).Sub(signedState.State.Data.Sent.Nano(), channel.Their.State.Data.Sent.Nano())
 		amount := new(big.Int).SetBytes(data.Amount)
 		maxRentPerAction := cc.MustAmountDecimal(cc.VirtualTunnelConfig.MaxCapacityToRentPerTx)
@@ -914,6 +1310,12 @@ func (s *Service) ProcessActionRequest(ctx context.Context, key ed25519.PublicKe
 		return nil, fmt.Errorf("unauthorized channel")
 	}
 
+	var failure []byte
+	if data, ok := action.(transport.RequestRemoveVirtualWithFailureAction); ok {
+		// processed as a regular removal request, report is only passed to the sender
+		action, failure = transport.RequestRemoveVirtualAction{Key: data.Key}, data.Failure
+	}
+
 	log.Debug().Str("action", reflect.TypeOf(action).String()).Msg("action request process")
 
 	switch data := action.(type) {
@@ -930,6 +1332,13 @@ func (s *Service) ProcessActionRequest(ctx context.Context, key ed25519.PublicKe
 			return nil, fmt.Errorf("failed to find virtual channel: %w", err)
 		}
 
+		if len(failure) > 0 {
+			// report is only informational, so we don't want to block removal because of it
+			if err = s.acceptFailureReport(context.Background(), channel.Address, vch.Key, failure); err != nil {
+				log.Warn().Err(err).Str("key", base64.StdEncoding.EncodeToString(vch.Key)).Msg("failed to accept failure report")
+			}
+		}
+
 		if err = s.db.CreateTask(context.Background(), PaymentsTaskPool, "remove-virtual", channel.Address,
 			"remove-virtual-"+base64.StdEncoding.EncodeToString(vch.Key)+"-requested",
 			db.RemoveVirtualTask{
@@ -939,27 +1348,24 @@ func (s *Service) ProcessActionRequest(ctx context.Context, key ed25519.PublicKe
 			return nil, fmt.Errorf("failed to create remove-virtual task: %w", err)
 		}
 		s.touchWorker()
+	case transport.VirtualUpdateResultAction:
+		if err = s.acceptVirtualUpdateResult(context.Background(), channel.Address, data); err != nil {
+			return nil, fmt.Errorf("failed to accept virtual channel update result: %w", err)
+		}
+		s.touchWorker()
 	case transport.CloseVirtualAction:
 		if !channel.AcceptingActions {
 			return nil, fmt.Errorf("channel is currently not accepting new actions")
 		}
 
-		var vState payments.VirtualChannelState
-		if err = tlb.LoadFromCell(&vState, data.State.BeginParse()); err != nil {
-			return nil, fmt.Errorf("failed to load virtual channel state cell: %w", err)
-		}
-
 		_, vch, err := payments.FindVirtualChannel(channel.Our.Conditionals, data.Key)
 		if err != nil {
 			return nil, fmt.Errorf("failed to find virtual channel: %w", err)
 		}
 
-		if !vState.Verify(vch.Key) {
-			return nil, fmt.Errorf("incorrect channel state signature")
-		}
-
-		if vState.Amount.Cmp(vch.Capacity) > 0 {
-			return nil, fmt.Errorf("amount cannot be > capacity")
+		amount, err := vch.ResolveAmount(data.State)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect resolve: %w", err)
 		}
 
 		if vch.Deadline < time.Now().UTC().Unix() {
@@ -967,17 +1373,43 @@ func (s *Service) ProcessActionRequest(ctx context.Context, key ed25519.PublicKe
 		}
 
 		if err = s.db.Transaction(context.Background(), func(ctx context.Context) error {
-			if err = s.AddVirtualChannelResolve(ctx, vch.Key, vState); err != nil {
-				// we don't care if it is older, since party wants to close with this amount
-				if !errors.Is(err, db.ErrNewerStateIsKnown) {
-					return fmt.Errorf("failed to add virtual channel resolve: %w", err)
+			var stateCell *cell.Cell
+			if vch.IsHashLocked() {
+				var hState payments.HTLCState
+				if err = tlb.LoadFromCell(&hState, data.State.BeginParse()); err != nil {
+					return fmt.Errorf("failed to load preimage cell: %w", err)
+				}
+
+				if err = s.AddVirtualChannelPreimage(ctx, vch.Key, hState.Preimage); err != nil {
+					return fmt.Errorf("failed to add virtual channel preimage: %w", err)
+				}
+
+				// serialize by ourselves for safety
+				if stateCell, err = hState.ToCell(); err != nil {
+					return fmt.Errorf("failed to serialize preimage: %w", err)
+				}
+			} else {
+				var vState payments.VirtualChannelState
+				if err = tlb.LoadFromCell(&vState, data.State.BeginParse()); err != nil {
+					return fmt.Errorf("failed to load virtual channel state cell: %w", err)
+				}
+
+				if err = s.AddVirtualChannelResolve(ctx, vch.Key, vState); err != nil {
+					// we don't care if it is older, since party wants to close with this amount
+					if !errors.Is(err, db.ErrNewerStateIsKnown) {
+						return fmt.Errorf("failed to add virtual channel resolve: %w", err)
+					}
+				}
+
+				// serialize by ourselves for safety
+				if stateCell, err = vState.ToCell(); err != nil {
+					return fmt.Errorf("failed to serialize virtual channel state: %w", err)
 				}
 			}
 
-			// serialize by ourselves for safety
-			stateCell, err := vState.ToCell()
-			if err != nil {
-				return fmt.Errorf("failed to serialize virtual channel state: %w", err)
+			// receiver has closed the channel, so when it is opened by us it is delivered
+			if err = s.updateTransfer(ctx, vch.Key, db.TransferStatusDelivered, amount, ""); err != nil {
+				return err
 			}
 
 			tryTill := time.Unix(vch.Deadline+(channel.SafeOnchainClosePeriod/2), 0)
@@ -0,0 +1,249 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+	"math/big"
+	"time"
+)
+
+// Rebalance - moves liquidity from our channel with enough balance to depleted one, without onchain transactions.
+// Virtual transfer is sent from us to ourselves: it goes out through 'from' channel, passes a cycle of peers,
+// and comes back through 'to' channel, so we pay only proxy fees. With dry run only route and fee are estimated.
+func (s *Service) Rebalance(ctx context.Context, fromAddr, toAddr string, amount, maxFee *big.Int, ttl time.Duration, dryRun bool) (*db.Rebalance, error) {
+	if amount.Sign() <= 0 {
+		return nil, fmt.Errorf("amount should be positive")
+	}
+
+	if fromAddr == toAddr {
+		return nil, fmt.Errorf("channels should be different")
+	}
+
+	from, err := s.GetActiveChannel(ctx, fromAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get 'from' channel: %w", err)
+	}
+
+	to, err := s.GetActiveChannel(ctx, toAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get 'to' channel: %w", err)
+	}
+
+	if from.JettonAddress != to.JettonAddress || from.ExtraCurrencyID != to.ExtraCurrencyID {
+		return nil, fmt.Errorf("channels should be in the same coin")
+	}
+
+	cc, err := s.ResolveCoinConfig(from.JettonAddress, from.ExtraCurrencyID, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	theirBalance, _, err := to.CalcBalance(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calc 'to' channel balance: %w", err)
+	}
+
+	if theirBalance.Cmp(amount) < 0 {
+		return nil, fmt.Errorf("party of 'to' channel has not enough balance to send %s to us", cc.MustAmount(amount).String())
+	}
+
+	channels, err := s.db.GetChannels(ctx, nil, db.ChannelStateActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active channels: %w", err)
+	}
+
+	// route should start with 'from' channel, so all other our channels are excluded
+	restrictions := &routeRestrictions{
+		excludeChannels: map[string]bool{},
+	}
+	for _, ch := range channels {
+		if ch.Address != from.Address {
+			restrictions.excludeChannels[ch.Address] = true
+		}
+	}
+
+	route, err := s.findRoute(ctx, to.TheirOnchain.Key, from.JettonAddress, from.ExtraCurrencyID, amount, restrictions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find route: %w", err)
+	}
+
+	ourKey := s.key.Public().(ed25519.PublicKey)
+	keys := make([]ed25519.PublicKey, 0, len(route)+1)
+	for _, hop := range route {
+		keys = append(keys, hop.Key)
+	}
+	// last party of the cycle tunnels it back to us
+	keys = append(keys, ourKey)
+
+	fees, err := s.CalcTunnelChainFees(ctx, keys, from.JettonAddress, from.ExtraCurrencyID, amount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calc fees: %w", err)
+	}
+
+	if maxFee != nil && fees[0].Cmp(maxFee) > 0 {
+		return nil, fmt.Errorf("fee %s is more than max fee %s", cc.MustAmount(fees[0]).String(), cc.MustAmount(maxFee).String())
+	}
+
+	rb := &db.Rebalance{
+		FromChannel: from.Address,
+		ToChannel:   to.Address,
+		Amount:      amount,
+		Fee:         fees[0],
+		Route:       keys,
+		CreatedAt:   time.Now(),
+	}
+
+	if dryRun {
+		return rb, nil
+	}
+
+	balance, _, err := from.CalcBalance(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calc 'from' channel balance: %w", err)
+	}
+
+	if balance.Cmp(new(big.Int).Add(amount, fees[0])) < 0 {
+		return nil, fmt.Errorf("not enough balance in 'from' channel")
+	}
+
+	now := time.Now()
+	chain := make([]transport.TunnelChainPart, len(keys))
+	for i, key := range keys {
+		chain[i] = transport.TunnelChainPart{
+			Target:   key,
+			Capacity: amount,
+			Fee:      fees[i],
+			Deadline: now.Add(ttl + s.GetMinSafeTTL()*time.Duration(len(keys)-i)),
+		}
+	}
+
+	var jettonMaster *address.Address
+	if from.JettonAddress != "" {
+		jettonMaster = address.MustParseAddr(from.JettonAddress)
+	}
+
+	_, vPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	vc, firstInstructionKey, tun, err := transport.GenerateTunnel(vPriv, chain, 5, true, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate tunnel: %w", err)
+	}
+	rb.ID = vc.Key
+
+	err = s.db.Transaction(ctx, func(ctx context.Context) error {
+		if err = s.db.CreateRebalance(ctx, rb); err != nil {
+			return fmt.Errorf("failed to create rebalance: %w", err)
+		}
+
+		if err = s.OpenVirtualChannel(ctx, chain[0].Target, firstInstructionKey, ourKey, vPriv, tun, vc, jettonMaster, from.ExtraCurrencyID); err != nil {
+			return fmt.Errorf("failed to open virtual channel: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("key", base64.StdEncoding.EncodeToString(rb.ID)).
+		Str("from", from.Address).
+		Str("to", to.Address).
+		Str("amount", cc.MustAmount(amount).String()).
+		Str("fee", cc.MustAmount(rb.Fee).String()).
+		Int("hops", len(keys)).
+		Msg("rebalance started")
+
+	return rb, nil
+}
+
+// GetRebalance - returns rebalance and transfer which tracks its status
+func (s *Service) GetRebalance(ctx context.Context, id []byte) (*db.Rebalance, *db.Transfer, error) {
+	rb, err := s.db.GetRebalance(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tr, err := s.GetTransfer(ctx, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get transfer: %w", err)
+	}
+	return rb, tr, nil
+}
+
+// isOwnRebalance - checks that virtual channel was opened by us to ourselves,
+// in this case the same meta has both outgoing and incoming sides
+func (s *Service) isOwnRebalance(ctx context.Context, meta *db.VirtualChannelMeta) (bool, error) {
+	if meta.Outgoing == nil {
+		return false, nil
+	}
+
+	if _, err := s.db.GetRebalance(ctx, meta.Key); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get rebalance: %w", err)
+	}
+	return true, nil
+}
+
+// onRebalanceIncoming - adds incoming side to meta of our outgoing rebalance channel and closes it,
+// after close the cycle will be closed back to our outgoing channel
+func (s *Service) onRebalanceIncoming(ctx context.Context, channel *db.Channel, senderKey []byte, vch *payments.VirtualChannel, state *payments.VirtualChannelState, stateCell *cell.Cell) error {
+	cc, err := s.ResolveCoinConfig(channel.JettonAddress, channel.ExtraCurrencyID, false)
+	if err != nil {
+		return fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	meta, err := s.db.GetVirtualChannelMeta(ctx, vch.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	meta.Incoming = &db.VirtualChannelMetaSide{
+		SenderKey:             senderKey,
+		ChannelAddress:        channel.Address,
+		Capacity:              tlb.MustFromNano(vch.Capacity, int(cc.Decimals)).String(),
+		Fee:                   tlb.MustFromNano(vch.Fee, int(cc.Decimals)).String(),
+		UncooperativeDeadline: time.Unix(vch.Deadline, 0),
+		SafeDeadline:          time.Unix(vch.Deadline, 0).Add(-time.Duration(channel.SafeOnchainClosePeriod+int64(s.cfg.MinSafeVirtualChannelTimeoutSec)) * time.Second),
+	}
+
+	if err = meta.AddKnownResolve(state); err != nil {
+		return fmt.Errorf("failed to add channel condition resolve: %w", err)
+	}
+
+	meta.UpdatedAt = time.Now()
+	if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+		return fmt.Errorf("failed to update virtual channel meta: %w", err)
+	}
+
+	tryTill := time.Unix(vch.Deadline, 0)
+	if err = s.db.CreateTask(ctx, PaymentsTaskPool, "close-next-virtual", channel.Address,
+		"close-next-"+base64.StdEncoding.EncodeToString(vch.Key),
+		db.CloseNextVirtualTask{
+			VirtualKey: vch.Key,
+			State:      stateCell.ToBOC(),
+		}, nil, &tryTill,
+	); err != nil {
+		return fmt.Errorf("failed to create close-next-virtual task: %w", err)
+	}
+
+	log.Info().Str("key", base64.StdEncoding.EncodeToString(vch.Key)).
+		Str("amount", cc.MustAmount(state.Amount).String()).
+		Str("channel", channel.Address).
+		Msg("rebalance reached us, closing")
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+// rebalanceCycle - a has most of liquidity in channel with b, and little in channel with c, b and c can pass it around.
+// Transfers are sent through both channels of a, so their states are exchanged.
+func rebalanceCycle(t *testing.T) (n *testNetwork, a, b, c *testNode, ab, ca string) {
+	n = newTestNetwork()
+	a, b, c = n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	ab = n.connect(t, a, b, "10", "0")
+	n.connect(t, b, c, "10", "0")
+	ca = n.connect(t, c, a, "10", "0")
+
+	waitTransferStatus(t, a, sendTransfer(t, a, b, "1"), db.TransferStatusClosed)
+	waitTransferStatus(t, c, sendTransfer(t, c, a, "1"), db.TransferStatusClosed)
+	return
+}
+
+func TestRebalance_Completed(t *testing.T) {
+	_, a, b, c, ab, ca := rebalanceCycle(t)
+
+	est, err := a.svc.Rebalance(context.Background(), ab, ca, mustNano(t, "1"), nil, 5*time.Minute, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(est.Route) != 3 || !est.Route[0].Equal(b.pub()) || !est.Route[1].Equal(c.pub()) || !est.Route[2].Equal(a.pub()) {
+		t.Fatal("route should pass the cycle back to us", len(est.Route))
+	}
+	if est.Fee.Sign() <= 0 {
+		t.Fatal("proxy fees should be estimated", est.Fee.String())
+	}
+	if _, err = a.db.GetRebalance(context.Background(), est.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Fatal("dry run should not be stored", err)
+	}
+
+	rb, err := a.svc.Rebalance(context.Background(), ab, ca, mustNano(t, "1"), est.Fee, 5*time.Minute, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a.svc.touchWorker()
+
+	waitFor(t, 15*time.Second, "rebalance close", func() bool {
+		_, tr, err := a.svc.GetRebalance(context.Background(), rb.ID)
+		return err == nil && tr.Status == db.TransferStatusClosed
+	})
+
+	waitFor(t, 10*time.Second, "balance with c", func() bool {
+		ch, err := a.db.GetChannel(context.Background(), ca)
+		if err != nil {
+			return false
+		}
+		balance, _, err := ch.CalcBalance(false)
+		return err == nil && balance.Cmp(mustNano(t, "2")) == 0
+	})
+
+	ch, err := a.db.GetChannel(context.Background(), ab)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	balance, _, err := ch.CalcBalance(false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if exp := new(big.Int).Sub(mustNano(t, "8"), rb.Fee); balance.Cmp(exp) != 0 {
+		t.Fatal("amount with fee should be taken from 'from' channel", balance.String(), exp.String())
+	}
+}
+
+func TestRebalance_Validation(t *testing.T) {
+	_, a, _, _, ab, ca := rebalanceCycle(t)
+
+	if _, err := a.svc.Rebalance(context.Background(), ab, ab, mustNano(t, "1"), nil, 5*time.Minute, true); err == nil || !strings.Contains(err.Error(), "should be different") {
+		t.Fatal("the same channel should be rejected", err)
+	}
+
+	if _, err := a.svc.Rebalance(context.Background(), ab, ca, mustNano(t, "11"), nil, 5*time.Minute, true); err == nil || !strings.Contains(err.Error(), "not enough balance to send") {
+		t.Fatal("amount more than party has should be rejected", err)
+	}
+
+	if _, err := a.svc.Rebalance(context.Background(), ab, ca, mustNano(t, "1"), big.NewInt(1), 5*time.Minute, true); err == nil || !strings.Contains(err.Error(), "more than max fee") {
+		t.Fatal("fee above max should be rejected", err)
+	}
+
+	if _, err := a.svc.Rebalance(context.Background(), ab, ca, mustNano(t, "9"), nil, 5*time.Minute, false); err == nil || !strings.Contains(err.Error(), "enough balance") {
+		t.Fatal("amount with fee more than we have should be rejected", err)
+	}
+}
+
+func TestRebalance_ProcessAction(t *testing.T) {
+	n, a, b, c, _, ca := rebalanceCycle(t)
+
+	_, vPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	key := vPriv.Public().(ed25519.PublicKey)
+
+	// a has started rebalance with this key, and is waiting for it to come back
+	if err = a.db.CreateRebalance(context.Background(), &db.Rebalance{
+		ID:        key,
+		Amount:    mustNano(t, "1"),
+		Fee:       big.NewInt(0),
+		CreatedAt: time.Now(),
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = a.db.CreateVirtualChannelMeta(context.Background(), &db.VirtualChannelMeta{
+		Key:       key,
+		Status:    db.VirtualChannelStateActive,
+		Outgoing:  &db.VirtualChannelMetaSide{ChannelAddress: n.connect(t, a, b, "10", "0")},
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	safe := c.svc.GetMinSafeTTL()
+	toUs := []transport.TunnelChainPart{{
+		Target:   a.pub(),
+		Capacity: mustNano(t, "1"),
+		Fee:      big.NewInt(0),
+		Deadline: time.Now().Add(5*time.Minute + safe),
+	}}
+
+	if _, err = proposeTunnelKey(t, c, ca, vPriv, toUs, false, nil); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "should have only final state") {
+		t.Fatal("rebalance without final state should be rejected", err)
+	}
+
+	if _, err = proposeTunnelKey(t, c, ca, vPriv, toUs, true, nil, transport.MemoPayload{Memo: "hi"}); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "should have only final state") {
+		t.Fatal("rebalance with payloads should be rejected", err)
+	}
+
+	// our rebalance should end on us, and cannot be tunnelled further
+	through := []transport.TunnelChainPart{
+		{
+			Target:   a.pub(),
+			Capacity: mustNano(t, "1"),
+			Fee:      mustNano(t, "0.01"),
+			Deadline: time.Now().Add(5*time.Minute + 2*safe),
+		},
+		{
+			Target:   b.pub(),
+			Capacity: mustNano(t, "1"),
+			Fee:      big.NewInt(0),
+			Deadline: time.Now().Add(5*time.Minute + safe),
+		},
+	}
+	if _, err = proposeTunnelKey(t, c, ca, vPriv, through, true, nil); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "already used") {
+		t.Fatal("tunnelling of our rebalance should be rejected", err)
+	}
+
+	if _, err = proposeTunnelKey(t, c, ca, vPriv, toUs, true, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	meta, err := a.db.GetVirtualChannelMeta(context.Background(), key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if meta.Incoming == nil || meta.Incoming.ChannelAddress != ca {
+		t.Fatal("incoming side should be added to our rebalance")
+	}
+
+	// the same cycle cannot come back twice
+	if _, err = proposeTunnelKey(t, c, n.connect(t, c, a, "10", "0"), vPriv, toUs, true, nil); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "already used") {
+		t.Fatal("second incoming of the same rebalance should be rejected", err)
+	}
+}
@@ -0,0 +1,498 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoRouteFound = errors.New("no route found")
+
+const maxRouteHops = 6
+
+// GraphChannel - channel between 2 other nodes, known from announcements
+type GraphChannel struct {
+	Address         string
+	KeyA            ed25519.PublicKey
+	KeyB            ed25519.PublicKey
+	JettonAddress   string
+	ExtraCurrencyID uint32
+	UpdatedAt       time.Time
+}
+
+// NodeTunnelPolicy - tunnelling conditions of some node for specific coin
+type NodeTunnelPolicy struct {
+	AllowTunneling bool
+	MinFee         *big.Int
+	FeePercent     float64
+	// MaxCapacity - nil when unknown
+	MaxCapacity *big.Int
+	UpdatedAt   time.Time
+}
+
+// RouteHop - node on the way to destination, Fee is what this node keeps for tunnelling
+type RouteHop struct {
+	Key ed25519.PublicKey
+	Fee *big.Int
+}
+
+// ChannelGraph - network view used to find routes for virtual channels,
+// our own channels are not stored here, they are taken from db at the moment of search
+type ChannelGraph struct {
+	channels map[string]*GraphChannel
+	policies map[string]*NodeTunnelPolicy
+
+	mx sync.RWMutex
+}
+
+func NewChannelGraph() *ChannelGraph {
+	return &ChannelGraph{
+		channels: map[string]*GraphChannel{},
+		policies: map[string]*NodeTunnelPolicy{},
+	}
+}
+
+func (g *ChannelGraph) UpdateChannel(ch *GraphChannel) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	if old := g.channels[ch.Address]; old != nil && old.UpdatedAt.After(ch.UpdatedAt) {
+		return
+	}
+	g.channels[ch.Address] = ch
+}
+
+func (g *ChannelGraph) RemoveChannel(addr string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	delete(g.channels, addr)
+}
+
+func (g *ChannelGraph) SetNodePolicy(key ed25519.PublicKey, jetton string, ecID uint32, policy *NodeTunnelPolicy) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	g.policies[string(key)+ccToKey(jetton, ecID)] = policy
+}
+
+func (g *ChannelGraph) RemoveNodePolicies(key ed25519.PublicKey) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	for k := range g.policies {
+		if strings.HasPrefix(k, string(key)) {
+			delete(g.policies, k)
+		}
+	}
+}
+
+func (g *ChannelGraph) GetNodePolicy(key ed25519.PublicKey, jetton string, ecID uint32) *NodeTunnelPolicy {
+	g.mx.RLock()
+	defer g.mx.RUnlock()
+
+	return g.policies[string(key)+ccToKey(jetton, ecID)]
+}
+
+func (g *ChannelGraph) ListChannels() []*GraphChannel {
+	g.mx.RLock()
+	defer g.mx.RUnlock()
+
+	list := make([]*GraphChannel, 0, len(g.channels))
+	for _, ch := range g.channels {
+		list = append(list, ch)
+	}
+	return list
+}
+
+// neighbours - adjacency of nodes by channels of specific coin
+func (g *ChannelGraph) neighbours(jetton string, ecID uint32, exclude map[string]bool) map[string][]string {
+	g.mx.RLock()
+	defer g.mx.RUnlock()
+
+	res := map[string][]string{}
+	for _, ch := range g.channels {
+		if ch.JettonAddress != jetton || ch.ExtraCurrencyID != ecID || exclude[ch.Address] {
+			continue
+		}
+
+		a, b := string(ch.KeyA), string(ch.KeyB)
+		res[a] = append(res[a], b)
+		res[b] = append(res[b], a)
+	}
+	return res
+}
+
+func (s *Service) GetChannelGraph() *ChannelGraph {
+	return s.graph
+}
+
+// routeRestrictions - conditions to skip some routes, used when several routes are built at once
+type routeRestrictions struct {
+	// reserved - amount already planned to send through our direct peer
+	reserved map[string]*big.Int
+	// excludeNodes - nodes which should not be used as intermediate
+	excludeNodes map[string]bool
+	// excludeChannels - channels (our and network) which should not be used
+	excludeChannels map[string]bool
+}
+
+func (r *routeRestrictions) isNodeExcluded(key string) bool {
+	return r != nil && r.excludeNodes[key]
+}
+
+func (r *routeRestrictions) isChannelExcluded(addr string) bool {
+	return r != nil && r.excludeChannels[addr]
+}
+
+// FindRoute - searches for the shortest path from us to target, using our active channels
+// and channels known from the network. Last hop is always the target with zero fee.
+func (s *Service) FindRoute(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount *big.Int) ([]RouteHop, error) {
+	return s.findRoute(ctx, target, jettonAddr, ecID, amount, nil)
+}
+
+func (s *Service) findRoute(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount *big.Int, restrictions *routeRestrictions) ([]RouteHop, error) {
+	cc, err := s.ResolveCoinConfig(jettonAddr, ecID, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	ourKey := s.key.Public().(ed25519.PublicKey)
+	if bytes.Equal(target, ourKey) {
+		return nil, fmt.Errorf("target cannot be our node")
+	}
+
+	balances, err := s.firstHopBalances(ctx, target, jettonAddr, ecID, restrictions)
+	if err != nil {
+		return nil, err
+	}
+
+	// first hops are limited by our channels with enough balance,
+	// fee is not known yet, so it is checked when path is found
+	var firstHops []string
+	for k, balance := range balances {
+		if balance.Cmp(amount) >= 0 {
+			firstHops = append(firstHops, k)
+		}
+	}
+
+	if len(firstHops) == 0 {
+		return nil, fmt.Errorf("%w: no active channels with enough balance", ErrNoRouteFound)
+	}
+	// to get the same route for the same graph
+	sort.Strings(firstHops)
+
+	var excludeChannels map[string]bool
+	if restrictions != nil {
+		excludeChannels = restrictions.excludeChannels
+	}
+	adj := s.graph.neighbours(jettonAddr, ecID, excludeChannels)
+
+	for {
+		route, err := s.searchPath(cc, adj, firstHops, target, jettonAddr, ecID, amount, restrictions)
+		if err != nil {
+			return nil, err
+		}
+
+		// first hop should carry the amount together with fees of all the nodes on the way
+		need := new(big.Int).Set(amount)
+		for _, hop := range route {
+			need.Add(need, hop.Fee)
+		}
+
+		if balances[string(route[0].Key)].Cmp(need) >= 0 {
+			return route, nil
+		}
+
+		// try another path without this first hop
+		for i, k := range firstHops {
+			if k == string(route[0].Key) {
+				firstHops = append(firstHops[:i], firstHops[i+1:]...)
+				break
+			}
+		}
+
+		if len(firstHops) == 0 {
+			return nil, fmt.Errorf("%w: no active channels with enough balance to cover route fees", ErrNoRouteFound)
+		}
+	}
+}
+
+// searchPath - bfs to find path with minimal number of hops, starting from one of the first hops
+func (s *Service) searchPath(cc *config.CoinConfig, adj map[string][]string, firstHops []string, target ed25519.PublicKey, jettonAddr string, ecID uint32, amount *big.Int, restrictions *routeRestrictions) ([]RouteHop, error) {
+	ourKey := s.key.Public().(ed25519.PublicKey)
+
+	prev := map[string]string{}
+	visited := map[string]bool{string(ourKey): true}
+	depth := map[string]int{}
+	queue := make([]string, 0, len(firstHops))
+	for _, k := range firstHops {
+		visited[k] = true
+		prev[k] = string(ourKey)
+		depth[k] = 1
+		queue = append(queue, k)
+	}
+
+	found := false
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		if cur == string(target) {
+			found = true
+			break
+		}
+
+		if depth[cur] >= maxRouteHops {
+			continue
+		}
+
+		// node should be able to proxy this amount to be used as intermediate
+		if !s.canTunnel(ed25519.PublicKey(cur), cc, jettonAddr, ecID, amount) {
+			continue
+		}
+
+		for _, next := range adj[cur] {
+			if visited[next] || (next != string(target) && restrictions.isNodeExcluded(next)) {
+				continue
+			}
+			visited[next] = true
+			prev[next] = cur
+			depth[next] = depth[cur] + 1
+			queue = append(queue, next)
+		}
+	}
+
+	if !found {
+		return nil, ErrNoRouteFound
+	}
+
+	var path []string
+	for cur := string(target); cur != string(ourKey); cur = prev[cur] {
+		path = append([]string{cur}, path...)
+	}
+
+	route := make([]RouteHop, len(path))
+	downstream := big.NewInt(0)
+	for i := len(path) - 1; i >= 0; i-- {
+		route[i] = RouteHop{
+			Key: ed25519.PublicKey(path[i]),
+			Fee: big.NewInt(0),
+		}
+
+		if i == len(path)-1 {
+			// receiver takes nothing
+			continue
+		}
+
+		route[i].Fee = s.estimateTunnelFee(route[i].Key, cc, jettonAddr, ecID, new(big.Int).Add(amount, downstream))
+		downstream = new(big.Int).Add(downstream, route[i].Fee)
+	}
+
+	return route, nil
+}
+
+// firstHopBalances - max available balance with each of our direct peers, which can be used as first hop
+func (s *Service) firstHopBalances(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, restrictions *routeRestrictions) (map[string]*big.Int, error) {
+	channels, err := s.db.GetChannels(ctx, nil, db.ChannelStateActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active channels: %w", err)
+	}
+
+	res := map[string]*big.Int{}
+	for _, ch := range channels {
+		if !ch.AcceptingActions || ch.JettonAddress != jettonAddr || ch.ExtraCurrencyID != ecID {
+			continue
+		}
+
+		if restrictions.isChannelExcluded(ch.Address) ||
+			(restrictions.isNodeExcluded(string(ch.TheirOnchain.Key)) && !bytes.Equal(ch.TheirOnchain.Key, target)) {
+			continue
+		}
+
+		balance, _, err := ch.CalcBalance(false)
+		if err != nil {
+			log.Warn().Err(err).Str("channel", ch.Address).Msg("failed to calc channel balance for route")
+			continue
+		}
+
+		if restrictions != nil && restrictions.reserved[string(ch.TheirOnchain.Key)] != nil {
+			balance = new(big.Int).Sub(balance, restrictions.reserved[string(ch.TheirOnchain.Key)])
+		}
+
+		k := string(ch.TheirOnchain.Key)
+		if res[k] == nil || res[k].Cmp(balance) < 0 {
+			res[k] = balance
+		}
+	}
+	return res, nil
+}
+
+// BuildRouteTunnelChain - finds route to target and prepares tunnel chain with cumulative fees and deadlines,
+// ttl is a time which receiver will have to close channel.
+func (s *Service) BuildRouteTunnelChain(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, capacity *big.Int, ttl time.Duration) ([]transport.TunnelChainPart, error) {
+	return s.buildRouteTunnelChain(ctx, target, jettonAddr, ecID, capacity, ttl, nil)
+}
+
+func (s *Service) buildRouteTunnelChain(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, capacity *big.Int, ttl time.Duration, restrictions *routeRestrictions) ([]transport.TunnelChainPart, error) {
+	route, err := s.findRoute(ctx, target, jettonAddr, ecID, capacity, restrictions)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]ed25519.PublicKey, len(route))
+	for i, hop := range route {
+		keys[i] = hop.Key
+	}
+
+	// route was found using possibly outdated policies, so we ask actual fees from the nodes on the way
+	fees, err := s.CalcTunnelChainFees(ctx, keys, jettonAddr, ecID, capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	// actual fees may be higher than estimated, so balance with first hop is checked again
+	balances, err := s.firstHopBalances(ctx, target, jettonAddr, ecID, restrictions)
+	if err != nil {
+		return nil, err
+	}
+
+	if b := balances[string(keys[0])]; b == nil || b.Cmp(new(big.Int).Add(capacity, fees[0])) < 0 {
+		return nil, fmt.Errorf("%w: not enough balance with first node to cover actual route fees", ErrNoRouteFound)
+	}
+
+	// each hop should have enough time to safely close channel onchain after the next one
+	now := time.Now()
+	chain := make([]transport.TunnelChainPart, len(route))
+	for i, hop := range route {
+		chain[i] = transport.TunnelChainPart{
+			Target:   hop.Key,
+			Capacity: capacity,
+			// hop gets fees for itself and for all the next hops
+			Fee:      fees[i],
+			Deadline: now.Add(ttl + s.GetMinSafeTTL()*time.Duration(len(route)-i)),
+		}
+	}
+
+	return chain, nil
+}
+
+// QueryTunnelingPolicy - asks node for its actual tunnelling conditions and remembers them for route search
+func (s *Service) QueryTunnelingPolicy(ctx context.Context, key ed25519.PublicKey, jettonAddr string, ecID uint32) (*NodeTunnelPolicy, error) {
+	var jettonData []byte
+	if jettonAddr != "" {
+		addr, err := address.ParseAddr(jettonAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse jetton address: %w", err)
+		}
+		jettonData = addr.Data()
+	}
+
+	cfg, err := s.regularTransport.GetTunnelingPolicy(ctx, key, jettonData, ecID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tunnelling policy: %w", err)
+	}
+
+	policy := policyFromVirtualConfig(cfg)
+	s.graph.SetNodePolicy(key, jettonAddr, ecID, policy)
+
+	return policy, nil
+}
+
+// CalcTunnelChainFees - queries actual policies of intermediate nodes and calculates
+// cumulative fee for each part of the chain, last node is the receiver and its fee is always zero.
+func (s *Service) CalcTunnelChainFees(ctx context.Context, keys []ed25519.PublicKey, jettonAddr string, ecID uint32, capacity *big.Int) ([]*big.Int, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("empty chain")
+	}
+
+	cc, err := s.ResolveCoinConfig(jettonAddr, ecID, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	fees := make([]*big.Int, len(keys))
+	fees[len(keys)-1] = big.NewInt(0)
+
+	for i := len(keys) - 2; i >= 0; i-- {
+		policy, err := s.QueryTunnelingPolicy(ctx, keys[i], jettonAddr, ecID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query node %s: %w", base64.StdEncoding.EncodeToString(keys[i]), err)
+		}
+
+		if !policy.AllowTunneling {
+			return nil, fmt.Errorf("node %s is not allowing tunnelling", base64.StdEncoding.EncodeToString(keys[i]))
+		}
+
+		next := new(big.Int).Add(capacity, fees[i+1])
+		if policy.MaxCapacity != nil && policy.MaxCapacity.Cmp(next) < 0 {
+			return nil, fmt.Errorf("node %s is not allowing tunnelling of such capacity, max is %s",
+				base64.StdEncoding.EncodeToString(keys[i]), cc.MustAmount(policy.MaxCapacity).String())
+		}
+
+		fees[i] = new(big.Int).Add(fees[i+1], calcTunnelFee(policy, next))
+	}
+
+	return fees, nil
+}
+
+func policyFromVirtualConfig(cfg transport.VirtualConfigResponse) *NodeTunnelPolicy {
+	return &NodeTunnelPolicy{
+		AllowTunneling: cfg.AllowTunneling,
+		MinFee:         cfg.ProxyMinFee,
+		FeePercent:     cfg.ProxyFeePercent,
+		MaxCapacity:    cfg.ProxyMaxCapacity,
+		UpdatedAt:      time.Now(),
+	}
+}
+
+func (s *Service) getNodePolicy(key ed25519.PublicKey, cc *config.CoinConfig, jettonAddr string, ecID uint32) *NodeTunnelPolicy {
+	if p := s.graph.GetNodePolicy(key, jettonAddr, ecID); p != nil {
+		return p
+	}
+
+	// policy is unknown, we assume that node has conditions similar to ours
+	return &NodeTunnelPolicy{
+		AllowTunneling: true,
+		MinFee:         cc.MustAmountDecimal(cc.VirtualTunnelConfig.ProxyMinFee).Nano(),
+		FeePercent:     cc.VirtualTunnelConfig.AdvertisedFeePercent(),
+	}
+}
+
+func (s *Service) canTunnel(key ed25519.PublicKey, cc *config.CoinConfig, jettonAddr string, ecID uint32, amount *big.Int) bool {
+	p := s.getNodePolicy(key, cc, jettonAddr, ecID)
+	if !p.AllowTunneling {
+		return false
+	}
+	if p.MaxCapacity != nil && p.MaxCapacity.Cmp(amount) < 0 {
+		return false
+	}
+	return true
+}
+
+// estimateTunnelFee - calculates fee using known or assumed policy of the node
+func (s *Service) estimateTunnelFee(key ed25519.PublicKey, cc *config.CoinConfig, jettonAddr string, ecID uint32, nextAmount *big.Int) *big.Int {
+	return calcTunnelFee(s.getNodePolicy(key, cc, jettonAddr, ecID), nextAmount)
+}
+
+// calcTunnelFee - calculates fee the same way as proxy node checks it when processing OpenVirtualAction
+func calcTunnelFee(p *NodeTunnelPolicy, nextAmount *big.Int) *big.Int {
+	fee, _ := new(big.Float).Mul(new(big.Float).SetInt(nextAmount), big.NewFloat(p.FeePercent/100.0)).Int(nil)
+	if p.MinFee != nil && fee.Cmp(p.MinFee) < 0 {
+		fee = new(big.Int).Set(p.MinFee)
+	}
+	return fee
+}
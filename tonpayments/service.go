@@ -19,6 +19,7 @@ import (
 	"github.com/xssnick/tonutils-go/tvm/cell"
 	"math/big"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +27,7 @@ var ErrNotActive = errors.New("channel is not active")
 var ErrDenied = errors.New("actions denied")
 var ErrChannelIsBusy = errors.New("channel is busy")
 var ErrNotPossible = errors.New("not possible")
+var ErrDraining = errors.New("node is draining")
 
 const PaymentsTaskPool = "pn"
 
@@ -33,16 +35,22 @@ type Transport interface {
 	AddUrgentPeer(channelKey ed25519.PublicKey)
 	RemoveUrgentPeer(channelKey ed25519.PublicKey)
 	ProposeChannelConfig(ctx context.Context, theirChannelKey ed25519.PublicKey, prop transport.ProposeChannelConfig) (*address.Address, transport.VirtualConfigResponse, error)
+	GetTunnelingPolicy(ctx context.Context, theirChannelKey ed25519.PublicKey, jettonAddr []byte, ecID uint32) (transport.VirtualConfigResponse, error)
 	RequestAction(ctx context.Context, channelAddr *address.Address, theirChannelKey []byte, action transport.Action) (*transport.Decision, error)
 	ProposeAction(ctx context.Context, lockId int64, channelAddr *address.Address, theirChannelKey []byte, state, updateProof *cell.Cell, action transport.Action) (*transport.ProposalDecision, error)
 	RequestChannelLock(ctx context.Context, theirChannelKey ed25519.PublicKey, channel *address.Address, id int64, lock bool) (*transport.Decision, error)
 	IsChannelUnlocked(ctx context.Context, theirChannelKey ed25519.PublicKey, channel *address.Address, id int64) (*transport.Decision, error)
 	OpenOffchainChannel(ctx context.Context, theirChannelKey, codeHash []byte, cfg payments.OpenConfigContainer) (*address.Address, error)
+	SendGossip(ctx context.Context, theirChannelKey ed25519.PublicKey, gossip transport.Gossip) error
+	SendStreamState(ctx context.Context, theirChannelKey, virtualKey ed25519.PublicKey, state *cell.Cell, final bool) (*big.Int, error)
+	SendWatchtowerBackup(ctx context.Context, towerKey ed25519.PublicKey, backup transport.WatchtowerBackup) error
 }
 
 type Webhook interface {
 	PushChannelEvent(ctx context.Context, ch *db.Channel) error
 	PushVirtualChannelEvent(ctx context.Context, event db.VirtualChannelEventType, meta *db.VirtualChannelMeta, cc *config.CoinConfig) error
+	PushInvoiceEvent(ctx context.Context, inv *db.Invoice) error
+	PushTransferEvent(ctx context.Context, tr *db.Transfer) error
 }
 
 type DB interface {
@@ -72,6 +80,48 @@ type DB interface {
 
 	GetChannelsHistoryByPeriod(ctx context.Context, addr string, limit int, before, after *time.Time) ([]db.ChannelHistoryItem, error)
 
+	CreatePayment(ctx context.Context, payment *db.Payment) error
+	UpdatePayment(ctx context.Context, payment *db.Payment) error
+	GetPayment(ctx context.Context, id []byte) (*db.Payment, error)
+	CreateInvoice(ctx context.Context, invoice *db.Invoice) error
+	UpdateInvoice(ctx context.Context, invoice *db.Invoice) error
+	GetInvoice(ctx context.Context, id []byte) (*db.Invoice, error)
+	CreateStreamSession(ctx context.Context, session *db.StreamSession) error
+	UpdateStreamSession(ctx context.Context, session *db.StreamSession) error
+	GetStreamSession(ctx context.Context, key []byte) (*db.StreamSession, error)
+	CreateSwap(ctx context.Context, swap *db.Swap) error
+	UpdateSwap(ctx context.Context, swap *db.Swap) error
+	GetSwap(ctx context.Context, id []byte) (*db.Swap, error)
+	GetSwapByHash(ctx context.Context, hash []byte) (*db.Swap, error)
+	CreateTransfer(ctx context.Context, tr *db.Transfer) error
+	UpdateTransfer(ctx context.Context, tr *db.Transfer) error
+	GetTransfer(ctx context.Context, id []byte) (*db.Transfer, error)
+	ListTransfers(ctx context.Context, filter db.TransferFilter) ([]*db.Transfer, error)
+	CreateRebalance(ctx context.Context, rb *db.Rebalance) error
+	GetRebalance(ctx context.Context, id []byte) (*db.Rebalance, error)
+	SetAutopilotChannel(ctx context.Context, ch *db.AutopilotChannel) error
+	GetAutopilotChannel(ctx context.Context, addr string) (*db.AutopilotChannel, error)
+	ListAutopilotChannels(ctx context.Context) ([]*db.AutopilotChannel, error)
+	RemoveAutopilotChannel(ctx context.Context, addr string) error
+	AddAutopilotDecision(ctx context.Context, dc *db.AutopilotDecision) error
+	ListAutopilotDecisions(ctx context.Context, limit int) ([]*db.AutopilotDecision, error)
+	SetTunnelOverride(ctx context.Context, o *db.TunnelOverride) error
+	RemoveTunnelOverride(ctx context.Context, o *db.TunnelOverride) error
+	ListTunnelOverrides(ctx context.Context) ([]*db.TunnelOverride, error)
+	SetWatchtowerChannel(ctx context.Context, ch *db.WatchtowerChannel) error
+	GetWatchtowerChannel(ctx context.Context, addr string, clientKey []byte) (*db.WatchtowerChannel, error)
+	RemoveWatchtowerChannel(ctx context.Context, addr string, clientKey []byte) error
+	ListWatchtowerChannels(ctx context.Context, addr string) ([]*db.WatchtowerChannel, error)
+
+	SetNetworkNode(ctx context.Context, node *db.NetworkNode) error
+	GetNetworkNode(ctx context.Context, key ed25519.PublicKey) (*db.NetworkNode, error)
+	ListNetworkNodes(ctx context.Context) ([]*db.NetworkNode, error)
+	RemoveNetworkNode(ctx context.Context, key ed25519.PublicKey) error
+	SetNetworkChannel(ctx context.Context, ch *db.NetworkChannel) error
+	GetNetworkChannel(ctx context.Context, addr string) (*db.NetworkChannel, error)
+	ListNetworkChannels(ctx context.Context) ([]*db.NetworkChannel, error)
+	RemoveNetworkChannel(ctx context.Context, addr string) error
+
 	Close()
 }
 
@@ -134,6 +184,7 @@ type Service struct {
 	updates          chan any
 	db               DB
 	webhook          Webhook
+	acceptancePolicy AcceptancePolicy
 
 	key ed25519.PrivateKey
 
@@ -157,14 +208,26 @@ type Service struct {
 	supportedEC        map[uint32]config.CoinConfig
 	supportedTon       bool
 	balanceControllers map[string]*balanceControlConfig
+	autopilots         map[string]*autopilotConfig
+	tunnelOverrides    map[string]*db.TunnelOverride
 	urgentPeers        map[string]int
+	towers             []ed25519.PublicKey
+	towerClients       map[string]bool
 	useMetrics         bool
 
+	watchContract func(addr string, watch bool)
+
+	draining atomic.Bool
+
+	graph *ChannelGraph
+
 	globalCtx    context.Context
 	globalCancel context.CancelFunc
 
-	urgentPeersMx sync.RWMutex
-	discoveryMx   sync.Mutex
+	urgentPeersMx     sync.RWMutex
+	tunnelOverridesMx sync.RWMutex
+	discoveryMx       sync.Mutex
+	streamMx          sync.Mutex
 }
 
 func NewService(api ChainAPI, database DB, transport, webTransport Transport, wallet Wallet, updates chan any, key ed25519.PrivateKey, cfg config.ChannelsConfig, useMetrics bool) (*Service, error) {
@@ -186,10 +249,14 @@ func NewService(api ChainAPI, database DB, transport, webTransport Transport, wa
 		supportedEC:                    map[uint32]config.CoinConfig{},
 		supportedTon:                   cfg.SupportedCoins.Ton.Enabled,
 		balanceControllers:             map[string]*balanceControlConfig{},
+		autopilots:                     map[string]*autopilotConfig{},
+		tunnelOverrides:                map[string]*db.TunnelOverride{},
 		urgentPeers:                    map[string]int{},
+		graph:                          NewChannelGraph(),
 		globalCtx:                      globalCtx,
 		globalCancel:                   globalCancel,
 		useMetrics:                     useMetrics,
+		acceptancePolicy:               ConfigAcceptancePolicy{},
 	}
 
 	addBalanceControl := func(jetton string, ecID uint32, currency config.CoinConfig) error {
@@ -214,6 +281,15 @@ func NewService(api ChainAPI, database DB, transport, webTransport Transport, wa
 		return nil
 	}
 
+	addAutopilot := func(jetton string, ecID uint32, currency config.CoinConfig) error {
+		ap, err := newAutopilotConfig(jetton, ecID, currency)
+		if err != nil {
+			return err
+		}
+		s.autopilots[ccToKey(jetton, ecID)] = ap
+		return nil
+	}
+
 	var balanceControl bool
 	for addr, currency := range cfg.SupportedCoins.Jettons {
 		if !currency.Enabled {
@@ -226,6 +302,9 @@ func NewService(api ChainAPI, database DB, transport, webTransport Transport, wa
 		}
 		addr = a.Bounce(true).String()
 
+		if err = validateTunnelConfig(currency); err != nil {
+			return nil, err
+		}
 		s.supportedJettons[addr] = currency
 
 		if currency.BalanceControl != nil {
@@ -234,6 +313,12 @@ func NewService(api ChainAPI, database DB, transport, webTransport Transport, wa
 				return nil, err
 			}
 		}
+
+		if currency.Autopilot != nil {
+			if err = addAutopilot(addr, 0, currency); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	for id, currency := range cfg.SupportedCoins.ExtraCurrencies {
@@ -245,6 +330,9 @@ func NewService(api ChainAPI, database DB, transport, webTransport Transport, wa
 			return nil, fmt.Errorf("extra currency id 0 is reserved")
 		}
 
+		if err := validateTunnelConfig(currency); err != nil {
+			return nil, err
+		}
 		s.supportedEC[id] = currency
 
 		if currency.BalanceControl != nil {
@@ -253,6 +341,12 @@ func NewService(api ChainAPI, database DB, transport, webTransport Transport, wa
 				return nil, err
 			}
 		}
+
+		if currency.Autopilot != nil {
+			if err := addAutopilot("", id, currency); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	if cfg.SupportedCoins.Ton.BalanceControl != nil {
@@ -262,10 +356,62 @@ func NewService(api ChainAPI, database DB, transport, webTransport Transport, wa
 		}
 	}
 
+	if err := validateTunnelConfig(cfg.SupportedCoins.Ton); err != nil {
+		return nil, err
+	}
+
+	if cfg.SupportedCoins.Ton.Enabled && cfg.SupportedCoins.Ton.Autopilot != nil {
+		if err := addAutopilot("", 0, cfg.SupportedCoins.Ton); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := s.loadUrgentPeers(context.Background()); err != nil {
 		return nil, err
 	}
 
+	if err := s.loadTunnelOverrides(context.Background()); err != nil {
+		return nil, err
+	}
+
+	if cfg.Watchtower != nil {
+		if cfg.Watchtower.Serve && cfg.Watchtower.MaxChannelsPerClient <= 0 {
+			return nil, fmt.Errorf("watchtower max channels per client should be positive")
+		}
+
+		if cfg.Watchtower.Serve && len(cfg.Watchtower.Clients) == 0 {
+			return nil, fmt.Errorf("watchtower clients should be registered to serve")
+		}
+
+		s.towerClients = map[string]bool{}
+		for _, c := range cfg.Watchtower.Clients {
+			k, err := base64.StdEncoding.DecodeString(c)
+			if err != nil || len(k) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("incorrect watchtower client key %s", c)
+			}
+			s.towerClients[string(k)] = true
+		}
+
+		for _, t := range cfg.Watchtower.Towers {
+			k, err := base64.StdEncoding.DecodeString(t.Key)
+			if err != nil || len(k) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("incorrect watchtower key %s", t.Key)
+			}
+			s.towers = append(s.towers, k)
+		}
+
+		if len(s.towers) > 0 {
+			handler := s.watchtowerCallback
+			if current := database.GetOnChannelUpdated(); current != nil {
+				handler = func(ctx context.Context, ch *db.Channel, statusChanged bool) {
+					current(ctx, ch, statusChanged)
+					s.watchtowerCallback(ctx, ch, statusChanged)
+				}
+			}
+			database.SetOnChannelUpdated(handler)
+		}
+	}
+
 	if balanceControl {
 		handler := s.channelCallback
 		if current := database.GetOnChannelUpdated(); current != nil {
@@ -292,6 +438,8 @@ func NewService(api ChainAPI, database DB, transport, webTransport Transport, wa
 		}()
 	}
 
+	s.draining.Store(cfg.DrainMode)
+
 	return s, nil
 }
 
@@ -465,7 +613,7 @@ func (s *Service) GetMinSafeTTL() time.Duration {
 	return time.Duration(s.cfg.MinSafeVirtualChannelTimeoutSec+s.cfg.BufferTimeToCommit+s.cfg.ConditionalCloseDurationSec+s.cfg.QuarantineDurationSec) * time.Second
 }
 
-func (s *Service) ReviewChannelConfig(prop transport.ProposeChannelConfig) (*address.Address, config.CoinConfig, error) {
+func (s *Service) ReviewChannelConfig(key ed25519.PublicKey, prop transport.ProposeChannelConfig) (*address.Address, config.CoinConfig, error) {
 	var jetton *address.Address
 	if !bytes.Equal(prop.JettonAddr, make([]byte, 32)) {
 		jetton = address.NewAddress(0, 0, prop.JettonAddr)
@@ -500,6 +648,13 @@ func (s *Service) ReviewChannelConfig(prop transport.ProposeChannelConfig) (*add
 		return nil, config.CoinConfig{}, fmt.Errorf("node wants different channel config: quarantine %d, cond close %d, fine %s; if you want to deploy", s.cfg.QuarantineDurationSec, s.cfg.ConditionalCloseDurationSec, ourFine.String())
 	}
 
+	var jettonAddr string
+	if jetton != nil {
+		jettonAddr = jetton.Bounce(true).String()
+	}
+	// peer sees conditions we have for it
+	cfg.VirtualTunnelConfig = s.tunnelConfig(key, jettonAddr, prop.ExtraCurrencyID, &cfg)
+
 	return s.wallet.WalletAddress(), cfg, nil
 }
 
@@ -525,12 +680,6 @@ func (s *Service) scanSettledConditionals(channelAddr string, tx *client.Transac
 			continue
 		}
 
-		var state payments.VirtualChannelState
-		if err = tlb.LoadFromCell(&state, kv.Value); err != nil {
-			log.Warn().Err(err).Str("address", channelAddr).Uint64("id", key).Msg("failed to load condition state")
-			continue
-		}
-
 		cond, err := proofDict.LoadValueByIntKey(big.NewInt(int64(key)))
 		if err != nil {
 			log.Warn().Err(err).Str("address", channelAddr).Uint64("id", key).Msg("failed to load condition code")
@@ -543,9 +692,29 @@ func (s *Service) scanSettledConditionals(channelAddr string, tx *client.Transac
 			continue
 		}
 
-		if err = s.AddVirtualChannelResolve(context.Background(), vch.Key, state); err != nil {
-			log.Warn().Err(err).Str("address", channelAddr).Str("key", base64.StdEncoding.EncodeToString(vch.Key)).Msg("failed to add virtual channel resolve")
-			continue
+		if vch.IsHashLocked() {
+			var state payments.HTLCState
+			if err = tlb.LoadFromCell(&state, kv.Value); err != nil {
+				log.Warn().Err(err).Str("address", channelAddr).Uint64("id", key).Msg("failed to load condition preimage")
+				continue
+			}
+
+			// preimage is revealed onchain, so we can use it to unlock previous channel in chain
+			if err = s.AddVirtualChannelPreimage(context.Background(), vch.Key, state.Preimage); err != nil {
+				log.Warn().Err(err).Str("address", channelAddr).Str("key", base64.StdEncoding.EncodeToString(vch.Key)).Msg("failed to add virtual channel preimage")
+				continue
+			}
+		} else {
+			var state payments.VirtualChannelState
+			if err = tlb.LoadFromCell(&state, kv.Value); err != nil {
+				log.Warn().Err(err).Str("address", channelAddr).Uint64("id", key).Msg("failed to load condition state")
+				continue
+			}
+
+			if err = s.AddVirtualChannelResolve(context.Background(), vch.Key, state); err != nil {
+				log.Warn().Err(err).Str("address", channelAddr).Str("key", base64.StdEncoding.EncodeToString(vch.Key)).Msg("failed to add virtual channel resolve")
+				continue
+			}
 		}
 
 		// close next virtual channels since they commited latest resolve onchain
@@ -563,6 +732,17 @@ func (s *Service) scanSettledConditionals(channelAddr string, tx *client.Transac
 
 func (s *Service) Start() {
 	go s.taskExecutor()
+	if !isWeb {
+		go s.gossipLoop()
+
+		if len(s.autopilots) > 0 {
+			go s.autopilotLoop()
+		}
+
+		if s.cfg.Watchtower != nil && s.cfg.Watchtower.Serve {
+			s.startWatchtower()
+		}
+	}
 	if s.useMetrics {
 		go s.channelsMonitor()
 		go s.walletMonitor()
@@ -583,6 +763,10 @@ func (s *Service) Start() {
 				continue
 			}
 		case ChannelUpdatedEvent:
+			if s.cfg.Watchtower != nil && s.cfg.Watchtower.Serve {
+				s.watchtowerOnChannelUpdate(upd)
+			}
+
 			channelJson, _ := json.Marshal(upd.Channel)
 			ok, isLeft := s.verifyChannel(upd.Channel)
 			if !ok {
@@ -1236,7 +1420,7 @@ func (s *Service) proposeAction(ctx context.Context, lockId int64, channelAddres
 			return ErrChannelIsBusy
 		}
 		log.Warn().Str("reason", res.Reason).Msg("actions request denied")
-		return ErrDenied
+		return fmt.Errorf("%w: %s", ErrDenied, res.Reason)
 	}
 
 	var theirState payments.SignedSemiChannel
@@ -0,0 +1,399 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/db/leveldb"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tl"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+)
+
+// testNetwork - in-memory network provider, messages are serialized and parsed
+// on each query, so nodes talk the same way as over adnl.
+type testNetwork struct {
+	nodes map[string]*testNode
+	mx    sync.Mutex
+}
+
+type testNode struct {
+	net *testNetwork
+	key ed25519.PrivateKey
+	svc *Service
+	db  *db.DB
+
+	q      func(ctx context.Context, peer *transport.Peer, msg any) (any, error)
+	peers  map[string]*transport.Peer
+	pinged map[string]bool
+	mx     sync.Mutex
+}
+
+type testConn struct {
+	from, to *testNode
+}
+
+func newTestNetwork() *testNetwork {
+	return &testNetwork{nodes: map[string]*testNode{}}
+}
+
+func testConfig() config.ChannelsConfig {
+	return config.ChannelsConfig{
+		SupportedCoins: config.CoinTypes{
+			Ton: config.CoinConfig{
+				Enabled:  true,
+				Decimals: 9,
+				Symbol:   "TON",
+				VirtualTunnelConfig: config.VirtualConfig{
+					MaxCapacityToRentPerTx: "5",
+					CapacityDepositFee:     "0.05",
+					ProxyMaxCapacity:       "100",
+					ProxyMinFee:            "0.001",
+					ProxyFeePercent:        1,
+					AllowTunneling:         true,
+				},
+				MisbehaviorFine:       "0.1",
+				ExcessFeeTon:          "0.25",
+				MinCapacityRequest:    "1",
+				FeePerWithdrawPropose: "0.05",
+			},
+		},
+		BufferTimeToCommit:              30,
+		QuarantineDurationSec:           30,
+		ConditionalCloseDurationSec:     30,
+		MinSafeVirtualChannelTimeoutSec: 30,
+	}
+}
+
+func (n *testNetwork) addNode(t *testing.T, cfg config.ChannelsConfig) *testNode {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ldb, _, err := leveldb.NewLevelDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	node := &testNode{
+		net:    n,
+		key:    key,
+		db:     db.NewDB(ldb, key.Public().(ed25519.PublicKey)),
+		peers:  map[string]*transport.Peer{},
+		pinged: map[string]bool{},
+	}
+
+	tr := transport.NewTransport(key, node, false)
+	node.svc, err = NewService(nil, node.db, tr, nil, nil, make(chan any), key, cfg, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.SetService(node.svc)
+	go node.svc.taskExecutor()
+
+	t.Cleanup(func() {
+		node.svc.Stop()
+		tr.Stop()
+		// give executor time to finish current task
+		time.Sleep(50 * time.Millisecond)
+		ldb.Close()
+	})
+
+	n.mx.Lock()
+	n.nodes[string(node.pub())] = node
+	n.mx.Unlock()
+
+	return node
+}
+
+func (n *testNode) pub() ed25519.PublicKey {
+	return n.key.Public().(ed25519.PublicKey)
+}
+
+func (n *testNode) GetOurID() []byte {
+	return n.pub()
+}
+
+func (n *testNode) SetHandlers(q func(ctx context.Context, peer *transport.Peer, msg any) (any, error), _ func(ctx context.Context, peer *transport.Peer) error) {
+	n.q = q
+}
+
+func (n *testNode) Connect(_ context.Context, channelKey ed25519.PublicKey) (*transport.Peer, error) {
+	n.net.mx.Lock()
+	to := n.net.nodes[string(channelKey)]
+	n.net.mx.Unlock()
+
+	if to == nil {
+		return nil, fmt.Errorf("node is not reachable")
+	}
+	return n.peer(to), nil
+}
+
+// peer - connection with the node as it is seen on our side, reused for queries in both directions
+func (n *testNode) peer(from *testNode) *transport.Peer {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	p := n.peers[string(from.pub())]
+	if p == nil {
+		p = &transport.Peer{ID: from.pub(), Conn: &testConn{from: n, to: from}}
+		n.peers[string(from.pub())] = p
+	}
+	return p
+}
+
+func (c *testConn) Query(ctx context.Context, msg, res tl.Serializable) error {
+	data, err := tl.Serialize(msg, true)
+	if err != nil {
+		return fmt.Errorf("failed to serialize query: %w", err)
+	}
+
+	var req any
+	if _, err = tl.Parse(&req, data, true); err != nil {
+		return fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	resp, err := c.to.q(ctx, c.to.peer(c.from), req)
+	if err != nil {
+		return fmt.Errorf("failed to handle query: %w", err)
+	}
+
+	if _, ok := req.(transport.Ping); ok {
+		// ping is sent only after authentication
+		c.to.mx.Lock()
+		c.to.pinged[string(c.from.pub())] = true
+		c.to.mx.Unlock()
+	}
+
+	if data, err = tl.Serialize(resp, true); err != nil {
+		return fmt.Errorf("failed to serialize response: %w", err)
+	}
+
+	if _, err = tl.Parse(res, data, true); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
+
+// connect - creates active ton channel between nodes in both dbs, as if it was deployed and topped up onchain,
+// all other nodes learn about it like from announcement. Returns channel address.
+func (n *testNetwork) connect(t *testing.T, a, b *testNode, depositA, depositB string) string {
+	return n.connectCoin(t, a, b, 0, depositA, depositB)
+}
+
+// connectCoin - the same as connect, but channel is in extra currency, when ecID is not zero
+func (n *testNetwork) connectCoin(t *testing.T, a, b *testNode, ecID uint32, depositA, depositB string) string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := address.NewAddress(0, 0, append(append([]byte{}, id...), id...)).String()
+
+	side := func(our, their *testNode, ourDeposit, theirDeposit string, left bool) *db.Channel {
+		ch := &db.Channel{
+			ID:              id,
+			Address:         addr,
+			Status:          db.ChannelStateActive,
+			WeLeft:          left,
+			ExtraCurrencyID: ecID,
+			OurOnchain: db.OnchainState{
+				Key:       our.pub(),
+				Deposited: mustNano(t, ourDeposit),
+				Withdrawn: big.NewInt(0),
+				Sent:      big.NewInt(0),
+			},
+			TheirOnchain: db.OnchainState{
+				Key:       their.pub(),
+				Deposited: mustNano(t, theirDeposit),
+				Withdrawn: big.NewInt(0),
+				Sent:      big.NewInt(0),
+			},
+			SafeOnchainClosePeriod: 90,
+			AcceptingActions:       true,
+			ActiveOnchain:          true,
+			Our:                    db.NewSide(id, 0, 0),
+			Their:                  db.NewSide(id, 0, 0),
+			InitAt:                 time.Now(),
+			CreatedAt:              time.Now(),
+		}
+		ch.Our.Conditionals = cell.NewDict(32)
+		ch.Their.Conditionals = cell.NewDict(32)
+		return ch
+	}
+
+	if err := a.db.CreateChannel(context.Background(), side(a, b, depositA, depositB, true)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.db.CreateChannel(context.Background(), side(b, a, depositB, depositA, false)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// nodes keep connection with peers they have channels with
+	a.svc.AddUrgentPeer(b.pub())
+	waitFor(t, 5*time.Second, "peers connection", func() bool {
+		b.mx.Lock()
+		defer b.mx.Unlock()
+		return b.pinged[string(a.pub())]
+	})
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	for _, node := range n.nodes {
+		if node == a || node == b {
+			continue
+		}
+		node.svc.graph.UpdateChannel(&GraphChannel{
+			Address:         addr,
+			KeyA:            a.pub(),
+			KeyB:            b.pub(),
+			ExtraCurrencyID: ecID,
+			UpdatedAt:       time.Now(),
+		})
+	}
+	return addr
+}
+
+func mustNano(t *testing.T, amount string) *big.Int {
+	v, err := tlb.FromDecimal(amount, 9)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return v.Nano()
+}
+
+// waitFor - checks condition until it is true or timeout is reached
+func waitFor(t *testing.T, timeout time.Duration, what string, f func() bool) {
+	till := time.Now().Add(timeout)
+	for !f() {
+		if time.Now().After(till) {
+			t.Fatal("timeout waiting for " + what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// openVirtual - opens virtual channel from the first node to the last one through the others
+// and waits until receiver accepts it. Returns key of the channel.
+func openVirtual(t *testing.T, capacity string, payloads []any, nodes ...*testNode) ed25519.PrivateKey {
+	sender, receiver := nodes[0], nodes[len(nodes)-1]
+
+	_, vPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	chain, err := sender.svc.BuildRouteTunnelChain(context.Background(), receiver.pub(), "", 0, mustNano(t, capacity), 5*time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(chain) != len(nodes)-1 {
+		t.Fatal("unexpected route length", len(chain))
+	}
+
+	vc, firstInstructionKey, tun, err := transport.GenerateTunnel(vPriv, chain, 5, false, sender.key, payloads...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = sender.svc.OpenVirtualChannel(context.Background(), chain[0].Target, firstInstructionKey, receiver.pub(), vPriv, tun, vc, nil, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	sender.svc.touchWorker()
+
+	vKey := vPriv.Public().(ed25519.PublicKey)
+	waitFor(t, 10*time.Second, "virtual channel open", func() bool {
+		meta, err := receiver.db.GetVirtualChannelMeta(context.Background(), vKey)
+		return err == nil && meta.Status == db.VirtualChannelStateActive
+	})
+	waitFor(t, 10*time.Second, "sender to see channel open", func() bool {
+		meta, err := sender.db.GetVirtualChannelMeta(context.Background(), vKey)
+		return err == nil && meta.Status == db.VirtualChannelStateActive && meta.Outgoing != nil && bytes.Equal(meta.Key, vKey)
+	})
+	return vPriv
+}
+
+// propose - sends action to the party in the channel the same way as tasks do, returns their decision
+func propose(t *testing.T, n *testNode, channelAddr string, action transport.Action) error {
+	_, lockId, unlock, err := n.svc.AcquireChannel(context.Background(), channelAddr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer unlock()
+
+	return n.svc.proposeAction(context.Background(), lockId, channelAddr, action, nil)
+}
+
+// outgoingVirtual - virtual channel condition in our state of the channel
+func outgoingVirtual(t *testing.T, n *testNode, channelAddr string, key ed25519.PublicKey) *payments.VirtualChannel {
+	ch, err := n.db.GetChannel(context.Background(), channelAddr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, vch, err := payments.FindVirtualChannel(ch.Our.Conditionals, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return vch
+}
+
+// proposeVirtual - proposes opening of virtual channel directly to the party, the same way as open-virtual task does,
+// returns key of the channel and their decision
+func proposeVirtual(t *testing.T, from, to *testNode, channelAddr, capacity string, withFinalState bool, hashLock []byte, payloads ...any) (ed25519.PublicKey, error) {
+	return proposeVirtualTTL(t, from, to, channelAddr, capacity, 5*time.Minute, withFinalState, hashLock, payloads...)
+}
+
+func proposeVirtualTTL(t *testing.T, from, to *testNode, channelAddr, capacity string, ttl time.Duration, withFinalState bool, hashLock []byte, payloads ...any) (ed25519.PublicKey, error) {
+	chain, err := from.svc.BuildRouteTunnelChain(context.Background(), to.pub(), "", 0, mustNano(t, capacity), ttl)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return proposeTunnel(t, from, channelAddr, chain, withFinalState, hashLock, payloads...)
+}
+
+// proposeTunnel - the same as proposeVirtual, but with the given chain, so each hop can get its own payloads
+func proposeTunnel(t *testing.T, from *testNode, channelAddr string, chain []transport.TunnelChainPart, withFinalState bool, hashLock []byte, payloads ...any) (ed25519.PublicKey, error) {
+	_, vPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return proposeTunnelKey(t, from, channelAddr, vPriv, chain, withFinalState, hashLock, payloads...)
+}
+
+// proposeTunnelKey - the same as proposeTunnel, but with the given key of virtual channel
+func proposeTunnelKey(t *testing.T, from *testNode, channelAddr string, vPriv ed25519.PrivateKey, chain []transport.TunnelChainPart, withFinalState bool, hashLock []byte, payloads ...any) (ed25519.PublicKey, error) {
+	vc, firstInstructionKey, tun, err := transport.GenerateTunnel(vPriv, chain, 5, withFinalState, from.key, payloads...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vc.HashLock = hashLock
+
+	act := transport.OpenVirtualAction{
+		ChannelKey:     vc.Key,
+		InstructionKey: firstInstructionKey,
+	}
+	if err = act.SetInstructions(tun, vPriv); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, lockId, unlock, err := from.svc.AcquireChannel(context.Background(), channelAddr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer unlock()
+
+	return vc.Key, from.svc.proposeAction(context.Background(), lockId, channelAddr, act, vc)
+}
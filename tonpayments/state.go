@@ -116,6 +116,104 @@ func (s *Service) updateOurStateWithAction(channel *db.Channel, action transport
 				Msg("virtual channel commit confirmed")
 			return nil
 		}
+	case transport.ExtendVirtualAction:
+		_, vch, err := payments.FindVirtualChannelWithProof(channel.Our.Conditionals, act.Key, dictRoot)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if act.Deadline < vch.Deadline {
+			return nil, nil, nil, fmt.Errorf("deadline cannot be decreased")
+		} else if act.Deadline == vch.Deadline {
+			// same
+			idempotency = true
+			break
+		}
+
+		fee := new(big.Int).SetBytes(act.Fee)
+
+		key := big.NewInt(int64(binary.LittleEndian.Uint32(vch.Key)))
+
+		vch.Deadline = act.Deadline
+		if err := channel.Our.Conditionals.SetIntKey(key, vch.Serialize()); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to set condition: %w", err)
+		}
+
+		channel.Our.State.Data.Sent = cc.MustAmount(new(big.Int).Add(channel.Our.State.Data.Sent.Nano(), fee))
+
+		balance, _, err := channel.CalcBalance(false)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to calc our side balance: %w", err)
+		}
+
+		if balance.Sign() < 0 {
+			return nil, nil, nil, fmt.Errorf("not enough available balance to pay extension fee")
+		}
+
+		onSuccess = func(ctx context.Context) error {
+			if err := s.onOutgoingVirtualExtended(ctx, channel, vch); err != nil {
+				return err
+			}
+
+			log.Info().Str("key", base64.StdEncoding.EncodeToString(vch.Key)).
+				Str("fee", cc.MustAmount(fee).String()).
+				Time("deadline", time.Unix(vch.Deadline, 0)).
+				Str("channel", channel.Address).
+				Msg("virtual channel extension confirmed")
+			return nil
+		}
+	case transport.IncreaseVirtualAction:
+		_, vch, err := payments.FindVirtualChannelWithProof(channel.Our.Conditionals, act.Key, dictRoot)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		capacity := new(big.Int).SetBytes(act.Capacity)
+		fee := new(big.Int).SetBytes(act.Fee)
+
+		if capacity.Cmp(vch.Capacity) == 0 && fee.Cmp(vch.Fee) == 0 {
+			// same
+			idempotency = true
+			break
+		}
+
+		if capacity.Cmp(vch.Capacity) <= 0 {
+			return nil, nil, nil, fmt.Errorf("capacity should be increased")
+		}
+
+		if fee.Cmp(vch.Fee) < 0 {
+			return nil, nil, nil, fmt.Errorf("fee cannot be decreased")
+		}
+
+		key := big.NewInt(int64(binary.LittleEndian.Uint32(vch.Key)))
+
+		vch.Capacity = capacity
+		vch.Fee = fee
+		if err := channel.Our.Conditionals.SetIntKey(key, vch.Serialize()); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to set condition: %w", err)
+		}
+
+		balance, _, err := channel.CalcBalance(false)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to calc our side balance: %w", err)
+		}
+
+		if balance.Sign() < 0 {
+			return nil, nil, nil, fmt.Errorf("not enough available balance to increase capacity, need %s more", cc.MustAmount(new(big.Int).Neg(balance)).String())
+		}
+
+		onSuccess = func(ctx context.Context) error {
+			if err := s.onOutgoingVirtualIncreased(ctx, channel, vch); err != nil {
+				return err
+			}
+
+			log.Info().Str("key", base64.StdEncoding.EncodeToString(vch.Key)).
+				Str("capacity", cc.MustAmount(vch.Capacity).String()).
+				Str("fee", cc.MustAmount(vch.Fee).String()).
+				Str("channel", channel.Address).
+				Msg("virtual channel capacity increase confirmed")
+			return nil
+		}
 	case transport.RemoveVirtualAction:
 		idx, vch, err := payments.FindVirtualChannelWithProof(channel.Our.Conditionals, act.Key, dictRoot)
 		if err != nil {
@@ -141,7 +239,11 @@ func (s *Service) updateOurStateWithAction(channel *db.Channel, action transport
 			return nil, nil, nil, fmt.Errorf("deleted value is still exists for some reason: %w", err)
 		}
 
-		onSuccess = func(_ context.Context) error {
+		onSuccess = func(ctx context.Context) error {
+			if err := s.updateTransfer(ctx, vch.Key, db.TransferStatusFailed, nil, s.transferFailReason(ctx, vch)); err != nil {
+				return err
+			}
+
 			log.Info().Str("key", base64.StdEncoding.EncodeToString(vch.Key)).
 				Str("capacity", tlb.MustFromNano(vch.Capacity, int(cc.Decimals)).String()).
 				Str("channel", channel.Address).
@@ -149,15 +251,6 @@ func (s *Service) updateOurStateWithAction(channel *db.Channel, action transport
 			return nil
 		}
 	case transport.ConfirmCloseAction:
-		var vState payments.VirtualChannelState
-		if err := tlb.LoadFromCell(&vState, act.State.BeginParse()); err != nil {
-			return nil, nil, nil, fmt.Errorf("failed to load virtual channel state cell: %w", err)
-		}
-
-		if !vState.Verify(act.Key) {
-			return nil, nil, nil, fmt.Errorf("incorrect channel state signature")
-		}
-
 		idx, vch, err := payments.FindVirtualChannelWithProof(channel.Our.Conditionals, act.Key, dictRoot)
 		if err != nil {
 			if errors.Is(err, payments.ErrNotFound) {
@@ -167,6 +260,11 @@ func (s *Service) updateOurStateWithAction(channel *db.Channel, action transport
 			}
 			return nil, nil, nil, err
 		}
+
+		amount, err := vch.ResolveAmount(act.State)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("incorrect resolve: %w", err)
+		}
 		// new skeleton to reset prev path
 		dictRoot = cell.CreateProofSkeleton()
 
@@ -186,7 +284,7 @@ func (s *Service) updateOurStateWithAction(channel *db.Channel, action transport
 			return nil, nil, nil, fmt.Errorf("deleted value is still exists for some reason: %w", err)
 		}
 
-		toSend := new(big.Int).Set(vState.Amount)
+		toSend := new(big.Int).Set(amount)
 		toSend = toSend.Sub(toSend, vch.Prepay)
 		toSend = toSend.Add(toSend, vch.Fee)
 
@@ -200,11 +298,15 @@ func (s *Service) updateOurStateWithAction(channel *db.Channel, action transport
 			channel.OurLockedDeposit.Used.Add(channel.OurLockedDeposit.Used, toSend)
 		}
 
-		onSuccess = func(_ context.Context) error {
+		onSuccess = func(ctx context.Context) error {
+			if err := s.updateTransfer(ctx, vch.Key, db.TransferStatusClosed, amount, ""); err != nil {
+				return err
+			}
+
 			log.Info().Str("key", base64.StdEncoding.EncodeToString(vch.Key)).
 				Str("capacity", cc.MustAmount(vch.Capacity).String()).
 				Str("fee", cc.MustAmount(vch.Fee).String()).
-				Str("amount", cc.MustAmount(vState.Amount).String()).
+				Str("amount", cc.MustAmount(amount).String()).
 				Str("prepaid", cc.MustAmount(vch.Prepay).String()).
 				Str("channel", channel.Address).
 				Msg("virtual channel close confirmed")
@@ -0,0 +1,449 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+	"math/big"
+	"time"
+)
+
+const (
+	MinStreamIdleTimeout     = 10 * time.Second
+	DefaultStreamIdleTimeout = 5 * time.Minute
+)
+
+var ErrStreamSessionClosed = errors.New("stream session is closed")
+
+// OpenStreamSession - opens virtual channel to target, which can be paid incrementally using StreamPay
+func (s *Service) OpenStreamSession(ctx context.Context, target ed25519.PublicKey, jettonAddr string, ecID uint32, capacity *big.Int, ttl, idleTimeout time.Duration) (*db.StreamSession, error) {
+	var jettonMaster *address.Address
+	if jettonAddr != "" {
+		var err error
+		jettonMaster, err = address.ParseAddr(jettonAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse jetton address: %w", err)
+		}
+		jettonAddr = jettonMaster.Bounce(true).String()
+	}
+
+	if capacity.Sign() <= 0 {
+		return nil, fmt.Errorf("capacity should be positive")
+	}
+
+	if idleTimeout == 0 {
+		idleTimeout = DefaultStreamIdleTimeout
+	} else if idleTimeout < MinStreamIdleTimeout {
+		return nil, fmt.Errorf("idle timeout should be at least %s", MinStreamIdleTimeout)
+	}
+
+	chain, err := s.BuildRouteTunnelChain(ctx, target, jettonAddr, ecID, capacity, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build route: %w", err)
+	}
+
+	_, vPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	vc, firstInstructionKey, tun, err := transport.GenerateTunnel(vPriv, chain, 5, false, s.key, transport.StreamPayload{
+		IdleTimeout: int32(idleTimeout / time.Second),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate tunnel: %w", err)
+	}
+
+	session := &db.StreamSession{
+		Key:             vc.Key,
+		Incoming:        false,
+		Counterparty:    target,
+		JettonAddress:   jettonAddr,
+		ExtraCurrencyID: ecID,
+		Capacity:        capacity,
+		Paid:            big.NewInt(0),
+		IdleTimeout:     idleTimeout,
+		Deadline:        chain[len(chain)-1].Deadline,
+		Status:          db.StreamSessionStatusActive,
+		PrivateKey:      vPriv,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	// session is saved before opening, so we will not lose the key in case of failure in between
+	if err = s.db.CreateStreamSession(ctx, session); err != nil {
+		return nil, fmt.Errorf("failed to save stream session: %w", err)
+	}
+
+	if err = s.OpenVirtualChannel(ctx, chain[0].Target, firstInstructionKey, target, vPriv, tun, vc, jettonMaster, ecID); err != nil {
+		session.Status = db.StreamSessionStatusClosed
+		session.UpdatedAt = time.Now()
+		if err := s.db.UpdateStreamSession(ctx, session); err != nil {
+			log.Warn().Err(err).Str("key", base64.StdEncoding.EncodeToString(session.Key)).Msg("failed to update stream session")
+		}
+		return nil, fmt.Errorf("failed to open virtual channel: %w", err)
+	}
+
+	log.Info().Str("key", base64.StdEncoding.EncodeToString(session.Key)).
+		Str("capacity", capacity.String()).
+		Msg("stream session opening started")
+
+	return session, nil
+}
+
+// StreamPay - increases paid amount of outgoing stream session, new state is sent to the receiver,
+// and considered paid only after receiver's acknowledgement
+func (s *Service) StreamPay(ctx context.Context, key ed25519.PublicKey, increment *big.Int) (*db.StreamSession, error) {
+	if increment.Sign() <= 0 {
+		return nil, fmt.Errorf("increment should be positive")
+	}
+
+	s.streamMx.Lock()
+	defer s.streamMx.Unlock()
+
+	session, err := s.getOutgoingStreamSession(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	paid := new(big.Int).Add(session.Paid, increment)
+	if paid.Cmp(session.Capacity) > 0 {
+		return nil, fmt.Errorf("amount cannot be > capacity, %s left", new(big.Int).Sub(session.Capacity, session.Paid).String())
+	}
+
+	if err = s.sendStreamState(ctx, session, paid, false); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CloseStreamSession - sends the last state to the receiver and asks it to close the virtual channel,
+// when we are the receiver, virtual channel is closed with the last known state
+func (s *Service) CloseStreamSession(ctx context.Context, key ed25519.PublicKey) (*db.StreamSession, error) {
+	s.streamMx.Lock()
+	defer s.streamMx.Unlock()
+
+	session, err := s.db.GetStreamSession(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Status != db.StreamSessionStatusActive {
+		return nil, ErrStreamSessionClosed
+	}
+
+	if session.Incoming {
+		if err = s.closeIncomingStreamSession(ctx, session); err != nil {
+			return nil, err
+		}
+		return session, nil
+	}
+
+	if session, err = s.getOutgoingStreamSession(ctx, key); err != nil {
+		return nil, err
+	}
+
+	if err = s.sendStreamState(ctx, session, session.Paid, true); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetStreamSession - returns stream session, outgoing one is marked as closed when its deadline is passed
+func (s *Service) GetStreamSession(ctx context.Context, key ed25519.PublicKey) (*db.StreamSession, error) {
+	session, err := s.db.GetStreamSession(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !session.Incoming && session.Status == db.StreamSessionStatusActive && time.Now().After(session.Deadline) {
+		session.Status = db.StreamSessionStatusClosed
+		session.UpdatedAt = time.Now()
+		if err = s.db.UpdateStreamSession(ctx, session); err != nil {
+			return nil, fmt.Errorf("failed to update stream session: %w", err)
+		}
+	}
+	return session, nil
+}
+
+func (s *Service) getOutgoingStreamSession(ctx context.Context, key ed25519.PublicKey) (*db.StreamSession, error) {
+	session, err := s.GetStreamSession(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Incoming {
+		return nil, fmt.Errorf("only sender can pay to stream session")
+	}
+
+	if session.Status != db.StreamSessionStatusActive {
+		return nil, ErrStreamSessionClosed
+	}
+
+	meta, err := s.db.GetVirtualChannelMeta(ctx, key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, fmt.Errorf("virtual channel is not opened yet")
+		}
+		return nil, fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	switch meta.Status {
+	case db.VirtualChannelStateActive:
+	case db.VirtualChannelStatePending:
+		return nil, fmt.Errorf("virtual channel is not opened yet")
+	default:
+		return nil, fmt.Errorf("virtual channel is inactive")
+	}
+	return session, nil
+}
+
+// sendStreamState - signs state for the paid amount and delivers it to the receiver, session is updated when acknowledged
+func (s *Service) sendStreamState(ctx context.Context, session *db.StreamSession, paid *big.Int, final bool) error {
+	state := payments.VirtualChannelState{
+		Amount: paid,
+	}
+	state.Sign(session.PrivateKey)
+
+	stateCell, err := state.ToCell()
+	if err != nil {
+		return fmt.Errorf("failed to serialize state: %w", err)
+	}
+
+	acknowledged, err := s.regularTransport.SendStreamState(ctx, session.Counterparty, session.Key, stateCell, final)
+	if err != nil {
+		return fmt.Errorf("failed to deliver state to receiver: %w", err)
+	}
+
+	if acknowledged.Cmp(paid) != 0 {
+		return fmt.Errorf("receiver acknowledged %s instead of %s", acknowledged.String(), paid.String())
+	}
+
+	now := time.Now()
+	session.Paid = paid
+	session.LastPaidAt = now
+	session.UpdatedAt = now
+	if final {
+		session.Status = db.StreamSessionStatusClosed
+	}
+	if err = s.db.UpdateStreamSession(ctx, session); err != nil {
+		return fmt.Errorf("failed to update stream session: %w", err)
+	}
+
+	if paid.Sign() > 0 {
+		// we keep the last state too, to be able to prove amount in case of dispute
+		if err = s.AddVirtualChannelResolve(ctx, session.Key, state); err != nil && !errors.Is(err, db.ErrNewerStateIsKnown) {
+			log.Warn().Err(err).Str("key", base64.StdEncoding.EncodeToString(session.Key)).Msg("failed to save stream state resolve")
+		}
+	}
+
+	log.Debug().Str("key", base64.StdEncoding.EncodeToString(session.Key)).
+		Str("paid", paid.String()).Bool("final", final).
+		Msg("stream state acknowledged by receiver")
+
+	return nil
+}
+
+// ProcessStreamState - accepts next state of incoming stream session from its sender, returns total acknowledged amount
+func (s *Service) ProcessStreamState(ctx context.Context, key ed25519.PublicKey, virtualKey ed25519.PublicKey, stateCell *cell.Cell, final bool) (*big.Int, error) {
+	s.streamMx.Lock()
+	defer s.streamMx.Unlock()
+
+	session, err := s.db.GetStreamSession(ctx, virtualKey)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, fmt.Errorf("stream session is not found")
+		}
+		return nil, fmt.Errorf("failed to load stream session: %w", err)
+	}
+
+	if !session.Incoming || !bytes.Equal(session.Counterparty, key) {
+		return nil, fmt.Errorf("not a sender of the stream session")
+	}
+
+	if session.Status != db.StreamSessionStatusActive {
+		return nil, ErrStreamSessionClosed
+	}
+
+	var state payments.VirtualChannelState
+	if err = tlb.LoadFromCell(&state, stateCell.BeginParse()); err != nil {
+		return nil, fmt.Errorf("failed to parse state: %w", err)
+	}
+
+	if !state.Verify(virtualKey) {
+		return nil, fmt.Errorf("incorrect state signature")
+	}
+
+	if state.Amount.Cmp(session.Paid) < 0 {
+		return nil, fmt.Errorf("amount cannot be less than already paid %s", session.Paid.String())
+	}
+
+	if state.Amount.Cmp(session.Capacity) > 0 {
+		return nil, fmt.Errorf("amount cannot be > capacity")
+	}
+
+	if state.Amount.Cmp(session.Paid) > 0 {
+		if err = s.AddVirtualChannelResolve(ctx, virtualKey, state); err != nil {
+			return nil, fmt.Errorf("failed to add resolve: %w", err)
+		}
+	}
+
+	now := time.Now()
+	session.Paid = state.Amount
+	session.LastPaidAt = now
+	session.UpdatedAt = now
+	if err = s.db.UpdateStreamSession(ctx, session); err != nil {
+		return nil, fmt.Errorf("failed to update stream session: %w", err)
+	}
+
+	if final {
+		if err = s.closeIncomingStreamSession(ctx, session); err != nil {
+			return nil, err
+		}
+	}
+
+	return session.Paid, nil
+}
+
+// createIncomingStreamSession - called from action processing transaction, when virtual channel with stream payload is accepted
+func (s *Service) createIncomingStreamSession(ctx context.Context, payload *transport.StreamPayload, meta *db.VirtualChannelMeta, channel *db.Channel, capacity *big.Int) error {
+	idleTimeout := time.Duration(payload.IdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultStreamIdleTimeout
+	} else if idleTimeout < MinStreamIdleTimeout {
+		idleTimeout = MinStreamIdleTimeout
+	}
+
+	session := &db.StreamSession{
+		Key:             meta.Key,
+		Incoming:        true,
+		Counterparty:    meta.Incoming.SenderKey,
+		JettonAddress:   channel.JettonAddress,
+		ExtraCurrencyID: channel.ExtraCurrencyID,
+		Capacity:        capacity,
+		Paid:            big.NewInt(0),
+		IdleTimeout:     idleTimeout,
+		Deadline:        meta.Incoming.SafeDeadline,
+		Status:          db.StreamSessionStatusActive,
+		LastPaidAt:      time.Now(),
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	if err := s.db.CreateStreamSession(ctx, session); err != nil {
+		return fmt.Errorf("failed to create stream session: %w", err)
+	}
+
+	return s.scheduleStreamSessionCheck(ctx, session)
+}
+
+func (s *Service) scheduleStreamSessionCheck(ctx context.Context, session *db.StreamSession) error {
+	at := streamSessionCloseAt(session)
+	if err := s.db.CreateTask(ctx, PaymentsTaskPool, "stream-session-check", "stream-"+base64.StdEncoding.EncodeToString(session.Key),
+		"stream-session-check-"+base64.StdEncoding.EncodeToString(session.Key)+"-"+fmt.Sprint(at.Unix()),
+		db.StreamSessionCheckTask{
+			Key: session.Key,
+		}, &at, nil,
+	); err != nil {
+		return fmt.Errorf("failed to create stream-session-check task: %w", err)
+	}
+	return nil
+}
+
+// streamSessionCloseAt - moment when incoming session should be closed, because of deadline or sender's inactivity
+func streamSessionCloseAt(session *db.StreamSession) time.Time {
+	at := session.LastPaidAt.Add(session.IdleTimeout)
+	if session.Deadline.Before(at) {
+		at = session.Deadline
+	}
+	return at
+}
+
+func (s *Service) executeStreamSessionCheck(ctx context.Context, key []byte) error {
+	s.streamMx.Lock()
+	defer s.streamMx.Unlock()
+
+	session, err := s.db.GetStreamSession(ctx, key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load stream session: %w", err)
+	}
+
+	if session.Status != db.StreamSessionStatusActive {
+		return nil
+	}
+
+	if time.Now().Before(streamSessionCloseAt(session)) {
+		// sender paid since check was scheduled, so we check again later
+		return s.scheduleStreamSessionCheck(ctx, session)
+	}
+
+	log.Info().Str("key", base64.StdEncoding.EncodeToString(session.Key)).
+		Str("paid", session.Paid.String()).
+		Msg("stream session is idle or near deadline, closing")
+
+	return s.closeIncomingStreamSession(ctx, session)
+}
+
+// closeIncomingStreamSession - closes virtual channel with the last acknowledged state,
+// or asks to remove it when nothing was paid
+func (s *Service) closeIncomingStreamSession(ctx context.Context, session *db.StreamSession) error {
+	meta, err := s.db.GetVirtualChannelMeta(ctx, session.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load virtual channel meta: %w", err)
+	}
+
+	if meta.Status == db.VirtualChannelStateActive {
+		if session.Paid.Sign() > 0 {
+			if err = s.CloseVirtualChannel(ctx, session.Key); err != nil {
+				return fmt.Errorf("failed to close virtual channel: %w", err)
+			}
+		} else {
+			err = s.db.Transaction(ctx, func(ctx context.Context) error {
+				meta.Status = db.VirtualChannelStateWantRemove
+				meta.UpdatedAt = time.Now()
+				if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+					return fmt.Errorf("failed to update virtual channel meta: %w", err)
+				}
+
+				if err = s.db.CreateTask(ctx, PaymentsTaskPool, "ask-remove-virtual", meta.Incoming.ChannelAddress,
+					"ask-remove-virtual-"+base64.StdEncoding.EncodeToString(meta.Key),
+					db.AskRemoveVirtualTask{
+						ChannelAddress: meta.Incoming.ChannelAddress,
+						Key:            meta.Key,
+					}, nil, nil,
+				); err != nil {
+					return fmt.Errorf("failed to create ask-remove-virtual task: %w", err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.touchWorker()
+		}
+	}
+
+	session.Status = db.StreamSessionStatusClosed
+	session.UpdatedAt = time.Now()
+	if err = s.db.UpdateStreamSession(ctx, session); err != nil {
+		return fmt.Errorf("failed to update stream session: %w", err)
+	}
+
+	log.Info().Str("key", base64.StdEncoding.EncodeToString(session.Key)).
+		Str("paid", session.Paid.String()).
+		Msg("stream session closed")
+	return nil
+}
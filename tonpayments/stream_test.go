@@ -0,0 +1,101 @@
+package tonpayments
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+func TestStreamPayload_ProcessAction(t *testing.T) {
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	addr := n.connect(t, a, b, "10", "0")
+
+	stream := transport.StreamPayload{IdleTimeout: 60}
+
+	if _, err := proposeVirtual(t, a, b, addr, "1", true, nil, stream); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "should not have final state") {
+		t.Fatal("stream with final state should be rejected", err)
+	}
+
+	if _, err := proposeVirtual(t, a, b, addr, "1", false, make([]byte, 32), stream); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "cannot carry payment, invoice or stream") {
+		t.Fatal("hash-locked stream should be rejected", err)
+	}
+
+	key, err := proposeVirtual(t, a, b, addr, "1", false, nil, stream)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	session, err := b.db.GetStreamSession(context.Background(), key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !session.Incoming || session.Status != db.StreamSessionStatusActive || session.IdleTimeout != time.Minute ||
+		session.Capacity.Cmp(mustNano(t, "1")) != 0 || session.Paid.Sign() != 0 {
+		t.Fatal("incorrect incoming stream session")
+	}
+}
+
+func TestStreamSession_PayAndClose(t *testing.T) {
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	n.connect(t, a, b, "10", "0")
+
+	session, err := a.svc.OpenStreamSession(context.Background(), b.pub(), "", 0, mustNano(t, "1"), 5*time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a.svc.touchWorker()
+
+	waitFor(t, 10*time.Second, "stream session open", func() bool {
+		_, err := a.svc.StreamPay(context.Background(), session.Key, mustNano(t, "0.3"))
+		return err == nil
+	})
+
+	if _, err = a.svc.StreamPay(context.Background(), session.Key, mustNano(t, "0.8")); err == nil {
+		t.Fatal("payment over capacity should be rejected")
+	}
+
+	in, err := b.db.GetStreamSession(context.Background(), session.Key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if in.Paid.Cmp(mustNano(t, "0.3")) != 0 {
+		t.Fatal("receiver should acknowledge paid amount", in.Paid.String())
+	}
+
+	// state for less amount than already paid is not accepted
+	state := payments.VirtualChannelState{Amount: mustNano(t, "0.1")}
+	state.Sign(session.PrivateKey)
+	stateCell, err := state.ToCell()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = b.svc.ProcessStreamState(context.Background(), a.pub(), session.Key, stateCell, false); err == nil || !strings.Contains(err.Error(), "less than already paid") {
+		t.Fatal("decreased amount should be rejected", err)
+	}
+	if _, err = b.svc.ProcessStreamState(context.Background(), b.pub(), session.Key, stateCell, false); err == nil || !strings.Contains(err.Error(), "not a sender") {
+		t.Fatal("state from another node should be rejected", err)
+	}
+
+	if _, err = a.svc.CloseStreamSession(context.Background(), session.Key); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = a.svc.StreamPay(context.Background(), session.Key, mustNano(t, "0.1")); !errors.Is(err, ErrStreamSessionClosed) {
+		t.Fatal("closed session should not be paid", err)
+	}
+
+	waitFor(t, 10*time.Second, "virtual channel close", func() bool {
+		meta, err := a.db.GetVirtualChannelMeta(context.Background(), session.Key)
+		if err != nil || meta.GetKnownResolve() == nil {
+			return false
+		}
+		return meta.GetKnownResolve().Amount.Cmp(mustNano(t, "0.3")) == 0
+	})
+}
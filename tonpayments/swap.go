@@ -0,0 +1,435 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"math/big"
+	"time"
+)
+
+const (
+	DefaultSwapTTL = 1 * time.Hour
+	// MinSwapLockTime - maker locks its part for a half of the time left for taker's part,
+	// so the maker has enough time to resolve taker's part after preimage is revealed.
+	MinSwapLockTime = 10 * time.Minute
+)
+
+// QuoteSwap - creates quote to give amount of one coin in exchange for another coin at the given rate,
+// rate is an amount of coins we want to receive for each coin we give. Quote can be taken once by any node before expiration.
+func (s *Service) QuoteSwap(ctx context.Context, giveJettonAddr string, giveEcID uint32, giveAmount *big.Int, receiveJettonAddr string, receiveEcID uint32, rate *big.Rat, ttl time.Duration) (*db.Swap, error) {
+	if giveAmount.Sign() <= 0 {
+		return nil, fmt.Errorf("amount should be positive")
+	}
+
+	if rate.Sign() <= 0 {
+		return nil, fmt.Errorf("rate should be positive")
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl should be positive")
+	}
+
+	var err error
+	if giveJettonAddr, err = normalizeJettonAddr(giveJettonAddr); err != nil {
+		return nil, err
+	}
+	if receiveJettonAddr, err = normalizeJettonAddr(receiveJettonAddr); err != nil {
+		return nil, err
+	}
+
+	if giveJettonAddr == receiveJettonAddr && giveEcID == receiveEcID {
+		return nil, fmt.Errorf("coins to swap should be different")
+	}
+
+	giveCC, err := s.ResolveCoinConfig(giveJettonAddr, giveEcID, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config to give: %w", err)
+	}
+
+	receiveCC, err := s.ResolveCoinConfig(receiveJettonAddr, receiveEcID, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config to receive: %w", err)
+	}
+
+	// convert with decimals difference: receive = give * rate * 10^(receive decimals - give decimals)
+	amt := new(big.Rat).Mul(new(big.Rat).SetInt(giveAmount), rate)
+	amt.Mul(amt, new(big.Rat).SetFrac(
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(receiveCC.Decimals)), nil),
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(giveCC.Decimals)), nil),
+	))
+	receiveAmount := new(big.Int).Quo(amt.Num(), amt.Denom())
+
+	if receiveAmount.Sign() <= 0 {
+		return nil, fmt.Errorf("amount to receive is too small")
+	}
+
+	id := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate swap id: %w", err)
+	}
+
+	swap := &db.Swap{
+		ID:                     id,
+		Maker:                  true,
+		GiveJettonAddress:      giveJettonAddr,
+		GiveExtraCurrencyID:    giveEcID,
+		GiveAmount:             giveAmount,
+		ReceiveJettonAddress:   receiveJettonAddr,
+		ReceiveExtraCurrencyID: receiveEcID,
+		ReceiveAmount:          receiveAmount,
+		Status:                 db.SwapStatusPending,
+		ExpiresAt:              time.Now().Add(ttl),
+		CreatedAt:              time.Now(),
+		UpdatedAt:              time.Now(),
+	}
+
+	if err = s.db.CreateSwap(ctx, swap); err != nil {
+		return nil, fmt.Errorf("failed to save swap: %w", err)
+	}
+
+	log.Info().Str("id", base64.StdEncoding.EncodeToString(id)).
+		Str("give", giveAmount.String()).
+		Str("receive", receiveAmount.String()).
+		Msg("swap quote created")
+
+	return swap, nil
+}
+
+// ExecuteSwap - takes swap quote of the maker, we give what maker wants to receive and receive what maker gives.
+// Our part is hash-locked first, maker locks its part only after receiving ours, and then we reveal the preimage
+// by resolving maker's part, so both parts are resolved or none of them.
+func (s *Service) ExecuteSwap(ctx context.Context, maker ed25519.PublicKey, id []byte, giveJettonAddr string, giveEcID uint32, giveAmount *big.Int, receiveJettonAddr string, receiveEcID uint32, receiveAmount *big.Int, ttl time.Duration) (*db.Swap, error) {
+	if len(id) != 32 {
+		return nil, fmt.Errorf("incorrect swap id")
+	}
+
+	if bytes.Equal(maker, s.key.Public().(ed25519.PublicKey)) {
+		return nil, fmt.Errorf("cannot take own quote")
+	}
+
+	if giveAmount.Sign() <= 0 || receiveAmount.Sign() <= 0 {
+		return nil, fmt.Errorf("amounts should be positive")
+	}
+
+	if ttl == 0 {
+		ttl = DefaultSwapTTL
+	} else if ttl < 2*MinSwapLockTime {
+		return nil, fmt.Errorf("ttl should be at least %s", 2*MinSwapLockTime)
+	}
+
+	var err error
+	if giveJettonAddr, err = normalizeJettonAddr(giveJettonAddr); err != nil {
+		return nil, err
+	}
+	if receiveJettonAddr, err = normalizeJettonAddr(receiveJettonAddr); err != nil {
+		return nil, err
+	}
+
+	if _, err = s.ResolveCoinConfig(giveJettonAddr, giveEcID, true); err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config to give: %w", err)
+	}
+
+	if _, err = s.ResolveCoinConfig(receiveJettonAddr, receiveEcID, true); err != nil {
+		return nil, fmt.Errorf("failed to resolve coin config to receive: %w", err)
+	}
+
+	preimage := make([]byte, 32)
+	if _, err = rand.Read(preimage); err != nil {
+		return nil, fmt.Errorf("failed to generate preimage: %w", err)
+	}
+	hash := sha256.Sum256(preimage)
+
+	_, vPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	swap := &db.Swap{
+		ID:                     id,
+		Maker:                  false,
+		Counterparty:           maker,
+		GiveJettonAddress:      giveJettonAddr,
+		GiveExtraCurrencyID:    giveEcID,
+		GiveAmount:             giveAmount,
+		ReceiveJettonAddress:   receiveJettonAddr,
+		ReceiveExtraCurrencyID: receiveEcID,
+		ReceiveAmount:          receiveAmount,
+		Hash:                   hash[:],
+		Preimage:               preimage,
+		OutgoingPrivateKey:     vPriv,
+		Status:                 db.SwapStatusPending,
+		ExpiresAt:              time.Now().Add(ttl),
+		CreatedAt:              time.Now(),
+		UpdatedAt:              time.Now(),
+	}
+
+	// swap is saved before opening, so we will not lose the preimage in case of failure in between
+	if err = s.db.CreateSwap(ctx, swap); err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			return nil, fmt.Errorf("swap is already executed")
+		}
+		return nil, fmt.Errorf("failed to save swap: %w", err)
+	}
+
+	if err = s.openHashLockedChannel(ctx, vPriv, maker, giveJettonAddr, giveEcID, giveAmount, hash[:], ttl, transport.SwapPayload{
+		SwapID: id,
+		Taker:  s.key.Public().(ed25519.PublicKey),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to lock our part: %w", err)
+	}
+
+	log.Info().Str("id", base64.StdEncoding.EncodeToString(id)).
+		Str("maker", base64.StdEncoding.EncodeToString(maker)).
+		Msg("swap execution started, our part is locked")
+
+	return swap, nil
+}
+
+func (s *Service) GetSwap(ctx context.Context, id []byte) (*db.Swap, error) {
+	return s.db.GetSwap(ctx, id)
+}
+
+// checkIncomingSwapLock - verifies that taker's part matches our quote, called before accepting the channel
+func (s *Service) checkIncomingSwapLock(ctx context.Context, payload *transport.SwapPayload, channel *db.Channel, capacity *big.Int, deadline int64) error {
+	swap, err := s.db.GetSwap(ctx, payload.SwapID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("swap quote is not exists")
+		}
+		return fmt.Errorf("failed to load swap: %w", err)
+	}
+
+	if !swap.Maker || swap.Status != db.SwapStatusPending {
+		return fmt.Errorf("swap quote is already taken")
+	}
+
+	if time.Now().After(swap.ExpiresAt) {
+		return fmt.Errorf("swap quote is expired")
+	}
+
+	if channel.JettonAddress != swap.ReceiveJettonAddress || channel.ExtraCurrencyID != swap.ReceiveExtraCurrencyID {
+		return fmt.Errorf("incorrect swap coin")
+	}
+
+	if capacity.Cmp(swap.ReceiveAmount) < 0 {
+		return fmt.Errorf("amount is less than quoted")
+	}
+
+	if time.Until(time.Unix(deadline, 0))/2 < MinSwapLockTime {
+		return fmt.Errorf("too short deadline to lock our part")
+	}
+	return nil
+}
+
+// acceptIncomingSwapLock - taker's part is locked for us, so we can lock ours in response
+func (s *Service) acceptIncomingSwapLock(ctx context.Context, payload *transport.SwapPayload, meta *db.VirtualChannelMeta) error {
+	swap, err := s.db.GetSwap(ctx, payload.SwapID)
+	if err != nil {
+		return fmt.Errorf("failed to load swap: %w", err)
+	}
+
+	if swap.Status != db.SwapStatusPending {
+		return fmt.Errorf("swap quote is already taken")
+	}
+
+	swap.Counterparty = payload.Taker
+	swap.Hash = meta.HashLock
+	swap.IncomingKey = meta.Key
+	swap.Status = db.SwapStatusLocked
+	swap.UpdatedAt = time.Now()
+	if err = s.db.UpdateSwap(ctx, swap); err != nil {
+		return fmt.Errorf("failed to update swap: %w", err)
+	}
+
+	tryTill := meta.Incoming.SafeDeadline
+	if err = s.db.CreateTask(ctx, PaymentsTaskPool, "swap-lock", "swap-"+base64.StdEncoding.EncodeToString(swap.ID),
+		"swap-lock-"+base64.StdEncoding.EncodeToString(swap.ID),
+		db.SwapTask{
+			ID: swap.ID,
+		}, nil, &tryTill,
+	); err != nil {
+		return fmt.Errorf("failed to create swap-lock task: %w", err)
+	}
+
+	log.Info().Str("id", base64.StdEncoding.EncodeToString(swap.ID)).
+		Str("taker", base64.StdEncoding.EncodeToString(payload.Taker)).
+		Msg("swap quote is taken, locking our part")
+
+	return nil
+}
+
+// onIncomingHashLocked - checks if incoming hash-locked channel is the maker's part of the swap we execute,
+// and resolves it when everything is as expected
+func (s *Service) onIncomingHashLocked(ctx context.Context, meta *db.VirtualChannelMeta, channel *db.Channel, capacity *big.Int) error {
+	swap, err := s.db.GetSwapByHash(ctx, meta.HashLock)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load swap: %w", err)
+	}
+
+	if swap.Maker || swap.Status != db.SwapStatusPending {
+		return nil
+	}
+
+	if channel.JettonAddress != swap.ReceiveJettonAddress || channel.ExtraCurrencyID != swap.ReceiveExtraCurrencyID ||
+		capacity.Cmp(swap.ReceiveAmount) < 0 {
+		// not resolving it, it will be returned to the maker after deadline, and our part too
+		log.Warn().Str("id", base64.StdEncoding.EncodeToString(swap.ID)).
+			Str("key", base64.StdEncoding.EncodeToString(meta.Key)).
+			Msg("maker's part of the swap is not matching the quote, ignoring it")
+		return nil
+	}
+
+	swap.IncomingKey = meta.Key
+	swap.Status = db.SwapStatusLocked
+	swap.UpdatedAt = time.Now()
+	if err = s.db.UpdateSwap(ctx, swap); err != nil {
+		return fmt.Errorf("failed to update swap: %w", err)
+	}
+
+	return s.createSwapResolveTask(ctx, swap, meta.Incoming.SafeDeadline)
+}
+
+// onSwapPreimageRevealed - counterparty has resolved our part, so we can resolve its part with the same preimage
+func (s *Service) onSwapPreimageRevealed(ctx context.Context, hash, preimage []byte) error {
+	swap, err := s.db.GetSwapByHash(ctx, hash)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load swap: %w", err)
+	}
+
+	if !swap.Maker || swap.Status != db.SwapStatusLocked || swap.Preimage != nil {
+		return nil
+	}
+
+	meta, err := s.db.GetVirtualChannelMeta(ctx, swap.IncomingKey)
+	if err != nil {
+		return fmt.Errorf("failed to load virtual channel meta of taker's part: %w", err)
+	}
+
+	swap.Preimage = preimage
+	swap.UpdatedAt = time.Now()
+	if err = s.db.UpdateSwap(ctx, swap); err != nil {
+		return fmt.Errorf("failed to update swap: %w", err)
+	}
+
+	return s.createSwapResolveTask(ctx, swap, meta.Incoming.SafeDeadline)
+}
+
+func (s *Service) createSwapResolveTask(ctx context.Context, swap *db.Swap, till time.Time) error {
+	if err := s.db.CreateTask(ctx, PaymentsTaskPool, "swap-resolve", "swap-"+base64.StdEncoding.EncodeToString(swap.ID),
+		"swap-resolve-"+base64.StdEncoding.EncodeToString(swap.ID),
+		db.SwapTask{
+			ID: swap.ID,
+		}, nil, &till,
+	); err != nil {
+		return fmt.Errorf("failed to create swap-resolve task: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) executeSwapLock(ctx context.Context, id []byte) error {
+	swap, err := s.db.GetSwap(ctx, id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load swap: %w", err)
+	}
+
+	if swap.Status != db.SwapStatusLocked {
+		return nil
+	}
+
+	meta, err := s.db.GetVirtualChannelMeta(ctx, swap.IncomingKey)
+	if err != nil {
+		return fmt.Errorf("failed to load virtual channel meta of taker's part: %w", err)
+	}
+
+	if meta.Status != db.VirtualChannelStateActive {
+		log.Warn().Str("id", base64.StdEncoding.EncodeToString(swap.ID)).Msg("taker's part of the swap is not active anymore, not locking ours")
+		return nil
+	}
+
+	if swap.OutgoingPrivateKey == nil {
+		_, vPriv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return fmt.Errorf("failed to generate key: %w", err)
+		}
+
+		// key is saved first, so retries will not open our part twice
+		swap.OutgoingPrivateKey = vPriv
+		swap.UpdatedAt = time.Now()
+		if err = s.db.UpdateSwap(ctx, swap); err != nil {
+			return fmt.Errorf("failed to update swap: %w", err)
+		}
+	} else if _, err = s.db.GetVirtualChannelMeta(ctx, swap.OutgoingKey()); err == nil {
+		// already opened
+		return nil
+	}
+
+	ttl := time.Until(meta.Incoming.UncooperativeDeadline) / 2
+	if ttl < MinSwapLockTime {
+		log.Warn().Str("id", base64.StdEncoding.EncodeToString(swap.ID)).Msg("too late to lock our part of the swap")
+		return nil
+	}
+
+	if err = s.openHashLockedChannel(ctx, swap.OutgoingPrivateKey, swap.Counterparty, swap.GiveJettonAddress, swap.GiveExtraCurrencyID,
+		swap.GiveAmount, swap.Hash, ttl); err != nil {
+		return fmt.Errorf("failed to lock our part: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) executeSwapResolve(ctx context.Context, id []byte) error {
+	swap, err := s.db.GetSwap(ctx, id)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load swap: %w", err)
+	}
+
+	if swap.Status != db.SwapStatusLocked {
+		return nil
+	}
+
+	if err = s.ResolveHashLockedChannel(ctx, swap.IncomingKey, swap.Preimage); err != nil {
+		return fmt.Errorf("failed to resolve counterparty's part: %w", err)
+	}
+
+	swap.Status = db.SwapStatusCompleted
+	swap.UpdatedAt = time.Now()
+	if err = s.db.UpdateSwap(ctx, swap); err != nil {
+		return fmt.Errorf("failed to update swap: %w", err)
+	}
+
+	log.Info().Str("id", base64.StdEncoding.EncodeToString(swap.ID)).Msg("swap completed")
+	return nil
+}
+
+func normalizeJettonAddr(jettonAddr string) (string, error) {
+	if jettonAddr == "" {
+		return "", nil
+	}
+
+	addr, err := address.ParseAddr(jettonAddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse jetton address: %w", err)
+	}
+	return addr.Bounce(true).String(), nil
+}
@@ -0,0 +1,112 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+const testEC = 7
+
+// testConfigEC - test config with extra currency supported in addition to ton
+func testConfigEC() config.ChannelsConfig {
+	cfg := testConfig()
+	ec := cfg.SupportedCoins.Ton
+	ec.Symbol = "EC"
+	cfg.SupportedCoins.ExtraCurrencies = map[uint32]config.CoinConfig{testEC: ec}
+	return cfg
+}
+
+func TestSwapPayload_ProcessAction(t *testing.T) {
+	n := newTestNetwork()
+	taker, maker := n.addNode(t, testConfigEC()), n.addNode(t, testConfigEC())
+	addr := n.connect(t, taker, maker, "10", "0")
+
+	// maker gives 1 EC for 2 TON
+	swap, err := maker.svc.QuoteSwap(context.Background(), "", testEC, mustNano(t, "1"), "", 0, big.NewRat(2, 1), time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hash := sha256.Sum256([]byte("preimage"))
+	payload := transport.SwapPayload{SwapID: swap.ID, Taker: taker.pub()}
+
+	if _, err = proposeVirtualTTL(t, taker, maker, addr, "2", time.Hour, false, nil, payload); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "should be hash-locked") {
+		t.Fatal("not hash-locked swap part should be rejected", err)
+	}
+
+	if _, err = proposeVirtualTTL(t, taker, maker, addr, "2", time.Hour, false, hash[:], transport.SwapPayload{SwapID: make([]byte, 32), Taker: taker.pub()}); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "quote is not exists") {
+		t.Fatal("part of unknown swap should be rejected", err)
+	}
+
+	if _, err = proposeVirtualTTL(t, taker, maker, addr, "1", time.Hour, false, hash[:], payload); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "less than quoted") {
+		t.Fatal("part with less amount should be rejected", err)
+	}
+
+	if _, err = proposeVirtualTTL(t, taker, maker, addr, "2", 5*time.Minute, false, hash[:], payload); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "too short deadline") {
+		t.Fatal("part with short deadline should be rejected", err)
+	}
+
+	if _, err = proposeVirtualTTL(t, taker, maker, addr, "2", time.Hour, false, hash[:], payload); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got, err := maker.db.GetSwap(context.Background(), swap.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Status != db.SwapStatusLocked || !got.Counterparty.Equal(taker.pub()) {
+		t.Fatal("swap should be locked for the taker", got.Status)
+	}
+
+	if _, err = proposeVirtualTTL(t, taker, maker, addr, "2", time.Hour, false, hash[:], payload); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "already taken") {
+		t.Fatal("taken quote should not be taken again", err)
+	}
+}
+
+func TestSwapPayload_IncorrectCoin(t *testing.T) {
+	n := newTestNetwork()
+	taker, maker := n.addNode(t, testConfigEC()), n.addNode(t, testConfigEC())
+	addr := n.connect(t, taker, maker, "10", "0")
+
+	// maker wants to receive EC, but taker locks TON
+	swap, err := maker.svc.QuoteSwap(context.Background(), "", 0, mustNano(t, "1"), "", testEC, big.NewRat(1, 1), time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hash := sha256.Sum256([]byte("preimage"))
+	if _, err = proposeVirtualTTL(t, taker, maker, addr, "1", time.Hour, false, hash[:], transport.SwapPayload{SwapID: swap.ID, Taker: taker.pub()}); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "incorrect swap coin") {
+		t.Fatal("part in another coin should be rejected", err)
+	}
+}
+
+func TestSwap_Executed(t *testing.T) {
+	n := newTestNetwork()
+	taker, maker := n.addNode(t, testConfigEC()), n.addNode(t, testConfigEC())
+	n.connect(t, taker, maker, "10", "0")
+	n.connectCoin(t, maker, taker, testEC, "10", "0")
+
+	swap, err := maker.svc.QuoteSwap(context.Background(), "", testEC, mustNano(t, "1"), "", 0, big.NewRat(2, 1), time.Hour)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err = taker.svc.ExecuteSwap(context.Background(), maker.pub(), swap.ID, "", 0, swap.ReceiveAmount, "", testEC, swap.GiveAmount, time.Hour); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, node := range []*testNode{taker, maker} {
+		waitFor(t, 20*time.Second, "swap completion", func() bool {
+			s, err := node.db.GetSwap(context.Background(), swap.ID)
+			return err == nil && s.Status == db.SwapStatusCompleted
+		})
+	}
+}
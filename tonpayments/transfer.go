@@ -0,0 +1,152 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"math/big"
+	"time"
+)
+
+// createTransfer - saves record of outgoing virtual channel, so its status can be tracked by the channel key
+func (s *Service) createTransfer(ctx context.Context, vch payments.VirtualChannel, dest ed25519.PublicKey, jettonAddr string, ecID uint32) error {
+	tr := &db.Transfer{
+		ID:              vch.Key,
+		Destination:     dest,
+		JettonAddress:   jettonAddr,
+		ExtraCurrencyID: ecID,
+		Capacity:        vch.Capacity,
+		Fee:             vch.Fee,
+		Deadline:        time.Unix(vch.Deadline, 0),
+		Status:          db.TransferStatusPending,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	if err := s.db.CreateTransfer(ctx, tr); err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			// open was requested again with the same key
+			return nil
+		}
+		return fmt.Errorf("failed to create transfer: %w", err)
+	}
+
+	if s.webhook != nil {
+		if err := s.webhook.PushTransferEvent(ctx, tr); err != nil {
+			return fmt.Errorf("failed to push transfer event: %w", err)
+		}
+	}
+	return nil
+}
+
+// updateTransfer - moves transfer forward to the given status. Records exist only for channels opened by us,
+// so it is safe to call it for any virtual channel, keys of channels tunnelled through us are ignored.
+func (s *Service) updateTransfer(ctx context.Context, key []byte, status db.TransferStatus, amount *big.Int, reason string) error {
+	tr, err := s.db.GetTransfer(ctx, key)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to get transfer: %w", err)
+	}
+
+	if tr.Status == db.TransferStatusClosed || tr.Status == db.TransferStatusFailed {
+		// final status is already known
+		return nil
+	}
+
+	if status != db.TransferStatusFailed && status <= tr.Status {
+		return nil
+	}
+
+	tr.Status = status
+	tr.Reason = reason
+	if amount != nil {
+		tr.Amount = amount
+	}
+	tr.UpdatedAt = time.Now()
+
+	if err = s.db.UpdateTransfer(ctx, tr); err != nil {
+		return fmt.Errorf("failed to update transfer: %w", err)
+	}
+
+	if s.webhook != nil {
+		if err = s.webhook.PushTransferEvent(ctx, tr); err != nil {
+			return fmt.Errorf("failed to push transfer event: %w", err)
+		}
+	}
+
+	log.Debug().Str("key", base64.StdEncoding.EncodeToString(key)).
+		Int("status", int(status)).
+		Str("reason", reason).
+		Msg("transfer status updated")
+
+	return nil
+}
+
+// transferFailReason - explains why virtual channel opened by us was removed
+func (s *Service) transferFailReason(ctx context.Context, vch *payments.VirtualChannel) string {
+	meta, err := s.db.GetVirtualChannelMeta(ctx, vch.Key)
+	if err == nil {
+		if meta.FailReason != "" {
+			return meta.FailReason
+		}
+
+		if meta.FailureReport != nil {
+			if _, rep, err := s.readFailureReport(meta); err == nil {
+				return rep.Message
+			}
+		}
+	}
+
+	if vch.Deadline < time.Now().UTC().Unix() {
+		return "virtual channel has expired"
+	}
+	return "virtual channel was removed"
+}
+
+// GetTransfer - returns record of outgoing virtual channel by its key
+func (s *Service) GetTransfer(ctx context.Context, id []byte) (*db.Transfer, error) {
+	tr, err := s.db.GetTransfer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.actualizeTransfer(ctx, tr)
+}
+
+func (s *Service) ListTransfers(ctx context.Context, filter db.TransferFilter) ([]*db.Transfer, error) {
+	list, err := s.db.ListTransfers(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*db.Transfer, 0, len(list))
+	for _, tr := range list {
+		if tr, err = s.actualizeTransfer(ctx, tr); err != nil {
+			return nil, err
+		}
+
+		if filter.Status != 0 && tr.Status != filter.Status {
+			continue
+		}
+		res = append(res, tr)
+	}
+	return res, nil
+}
+
+// actualizeTransfer - fails pending transfer which open task was not completed before deadline
+func (s *Service) actualizeTransfer(ctx context.Context, tr *db.Transfer) (*db.Transfer, error) {
+	if tr.Status != db.TransferStatusPending || time.Now().Before(tr.Deadline) {
+		return tr, nil
+	}
+
+	if err := s.updateTransfer(ctx, tr.ID, db.TransferStatusFailed, nil, "channel was not opened before deadline"); err != nil {
+		return nil, err
+	}
+	return s.db.GetTransfer(ctx, tr.ID)
+}
@@ -0,0 +1,99 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+// sendTransfer - opens virtual channel with final state to the receiver, it is closed by the receiver right after open
+func sendTransfer(t *testing.T, from, to *testNode, amount string) ed25519.PublicKey {
+	_, vPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	chain, err := from.svc.BuildRouteTunnelChain(context.Background(), to.pub(), "", 0, mustNano(t, amount), 5*time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	vc, firstInstructionKey, tun, err := transport.GenerateTunnel(vPriv, chain, 5, true, from.key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = from.svc.OpenVirtualChannel(context.Background(), chain[0].Target, firstInstructionKey, to.pub(), vPriv, tun, vc, nil, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	return vc.Key
+}
+
+func waitTransferStatus(t *testing.T, n *testNode, key ed25519.PublicKey, status db.TransferStatus) *db.Transfer {
+	var tr *db.Transfer
+	waitFor(t, 10*time.Second, "transfer status", func() bool {
+		var err error
+		tr, err = n.svc.GetTransfer(context.Background(), key)
+		return err == nil && tr.Status == status
+	})
+	return tr
+}
+
+func TestTransfer_Closed(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	n.connect(t, a, b, "10", "0")
+	n.connect(t, b, c, "10", "0")
+
+	key := sendTransfer(t, a, c, "1")
+
+	tr, err := a.svc.GetTransfer(context.Background(), key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !tr.Destination.Equal(c.pub()) || tr.Capacity.Cmp(mustNano(t, "1")) != 0 {
+		t.Fatal("incorrect transfer record")
+	}
+
+	tr = waitTransferStatus(t, a, key, db.TransferStatusClosed)
+	if tr.Amount.Cmp(mustNano(t, "1")) != 0 || tr.Reason != "" {
+		t.Fatal("closed transfer should have paid amount", tr.Amount, tr.Reason)
+	}
+
+	if _, err = b.svc.GetTransfer(context.Background(), key); err == nil {
+		t.Fatal("transfer should be recorded only by the sender")
+	}
+
+	list, err := a.svc.ListTransfers(context.Background(), db.TransferFilter{Status: db.TransferStatusClosed})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list) != 1 || !list[0].ID.Equal(key) {
+		t.Fatal("closed transfer should be listed", len(list))
+	}
+
+	if list, err = a.svc.ListTransfers(context.Background(), db.TransferFilter{Status: db.TransferStatusFailed}); err != nil || len(list) != 0 {
+		t.Fatal("failed transfers should not be listed", err, len(list))
+	}
+}
+
+func TestTransfer_Failed(t *testing.T) {
+	n := newTestNetwork()
+	a, b, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+	n.connect(t, a, b, "10", "0")
+	n.connect(t, b, c, "10", "0")
+
+	// rejection of the receiver is reported back through the chain
+	c.svc.SetDrainMode(true)
+	key := sendTransfer(t, a, c, "1")
+
+	tr := waitTransferStatus(t, a, key, db.TransferStatusFailed)
+	if !strings.Contains(tr.Reason, ErrDraining.Error()) {
+		t.Fatal("reason of rejection should be kept", tr.Reason)
+	}
+}
@@ -36,7 +36,7 @@ type PeerConnection struct {
 }
 
 type Service interface {
-	ReviewChannelConfig(prop transport.ProposeChannelConfig) (*address.Address, config.CoinConfig, error)
+	ReviewChannelConfig(key ed25519.PublicKey, prop transport.ProposeChannelConfig) (*address.Address, config.CoinConfig, error)
 	ProcessAction(ctx context.Context, key ed25519.PublicKey, lockId int64, channelAddr *address.Address, signedState payments.SignedSemiChannel, action transport.Action, updateProof *cell.Cell, fromWeb bool) (*payments.SignedSemiChannel, error)
 	ProcessActionRequest(ctx context.Context, key ed25519.PublicKey, channelAddr *address.Address, action transport.Action) ([]byte, error)
 	ProcessExternalChannelLock(ctx context.Context, key ed25519.PublicKey, addr *address.Address, id int64, lock bool) error
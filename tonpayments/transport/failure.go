@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+)
+
+const (
+	// FailureCodeDenied - next node has rejected the virtual channel
+	FailureCodeDenied int32 = iota + 1
+	// FailureCodeNotPossible - node is not able to open virtual channel to the next node
+	FailureCodeNotPossible
+	// FailureCodeAccepted - not a failure, final receiver confirms that update of virtual channel is accepted
+	FailureCodeAccepted
+)
+
+// FailureReportSize - all reports have the same size, to not reveal the origin by length
+const FailureReportSize = 256
+
+const failureMacSize = 32
+
+// FailureReport - reason why virtual channel was not opened, it is encrypted by the node where it has happened
+// using key shared with the sender by instruction, and then wrapped by each previous node of the tunnel.
+// So only the sender can read it and know which node has sent it. Result of virtual channel update is reported the same way.
+type FailureReport struct {
+	Code    int32  `tl:"int"`
+	Message string `tl:"string"`
+}
+
+// NewFailureReport - serializes and encrypts report, shared key is calculated from our key and instruction key of the previous node
+func NewFailureReport(sharedKey, channelKey []byte, code int32, message string) ([]byte, error) {
+	const maxDataSize = FailureReportSize - failureMacSize - 2
+
+	var data []byte
+	for {
+		var err error
+		data, err = tl.Serialize(FailureReport{Code: code, Message: message}, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize report: %w", err)
+		}
+
+		if len(data) <= maxDataSize {
+			break
+		}
+		// cut message to fit the size
+		message = message[:len(message)-(len(data)-maxDataSize)]
+	}
+
+	report := make([]byte, FailureReportSize)
+	binary.LittleEndian.PutUint16(report[failureMacSize:], uint16(len(data)))
+	copy(report[failureMacSize+2:], data)
+	// fill padding with random bytes to avoid potential zero padding attacks
+	_, _ = rand.Read(report[failureMacSize+2+len(data):])
+
+	copy(report, failureMac(sharedKey, report[failureMacSize:]))
+
+	return WrapFailureReport(sharedKey, channelKey, report)
+}
+
+// WrapFailureReport - adds our encryption layer to report received from the next node
+func WrapFailureReport(sharedKey, channelKey, report []byte) ([]byte, error) {
+	if len(report) != FailureReportSize {
+		return nil, fmt.Errorf("incorrect report size")
+	}
+
+	stream, err := keys.BuildSharedCipher(sharedKey, failureChecksum(channelKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to init cipher: %w", err)
+	}
+
+	res := make([]byte, len(report))
+	stream.XORKeyStream(res, report)
+	return res, nil
+}
+
+// DecryptFailureReport - removes encryption layers one by one, using shared keys of tunnel nodes in order,
+// returns index of the node which has created the report.
+func DecryptFailureReport(sharedKeys [][]byte, channelKey, report []byte) (int, *FailureReport, error) {
+	if len(report) != FailureReportSize {
+		return -1, nil, fmt.Errorf("incorrect report size")
+	}
+
+	for i, sharedKey := range sharedKeys {
+		var err error
+		report, err = WrapFailureReport(sharedKey, channelKey, report)
+		if err != nil {
+			return -1, nil, err
+		}
+
+		if !hmac.Equal(report[:failureMacSize], failureMac(sharedKey, report[failureMacSize:])) {
+			// not created by this node, continue unwrapping
+			continue
+		}
+
+		sz := int(binary.LittleEndian.Uint16(report[failureMacSize:]))
+		if sz > FailureReportSize-failureMacSize-2 {
+			return -1, nil, fmt.Errorf("incorrect report data size")
+		}
+
+		var rep FailureReport
+		if _, err = tl.Parse(&rep, report[failureMacSize+2:failureMacSize+2+sz], true); err != nil {
+			return -1, nil, fmt.Errorf("failed to parse report: %w", err)
+		}
+		return i, &rep, nil
+	}
+
+	return -1, nil, fmt.Errorf("report is not created by any of tunnel nodes")
+}
+
+// TunnelFailureKeys - calculates keys shared with each node of the tunnel, in the order of nodes,
+// they are used by the sender to decrypt failure reports.
+func TunnelFailureKeys(tunnel []OpenVirtualInstruction, firstInstructionKey ed25519.PublicKey) ([][]byte, error) {
+	var res [][]byte
+	next := []byte(firstInstructionKey)
+	for len(res) < len(tunnel) {
+		var inst *OpenVirtualInstruction
+		for i := range tunnel {
+			if tunnel[i].instructionPrivateKey != nil &&
+				bytes.Equal(tunnel[i].instructionPrivateKey.Public().(ed25519.PublicKey), next) {
+				inst = &tunnel[i]
+				break
+			}
+		}
+
+		if inst == nil {
+			break
+		}
+
+		sharedKey, err := keys.SharedKey(inst.instructionPrivateKey, inst.Target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to calc shared key: %w", err)
+		}
+		res = append(res, sharedKey)
+
+		if bytes.Equal(inst.NextTarget, inst.Target) {
+			// final node
+			break
+		}
+		next = inst.NextInstructionKey
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("first instruction is not found")
+	}
+	return res, nil
+}
+
+func failureMac(sharedKey, data []byte) []byte {
+	mac := hmac.New(sha256.New, sharedKey)
+	mac.Write([]byte("failure"))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func failureChecksum(channelKey []byte) []byte {
+	hash := sha256.Sum256(append([]byte("failure"), channelKey...))
+	return hash[:]
+}
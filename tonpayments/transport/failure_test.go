@@ -0,0 +1,147 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+)
+
+func TestFailureReport_MultiHop(t *testing.T) {
+	const hops = 3
+
+	var nodes []ed25519.PrivateKey
+	var chain []TunnelChainPart
+	for i := 0; i < hops; i++ {
+		_, priv, _ := ed25519.GenerateKey(nil)
+		nodes = append(nodes, priv)
+		chain = append(chain, TunnelChainPart{
+			Target:   priv.Public().(ed25519.PublicKey),
+			Capacity: big.NewInt(1000),
+			Fee:      big.NewInt(int64(10 * (hops - 1 - i))),
+			Deadline: time.Now().Add(time.Duration(hops-i) * time.Hour),
+		})
+	}
+
+	_, chKey, _ := ed25519.GenerateKey(nil)
+	_, firstKey, tunnel, err := GenerateTunnel(chKey, chain, 4, false, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	senderKeys, err := TunnelFailureKeys(tunnel, firstKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(senderKeys) != hops {
+		t.Fatal("incorrect number of keys", len(senderKeys))
+	}
+
+	// keys calculated by the nodes from their keys and instruction keys they have received
+	var nodeKeys [][]byte
+	instKey := firstKey
+	for i := 0; i < hops; i++ {
+		sk, err := keys.SharedKey(nodes[i], instKey)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(sk, senderKeys[i]) {
+			t.Fatal("shared key mismatch for node", i)
+		}
+		nodeKeys = append(nodeKeys, sk)
+
+		for _, inst := range tunnel {
+			if bytes.Equal(inst.Target, chain[i].Target) {
+				instKey = inst.NextInstructionKey
+				break
+			}
+		}
+	}
+
+	chID := chKey.Public().(ed25519.PublicKey)
+
+	// report created by node and wrapped by all previous ones
+	makeReport := func(at int, msg string) []byte {
+		rep, err := NewFailureReport(nodeKeys[at], chID, FailureCodeDenied, msg)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for i := at - 1; i >= 0; i-- {
+			if rep, err = WrapFailureReport(nodeKeys[i], chID, rep); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if len(rep) != FailureReportSize {
+			t.Fatal("incorrect report size", len(rep))
+		}
+		return rep
+	}
+
+	for at := 0; at < hops; at++ {
+		idx, rep, err := DecryptFailureReport(senderKeys, chID, makeReport(at, "not enough balance"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if idx != at || rep.Code != FailureCodeDenied || rep.Message != "not enough balance" {
+			t.Fatal("incorrect report", idx, rep.Code, rep.Message)
+		}
+	}
+
+	long := strings.Repeat("x", 1000)
+	idx, rep, err := DecryptFailureReport(senderKeys, chID, makeReport(2, long))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if idx != 2 || len(rep.Message) == 0 || len(rep.Message) >= FailureReportSize || !strings.HasPrefix(long, rep.Message) {
+		t.Fatal("message is not truncated correctly", len(rep.Message))
+	}
+
+	tampered := makeReport(1, "denied")
+	tampered[failureMacSize+5] ^= 0xFF
+	if _, _, err = DecryptFailureReport(senderKeys, chID, tampered); err == nil {
+		t.Fatal("tampered report should be rejected")
+	}
+
+	// wrong channel key gives another cipher stream
+	if _, _, err = DecryptFailureReport(senderKeys, make([]byte, 32), makeReport(1, "denied")); err == nil {
+		t.Fatal("report with wrong channel key should be rejected")
+	}
+}
+
+func TestRequestRemoveVirtual_Compatibility(t *testing.T) {
+	key := make([]byte, 32)
+	key[0] = 7
+
+	// older nodes should still be able to parse removal request without report
+	data, err := tl.Serialize(RequestRemoveVirtualAction{Key: key}, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if binary.LittleEndian.Uint32(data) != tl.CRC("payments.requestRemoveVirtualAction key:int256 = payments.Action") {
+		t.Fatal("constructor of removal request is changed")
+	}
+
+	data, err = tl.Serialize(RequestAction{
+		ChannelAddr: make([]byte, 32),
+		Action:      RequestRemoveVirtualWithFailureAction{Key: key, Failure: []byte{1, 2, 3}},
+	}, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var req RequestAction
+	if _, err = tl.Parse(&req, data, true); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	act, ok := req.Action.(RequestRemoveVirtualWithFailureAction)
+	if !ok || !bytes.Equal(act.Key, key) || !bytes.Equal(act.Failure, []byte{1, 2, 3}) {
+		t.Fatal("incorrect removal request with failure", req.Action)
+	}
+}
@@ -39,12 +39,22 @@ type Peer struct {
 }
 
 type Service interface {
-	ReviewChannelConfig(prop ProposeChannelConfig) (*address.Address, config.CoinConfig, error)
+	ReviewChannelConfig(key ed25519.PublicKey, prop ProposeChannelConfig) (*address.Address, config.CoinConfig, error)
 	ProcessAction(ctx context.Context, key ed25519.PublicKey, lockId int64, channelAddr *address.Address, signedState payments.SignedSemiChannel, action Action, updateProof *cell.Cell, fromWeb bool) (*payments.SignedSemiChannel, error)
 	ProcessActionRequest(ctx context.Context, key ed25519.PublicKey, channelAddr *address.Address, action Action) ([]byte, error)
 	ProcessExternalChannelLock(ctx context.Context, key ed25519.PublicKey, addr *address.Address, id int64, lock bool) error
 	ProcessIsChannelLocked(ctx context.Context, key ed25519.PublicKey, addr *address.Address, id int64) error
 	OpenChannelOffchain(ctx context.Context, cfg *payments.OpenConfigContainer, codeHash, authorizedKey []byte, urgent, withWeb bool) (*address.Address, error)
+	ProcessGossip(ctx context.Context, key ed25519.PublicKey, gossip Gossip) error
+	ProcessStreamState(ctx context.Context, key ed25519.PublicKey, virtualKey ed25519.PublicKey, state *cell.Cell, final bool) (*big.Int, error)
+	ResolvePeerCoinConfig(key ed25519.PublicKey, jetton string, ecID uint32) (*config.CoinConfig, error)
+	ProcessWatchtowerBackup(ctx context.Context, backup WatchtowerBackup) error
+}
+
+// WatchtowerNetwork - network which cannot reach the tower as a regular peer,
+// but can deliver backups to it in its own way, like web
+type WatchtowerNetwork interface {
+	SendWatchtowerBackup(ctx context.Context, towerKey ed25519.PublicKey, backup WatchtowerBackup) (*Decision, error)
 }
 
 type Transport struct {
@@ -166,17 +176,29 @@ func (t *Transport) handleQuery(ctx context.Context, peer *Peer, msg any) (any,
 			reason = err.Error()
 		}
 
+		return Decision{Agreed: reason == "", Reason: reason}, nil
+	case WatchtowerBackup:
+		// authorized by signature, because web clients upload to the tower without session
+		if !q.Verify() {
+			return nil, fmt.Errorf("incorrect signature")
+		}
+
+		var reason string
+		if err := t.svc.ProcessWatchtowerBackup(ctx, q); err != nil {
+			reason = err.Error()
+		}
+
 		return Decision{Agreed: reason == "", Reason: reason}, nil
 	case ProposeChannelConfig:
 		var res ChannelConfigDecision
-		if addr, cc, err := t.svc.ReviewChannelConfig(q); err == nil {
+		if addr, cc, err := t.svc.ReviewChannelConfig(peer.AuthKey, q); err == nil {
 			res.WalletAddr = addr.Data()
 
 			res.ProxyAllowed = cc.VirtualTunnelConfig.AllowTunneling
 			if res.ProxyAllowed {
 				res.ProxyMaxCap = tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMaxCapacity, int(cc.Decimals)).Nano().Bytes()
 				res.ProxyMinFee = tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMinFee, int(cc.Decimals)).Nano().Bytes()
-				res.ProxyPercentFeeFloat = math.Float64bits(cc.VirtualTunnelConfig.ProxyFeePercent)
+				res.ProxyPercentFeeFloat = math.Float64bits(cc.VirtualTunnelConfig.AdvertisedFeePercent())
 			}
 
 			res.Ok = true
@@ -253,6 +275,57 @@ func (t *Transport) handleQuery(ctx context.Context, peer *Peer, msg any) (any,
 		}
 
 		return OpenChannelOffchainResponse{addr.Data(), ""}, nil
+	case GetTunnelingPolicy:
+		if peer.AuthKey == nil {
+			return nil, fmt.Errorf("not authorized")
+		}
+
+		var jetton string
+		if !bytes.Equal(q.JettonAddr, make([]byte, 32)) {
+			jetton = address.NewAddress(0, 0, q.JettonAddr).Bounce(true).String()
+		}
+
+		res := CoinPolicy{
+			JettonAddr:      q.JettonAddr,
+			ExtraCurrencyID: q.ExtraCurrencyID,
+		}
+
+		if cc, err := t.svc.ResolvePeerCoinConfig(peer.AuthKey, jetton, q.ExtraCurrencyID); err == nil {
+			res.ProxyAllowed = cc.VirtualTunnelConfig.AllowTunneling
+			if res.ProxyAllowed {
+				res.ProxyMaxCap = tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMaxCapacity, int(cc.Decimals)).Nano().Bytes()
+				res.ProxyMinFee = tlb.MustFromDecimal(cc.VirtualTunnelConfig.ProxyMinFee, int(cc.Decimals)).Nano().Bytes()
+				res.ProxyPercentFeeFloat = math.Float64bits(cc.VirtualTunnelConfig.AdvertisedFeePercent())
+			}
+		}
+
+		return res, nil
+	case Gossip:
+		if peer.AuthKey == nil {
+			return nil, fmt.Errorf("not authorized")
+		}
+
+		var reason string
+		if err := t.svc.ProcessGossip(ctx, peer.AuthKey, q); err != nil {
+			reason = err.Error()
+		}
+
+		return Decision{Agreed: reason == "", Reason: reason}, nil
+	case StreamState:
+		if peer.AuthKey == nil {
+			return nil, fmt.Errorf("not authorized")
+		}
+
+		if len(q.Key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("incorrect key")
+		}
+
+		amount, err := t.svc.ProcessStreamState(ctx, peer.AuthKey, q.Key, q.State, q.Final)
+		if err != nil {
+			return StreamStateAck{Accepted: false, Reason: err.Error(), Amount: []byte{}}, nil
+		}
+
+		return StreamStateAck{Accepted: true, Amount: amount.Bytes()}, nil
 	}
 
 	return nil, fmt.Errorf("unknown query")
@@ -426,6 +499,60 @@ func (t *Transport) ProposeChannelConfig(ctx context.Context, theirChannelKey ed
 	return address.NewAddress(0, 0, res.WalletAddr), cfg, nil
 }
 
+func (t *Transport) GetTunnelingPolicy(ctx context.Context, theirChannelKey ed25519.PublicKey, jettonAddr []byte, ecID uint32) (VirtualConfigResponse, error) {
+	if jettonAddr == nil {
+		jettonAddr = make([]byte, 32)
+	}
+
+	var res CoinPolicy
+	err := t.doQuery(ctx, theirChannelKey, GetTunnelingPolicy{
+		JettonAddr:      jettonAddr,
+		ExtraCurrencyID: ecID,
+	}, &res, true)
+	if err != nil {
+		return VirtualConfigResponse{}, fmt.Errorf("failed to make request: %w", err)
+	}
+
+	cfg := VirtualConfigResponse{
+		AllowTunneling: res.ProxyAllowed,
+	}
+
+	if res.ProxyAllowed {
+		if len(res.ProxyMinFee) > 32 || len(res.ProxyMaxCap) > 32 {
+			return VirtualConfigResponse{}, fmt.Errorf("invalid proxy config")
+		}
+
+		cfg.ProxyFeePercent = math.Float64frombits(res.ProxyPercentFeeFloat)
+		if math.IsNaN(cfg.ProxyFeePercent) || math.IsInf(cfg.ProxyFeePercent, 0) || cfg.ProxyFeePercent < 0 {
+			return VirtualConfigResponse{}, fmt.Errorf("invalid proxy fee percent")
+		}
+
+		cfg.ProxyMinFee = new(big.Int).SetBytes(res.ProxyMinFee)
+		cfg.ProxyMaxCapacity = new(big.Int).SetBytes(res.ProxyMaxCap)
+	}
+
+	return cfg, nil
+}
+
+// SendWatchtowerBackup - uploads latest backup of our channel to the tower
+func (t *Transport) SendWatchtowerBackup(ctx context.Context, towerKey ed25519.PublicKey, backup WatchtowerBackup) error {
+	var res Decision
+	if wn, ok := t.net.(WatchtowerNetwork); ok {
+		d, err := wn.SendWatchtowerBackup(ctx, towerKey, backup)
+		if err != nil {
+			return fmt.Errorf("failed to make request: %w", err)
+		}
+		res = *d
+	} else if err := t.doQuery(ctx, towerKey, backup, &res, true); err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+
+	if !res.Agreed {
+		return fmt.Errorf("backup rejected: %s", res.Reason)
+	}
+	return nil
+}
+
 func (t *Transport) RequestChannelLock(ctx context.Context, theirChannelKey ed25519.PublicKey, channel *address.Address, id int64, lock bool) (*Decision, error) {
 	var res Decision
 	err := t.doQuery(ctx, theirChannelKey, RequestChannelLock{
@@ -500,6 +627,39 @@ func (t *Transport) OpenOffchainChannel(ctx context.Context, theirChannelKey, co
 	return address.NewAddress(0, 0, res.Addr), nil
 }
 
+func (t *Transport) SendGossip(ctx context.Context, theirChannelKey ed25519.PublicKey, gossip Gossip) error {
+	var res Decision
+	err := t.doQuery(ctx, theirChannelKey, gossip, &res, false)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	if !res.Agreed {
+		return fmt.Errorf("gossip rejected: %s", res.Reason)
+	}
+	return nil
+}
+
+// SendStreamState - delivers next state of streaming session directly to the receiver,
+// returns total amount acknowledged by receiver
+func (t *Transport) SendStreamState(ctx context.Context, theirChannelKey, virtualKey ed25519.PublicKey, state *cell.Cell, final bool) (*big.Int, error) {
+	var res StreamStateAck
+	err := t.doQuery(ctx, theirChannelKey, StreamState{
+		Key:   virtualKey,
+		State: state,
+		Final: final,
+	}, &res, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	if !res.Accepted {
+		return nil, fmt.Errorf("stream state rejected: %s", res.Reason)
+	}
+	if len(res.Amount) > 32 {
+		return nil, fmt.Errorf("invalid acknowledged amount")
+	}
+	return new(big.Int).SetBytes(res.Amount), nil
+}
+
 func (t *Transport) doQuery(ctx context.Context, theirKey []byte, req, resp tl.Serializable, connect bool) error {
 	maxWait := 7 * time.Second
 	if connect {
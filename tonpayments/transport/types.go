@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/tonutils-go/address"
 	"github.com/xssnick/tonutils-go/adnl/keys"
 	"github.com/xssnick/tonutils-go/tl"
 	"github.com/xssnick/tonutils-go/tlb"
@@ -29,6 +30,8 @@ func init() {
 		"payments.syncStateAction",
 		"payments.incrementStatesAction",
 		"payments.commitVirtualAction",
+		"payments.extendVirtualAction",
+		"payments.increaseVirtualAction",
 		"payments.rentCapacityAction",
 		"payments.cooperativeCommitAction")
 
@@ -39,7 +42,9 @@ func init() {
 		"payments.syncStateAction",
 		"payments.cooperativeCloseAction",
 		"payments.cooperativeCommitAction",
-		"payments.requestRemoveVirtualAction")
+		"payments.requestRemoveVirtualAction",
+		"payments.requestRemoveVirtualWithFailureAction",
+		"payments.virtualUpdateResultAction")
 
 	tl.Register(Ping{}, "payments.ping value:long = payments.Ping")
 	tl.Register(Pong{}, "payments.pong value:long = payments.Pong")
@@ -53,8 +58,12 @@ func init() {
 	tl.Register(ConfirmCloseAction{}, "payments.confirmCloseAction key:int256 state:bytes = payments.Action")
 	tl.Register(RemoveVirtualAction{}, "payments.removeVirtualAction key:int256 = payments.Action")
 	tl.Register(RequestRemoveVirtualAction{}, "payments.requestRemoveVirtualAction key:int256 = payments.Action")
+	tl.Register(RequestRemoveVirtualWithFailureAction{}, "payments.requestRemoveVirtualWithFailureAction key:int256 failure:bytes = payments.Action")
 	tl.Register(OpenVirtualAction{}, "payments.openVirtualAction channel_key:int256 instruction_key:int256 instructions:payments.instructionsToSign signature:bytes = payments.Action")
 	tl.Register(CommitVirtualAction{}, "payments.commitVirtualAction key:int256 prepayAmount:bytes = payments.Action")
+	tl.Register(ExtendVirtualAction{}, "payments.extendVirtualAction key:int256 id:int256 deadline:long fee:bytes = payments.Action")
+	tl.Register(IncreaseVirtualAction{}, "payments.increaseVirtualAction key:int256 id:int256 capacity:bytes fee:bytes = payments.Action")
+	tl.Register(VirtualUpdateResultAction{}, "payments.virtualUpdateResultAction key:int256 id:int256 report:bytes = payments.Action")
 	tl.Register(CloseVirtualAction{}, "payments.closeVirtualAction key:int256 state:bytes = payments.Action")
 	tl.Register(CooperativeCloseAction{}, "payments.cooperativeCloseAction signedCloseRequest:bytes = payments.Action")
 	tl.Register(CooperativeCommitAction{}, "payments.cooperativeCommitAction signedCommitRequest:bytes = payments.Action")
@@ -62,20 +71,38 @@ func init() {
 	tl.Register(RentCapacityAction{}, "payments.rentCapacityAction till:long amount:bytes = payments.Action")
 
 	tl.Register(ProposeChannelConfig{}, "payments.proposeChannelConfig jettonAddr:int256 ec_id:int excessFee:bytes quarantineDuration:int misbehaviorFine:bytes conditionalCloseDuration:int nodeVersion:int codeHash:int256 = payments.Request")
+	tl.Register(GetTunnelingPolicy{}, "payments.getTunnelingPolicy jettonAddr:int256 ec_id:int = payments.Request")
 	tl.Register(RequestAction{}, "payments.requestAction channelAddr:int256 action:payments.Action = payments.Request")
 	tl.Register(ProposeAction{}, "payments.proposeAction lockId:long channelAddr:int256 action:payments.Action state:bytes conditionals:bytes = payments.Request")
 	tl.Register(Authenticate{}, "payments.authenticate key:int256 timestamp:long signature:bytes = payments.Authenticate")
 	tl.Register(OpenChannelOffchain{}, "payments.openChannelOffchain codeHash:int256 openConfig:bytes nodeVersion:int = payments.OpenChannelOffchain")
 	tl.Register(OpenChannelOffchainResponse{}, "payments.openChannelOffchainResponse addr:int256 reason:string = payments.OpenChannelOffchainResponse")
 
+	tl.Register(PaymentPartPayload{}, "payments.paymentPartPayload paymentId:int256 totalAmount:bytes = payments.Payload")
+	tl.Register(InvoicePayload{}, "payments.invoicePayload invoiceId:int256 = payments.Payload")
+	tl.Register(MemoPayload{}, "payments.memoPayload memo:string = payments.Payload")
+	tl.Register(StreamPayload{}, "payments.streamPayload idleTimeout:int = payments.Payload")
+	tl.Register(SwapPayload{}, "payments.swapPayload swapId:int256 taker:int256 = payments.Payload")
+	tl.Register(ConvertPayload{}, "payments.convertPayload jettonAddr:int256 ecId:int = payments.Payload")
+	tl.Register(StreamState{}, "payments.streamState key:int256 state:bytes final:Bool = payments.Request")
+	tl.Register(StreamStateAck{}, "payments.streamStateAck accepted:Bool reason:string amount:bytes = payments.StreamStateAck")
+	tl.Register(FailureReport{}, "payments.failureReport code:int message:string = payments.FailureReport")
 	tl.Register(InstructionContainer{}, "payments.instructionContainer hash:int256 data:bytes = payments.InstructionContainer")
 	tl.RegisterWithFabric(InstructionsToSign{}, "payments.instructionsToSign list:(vector payments.instructionContainer) = payments.InstructionsToSign", func() reflect.Value {
 		return reflect.ValueOf(&InstructionsToSign{})
 	})
 	tl.Register(OpenVirtualInstruction{}, "payments.openVirtualInstruction target:int256 expectedFee:bytes expectedCapacity:bytes expectedDeadline:long nextTarget:int256 nextFee:bytes nextCapacity:bytes nextDeadline:long finalState:bytes = payments.OpenVirtualInstruction")
 
+	tl.Register(CoinPolicy{}, "payments.coinPolicy jettonAddr:int256 ec_id:int proxyAllowed:Bool proxyMinFee:bytes proxyMaxCap:bytes proxyPercentFeeFloat:long = payments.CoinPolicy")
+	tl.Register(NodeAnnouncement{}, "payments.nodeAnnouncement key:int256 timestamp:long policies:(vector payments.coinPolicy) signature:bytes = payments.NodeAnnouncement")
+	tl.Register(ChannelAnnouncement{}, "payments.channelAnnouncement channelAddr:int256 key:int256 timestamp:long signature:bytes = payments.ChannelAnnouncement")
+	tl.Register(Gossip{}, "payments.gossip nodes:(vector payments.nodeAnnouncement) channels:(vector payments.channelAnnouncement) = payments.Gossip")
+
 	tl.Register(RequestChannelLock{}, "payments.requestChannelLock lockId:long channel:int256 lock:Bool = payments.RequestChannelLock")
 	tl.Register(IsChannelUnlocked{}, "payments.isChannelUnlocked lockId:long channel:int256 = payments.IsChannelUnlocked")
+
+	tl.Register(WatchtowerBackup{}, "payments.watchtowerBackup key:int256 channelAddr:int256 version:long seqno:long committedSeqno:long wrap:bytes data:bytes signature:bytes = payments.Request")
+	tl.Register(WatchtowerBlob{}, "payments.watchtowerBlob challenge:bytes settle:(vector bytes) = payments.WatchtowerBlob")
 }
 
 type Action any
@@ -173,6 +200,26 @@ type CommitVirtualAction struct {
 	PrepayAmount []byte `tl:"bytes"`
 }
 
+// ExtendVirtualAction - move deadline of virtual channel further, without closing it.
+// Fee is paid to the next node for locking its liquidity longer, it takes its part and passes the rest further.
+// ID is chosen by the sender and passed unchanged along the chain, result is reported back with it.
+type ExtendVirtualAction struct {
+	Key      []byte `tl:"int256"`
+	ID       []byte `tl:"int256"`
+	Deadline int64  `tl:"long"`
+	Fee      []byte `tl:"bytes"`
+}
+
+// IncreaseVirtualAction - raise capacity of virtual channel without reopening it.
+// Capacity and Fee are the new values of the condition, each node takes its part of the fee increase and passes the rest further.
+// ID is the same as in ExtendVirtualAction.
+type IncreaseVirtualAction struct {
+	Key      []byte `tl:"int256"`
+	ID       []byte `tl:"int256"`
+	Capacity []byte `tl:"bytes"`
+	Fee      []byte `tl:"bytes"`
+}
+
 // OpenVirtualAction - request party to open virtual channel (tunnel) with specified target
 type OpenVirtualAction struct {
 	ChannelKey []byte `tl:"int256"`
@@ -220,6 +267,71 @@ type OpenVirtualInstruction struct {
 	FinalState *cell.Cell `tl:"cell optional"`
 
 	instructionPrivateKey ed25519.PrivateKey `tl:"-"`
+	// payloads - additional data for the target, encrypted separately with the same key
+	payloads []any `tl:"-"`
+}
+
+// PaymentPartPayload - attached for the final receiver when payment is split to several virtual channels,
+// receiver should accept parts only when total amount is collected
+type PaymentPartPayload struct {
+	PaymentID   []byte `tl:"int256"`
+	TotalAmount []byte `tl:"bytes"`
+}
+
+// InvoicePayload - tells receiver which invoice is paid by the virtual channel
+type InvoicePayload struct {
+	InvoiceID []byte `tl:"int256"`
+}
+
+// MaxMemoLength - memo is encrypted together with instructions, so we limit it to not inflate all of them
+const MaxMemoLength = 512
+
+// MemoPayload - comment or payment reference for the final receiver, like order id
+type MemoPayload struct {
+	Memo string `tl:"string"`
+}
+
+// StreamPayload - tells receiver that virtual channel is used for streaming session,
+// states will be sent directly by the sender, and channel is closed when sender is idle for IdleTimeout seconds
+type StreamPayload struct {
+	IdleTimeout int32 `tl:"int"`
+}
+
+// SwapPayload - tells receiver that hash-locked virtual channel is the taker's part of the swap quoted by the receiver,
+// receiver should lock its part for the taker with the same hash
+type SwapPayload struct {
+	SwapID []byte            `tl:"int256"`
+	Taker  ed25519.PublicKey `tl:"int256"`
+}
+
+// ConvertPayload - asks intermediate node to tunnel next virtual channel in another coin,
+// next capacity and fee are specified in that coin. Possible only for hash-locked channels.
+type ConvertPayload struct {
+	// JettonAddr - data part of jetton master address, zeroes for ton and extra currencies
+	JettonAddr      []byte `tl:"int256"`
+	ExtraCurrencyID uint32 `tl:"int"`
+}
+
+// JettonAddress - returns jetton master address in the same format as channels store it, empty for ton and extra currencies
+func (p *ConvertPayload) JettonAddress() string {
+	if bytes.Equal(p.JettonAddr, make([]byte, 32)) {
+		return ""
+	}
+	return address.NewAddress(0, 0, p.JettonAddr).Bounce(true).String()
+}
+
+// StreamState - next signed state of the streaming session, sent by the sender directly to the receiver
+type StreamState struct {
+	Key   []byte     `tl:"int256"`
+	State *cell.Cell `tl:"cell"`
+	Final bool       `tl:"bool"`
+}
+
+// StreamStateAck - receiver's confirmation of StreamState, Amount is the total amount known by receiver
+type StreamStateAck struct {
+	Accepted bool   `tl:"bool"`
+	Reason   string `tl:"string"`
+	Amount   []byte `tl:"bytes"`
 }
 
 // CloseVirtualAction - request party to close virtual channel,
@@ -251,6 +363,22 @@ type RequestRemoveVirtualAction struct {
 	Key []byte `tl:"int256"`
 }
 
+// RequestRemoveVirtualWithFailureAction - same as RequestRemoveVirtualAction,
+// but also passes onion encrypted failure report for the sender
+type RequestRemoveVirtualWithFailureAction struct {
+	Key     []byte `tl:"int256"`
+	Failure []byte `tl:"bytes"`
+}
+
+// VirtualUpdateResultAction - result of virtual channel extension or capacity increase, passed back to the sender hop by hop.
+// Report is created by the final receiver when it has accepted update, or by the node whose next node has not,
+// it is onion encrypted in the same way as failure report, so only the sender can read and verify it.
+type VirtualUpdateResultAction struct {
+	Key    []byte `tl:"int256"`
+	ID     []byte `tl:"int256"`
+	Report []byte `tl:"bytes"`
+}
+
 // ConfirmCloseAction - request party to remove closed condition
 // and increase unconditional amount
 type ConfirmCloseAction struct {
@@ -278,6 +406,12 @@ type ProposeChannelConfig struct {
 	CodeHash                 []byte `tl:"int256"`
 }
 
+// GetTunnelingPolicy - asks node for its current tunnelling conditions for specific coin, response is CoinPolicy
+type GetTunnelingPolicy struct {
+	JettonAddr      []byte `tl:"int256"`
+	ExtraCurrencyID uint32 `tl:"int"`
+}
+
 // ChannelConfigDecision - response for ProposeChannelConfig
 type ChannelConfigDecision struct {
 	Ok                   bool   `tl:"bool"`
@@ -289,6 +423,39 @@ type ChannelConfigDecision struct {
 	ProxyPercentFeeFloat uint64 `tl:"long"`
 }
 
+// CoinPolicy - tunnelling conditions of the node for specific coin
+type CoinPolicy struct {
+	JettonAddr           []byte `tl:"int256"`
+	ExtraCurrencyID      uint32 `tl:"int"`
+	ProxyAllowed         bool   `tl:"bool"`
+	ProxyMinFee          []byte `tl:"bytes"`
+	ProxyMaxCap          []byte `tl:"bytes"`
+	ProxyPercentFeeFloat uint64 `tl:"long"`
+}
+
+// NodeAnnouncement - node's tunnelling policies, signed by node channel key
+type NodeAnnouncement struct {
+	Key       []byte       `tl:"int256"`
+	Timestamp int64        `tl:"long"`
+	Policies  []CoinPolicy `tl:"vector struct"`
+	Signature []byte       `tl:"bytes"`
+}
+
+// ChannelAnnouncement - one of the channel parties declares that channel can be used for routing,
+// second party and coin are taken from the onchain contract during verification
+type ChannelAnnouncement struct {
+	ChannelAddr []byte `tl:"int256"`
+	Key         []byte `tl:"int256"`
+	Timestamp   int64  `tl:"long"`
+	Signature   []byte `tl:"bytes"`
+}
+
+// Gossip - announcements relayed between peers to build network view
+type Gossip struct {
+	Nodes    []NodeAnnouncement    `tl:"vector struct"`
+	Channels []ChannelAnnouncement `tl:"vector struct"`
+}
+
 type VirtualConfigResponse struct {
 	ProxyMaxCapacity *big.Int
 	ProxyMinFee      *big.Int
@@ -296,19 +463,89 @@ type VirtualConfigResponse struct {
 	AllowTunneling   bool
 }
 
+func (a *NodeAnnouncement) Sign(key ed25519.PrivateKey) error {
+	a.Key = key.Public().(ed25519.PublicKey)
+	a.Signature = nil
+
+	hash, err := tl.Hash(*a)
+	if err != nil {
+		return fmt.Errorf("failed to hash announcement: %w", err)
+	}
+	a.Signature = ed25519.Sign(key, hash)
+	return nil
+}
+
+func (a *NodeAnnouncement) Verify() bool {
+	if len(a.Key) != ed25519.PublicKeySize {
+		return false
+	}
+
+	toSign := *a
+	toSign.Signature = nil
+
+	hash, err := tl.Hash(toSign)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(a.Key, hash, a.Signature)
+}
+
+func (a *ChannelAnnouncement) Sign(key ed25519.PrivateKey) error {
+	a.Key = key.Public().(ed25519.PublicKey)
+	a.Signature = nil
+
+	hash, err := tl.Hash(*a)
+	if err != nil {
+		return fmt.Errorf("failed to hash announcement: %w", err)
+	}
+	a.Signature = ed25519.Sign(key, hash)
+	return nil
+}
+
+func (a *ChannelAnnouncement) Verify() bool {
+	if len(a.Key) != ed25519.PublicKeySize {
+		return false
+	}
+
+	toSign := *a
+	toSign.Signature = nil
+
+	hash, err := tl.Hash(toSign)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(a.Key, hash, a.Signature)
+}
+
 func (a *OpenVirtualAction) SetInstructions(actions []OpenVirtualInstruction, key ed25519.PrivateKey) error {
 	a.Instructions = InstructionsToSign{}
 
+	type toEncrypt struct {
+		data   []byte
+		action *OpenVirtualInstruction
+	}
+
 	maxLen := 0
-	serializedActions := make([][]byte, len(actions))
+	var serialized []toEncrypt
 	for i := 0; i < len(actions); i++ {
 		data, err := tl.Serialize(actions[i], true)
 		if err != nil {
 			return fmt.Errorf("failed to serialize action data: %w", err)
 		}
-		serializedActions[i] = data
-		if len(data) > maxLen {
-			maxLen = len(data)
+		serialized = append(serialized, toEncrypt{data, &actions[i]})
+
+		for _, payload := range actions[i].payloads {
+			data, err := tl.Serialize(payload, true)
+			if err != nil {
+				return fmt.Errorf("failed to serialize payload data: %w", err)
+			}
+			serialized = append(serialized, toEncrypt{data, &actions[i]})
+		}
+	}
+
+	for _, ser := range serialized {
+		if len(ser.data) > maxLen {
+			maxLen = len(ser.data)
 		}
 	}
 
@@ -319,14 +556,14 @@ func (a *OpenVirtualAction) SetInstructions(actions []OpenVirtualInstruction, ke
 	}
 	maxLen += int(fuzz.Int64())
 
-	for i := 0; i < len(actions); i++ {
-		lenDiff := maxLen - len(serializedActions[i])
+	for _, ser := range serialized {
+		lenDiff := maxLen - len(ser.data)
 		// add random stub data to hide real size
-		data := append(serializedActions[i], make([]byte, lenDiff)...)
+		data := append(ser.data, make([]byte, lenDiff)...)
 		// fill padding with random bytes to avoid potential zero padding attacks
-		_, _ = rand.Read(data[len(serializedActions[i]):])
+		_, _ = rand.Read(data[len(ser.data):])
 
-		sharedKey, err := keys.SharedKey(actions[i].instructionPrivateKey, actions[i].Target)
+		sharedKey, err := keys.SharedKey(ser.action.instructionPrivateKey, ser.action.Target)
 		if err != nil {
 			return fmt.Errorf("failed to calc shared key: %w", err)
 		}
@@ -344,6 +581,11 @@ func (a *OpenVirtualAction) SetInstructions(actions []OpenVirtualInstruction, ke
 		})
 	}
 
+	// payloads are placed after their instructions, so we shuffle to not reveal the receiver
+	mRand.Shuffle(len(a.Instructions.List), func(i, j int) {
+		a.Instructions.List[i], a.Instructions.List[j] = a.Instructions.List[j], a.Instructions.List[i]
+	})
+
 	data, err := tl.Serialize(a.Instructions, true)
 	if err != nil {
 		return fmt.Errorf("failed to serialize instructions data: %w", err)
@@ -354,24 +596,32 @@ func (a *OpenVirtualAction) SetInstructions(actions []OpenVirtualInstruction, ke
 }
 
 func (a *OpenVirtualAction) DecryptOurInstruction(key ed25519.PrivateKey, instructionKey ed25519.PublicKey) (*OpenVirtualInstruction, error) {
+	inst, _, err := a.DecryptOurInstructionWithPayloads(key, instructionKey)
+	return inst, err
+}
+
+// DecryptOurInstructionWithPayloads - decrypts our instruction and additional payloads attached for us by sender
+func (a *OpenVirtualAction) DecryptOurInstructionWithPayloads(key ed25519.PrivateKey, instructionKey ed25519.PublicKey) (*OpenVirtualInstruction, []any, error) {
 	verifyData, err := tl.Serialize(a.Instructions, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to serialize verify data: %w", err)
+		return nil, nil, fmt.Errorf("failed to serialize verify data: %w", err)
 	}
 
 	if !ed25519.Verify(a.ChannelKey, verifyData, a.Signature) {
-		return nil, fmt.Errorf("incorrect signature")
+		return nil, nil, fmt.Errorf("incorrect signature")
 	}
 
 	sharedKey, err := keys.SharedKey(key, instructionKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to calc shared key: %w", err)
+		return nil, nil, fmt.Errorf("failed to calc shared key: %w", err)
 	}
 
+	var our *OpenVirtualInstruction
+	var payloads []any
 	for _, instruction := range a.Instructions.List {
 		stream, err := keys.BuildSharedCipher(sharedKey, instruction.Hash)
 		if err != nil {
-			return nil, fmt.Errorf("failed to init cipher: %w", err)
+			return nil, nil, fmt.Errorf("failed to init cipher: %w", err)
 		}
 
 		payload := make([]byte, len(instruction.Data))
@@ -383,13 +633,26 @@ func (a *OpenVirtualAction) DecryptOurInstruction(key ed25519.PrivateKey, instru
 			continue
 		}
 
-		var value OpenVirtualInstruction
+		var value any
 		if _, err = tl.Parse(&value, payload, true); err != nil {
-			return nil, fmt.Errorf("incorrect OpenVirtualInstruction: %w", err)
+			return nil, nil, fmt.Errorf("incorrect instruction data: %w", err)
 		}
-		return &value, nil
+
+		switch v := value.(type) {
+		case OpenVirtualInstruction:
+			if our != nil {
+				return nil, nil, fmt.Errorf("duplicate instruction")
+			}
+			our = &v
+		default:
+			payloads = append(payloads, v)
+		}
+	}
+
+	if our == nil {
+		return nil, nil, fmt.Errorf("not found")
 	}
-	return nil, fmt.Errorf("not found")
+	return our, payloads, nil
 }
 
 type TunnelChainPart struct {
@@ -397,9 +660,14 @@ type TunnelChainPart struct {
 	Capacity *big.Int
 	Fee      *big.Int
 	Deadline time.Time
+	// Payloads - additional data for this node, like ConvertPayload
+	Payloads []any
 }
 
-func GenerateTunnel(key ed25519.PrivateKey, chain []TunnelChainPart, stubSize uint8, withFinalState bool, senderKey ed25519.PrivateKey) (payments.VirtualChannel, ed25519.PublicKey, []OpenVirtualInstruction, error) {
+// GenerateTunnel - prepares encrypted instructions for each node of the chain,
+// payloads are optional and will be available only for the final receiver,
+// payloads for intermediate nodes can be set in chain parts.
+func GenerateTunnel(key ed25519.PrivateKey, chain []TunnelChainPart, stubSize uint8, withFinalState bool, senderKey ed25519.PrivateKey, payloads ...any) (payments.VirtualChannel, ed25519.PublicKey, []OpenVirtualInstruction, error) {
 	if len(chain) == 0 {
 		return payments.VirtualChannel{}, nil, nil, fmt.Errorf("chain is empty")
 	}
@@ -420,6 +688,7 @@ func GenerateTunnel(key ed25519.PrivateKey, chain []TunnelChainPart, stubSize ui
 			ExpectedCapacity: chain[i].Capacity.Bytes(),
 			ExpectedDeadline: chain[i].Deadline.UTC().Unix(),
 			Target:           chain[i].Target,
+			payloads:         chain[i].Payloads,
 		}
 
 		var err error
@@ -453,6 +722,7 @@ func GenerateTunnel(key ed25519.PrivateKey, chain []TunnelChainPart, stubSize ui
 			inst.NextFee = chain[i].Fee.Bytes()
 			inst.NextCapacity = chain[i].Capacity.Bytes()
 			inst.NextDeadline = chain[i].Deadline.UTC().Unix()
+			inst.payloads = append(inst.payloads, payloads...)
 			if withFinalState {
 				state := payments.VirtualChannelState{Amount: chain[i].Capacity}
 				state.Sign(key)
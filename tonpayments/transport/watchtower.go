@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/tonutils-go/tl"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+)
+
+// WatchtowerWrapSize - size of the blob key encrypted with the state key
+const WatchtowerWrapSize = 12 + 32 + 16
+
+// WatchtowerBackup - latest state of the client's channel, uploaded to the tower, signed by client channel key.
+// Data is encrypted WatchtowerBlob, its key is known only to the client. Wrap is the same key encrypted
+// with the key derived from the client signature of its state with Seqno. Signature appears onchain only in
+// the message which commits this state by uncooperative close, so tower can open the blob only after that.
+// Wraps of all client states since CommittedSeqno are kept by the tower, so the latest blob
+// can be opened whichever of them is committed. Version should grow with each upload, tower keeps only the latest blob.
+type WatchtowerBackup struct {
+	Key            []byte `tl:"int256"`
+	ChannelAddr    []byte `tl:"int256"`
+	Version        uint64 `tl:"long"`
+	Seqno          uint64 `tl:"long"`
+	CommittedSeqno uint64 `tl:"long"`
+	Wrap           []byte `tl:"bytes"`
+	Data           []byte `tl:"bytes"`
+	Signature      []byte `tl:"bytes"`
+}
+
+// WatchtowerBlob - messages to the channel contract, presigned by the client,
+// tower only sends them from its wallet. Settle messages should be sent in the same order.
+type WatchtowerBlob struct {
+	Challenge *cell.Cell `tl:"cell"`
+	Settle    [][]byte   `tl:"vector bytes"`
+}
+
+func (b *WatchtowerBackup) Sign(key ed25519.PrivateKey) error {
+	b.Key = key.Public().(ed25519.PublicKey)
+	b.Signature = nil
+
+	hash, err := tl.Hash(*b)
+	if err != nil {
+		return fmt.Errorf("failed to hash backup: %w", err)
+	}
+	b.Signature = ed25519.Sign(key, hash)
+	return nil
+}
+
+func (b *WatchtowerBackup) Verify() bool {
+	if len(b.Key) != ed25519.PublicKeySize {
+		return false
+	}
+
+	toSign := *b
+	toSign.Signature = nil
+
+	hash, err := tl.Hash(toSign)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(b.Key, hash, b.Signature)
+}
+
+// WatchtowerBlobKey - key of the client blobs, derived from its private key, so nothing has to be stored
+func WatchtowerBlobKey(key ed25519.PrivateKey, channelID []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("watchtower-blob:"))
+	h.Write(key.Seed())
+	h.Write(channelID)
+	return h.Sum(nil)
+}
+
+// WrapWatchtowerKey - encrypts blob key with the key of the client state, state should be signed by the client
+func WrapWatchtowerKey(blobKey, channelID []byte, state payments.SignedSemiChannel) ([]byte, error) {
+	return watchtowerSeal(watchtowerStateKey(channelID, state), blobKey, channelID)
+}
+
+// SetBlob - encrypts blob with the client key and sets wrap of the key for the given client state
+func (b *WatchtowerBackup) SetBlob(blob WatchtowerBlob, blobKey, channelID []byte, seqno uint64, wrap []byte) error {
+	data, err := tl.Serialize(blob, true)
+	if err != nil {
+		return fmt.Errorf("failed to serialize blob: %w", err)
+	}
+
+	if b.Data, err = watchtowerSeal(blobKey, data, channelID); err != nil {
+		return fmt.Errorf("failed to encrypt blob: %w", err)
+	}
+	b.Seqno = seqno
+	b.Wrap = wrap
+	return nil
+}
+
+// OpenBlob - decrypts blob, using wrap made for the client state, committed is taken from the onchain close message
+func (b *WatchtowerBackup) OpenBlob(channelID, wrap []byte, committed payments.SignedSemiChannel) (*WatchtowerBlob, error) {
+	blobKey, err := watchtowerOpen(watchtowerStateKey(channelID, committed), wrap, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("wrap is not for the committed state: %w", err)
+	}
+
+	data, err := watchtowerOpen(blobKey, b.Data, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("blob is not for this channel or corrupted: %w", err)
+	}
+
+	var blob WatchtowerBlob
+	if _, err = tl.Parse(&blob, data, true); err != nil {
+		return nil, fmt.Errorf("incorrect blob data: %w", err)
+	}
+	return &blob, nil
+}
+
+// watchtowerStateKey - signature is deterministic, so the same key is derived from the state published onchain
+func watchtowerStateKey(channelID []byte, state payments.SignedSemiChannel) []byte {
+	h := sha256.New()
+	h.Write([]byte("watchtower-state:"))
+	h.Write(channelID)
+	h.Write(state.Signature.Value)
+	return h.Sum(nil)
+}
+
+func watchtowerAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// watchtowerSeal - channel id is authenticated, so data cannot be moved to another channel
+func watchtowerSeal(key, data, channelID []byte) ([]byte, error) {
+	aead, err := watchtowerAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, data, channelID), nil
+}
+
+func watchtowerOpen(key, sealed, channelID []byte) ([]byte, error) {
+	aead, err := watchtowerAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("too short data")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], channelID)
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+)
+
+func TestWatchtowerBackup_Blob(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	channelID := bytes.Repeat([]byte{0xAA}, 16)
+
+	blob := WatchtowerBlob{
+		Challenge: cell.BeginCell().MustStoreUInt(777, 32).EndCell(),
+		Settle:    [][]byte{{1, 2, 3}, {4, 5}},
+	}
+
+	var state, other payments.SignedSemiChannel
+	state.Signature.Value = bytes.Repeat([]byte{0x01}, 64)
+	other.Signature.Value = bytes.Repeat([]byte{0x02}, 64)
+
+	blobKey := WatchtowerBlobKey(key, channelID)
+	wrap, err := WrapWatchtowerKey(blobKey, channelID, state)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(wrap) != WatchtowerWrapSize {
+		t.Fatal("incorrect wrap size", len(wrap))
+	}
+
+	backup := WatchtowerBackup{
+		ChannelAddr: make([]byte, 32),
+		Version:     1,
+	}
+	if err = backup.SetBlob(blob, blobKey, channelID, 5, wrap); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = backup.Sign(key); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !backup.Verify() {
+		t.Fatal("signature is not valid")
+	}
+
+	if bytes.Contains(backup.Data, blob.Settle[0]) {
+		t.Fatal("blob should be encrypted")
+	}
+
+	got, err := backup.OpenBlob(channelID, backup.Wrap, state)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(got.Challenge.Hash(), blob.Challenge.Hash()) || len(got.Settle) != 2 || !bytes.Equal(got.Settle[1], blob.Settle[1]) {
+		t.Fatal("incorrect blob after round trip")
+	}
+
+	// blob can be opened only with the committed state it was wrapped for
+	if _, err = backup.OpenBlob(channelID, backup.Wrap, other); err == nil {
+		t.Fatal("blob should not be opened with another state")
+	}
+
+	// blob made for another channel should not be used
+	if _, err = backup.OpenBlob(bytes.Repeat([]byte{0xBB}, 16), backup.Wrap, state); err == nil {
+		t.Fatal("blob should not be opened with another channel id")
+	}
+
+	tampered := backup
+	tampered.Data = append([]byte{}, backup.Data...)
+	tampered.Data[len(tampered.Data)-1] ^= 0xFF
+	if _, err = tampered.OpenBlob(channelID, backup.Wrap, state); err == nil {
+		t.Fatal("tampered blob should be rejected")
+	}
+	if tampered.Verify() {
+		t.Fatal("signature should not match tampered data")
+	}
+}
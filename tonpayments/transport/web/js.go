@@ -36,8 +36,9 @@ type HTTP struct {
 	queryHandler      func(ctx context.Context, from *transport.Peer, msg any) (any, error)
 	disconnectHandler func(ctx context.Context, from *transport.Peer) error
 
-	peer *PeerConnection
-	ton  *client.TON
+	peer   *PeerConnection
+	ton    *client.TON
+	towers map[string]string
 
 	mx sync.RWMutex
 }
@@ -146,6 +147,45 @@ func (h *HTTP) Connect(ctx context.Context, channelKey ed25519.PublicKey) (*tran
 	return peer.transport, nil
 }
 
+// SetWatchtowers - base urls of web transport of towers, by their channel keys
+func (h *HTTP) SetWatchtowers(towers map[string]string) {
+	h.mx.Lock()
+	h.towers = towers
+	h.mx.Unlock()
+}
+
+// SendWatchtowerBackup - uploads backup directly to the tower web transport, because from web
+// we are connected only to the single server peer
+func (h *HTTP) SendWatchtowerBackup(ctx context.Context, towerKey ed25519.PublicKey, backup transport.WatchtowerBackup) (*transport.Decision, error) {
+	h.mx.RLock()
+	url, ok := h.towers[string(towerKey)]
+	h.mx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown watchtower")
+	}
+
+	req, err := tl.Serialize(backup, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resBytes, err := (&PeerConnection{}).pushJSON(ctx, url+"/web-channel/api/v1/watchtower/backup", Event{Key: h.GetOurID(), Data: req})
+	if err != nil {
+		return nil, err
+	}
+
+	var ev Event
+	if err = json.Unmarshal(resBytes, &ev); err != nil {
+		return nil, err
+	}
+
+	var res transport.Decision
+	if _, err = tl.Parse(&res, ev.Data, true); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
 func (h *HTTP) SetHandlers(q func(ctx context.Context, peer *transport.Peer, msg any) (any, error), d func(ctx context.Context, peer *transport.Peer) error) {
 	h.queryHandler = q
 	h.disconnectHandler = d
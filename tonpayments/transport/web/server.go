@@ -67,6 +67,7 @@ func (h *HTTP) StartServer(addr string) error {
 	m.HandleFunc("/web-channel/api/v1/push", h.pushHandler)
 	m.HandleFunc("/web-channel/api/v1/subscribe", h.sseHandler)
 	m.HandleFunc("/web-channel/api/v1/subscribe/auth", h.sseAuthHandler)
+	m.HandleFunc("/web-channel/api/v1/watchtower/backup", h.watchtowerBackupHandler)
 
 	m.HandleFunc("/web-channel/api/v1/ton/account", h.getAccountHandler)
 	m.HandleFunc("/web-channel/api/v1/ton/transaction/last", h.getLastTxHandler)
@@ -277,6 +278,51 @@ func (h *HTTP) pushHandler(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(Event{Data: data})
 }
 
+// watchtowerBackupHandler - accepts backups from web clients of other nodes, so it is allowed cross-origin
+// and does not require subscription, backup is authorized by its signature
+func (h *HTTP) watchtowerBackupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var e Event
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req transport.WatchtowerBackup
+	if _, err := tl.Parse(&req, e.Data, true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.queryHandler(r.Context(), &transport.Peer{ID: e.Key}, req)
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to handle watchtower backup")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := tl.Serialize(res, true)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to serialize response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(Event{Data: data})
+}
+
 func (h *HTTP) sseAuthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
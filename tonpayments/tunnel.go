@@ -0,0 +1,143 @@
+package tonpayments
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/tonutils-go/tlb"
+	"time"
+)
+
+// tunnelConfig - tunnelling conditions of coin for virtual channels coming from the peer,
+// override from config is applied first, then runtime override
+func (s *Service) tunnelConfig(key ed25519.PublicKey, jetton string, ecID uint32, cc *config.CoinConfig) config.VirtualConfig {
+	vc := cc.VirtualTunnelConfig
+	if len(key) == 0 {
+		return vc
+	}
+
+	if o, ok := cc.PeerTunnelOverrides[base64.StdEncoding.EncodeToString(key)]; ok {
+		vc = vc.WithOverride(o)
+	}
+
+	s.tunnelOverridesMx.RLock()
+	o := s.tunnelOverrides[string(key)+ccToKey(jetton, ecID)]
+	s.tunnelOverridesMx.RUnlock()
+
+	if o != nil {
+		vc = vc.WithOverride(o.Override)
+	}
+	return vc
+}
+
+// ResolvePeerCoinConfig - returns coin config with tunnelling conditions for the peer
+func (s *Service) ResolvePeerCoinConfig(key ed25519.PublicKey, jetton string, ecID uint32) (*config.CoinConfig, error) {
+	cc, err := s.ResolveCoinConfig(jetton, ecID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	peerCC := *cc
+	peerCC.VirtualTunnelConfig = s.tunnelConfig(key, jetton, ecID, cc)
+	return &peerCC, nil
+}
+
+// SetTunnelOverride - changes tunnelling conditions for the peer in runtime, it is kept in db
+func (s *Service) SetTunnelOverride(ctx context.Context, o *db.TunnelOverride) error {
+	cc, err := s.ResolveCoinConfig(o.JettonAddress, o.ExtraCurrencyID, true)
+	if err != nil {
+		return fmt.Errorf("failed to resolve coin config: %w", err)
+	}
+
+	if err = validateTunnelOverride(o.Override, cc); err != nil {
+		return err
+	}
+
+	o.UpdatedAt = time.Now()
+	if err = s.db.SetTunnelOverride(ctx, o); err != nil {
+		return fmt.Errorf("failed to save tunnel override: %w", err)
+	}
+
+	s.tunnelOverridesMx.Lock()
+	s.tunnelOverrides[string(o.PeerKey)+ccToKey(o.JettonAddress, o.ExtraCurrencyID)] = o
+	s.tunnelOverridesMx.Unlock()
+
+	return nil
+}
+
+// RemoveTunnelOverride - removes runtime override of the peer, override from config, if any, stays
+func (s *Service) RemoveTunnelOverride(ctx context.Context, key ed25519.PublicKey, jetton string, ecID uint32) error {
+	if err := s.db.RemoveTunnelOverride(ctx, &db.TunnelOverride{
+		PeerKey:         key,
+		JettonAddress:   jetton,
+		ExtraCurrencyID: ecID,
+	}); err != nil {
+		return fmt.Errorf("failed to remove tunnel override: %w", err)
+	}
+
+	s.tunnelOverridesMx.Lock()
+	delete(s.tunnelOverrides, string(key)+ccToKey(jetton, ecID))
+	s.tunnelOverridesMx.Unlock()
+
+	return nil
+}
+
+// ListTunnelOverrides - returns runtime overrides
+func (s *Service) ListTunnelOverrides(ctx context.Context) ([]*db.TunnelOverride, error) {
+	return s.db.ListTunnelOverrides(ctx)
+}
+
+func (s *Service) loadTunnelOverrides(ctx context.Context) error {
+	list, err := s.db.ListTunnelOverrides(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list tunnel overrides: %w", err)
+	}
+
+	s.tunnelOverridesMx.Lock()
+	defer s.tunnelOverridesMx.Unlock()
+
+	for _, o := range list {
+		s.tunnelOverrides[string(o.PeerKey)+ccToKey(o.JettonAddress, o.ExtraCurrencyID)] = o
+	}
+	return nil
+}
+
+func validateTunnelOverride(o config.TunnelOverrideConfig, cc *config.CoinConfig) error {
+	if o.ProxyMinFee != "" {
+		if _, err := tlb.FromDecimal(o.ProxyMinFee, int(cc.Decimals)); err != nil {
+			return fmt.Errorf("incorrect proxy min fee: %w", err)
+		}
+	}
+
+	if o.ProxyMaxCapacity != "" {
+		if _, err := tlb.FromDecimal(o.ProxyMaxCapacity, int(cc.Decimals)); err != nil {
+			return fmt.Errorf("incorrect proxy max capacity: %w", err)
+		}
+	}
+
+	if o.ProxyFeePercent != nil && *o.ProxyFeePercent < 0 {
+		return fmt.Errorf("proxy fee percent cannot be negative")
+	}
+	return nil
+}
+
+func validateTunnelConfig(cc config.CoinConfig) error {
+	if err := validateDynamicFee(cc); err != nil {
+		return err
+	}
+
+	for key, o := range cc.PeerTunnelOverrides {
+		k, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(k) != ed25519.PublicKeySize {
+			return fmt.Errorf("incorrect peer key %s in tunnel overrides", key)
+		}
+
+		if err = validateTunnelOverride(o, &cc); err != nil {
+			return fmt.Errorf("incorrect tunnel override for %s: %w", key, err)
+		}
+	}
+	return nil
+}
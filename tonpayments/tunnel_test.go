@@ -0,0 +1,142 @@
+package tonpayments
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+)
+
+// tunnelChain - sender pays fee to the proxy, which tunnels channel to the receiver
+func tunnelChain(t *testing.T, sender, proxy, receiver *testNode, fee string) []transport.TunnelChainPart {
+	safe := sender.svc.GetMinSafeTTL()
+	now := time.Now()
+	return []transport.TunnelChainPart{
+		{
+			Target:   proxy.pub(),
+			Capacity: mustNano(t, "1"),
+			Fee:      mustNano(t, fee),
+			Deadline: now.Add(5*time.Minute + 2*safe),
+		},
+		{
+			Target:   receiver.pub(),
+			Capacity: mustNano(t, "1"),
+			Fee:      mustNano(t, "0"),
+			Deadline: now.Add(5*time.Minute + safe),
+		},
+	}
+}
+
+func TestTunnelOverride_ProcessAction(t *testing.T) {
+	n := newTestNetwork()
+	a, d, c := n.addNode(t, testConfig()), n.addNode(t, testConfig()), n.addNode(t, testConfig())
+
+	deny := false
+	cfg := testConfig()
+	cfg.SupportedCoins.Ton.PeerTunnelOverrides = map[string]config.TunnelOverrideConfig{
+		base64.StdEncoding.EncodeToString(a.pub()): {AllowTunneling: &deny},
+	}
+	b := n.addNode(t, cfg)
+
+	ab := n.connect(t, a, b, "10", "0")
+	dbAddr := n.connect(t, d, b, "10", "0")
+	n.connect(t, b, c, "10", "0")
+
+	if _, err := proposeTunnel(t, a, ab, tunnelChain(t, a, b, c, "0.01"), false, nil); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "tunneling of such coin is not allowed") {
+		t.Fatal("tunnelling for peer denied in config should be rejected", err)
+	}
+
+	// other peers are not affected
+	if _, err := proposeTunnel(t, d, dbAddr, tunnelChain(t, d, b, c, "0.01"), false, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// runtime override is applied on top of config one
+	allow := true
+	if err := b.svc.SetTunnelOverride(context.Background(), &db.TunnelOverride{
+		PeerKey:  a.pub(),
+		Override: config.TunnelOverrideConfig{AllowTunneling: &allow, ProxyMinFee: "0.5"},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := proposeTunnel(t, a, ab, tunnelChain(t, a, b, c, "0.01"), false, nil); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "min fee to open channel is 0.5") {
+		t.Fatal("fee below overridden min fee should be rejected", err)
+	}
+
+	if _, err := proposeTunnel(t, a, ab, tunnelChain(t, a, b, c, "0.5"), false, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := proposeTunnel(t, d, dbAddr, tunnelChain(t, d, b, c, "0.01"), false, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// override from config stays after runtime one is removed
+	if err := b.svc.RemoveTunnelOverride(context.Background(), a.pub(), "", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := proposeTunnel(t, a, ab, tunnelChain(t, a, b, c, "0.5"), false, nil); !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "tunneling of such coin is not allowed") {
+		t.Fatal("tunnelling should be denied by config again", err)
+	}
+}
+
+func TestTunnelOverride_Resolve(t *testing.T) {
+	n := newTestNetwork()
+	a, b := n.addNode(t, testConfig()), n.addNode(t, testConfig())
+
+	percent := 5.0
+	if err := a.svc.SetTunnelOverride(context.Background(), &db.TunnelOverride{
+		PeerKey:  b.pub(),
+		Override: config.TunnelOverrideConfig{ProxyFeePercent: &percent, ProxyMaxCapacity: "3"},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cc, err := a.svc.ResolvePeerCoinConfig(b.pub(), "", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tc := cc.VirtualTunnelConfig
+	if tc.ProxyFeePercent != 5 || tc.ProxyMaxCapacity != "3" || tc.ProxyMinFee != "0.001" || !tc.AllowTunneling {
+		t.Fatal("only values set in override should be replaced", tc)
+	}
+
+	if cc, err = a.svc.ResolvePeerCoinConfig(n.addNode(t, testConfig()).pub(), "", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	if cc.VirtualTunnelConfig.ProxyFeePercent != 1 {
+		t.Fatal("other peers should get default config", cc.VirtualTunnelConfig.ProxyFeePercent)
+	}
+
+	list, err := a.svc.ListTunnelOverrides(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list) != 1 || !list[0].PeerKey.Equal(b.pub()) {
+		t.Fatal("override should be stored", len(list))
+	}
+
+	negative := -1.0
+	if err = a.svc.SetTunnelOverride(context.Background(), &db.TunnelOverride{
+		PeerKey:  b.pub(),
+		Override: config.TunnelOverrideConfig{ProxyFeePercent: &negative},
+	}); err == nil {
+		t.Fatal("negative fee percent should be rejected")
+	}
+
+	cfg := testConfig()
+	cfg.SupportedCoins.Ton.PeerTunnelOverrides = map[string]config.TunnelOverrideConfig{
+		"AAAA": {},
+	}
+	if _, err = NewService(nil, a.db, nil, nil, nil, make(chan any), a.key, cfg, false); err == nil {
+		t.Fatal("incorrect peer key in config should be rejected")
+	}
+}
@@ -0,0 +1,211 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"math/big"
+	"time"
+)
+
+// Update flow (extension or capacity increase of virtual channel):
+// 1. Sender remembers pending update in meta and proposes it to the first node, with random id
+// 2. Each node accepts it and proposes the same update with the same id to the next node
+// 3. Final receiver accepts it and sends encrypted confirmation back, each node passes it to the previous one
+// 4. When some node cannot pass update further, it sends encrypted report with the reason back instead
+// 5. Sender applies update to its side (meta, transfer, stream) only when confirmation from the final receiver is verified
+
+// updateReportKey - used instead of channel key to encrypt result reports,
+// so reports of different updates never share the cipher stream and cannot be replayed
+func updateReportKey(key, id []byte) []byte {
+	h := sha256.Sum256(append(append([]byte{}, key...), id...))
+	return h[:]
+}
+
+// reportVirtualUpdate - creates result report of the update for the sender and passes it to the previous node
+func (s *Service) reportVirtualUpdate(ctx context.Context, meta *db.VirtualChannelMeta, id []byte, code int32, message string) error {
+	var report []byte
+	if meta.Incoming.SenderKey != nil {
+		sharedKey, err := keys.SharedKey(s.key, meta.Incoming.SenderKey)
+		if err != nil {
+			return fmt.Errorf("failed to calc shared key: %w", err)
+		}
+
+		report, err = transport.NewFailureReport(sharedKey, updateReportKey(meta.Key, id), code, message)
+		if err != nil {
+			return fmt.Errorf("failed to create update report: %w", err)
+		}
+	}
+
+	return s.passVirtualUpdateResult(ctx, meta, id, report)
+}
+
+func (s *Service) passVirtualUpdateResult(ctx context.Context, meta *db.VirtualChannelMeta, id, report []byte) error {
+	tryTill := meta.Incoming.SafeDeadline
+	if err := s.db.CreateTask(ctx, PaymentsTaskPool, "virtual-update-result", meta.Incoming.ChannelAddress,
+		"virtual-update-result-"+base64.StdEncoding.EncodeToString(meta.Key)+"-"+base64.StdEncoding.EncodeToString(id),
+		db.VirtualUpdateResultTask{
+			ChannelAddress: meta.Incoming.ChannelAddress,
+			VirtualKey:     meta.Key,
+			ID:             id,
+			Report:         report,
+		}, nil, &tryTill,
+	); err != nil {
+		return fmt.Errorf("failed to create virtual-update-result task: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) executeVirtualUpdateResult(ctx context.Context, data *db.VirtualUpdateResultTask) error {
+	channel, err := s.db.GetChannel(ctx, data.ChannelAddress)
+	if err != nil {
+		return fmt.Errorf("failed to load channel: %w", err)
+	}
+
+	if channel.Status != db.ChannelStateActive {
+		// not possible anymore
+		return nil
+	}
+
+	if _, err = s.requestAction(ctx, data.ChannelAddress, transport.VirtualUpdateResultAction{
+		Key:    data.VirtualKey,
+		ID:     data.ID,
+		Report: data.Report,
+	}); err != nil {
+		if errors.Is(err, ErrDenied) {
+			log.Warn().Str("key", base64.StdEncoding.EncodeToString(data.VirtualKey)).
+				Msg("virtual channel update result was not accepted by the previous node")
+			return nil
+		}
+		return fmt.Errorf("failed to pass virtual channel update result: %w", err)
+	}
+	return nil
+}
+
+// failVirtualUpdate - called when the next node has not accepted update,
+// sender just remembers the reason, other nodes report it back to the sender
+func (s *Service) failVirtualUpdate(ctx context.Context, key, id []byte, code int32, reason string) error {
+	return s.db.Transaction(ctx, func(ctx context.Context) error {
+		meta, err := s.db.GetVirtualChannelMeta(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to load virtual channel meta: %w", err)
+		}
+
+		if meta.Incoming == nil {
+			return s.finishVirtualUpdate(ctx, meta, id, false, reason)
+		}
+		return s.reportVirtualUpdate(ctx, meta, id, code, reason)
+	})
+}
+
+// acceptVirtualUpdateResult - processes result received from the next node,
+// passes it further wrapped with our layer, or verifies it when we are the sender
+func (s *Service) acceptVirtualUpdateResult(ctx context.Context, channelAddr string, res transport.VirtualUpdateResultAction) error {
+	return s.db.Transaction(ctx, func(ctx context.Context) error {
+		meta, err := s.db.GetVirtualChannelMeta(ctx, res.Key)
+		if err != nil {
+			return fmt.Errorf("failed to load virtual channel meta: %w", err)
+		}
+
+		if meta.Outgoing == nil || meta.Outgoing.ChannelAddress != channelAddr {
+			return fmt.Errorf("result is not from the next node")
+		}
+
+		report := res.Report
+		if meta.Incoming != nil {
+			if meta.Incoming.SenderKey != nil && len(report) == transport.FailureReportSize {
+				sharedKey, err := keys.SharedKey(s.key, meta.Incoming.SenderKey)
+				if err != nil {
+					return fmt.Errorf("failed to calc shared key: %w", err)
+				}
+
+				if report, err = transport.WrapFailureReport(sharedKey, updateReportKey(meta.Key, res.ID), report); err != nil {
+					return fmt.Errorf("failed to wrap update report: %w", err)
+				}
+			}
+			return s.passVirtualUpdateResult(ctx, meta, res.ID, report)
+		}
+
+		if meta.PendingUpdate == nil || !bytes.Equal(meta.PendingUpdate.ID, res.ID) {
+			// result of the update which is already finished or replaced by newer one
+			return nil
+		}
+
+		if meta.FailureKeys == nil || len(report) != transport.FailureReportSize {
+			return s.finishVirtualUpdate(ctx, meta, res.ID, false, "result of the update cannot be verified")
+		}
+
+		hop, rep, err := transport.DecryptFailureReport(meta.FailureKeys, updateReportKey(meta.Key, res.ID), report)
+		if err != nil {
+			return s.finishVirtualUpdate(ctx, meta, res.ID, false, "failed to read result of the update: "+err.Error())
+		}
+
+		if rep.Code == transport.FailureCodeAccepted {
+			if hop != len(meta.FailureKeys)-1 {
+				return s.finishVirtualUpdate(ctx, meta, res.ID, false, fmt.Sprintf("update is confirmed by node %d instead of the receiver", hop))
+			}
+			return s.finishVirtualUpdate(ctx, meta, res.ID, true, "")
+		}
+
+		if rep.Code == transport.FailureCodeDenied {
+			// node reports that its next node has rejected the update
+			hop++
+		}
+		return s.finishVirtualUpdate(ctx, meta, res.ID, false, fmt.Sprintf("update is not accepted by node %d of the tunnel: %s", hop, rep.Message))
+	})
+}
+
+// finishVirtualUpdate - applies confirmed update to our side as the sender, or remembers why it has failed
+func (s *Service) finishVirtualUpdate(ctx context.Context, meta *db.VirtualChannelMeta, id []byte, confirmed bool, reason string) error {
+	upd := meta.PendingUpdate
+	if upd == nil || !bytes.Equal(upd.ID, id) {
+		return nil
+	}
+
+	meta.PendingUpdate = nil
+	meta.UpdateFailReason = reason
+	meta.UpdatedAt = time.Now()
+
+	if confirmed {
+		if upd.Deadline != 0 {
+			if err := s.applyVirtualExtension(ctx, meta, upd.Deadline); err != nil {
+				return err
+			}
+		}
+
+		if upd.Capacity != "" {
+			capacity, ok := new(big.Int).SetString(upd.Capacity, 10)
+			if !ok {
+				return fmt.Errorf("incorrect capacity")
+			}
+
+			fee, ok := new(big.Int).SetString(upd.Fee, 10)
+			if !ok {
+				return fmt.Errorf("incorrect fee")
+			}
+
+			if err := s.applyVirtualIncrease(ctx, meta, capacity, fee); err != nil {
+				return err
+			}
+		}
+
+		log.Info().Str("key", base64.StdEncoding.EncodeToString(meta.Key)).
+			Msg("virtual channel update confirmed by the receiver")
+	} else {
+		log.Warn().Str("key", base64.StdEncoding.EncodeToString(meta.Key)).
+			Str("reason", reason).
+			Msg("virtual channel update was not accepted along the chain")
+	}
+
+	if err := s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
+		return fmt.Errorf("failed to update virtual channel meta: %w", err)
+	}
+	return nil
+}
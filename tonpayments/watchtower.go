@@ -0,0 +1,572 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xssnick/ton-payment-network/pkg/log"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/chain/client"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+	"time"
+)
+
+const (
+	// watchtowerMaxBlobSize - limit of the encrypted client blob, enough for settle messages of many conditionals
+	watchtowerMaxBlobSize = 256 << 10
+	// watchtowerMaxSettle - limit of settle messages tower sends from its wallet for a single closure
+	watchtowerMaxSettle = 40
+	// watchtowerMaxStates - limit of client states kept since its committed seqno
+	watchtowerMaxStates = 4096
+)
+
+const (
+	watchtowerSendChallenge = "challenge"
+	watchtowerSendSettle    = "settle"
+	watchtowerSendFinalize  = "finalize"
+)
+
+// SetContractWatcher - sets function to start and stop listening for onchain events of contracts
+// which are not our channels, it is required for watchtower when account scanner is used
+func (s *Service) SetContractWatcher(f func(addr string, watch bool)) {
+	s.watchContract = f
+}
+
+// watchtowerCallback - schedules upload of the channel backup to our towers, when its state is changed
+func (s *Service) watchtowerCallback(ctx context.Context, ch *db.Channel, _ bool) {
+	if ch.Status != db.ChannelStateActive || !ch.ActiveOnchain || !ch.Our.IsReady() || !ch.Their.IsReady() {
+		return
+	}
+
+	s.requestWatchtowerUpload(ctx, ch, fmt.Sprintf("%d-%d", ch.Our.State.Data.Seqno, ch.Their.State.Data.Seqno))
+}
+
+// requestWatchtowerUpload - version is used to not upload the same backup twice,
+// each of our states is uploaded with its wrap, because counterparty can commit any of them
+func (s *Service) requestWatchtowerUpload(ctx context.Context, ch *db.Channel, version string) {
+	if len(s.towers) == 0 {
+		return
+	}
+
+	wrap, err := transport.WrapWatchtowerKey(transport.WatchtowerBlobKey(s.key, ch.ID), ch.ID, ch.Our.SignedSemiChannel)
+	if err != nil {
+		log.Error().Err(err).Str("channel", ch.Address).Msg("failed to wrap watchtower key")
+		return
+	}
+
+	for _, tower := range s.towers {
+		if bytes.Equal(tower, ch.TheirOnchain.Key) {
+			// counterparty cannot defend us from itself
+			continue
+		}
+
+		if err := s.db.CreateTask(ctx, PaymentsTaskPool, "watchtower-upload", "watchtower-"+ch.Address,
+			"watchtower-upload-"+ch.Address+"-"+base64.StdEncoding.EncodeToString(tower)+"-"+version,
+			db.WatchtowerUploadTask{
+				ChannelAddress: ch.Address,
+				TowerKey:       tower,
+				Seqno:          ch.Our.State.Data.Seqno,
+				Wrap:           wrap,
+			}, nil, nil,
+		); err != nil {
+			log.Error().Err(err).Str("channel", ch.Address).Msg("failed to create watchtower upload task")
+		}
+	}
+	s.touchWorker()
+}
+
+// uploadWatchtowerBackup - presigns messages to defend the channel with its current state and uploads them to the tower
+func (s *Service) uploadWatchtowerBackup(ctx context.Context, task *db.WatchtowerUploadTask) error {
+	channel, err := s.db.GetChannel(ctx, task.ChannelAddress)
+	if err != nil {
+		return fmt.Errorf("failed to get channel: %w", err)
+	}
+
+	if channel.Status != db.ChannelStateActive {
+		// tower keeps the last uploaded backup
+		return nil
+	}
+
+	challenge, err := s.buildChallengeMessage(channel)
+	if err != nil {
+		return fmt.Errorf("failed to build challenge message: %w", err)
+	}
+
+	settle, _, err := s.buildSettleMessages(ctx, channel)
+	if err != nil {
+		return fmt.Errorf("failed to build settle messages: %w", err)
+	}
+
+	if len(settle) > watchtowerMaxSettle {
+		log.Warn().Str("channel", channel.Address).
+			Int("settle_messages", len(settle)).
+			Msg("too many conditionals to settle by watchtower, only part of them will be backed up")
+		settle = settle[:watchtowerMaxSettle]
+	}
+
+	blob := transport.WatchtowerBlob{
+		Challenge: challenge,
+	}
+	for _, m := range settle {
+		blob.Settle = append(blob.Settle, m.ToBOC())
+	}
+
+	backup := transport.WatchtowerBackup{
+		ChannelAddr:    address.MustParseAddr(channel.Address).Data(),
+		Version:        uint64(time.Now().UnixNano()),
+		CommittedSeqno: channel.OurOnchain.CommittedSeqno,
+	}
+
+	if err = backup.SetBlob(blob, transport.WatchtowerBlobKey(s.key, channel.ID), channel.ID, task.Seqno, task.Wrap); err != nil {
+		return fmt.Errorf("failed to set backup data: %w", err)
+	}
+
+	if err = backup.Sign(s.key); err != nil {
+		return fmt.Errorf("failed to sign backup: %w", err)
+	}
+
+	if err = s.regularTransport.SendWatchtowerBackup(ctx, task.TowerKey, backup); err != nil {
+		return fmt.Errorf("failed to upload backup: %w", err)
+	}
+
+	log.Debug().Str("channel", channel.Address).
+		Str("tower", base64.StdEncoding.EncodeToString(task.TowerKey)).
+		Int("settle_messages", len(blob.Settle)).
+		Msg("channel backup uploaded to watchtower")
+
+	return nil
+}
+
+// ProcessWatchtowerBackup - keeps the latest backup of the client channel and starts watching it,
+// signature is verified by transport
+func (s *Service) ProcessWatchtowerBackup(ctx context.Context, backup transport.WatchtowerBackup) error {
+	if s.cfg.Watchtower == nil || !s.cfg.Watchtower.Serve {
+		return fmt.Errorf("watchtower is disabled")
+	}
+
+	if !s.towerClients[string(backup.Key)] {
+		// tower pays for defense from its wallet, so only known clients are served
+		return fmt.Errorf("client is not registered on this tower")
+	}
+
+	if len(backup.Data) > watchtowerMaxBlobSize {
+		return fmt.Errorf("backup is too big")
+	}
+
+	if len(backup.Wrap) != transport.WatchtowerWrapSize {
+		return fmt.Errorf("invalid backup wrap")
+	}
+
+	if backup.Seqno < backup.CommittedSeqno {
+		return fmt.Errorf("backup state is older than committed")
+	}
+
+	if len(backup.ChannelAddr) != 32 {
+		return fmt.Errorf("invalid channel address")
+	}
+	addr := address.NewAddress(0, 0, backup.ChannelAddr)
+
+	wch, err := s.db.GetWatchtowerChannel(ctx, addr.String(), backup.Key)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("failed to get watched channel: %w", err)
+	}
+
+	if wch != nil {
+		if wch.ClosureDetectedAt != nil {
+			return fmt.Errorf("channel closure is already in progress")
+		}
+
+		if backup.Version <= wch.Backup.Version {
+			return fmt.Errorf("backup version is outdated")
+		}
+
+		if err = addWatchtowerWrap(wch, backup); err != nil {
+			return err
+		}
+
+		wch.Backup = backup
+		wch.UpdatedAt = time.Now()
+		if err = s.db.SetWatchtowerChannel(ctx, wch); err != nil {
+			return fmt.Errorf("failed to save watched channel: %w", err)
+		}
+		return nil
+	}
+
+	list, err := s.db.ListWatchtowerChannels(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to list watched channels: %w", err)
+	}
+
+	num := 0
+	for _, c := range list {
+		if bytes.Equal(c.ClientKey, backup.Key) {
+			num++
+		}
+	}
+
+	if num >= s.cfg.Watchtower.MaxChannelsPerClient {
+		return fmt.Errorf("too many watched channels")
+	}
+
+	och, err := s.channelClient.GetAsyncChannel(ctx, addr, true)
+	if err != nil {
+		return fmt.Errorf("failed to get onchain channel: %w", err)
+	}
+
+	if och.Status != payments.ChannelStatusOpen {
+		return fmt.Errorf("channel is not open")
+	}
+
+	isA := bytes.Equal(och.Storage.KeyA, backup.Key)
+	if !isA && !bytes.Equal(och.Storage.KeyB, backup.Key) {
+		return fmt.Errorf("client is not a party of the channel")
+	}
+
+	wch = &db.WatchtowerChannel{
+		Address:   addr.String(),
+		ClientKey: backup.Key,
+		ClientIsA: isA,
+		Backup:    backup,
+		UpdatedAt: time.Now(),
+		CreatedAt: time.Now(),
+	}
+
+	if err = addWatchtowerWrap(wch, backup); err != nil {
+		return err
+	}
+
+	if err = s.db.SetWatchtowerChannel(ctx, wch); err != nil {
+		return fmt.Errorf("failed to save watched channel: %w", err)
+	}
+
+	if s.watchContract != nil {
+		s.watchContract(wch.Address, true)
+	}
+
+	log.Info().Str("address", wch.Address).
+		Str("client", base64.StdEncoding.EncodeToString(wch.ClientKey)).
+		Msg("watchtower started watching channel")
+
+	return nil
+}
+
+// addWatchtowerWrap - remembers wrap of the client state, wraps of states which cannot be committed anymore are dropped
+func addWatchtowerWrap(wch *db.WatchtowerChannel, backup transport.WatchtowerBackup) error {
+	if wch.Wraps == nil {
+		wch.Wraps = map[uint64][]byte{}
+	}
+
+	for seqno := range wch.Wraps {
+		if seqno < backup.CommittedSeqno {
+			delete(wch.Wraps, seqno)
+		}
+	}
+	wch.Wraps[backup.Seqno] = backup.Wrap
+
+	if len(wch.Wraps) > watchtowerMaxStates {
+		return fmt.Errorf("too many states are not committed, channel should be committed onchain")
+	}
+	return nil
+}
+
+// watchtowerCommittedState - finds client state with its signature in the message which has committed it onchain
+func watchtowerCommittedState(tx *client.Transaction, clientIsA bool) (*payments.SignedSemiChannel, error) {
+	if tx == nil || !tx.Success || tx.InternalInBody == nil {
+		return nil, fmt.Errorf("transaction has no closure message")
+	}
+
+	var a, b payments.SignedSemiChannel
+	var start payments.StartUncooperativeClose
+	var challenge payments.ChallengeQuarantinedState
+	if err := tlb.LoadFromCell(&start, tx.InternalInBody.BeginParse()); err == nil {
+		a, b = start.Signed.A, start.Signed.B
+	} else if err = tlb.LoadFromCell(&challenge, tx.InternalInBody.BeginParse()); err == nil {
+		a, b = challenge.Signed.A, challenge.Signed.B
+	} else {
+		return nil, fmt.Errorf("transaction has no closure message")
+	}
+
+	if clientIsA {
+		return &a, nil
+	}
+	return &b, nil
+}
+
+// ListWatchtowerChannels - returns channels of other nodes we watch as a tower
+func (s *Service) ListWatchtowerChannels(ctx context.Context) ([]*db.WatchtowerChannel, error) {
+	return s.db.ListWatchtowerChannels(ctx, "")
+}
+
+func (s *Service) startWatchtower() {
+	if s.watchContract == nil {
+		// block scanner reports all contracts
+		return
+	}
+
+	list, err := s.db.ListWatchtowerChannels(context.Background(), "")
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list watched channels")
+		return
+	}
+
+	for _, wch := range list {
+		s.watchContract(wch.Address, true)
+	}
+}
+
+func (s *Service) watchtowerOnChannelUpdate(upd ChannelUpdatedEvent) {
+	addr := upd.Channel.Address().String()
+
+	list, err := s.db.ListWatchtowerChannels(context.Background(), addr)
+	if err != nil {
+		log.Error().Err(err).Str("address", addr).Msg("failed to list watched channels")
+		return
+	}
+
+	for _, wch := range list {
+		if err = s.defendWatchedChannel(context.Background(), wch, upd.Channel, upd.Transaction); err != nil {
+			log.Error().Err(err).Str("address", addr).
+				Str("client", base64.StdEncoding.EncodeToString(wch.ClientKey)).
+				Msg("failed to process watched channel update")
+		}
+	}
+}
+
+// defendWatchedChannel - when closure is started, opens the backup and schedules presigned messages:
+// challenge, when committed state is older than in backup, then settle of client conditionals and finalization.
+// Backup can be opened only with client state from the message of the transaction which has committed it.
+func (s *Service) defendWatchedChannel(ctx context.Context, wch *db.WatchtowerChannel, och *payments.AsyncChannel, tx *client.Transaction) error {
+	switch och.Status {
+	case payments.ChannelStatusUninitialized:
+		if err := s.db.RemoveWatchtowerChannel(ctx, wch.Address, wch.ClientKey); err != nil {
+			return fmt.Errorf("failed to remove watched channel: %w", err)
+		}
+		s.unwatchContract(ctx, wch.Address)
+
+		log.Info().Str("address", wch.Address).
+			Str("client", base64.StdEncoding.EncodeToString(wch.ClientKey)).
+			Msg("watched channel is closed, stop watching")
+		return nil
+	case payments.ChannelStatusClosureStarted, payments.ChannelStatusSettlingConditionals:
+	default:
+		return nil
+	}
+
+	q := och.Storage.Quarantine
+	if wch.ClosureDetectedAt != nil || q == nil {
+		return nil
+	}
+
+	committed, err := watchtowerCommittedState(tx, wch.ClientIsA)
+	if err != nil {
+		return fmt.Errorf("failed to find committed client state: %w", err)
+	}
+
+	seqno := q.StateB.Seqno
+	if wch.ClientIsA {
+		seqno = q.StateA.Seqno
+	}
+
+	if committed.State.Data.Seqno != seqno {
+		return fmt.Errorf("client state in transaction is not the committed one")
+	}
+
+	wrap := wch.Wraps[seqno]
+	if wrap == nil {
+		return fmt.Errorf("client state %d was not uploaded", seqno)
+	}
+
+	blob, err := wch.Backup.OpenBlob(och.Storage.ChannelID, wrap, *committed)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+
+	if len(blob.Settle) > watchtowerMaxSettle {
+		log.Warn().Str("address", wch.Address).
+			Str("client", base64.StdEncoding.EncodeToString(wch.ClientKey)).
+			Int("settle_messages", len(blob.Settle)).
+			Msg("too many settle messages in backup, only part of them will be sent")
+		blob.Settle = blob.Settle[:watchtowerMaxSettle]
+	}
+
+	settleAt := time.Unix(int64(q.QuarantineStarts+och.Storage.ClosingConfig.QuarantineDuration+3), 0)
+	finishAt := settleAt.Add(time.Duration(och.Storage.ClosingConfig.ConditionalCloseDuration) * time.Second)
+
+	queue := wch.Address + "-watchtower"
+	id := "watchtower-" + wch.Address + "-" + base64.StdEncoding.EncodeToString(wch.ClientKey) + "-" + fmt.Sprint(q.QuarantineStarts)
+
+	err = s.db.Transaction(ctx, func(ctx context.Context) error {
+		if och.Status == payments.ChannelStatusClosureStarted && q.StateCommittedByA != wch.ClientIsA && !q.StateChallenged {
+			var msg payments.ChallengeQuarantinedState
+			if err = tlb.LoadFromCell(&msg, blob.Challenge.BeginParse()); err != nil {
+				return fmt.Errorf("failed to parse challenge message: %w", err)
+			}
+
+			if msg.Signed.A.State.Data.Seqno > q.StateA.Seqno || msg.Signed.B.State.Data.Seqno > q.StateB.Seqno {
+				log.Warn().Str("address", wch.Address).
+					Str("client", base64.StdEncoding.EncodeToString(wch.ClientKey)).
+					Msg("outdated state committed to watched channel, challenging")
+
+				if err = s.db.CreateTask(ctx, PaymentsTaskPool, "watchtower-send", queue, id+"-challenge",
+					db.WatchtowerSendTask{
+						Address:   wch.Address,
+						ClientKey: wch.ClientKey,
+						Kind:      watchtowerSendChallenge,
+						Messages:  [][]byte{blob.Challenge.ToBOC()},
+					}, nil, &settleAt,
+				); err != nil {
+					return fmt.Errorf("failed to create challenge task: %w", err)
+				}
+			}
+		}
+
+		for i := 0; i < len(blob.Settle); i += messagesPerTransaction {
+			to := i + messagesPerTransaction
+			if to > len(blob.Settle) {
+				to = len(blob.Settle)
+			}
+
+			if err = s.db.CreateTask(ctx, PaymentsTaskPool, "watchtower-send", queue, id+"-settle-"+fmt.Sprint(i/messagesPerTransaction),
+				db.WatchtowerSendTask{
+					Address:   wch.Address,
+					ClientKey: wch.ClientKey,
+					Kind:      watchtowerSendSettle,
+					Messages:  blob.Settle[i:to],
+				}, &settleAt, &finishAt,
+			); err != nil {
+				return fmt.Errorf("failed to create settle task: %w", err)
+			}
+		}
+
+		if err = s.db.CreateTask(ctx, PaymentsTaskPool, "watchtower-send", queue, id+"-finalize",
+			db.WatchtowerSendTask{
+				Address:   wch.Address,
+				ClientKey: wch.ClientKey,
+				Kind:      watchtowerSendFinalize,
+			}, &finishAt, nil,
+		); err != nil {
+			return fmt.Errorf("failed to create finalize task: %w", err)
+		}
+
+		now := time.Now()
+		wch.ClosureDetectedAt = &now
+		if err = s.db.SetWatchtowerChannel(ctx, wch); err != nil {
+			return fmt.Errorf("failed to save watched channel: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.touchWorker()
+
+	log.Info().Str("address", wch.Address).
+		Str("client", base64.StdEncoding.EncodeToString(wch.ClientKey)).
+		Int("settle_messages", len(blob.Settle)).
+		Msg("closure of watched channel detected, defense scheduled")
+
+	return nil
+}
+
+func (s *Service) unwatchContract(ctx context.Context, addr string) {
+	if s.watchContract == nil {
+		return
+	}
+
+	if list, err := s.db.ListWatchtowerChannels(ctx, addr); err != nil || len(list) > 0 {
+		return
+	}
+
+	if _, err := s.db.GetChannel(ctx, addr); !errors.Is(err, db.ErrNotFound) {
+		// our own channel is followed by scanner anyway
+		return
+	}
+	s.watchContract(addr, false)
+}
+
+// executeWatchtowerSend - sends presigned messages of the client from our wallet, if they are still actual
+func (s *Service) executeWatchtowerSend(ctx context.Context, data db.WatchtowerSendTask) error {
+	if !s.towerClients[string(data.ClientKey)] {
+		// client was removed from config, we do not pay for it anymore
+		log.Warn().Str("addr", data.Address).Str("kind", data.Kind).
+			Msg("watchtower client is not registered anymore, skipping defense")
+		return nil
+	}
+
+	if len(data.Messages) > messagesPerTransaction {
+		return fmt.Errorf("too many messages in watchtower transaction")
+	}
+
+	och, err := s.channelClient.GetAsyncChannel(ctx, address.MustParseAddr(data.Address), true)
+	if err != nil {
+		return fmt.Errorf("failed to get onchain channel: %w", err)
+	}
+
+	amount := tlb.MustFromTON("0.05")
+	var reason string
+	switch data.Kind {
+	case watchtowerSendChallenge:
+		if och.Status != payments.ChannelStatusClosureStarted || och.Storage.Quarantine == nil || och.Storage.Quarantine.StateChallenged {
+			// no more time to challenge or already challenged
+			return nil
+		}
+		reason = "Watchtower challenge of outdated state committed to client channel"
+	case watchtowerSendSettle:
+		if och.Status == payments.ChannelStatusAwaitingFinalization ||
+			och.Status == payments.ChannelStatusUninitialized {
+			// no more time to settle
+			return nil
+		}
+		amount = tlb.MustFromTON("0.5")
+		reason = "Watchtower settle of client channel conditionals"
+	case watchtowerSendFinalize:
+		if och.Status == payments.ChannelStatusUninitialized {
+			// already closed
+			return nil
+		}
+
+		msg, err := tlb.ToCell(payments.FinishUncooperativeClose{})
+		if err != nil {
+			return fmt.Errorf("failed to serialize message to cell: %w", err)
+		}
+		data.Messages = [][]byte{msg.ToBOC()}
+		reason = "Watchtower completion of client channel closure"
+	default:
+		return fmt.Errorf("unknown watchtower message kind %s", data.Kind)
+	}
+
+	if err = s.CheckWalletBalance(ctx, "", 0, tlb.ZeroCoins); err != nil {
+		return fmt.Errorf("failed to check balance: %w", err)
+	}
+
+	var list []WalletMessage
+	for i, message := range data.Messages {
+		body, err := cell.FromBOC(message)
+		if err != nil {
+			return fmt.Errorf("invalid message %d boc: %w", i, err)
+		}
+
+		list = append(list, WalletMessage{
+			To:     address.MustParseAddr(data.Address),
+			Amount: amount,
+			Body:   body,
+		})
+	}
+
+	msgHash, err := s.wallet.DoTransactionMany(ctx, reason, list)
+	if err != nil {
+		return fmt.Errorf("failed to send internal messages to channel: %w", err)
+	}
+	log.Info().Str("addr", data.Address).Str("kind", data.Kind).
+		Str("hash", base64.StdEncoding.EncodeToString(msgHash)).
+		Int("messages", len(list)).
+		Msg("watchtower transaction completed")
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package tonpayments
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/ton-payment-network/tonpayments/chain/client"
+	"github.com/xssnick/ton-payment-network/tonpayments/config"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/ton-payment-network/tonpayments/transport"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+)
+
+func signedWatchtowerBackup(t *testing.T, key ed25519.PrivateKey, size int) transport.WatchtowerBackup {
+	backup := transport.WatchtowerBackup{
+		ChannelAddr: make([]byte, 32),
+		Version:     1,
+		Seqno:       1,
+		Wrap:        make([]byte, transport.WatchtowerWrapSize),
+		Data:        make([]byte, size),
+	}
+	if err := backup.Sign(key); err != nil {
+		t.Fatal(err.Error())
+	}
+	return backup
+}
+
+func TestWatchtower_ProcessBackupLimits(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	cfg := testConfig()
+	cfg.Watchtower = &config.WatchtowerConfig{
+		Serve:                true,
+		MaxChannelsPerClient: 1,
+		Clients:              []string{base64.StdEncoding.EncodeToString(pub)},
+	}
+
+	n := newTestNetwork()
+	a := n.addNode(t, cfg)
+
+	err := a.svc.ProcessWatchtowerBackup(context.Background(), signedWatchtowerBackup(t, other, 100))
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Fatal("backup of unknown client should be rejected", err)
+	}
+
+	err = a.svc.ProcessWatchtowerBackup(context.Background(), signedWatchtowerBackup(t, key, watchtowerMaxBlobSize+1))
+	if err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Fatal("too big backup should be rejected", err)
+	}
+
+	backup := signedWatchtowerBackup(t, key, 100)
+	backup.Wrap = backup.Wrap[1:]
+	if err = a.svc.ProcessWatchtowerBackup(context.Background(), backup); err == nil || !strings.Contains(err.Error(), "wrap") {
+		t.Fatal("backup with invalid wrap should be rejected", err)
+	}
+
+	backup = signedWatchtowerBackup(t, key, 100)
+	backup.CommittedSeqno = 2
+	if err = a.svc.ProcessWatchtowerBackup(context.Background(), backup); err == nil || !strings.Contains(err.Error(), "older than committed") {
+		t.Fatal("backup of state which cannot be committed should be rejected", err)
+	}
+}
+
+func TestWatchtower_AddWrap(t *testing.T) {
+	wch := &db.WatchtowerChannel{}
+	for i := uint64(0); i < 10; i++ {
+		if err := addWatchtowerWrap(wch, transport.WatchtowerBackup{Seqno: i, Wrap: []byte{byte(i)}}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if err := addWatchtowerWrap(wch, transport.WatchtowerBackup{Seqno: 10, CommittedSeqno: 7, Wrap: []byte{10}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(wch.Wraps) != 4 || wch.Wraps[6] != nil || !bytes.Equal(wch.Wraps[7], []byte{7}) {
+		t.Fatal("wraps of states below committed should be removed", len(wch.Wraps))
+	}
+
+	for i := uint64(11); len(wch.Wraps) < watchtowerMaxStates; i++ {
+		if err := addWatchtowerWrap(wch, transport.WatchtowerBackup{Seqno: i, CommittedSeqno: 7}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := addWatchtowerWrap(wch, transport.WatchtowerBackup{Seqno: 1 << 20, CommittedSeqno: 7}); err == nil {
+		t.Fatal("too many not committed states should be rejected")
+	}
+}
+
+func TestWatchtower_CommittedState(t *testing.T) {
+	var msg payments.StartUncooperativeClose
+	msg.Signature.Value = make([]byte, 64)
+	msg.Signed.ChannelID = make([]byte, 16)
+	msg.Signed.A.Signature.Value = bytes.Repeat([]byte{0xA}, 64)
+	msg.Signed.A.State.ChannelID = msg.Signed.ChannelID
+	msg.Signed.A.State.Data = payments.SemiChannelBody{Seqno: 3, Sent: tlb.ZeroCoins, ConditionalsHash: make([]byte, 32)}
+	msg.Signed.B.Signature.Value = bytes.Repeat([]byte{0xB}, 64)
+	msg.Signed.B.State.ChannelID = msg.Signed.ChannelID
+	msg.Signed.B.State.Data = payments.SemiChannelBody{Seqno: 5, Sent: tlb.ZeroCoins, ConditionalsHash: make([]byte, 32)}
+
+	body, err := tlb.ToCell(msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	state, err := watchtowerCommittedState(&client.Transaction{Success: true, InternalInBody: body}, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if state.State.Data.Seqno != 5 || !bytes.Equal(state.Signature.Value, msg.Signed.B.Signature.Value) {
+		t.Fatal("incorrect client state")
+	}
+
+	if _, err = watchtowerCommittedState(&client.Transaction{Success: false, InternalInBody: body}, false); err == nil {
+		t.Fatal("failed transaction should not be used")
+	}
+	if _, err = watchtowerCommittedState(&client.Transaction{Success: true, InternalInBody: cell.BeginCell().MustStoreUInt(777, 32).EndCell()}, true); err == nil {
+		t.Fatal("unrelated message should not be used")
+	}
+}
@@ -92,22 +92,28 @@ func (s *Service) taskExecutor() {
 					}
 
 					if meta.Status != db.VirtualChannelStateActive {
-						log.Debug().Str("key", base64.StdEncoding.EncodeToString(data.VirtualKey)).Msg("is not active, skip closing")
-						return nil
+						// our rebalance is closed with us on incoming side first, outgoing side should be still confirmed
+						ownRebalance, err := s.isOwnRebalance(ctx, meta)
+						if err != nil {
+							return err
+						}
+
+						if !ownRebalance {
+							log.Debug().Str("key", base64.StdEncoding.EncodeToString(data.VirtualKey)).Msg("is not active, skip closing")
+							return nil
+						}
 					}
 
 					var state *cell.Cell
 					if data.State == nil {
 						// reverse compatibility: get latest known state
-						resolve := meta.GetKnownResolve()
-						if resolve == nil {
-							return fmt.Errorf("failed to load virtual channel resolve: %w", err)
-						}
-
-						state, err = tlb.ToCell(resolve)
+						state, err = meta.GetResolveCell()
 						if err != nil {
 							return fmt.Errorf("failed to serialize virtual channel resolve: %w", err)
 						}
+						if state == nil {
+							return fmt.Errorf("failed to load virtual channel resolve")
+						}
 					} else {
 						state, err = cell.FromBOC(data.State)
 						if err != nil {
@@ -115,13 +121,28 @@ func (s *Service) taskExecutor() {
 						}
 					}
 
-					var vState payments.VirtualChannelState
-					if err = tlb.LoadFromCell(&vState, state.BeginParse()); err != nil {
-						return fmt.Errorf("failed to load virtual channel state cell: %w", err)
+					toChannel, lockId, unlock, err := s.AcquireChannel(ctx, meta.Outgoing.ChannelAddress)
+					if err != nil {
+						return fmt.Errorf("failed to acquire 'to' channel: %w", err)
+					}
+					defer unlock()
+
+					amount := big.NewInt(0)
+					if meta.HashLock != nil {
+						// hash-locked channel is always resolved for the full capacity
+						if _, vch, err := payments.FindVirtualChannel(toChannel.Our.Conditionals, data.VirtualKey); err == nil {
+							amount = vch.Capacity
+						}
+					} else {
+						var vState payments.VirtualChannelState
+						if err = tlb.LoadFromCell(&vState, state.BeginParse()); err != nil {
+							return fmt.Errorf("failed to load virtual channel state cell: %w", err)
+						}
+						amount = vState.Amount
 					}
 
 					evData := db.ChannelHistoryActionTransferOutData{
-						Amount: vState.Amount.String(),
+						Amount: amount.String(),
 						To:     meta.FinalDestination,
 					}
 					jsonData, err := json.Marshal(evData)
@@ -129,12 +150,6 @@ func (s *Service) taskExecutor() {
 						log.Error().Err(err).Msg("failed to marshal event data")
 					}
 
-					toChannel, lockId, unlock, err := s.AcquireChannel(ctx, meta.Outgoing.ChannelAddress)
-					if err != nil {
-						return fmt.Errorf("failed to acquire 'to' channel: %w", err)
-					}
-					defer unlock()
-
 					if meta.Incoming != nil {
 						if toChannel.Status == db.ChannelStateActive {
 							err = s.proposeAction(ctx, lockId, meta.Outgoing.ChannelAddress, transport.ConfirmCloseAction{
@@ -165,6 +180,34 @@ func (s *Service) taskExecutor() {
 					}); err != nil {
 						return fmt.Errorf("failed to create channel event: %w", err)
 					}
+				case "payment-attempt":
+					var data db.PaymentAttemptTask
+					if err = json.Unmarshal(task.Data, &data); err != nil {
+						return fmt.Errorf("invalid json: %w", err)
+					}
+
+					return s.executePaymentAttempt(ctx, data.PaymentID)
+				case "stream-session-check":
+					var data db.StreamSessionCheckTask
+					if err = json.Unmarshal(task.Data, &data); err != nil {
+						return fmt.Errorf("invalid json: %w", err)
+					}
+
+					return s.executeStreamSessionCheck(ctx, data.Key)
+				case "swap-lock":
+					var data db.SwapTask
+					if err = json.Unmarshal(task.Data, &data); err != nil {
+						return fmt.Errorf("invalid json: %w", err)
+					}
+
+					return s.executeSwapLock(ctx, data.ID)
+				case "swap-resolve":
+					var data db.SwapTask
+					if err = json.Unmarshal(task.Data, &data); err != nil {
+						return fmt.Errorf("invalid json: %w", err)
+					}
+
+					return s.executeSwapResolve(ctx, data.ID)
 				case "close-next-virtual":
 					var data db.CloseNextVirtualTask
 					if err = json.Unmarshal(task.Data, &data); err != nil {
@@ -225,13 +268,22 @@ func (s *Service) taskExecutor() {
 						return fmt.Errorf("failed to find virtual channel: %w", err)
 					}
 
-					resolve := meta.GetKnownResolve()
-					if resolve == nil {
-						// nothing to commit
-						return nil
+					var toPrepay *big.Int
+					if data.PrepayAmount != "" {
+						// previous node has already prepaid us, so we pass it further
+						toPrepay, _ = new(big.Int).SetString(data.PrepayAmount, 10)
+						if toPrepay == nil {
+							return fmt.Errorf("incorrect prepay amount")
+						}
+					} else {
+						resolve := meta.GetKnownResolve()
+						if resolve == nil {
+							// nothing to commit
+							return nil
+						}
+						toPrepay = new(big.Int).Add(resolve.Amount, vch.Fee)
 					}
 
-					toPrepay := new(big.Int).Add(resolve.Amount, vch.Fee)
 					if vch.Prepay.Cmp(toPrepay) >= 0 {
 						// already commited
 						return nil
@@ -244,6 +296,33 @@ func (s *Service) taskExecutor() {
 						// reversal is not mandatory, because 'sent amount' is atomic with conditional prepay, and no actual balance change
 						return fmt.Errorf("failed to propose action: %w", err)
 					}
+				case "extend-virtual":
+					var data db.ExtendVirtualTask
+					if err = json.Unmarshal(task.Data, &data); err != nil {
+						return fmt.Errorf("invalid json: %w", err)
+					}
+
+					if err = s.executeExtendVirtual(ctx, &data); err != nil {
+						return err
+					}
+				case "virtual-update-result":
+					var data db.VirtualUpdateResultTask
+					if err = json.Unmarshal(task.Data, &data); err != nil {
+						return fmt.Errorf("invalid json: %w", err)
+					}
+
+					if err = s.executeVirtualUpdateResult(ctx, &data); err != nil {
+						return err
+					}
+				case "increase-virtual":
+					var data db.IncreaseVirtualTask
+					if err = json.Unmarshal(task.Data, &data); err != nil {
+						return fmt.Errorf("invalid json: %w", err)
+					}
+
+					if err = s.executeIncreaseVirtual(ctx, &data); err != nil {
+						return err
+					}
 				case "open-virtual":
 					var data db.OpenVirtualTask
 					if err = json.Unmarshal(task.Data, &data); err != nil {
@@ -280,6 +359,8 @@ func (s *Service) taskExecutor() {
 							SafeDeadline:          time.Unix(data.Deadline, 0).Add(-time.Duration(channel.SafeOnchainClosePeriod+int64(s.cfg.MinSafeVirtualChannelTimeoutSec)) * time.Second),
 						},
 						FinalDestination: data.FinalDestinationKey,
+						FailureKeys:      data.FailureKeys,
+						HashLock:         data.HashLock,
 						CreatedAt:        time.Now(),
 						UpdatedAt:        time.Now(),
 					}
@@ -295,11 +376,17 @@ func (s *Service) taskExecutor() {
 							return fmt.Errorf("failed to find prev virtual channel: %w", err)
 						}
 
+						// prev channel can be in another coin, when it is converted by us
+						prevCC, err := s.ResolveCoinConfig(prev.JettonAddress, prev.ExtraCurrencyID, false)
+						if err != nil {
+							return fmt.Errorf("failed to resolve prev coin config: %w", err)
+						}
+
 						meta.Incoming = &db.VirtualChannelMetaSide{
 							SenderKey:             data.SenderKey,
 							ChannelAddress:        data.PrevChannelAddress,
-							Capacity:              tlb.MustFromNano(prevVch.Capacity, int(cc.Decimals)).String(),
-							Fee:                   tlb.MustFromNano(prevVch.Fee, int(cc.Decimals)).String(),
+							Capacity:              tlb.MustFromNano(prevVch.Capacity, int(prevCC.Decimals)).String(),
+							Fee:                   tlb.MustFromNano(prevVch.Fee, int(prevCC.Decimals)).String(),
 							UncooperativeDeadline: time.Unix(prevVch.Deadline, 0),
 							SafeDeadline:          time.Unix(prevVch.Deadline, 0).Add(-time.Duration(prev.SafeOnchainClosePeriod+int64(s.cfg.MinSafeVirtualChannelTimeoutSec)) * time.Second),
 						}
@@ -315,51 +402,34 @@ func (s *Service) taskExecutor() {
 						Fee:      nextFee,
 						Prepay:   big.NewInt(0),
 						Deadline: data.Deadline,
+						HashLock: data.HashLock,
 					}); err != nil {
 						if errors.Is(err, ErrDenied) {
+							failReason := err.Error()
+
 							// ensure that state was not modified on the other side by sending newer state without this conditional
 							if err := s.proposeAction(ctx, lockId, data.ChannelAddress, transport.IncrementStatesAction{WantResponse: false}, nil); err != nil {
 								return fmt.Errorf("failed to increment states on virtual channel revert: %w", err)
 							}
 
-							return s.db.Transaction(ctx, func(ctx context.Context) error {
-								meta, err := s.db.GetVirtualChannelMeta(ctx, data.VirtualKey)
-								if err != nil {
-									return fmt.Errorf("failed to load virtual channel meta: %w", err)
-								}
-
-								meta.Status = db.VirtualChannelStateWantRemove
-								meta.UpdatedAt = time.Now()
-								if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
-									return fmt.Errorf("failed to update virtual channel meta: %w", err)
-								}
-
-								// if we are not the first node of the tunnel
-								if data.PrevChannelAddress != "" {
-									// consider virtual channel unsuccessful and gracefully removed
-									// and notify previous party that we are ready to release locked coins.
-									err = s.db.CreateTask(ctx, PaymentsTaskPool, "ask-remove-virtual", data.PrevChannelAddress,
-										"ask-remove-virtual-"+base64.StdEncoding.EncodeToString(data.VirtualKey),
-										db.AskRemoveVirtualTask{
-											ChannelAddress: data.PrevChannelAddress,
-											Key:            data.VirtualKey,
-										}, nil, nil,
-									)
-									if err != nil {
-										return fmt.Errorf("failed to create ask-remove-virtual task: %w", err)
-									}
-								}
-								return nil
-							})
+							return s.failVirtualOpen(ctx, &data, transport.FailureCodeDenied, failReason)
 						} else if errors.Is(err, ErrNotPossible) {
 							// not possible by us, so no revert confirmation needed
 							log.Warn().Err(err).Msg("it is not possible to open virtual channel")
-							return nil
+							return s.failVirtualOpen(ctx, &data, transport.FailureCodeNotPossible, err.Error())
 						}
 						return fmt.Errorf("failed to propose actions to the next node: %w", err)
 					}
 
-					meta.Status = db.VirtualChannelStateActive
+					// reload, meta could be updated while we were waiting for the next node,
+					// for example our rebalance can already come back to us
+					if meta, err = s.db.GetVirtualChannelMeta(ctx, data.VirtualKey); err != nil {
+						return fmt.Errorf("failed to load virtual channel meta: %w", err)
+					}
+
+					if meta.Status == db.VirtualChannelStatePending {
+						meta.Status = db.VirtualChannelStateActive
+					}
 					meta.UpdatedAt = time.Now()
 					if err = s.db.UpdateVirtualChannelMeta(ctx, meta); err != nil {
 						return fmt.Errorf("failed to update virtual channel meta: %w", err)
@@ -371,6 +441,13 @@ func (s *Service) taskExecutor() {
 						}
 					}
 
+					if data.PrevChannelAddress == "" {
+						// we are the sender
+						if err = s.updateTransfer(ctx, data.VirtualKey, db.TransferStatusOpened, nil, ""); err != nil {
+							return err
+						}
+					}
+
 					log.Info().Str("key", base64.StdEncoding.EncodeToString(data.VirtualKey)).
 						Str("next_capacity", tlb.MustFromNano(nextCap, int(cc.Decimals)).String()).
 						Str("next_fee", tlb.MustFromNano(nextFee, int(cc.Decimals)).String()).
@@ -404,10 +481,25 @@ func (s *Service) taskExecutor() {
 						return nil
 					}
 
+					if meta.Status == db.VirtualChannelStateActive && meta.Incoming != nil &&
+						time.Now().Before(meta.Incoming.UncooperativeDeadline) {
+						// deadline was extended after removal was scheduled,
+						// not expired active channel will not be removed by party anyway
+						return nil
+					}
+
 					log.Debug().Str("channel", channel.Address).Str("key", base64.StdEncoding.EncodeToString(data.Key)).Msg("asking to remove virtual channel")
-					_, err = s.requestAction(ctx, data.ChannelAddress, transport.RequestRemoveVirtualAction{
-						Key: data.Key,
-					})
+					var action transport.Action = transport.RequestRemoveVirtualAction{Key: data.Key}
+					if len(meta.FailureReport) > 0 {
+						action = transport.RequestRemoveVirtualWithFailureAction{Key: data.Key, Failure: meta.FailureReport}
+					}
+
+					_, err = s.requestAction(ctx, data.ChannelAddress, action)
+					if err != nil && len(meta.FailureReport) > 0 && !errors.Is(err, ErrDenied) {
+						// party may run older version which doesn't know the action with report
+						log.Debug().Err(err).Str("channel", channel.Address).Msg("failed to request removal with failure report, requesting without it")
+						_, err = s.requestAction(ctx, data.ChannelAddress, transport.RequestRemoveVirtualAction{Key: data.Key})
+					}
 					if err != nil && !errors.Is(err, ErrDenied) {
 						return fmt.Errorf("request to remove virtual action failed: %w", err)
 					}
@@ -449,16 +541,15 @@ func (s *Service) taskExecutor() {
 						return fmt.Errorf("failed to load virtual channel meta: %w", err)
 					}
 
-					state := meta.GetKnownResolve()
-					if state == nil {
-						return ErrNoResolveExists
-					}
-
-					stateCell, err := state.ToCell()
+					stateCell, err := meta.GetResolveCell()
 					if err != nil {
 						return fmt.Errorf("failed to serialize state to cell: %w", err)
 					}
 
+					if stateCell == nil {
+						return ErrNoResolveExists
+					}
+
 					theirBalance, theirHoldBalance, err := channel.CalcBalance(true)
 					if err != nil {
 						return fmt.Errorf("failed to calc other side balance: %w", err)
@@ -847,6 +938,32 @@ func (s *Service) taskExecutor() {
 						log.Error().Err(err).Str("channel", data.Address).Msg("failed to finish close")
 						return err
 					}
+				case "watchtower-upload":
+					var data db.WatchtowerUploadTask
+					if err = json.Unmarshal(task.Data, &data); err != nil {
+						return fmt.Errorf("invalid json: %w", err)
+					}
+
+					ctxTx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+					defer cancel()
+
+					if err = s.uploadWatchtowerBackup(ctxTx, &data); err != nil {
+						log.Warn().Err(err).Str("channel", data.ChannelAddress).Msg("failed to upload backup to watchtower")
+						return err
+					}
+				case "watchtower-send":
+					var data db.WatchtowerSendTask
+					if err = json.Unmarshal(task.Data, &data); err != nil {
+						return fmt.Errorf("invalid json: %w", err)
+					}
+
+					ctxTx, cancel := context.WithTimeout(context.Background(), 240*time.Second)
+					defer cancel()
+
+					if err = s.executeWatchtowerSend(ctxTx, data); err != nil {
+						log.Error().Err(err).Str("channel", data.Address).Str("kind", data.Kind).Msg("failed to send watchtower messages")
+						return err
+					}
 				case "topup":
 					var data db.TopupTask
 					if err = json.Unmarshal(task.Data, &data); err != nil {